@@ -0,0 +1,409 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Коды отказа в переводе для неактивных аккаунтов
+const (
+	PolicyAccountDeactivated = "account_deactivated"
+	PolicyRecipientInactive  = "recipient_inactive"
+)
+
+var ErrAccountDeactivated = errors.New("аккаунт деактивирован")
+
+// DeleteAccountRequest - подтверждение удаления своего аккаунта
+type DeleteAccountRequest struct {
+	Confirm string `json:"confirm"` // Должно совпадать с именем пользователя
+}
+
+// AccountExport - все данные пользователя для выгрузки
+type AccountExport struct {
+	ExportedAt time.Time `json:"exportedAt"`
+	Profile    struct {
+		Username      string     `json:"username"`
+		Coins         int        `json:"coins"`
+		CreatedAt     time.Time  `json:"createdAt"`
+		Frozen        bool       `json:"frozen"`
+		DeactivatedAt *time.Time `json:"deactivatedAt,omitempty"`
+		Roles         []string   `json:"roles"`
+		TwoFactor     bool       `json:"twoFactorEnabled"`
+		Language      string     `json:"language,omitempty"`
+	} `json:"profile"`
+	Inventory []struct {
+		Type     string `json:"type"`
+		Quantity int    `json:"quantity"`
+	} `json:"inventory"`
+	Purchases []struct {
+		Item  string    `json:"item"`
+		Price int       `json:"price"`
+		Time  time.Time `json:"time"`
+	} `json:"purchases"`
+	Transfers []struct {
+		Direction    string    `json:"direction"` // sent или received
+		Counterparty string    `json:"counterparty"`
+		Amount       int       `json:"amount"`
+		Time         time.Time `json:"time"`
+		TransferMeta
+	} `json:"transfers"`
+	Schedules []ScheduledTransfer `json:"schedules"`
+	Sessions  []Session           `json:"sessions"`
+	APITokens []APIToken          `json:"apiTokens"`
+}
+
+// checkAccountsActive запрещает переводы от деактивированного отправителя
+// и деактивированному получателю
+func checkAccountsActive(q queryRower, senderID, recipientID int) error {
+	var senderInactive, recipientInactive bool
+	err := q.QueryRow(`
+		SELECT
+			(SELECT deactivated_at IS NOT NULL FROM users WHERE id = $1),
+			(SELECT deactivated_at IS NOT NULL FROM users WHERE id = $2)
+	`, senderID, recipientID).Scan(&senderInactive, &recipientInactive)
+	if err != nil {
+		return fmt.Errorf("ошибка при проверке аккаунта: %v", err)
+	}
+	if senderInactive {
+		return &PolicyViolation{Code: PolicyAccountDeactivated, Message: "Аккаунт деактивирован"}
+	}
+	if recipientInactive {
+		return &PolicyViolation{Code: PolicyRecipientInactive, Message: "Получатель деактивирован и не может принимать монеты"}
+	}
+	return nil
+}
+
+// isDeactivated сообщает, деактивирован ли аккаунт
+func isDeactivated(userID int) (bool, error) {
+	var inactive bool
+	err := db.QueryRow(`SELECT deactivated_at IS NOT NULL FROM users WHERE id = $1`, userID).Scan(&inactive)
+	return inactive, err
+}
+
+// DeactivateUser блокирует вход и получение монет. Сессии и персональные токены
+// перестают действовать, собственные расписания переводов ставятся на паузу.
+func DeactivateUser(username string) error {
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET deactivated_at = COALESCE(deactivated_at, now()) WHERE id = $1`, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE api_tokens SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL`, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE scheduled_transfers SET status = 'paused' WHERE sender_id = $1 AND status = 'active'`, user.ID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return RevokeAllSessions(user.ID)
+}
+
+// ReactivateUser возвращает доступ деактивированному, но не удалённому аккаунту
+func ReactivateUser(username string) error {
+	res, err := db.Exec(`
+		UPDATE users SET deactivated_at = NULL WHERE LOWER(username) = LOWER($1) AND deleted_at IS NULL
+	`, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// DeleteUser обезличивает аккаунт: имя заменяется на deleted-<id>, удаляются
+// учётные данные и личные настройки. Строка users остаётся, чтобы история переводов
+// и покупок у контрагентов не потеряла записи и балансы сходились. Сессии сначала
+// отзываются: выданные JWT содержат старое имя и иначе действовали бы до истечения,
+// в том числе для нового владельца этого имени.
+func DeleteUser(username string) error {
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	anonymized := fmt.Sprintf("%s%d", deletedUsernamePrefix, user.ID)
+	if err := RevokeAllSessions(user.ID); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{`UPDATE users SET username = $2, password_hash = $3, frozen_reason = NULL,
+			deactivated_at = COALESCE(deactivated_at, now()), deleted_at = now() WHERE id = $1`,
+			[]interface{}{user.ID, anonymized, noPasswordHash}},
+		// Отозванные сессии остаются без личных данных: по ним другие экземпляры узнают об отзыве
+		{`DELETE FROM refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE user_id = $1)`, []interface{}{user.ID}},
+		{`UPDATE sessions SET user_agent = NULL, ip = NULL WHERE user_id = $1`, []interface{}{user.ID}},
+		{`DELETE FROM api_tokens WHERE user_id = $1`, []interface{}{user.ID}},
+		{`DELETE FROM user_totp WHERE user_id = $1`, []interface{}{user.ID}},
+		{`DELETE FROM totp_recovery_codes WHERE user_id = $1`, []interface{}{user.ID}},
+		{`DELETE FROM user_identities WHERE user_id = $1`, []interface{}{user.ID}},
+		{`DELETE FROM user_roles WHERE user_id = $1`, []interface{}{user.ID}},
+		{`DELETE FROM scheduled_transfers WHERE sender_id = $1`, []interface{}{user.ID}},
+		{`UPDATE scheduled_transfers SET status = 'paused', last_error = 'получатель удалён'
+			WHERE receiver_id = $1 AND status = 'active'`, []interface{}{user.ID}},
+		{`DELETE FROM login_attempts WHERE key = $1`, []interface{}{usernameLockKey(user.Username)}},
+		// Имя встречается в журналах и полях "кем создано" текстом
+		{`UPDATE role_audit SET username = $2 WHERE username = $1`, []interface{}{user.Username, anonymized}},
+		{`UPDATE role_audit SET actor = $2 WHERE actor = $1`, []interface{}{user.Username, anonymized}},
+		{`UPDATE user_roles SET granted_by = $2 WHERE granted_by = $1`, []interface{}{user.Username, anonymized}},
+		{`UPDATE invite_codes SET created_by = $2 WHERE created_by = $1`, []interface{}{user.Username, anonymized}},
+		{`UPDATE fraud_findings SET reviewed_by = $2 WHERE reviewed_by = $1`, []interface{}{user.Username, anonymized}},
+		// Свои события для /api/events больше никто не прочитает
+		{`DELETE FROM user_events WHERE user_id = $1`, []interface{}{user.ID}},
+	}
+	for _, st := range statements {
+		if _, err := tx.Exec(st.query, st.args...); err != nil {
+			return fmt.Errorf("ошибка при удалении аккаунта: %v", err)
+		}
+	}
+	// Журнал доменных событий неизменяем, обезличивание - разрешённое триггером исключение
+	if _, err := tx.Exec(`SET LOCAL app.redact_domain_events = 'on'`); err != nil {
+		return fmt.Errorf("ошибка при удалении аккаунта: %v", err)
+	}
+	// Имя встречается и в JSON событий: у второй стороны переводов, в доставках
+	// вебхуков и в журнале доменных событий
+	for _, field := range []struct{ table, key string }{
+		{"user_events", "fromUser"},
+		{"user_events", "counterparty"},
+		{"webhook_deliveries", "fromUser"},
+		{"webhook_deliveries", "toUser"},
+		{"webhook_deliveries", "username"},
+		{"domain_events", "fromUser"},
+		{"domain_events", "toUser"},
+		{"domain_events", "username"},
+		{"domain_events", "changedBy"},
+	} {
+		if err := scrubPayloadUsername(tx, field.table, field.key, user.Username, anonymized); err != nil {
+			return fmt.Errorf("ошибка при удалении аккаунта: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// scrubPayloadUsername заменяет имя в поле key JSON-колонки payload таблицы table
+func scrubPayloadUsername(tx *sql.Tx, table, key, username, anonymized string) error {
+	_, err := tx.Exec(`
+		UPDATE `+table+` SET payload = jsonb_set(payload, ARRAY[$3::TEXT], to_jsonb($2::TEXT))
+		WHERE payload->>$3 = $1
+	`, username, anonymized, key)
+	return err
+}
+
+// ExportUserData собирает все данные пользователя
+func ExportUserData(user *User) (*AccountExport, error) {
+	export := &AccountExport{ExportedAt: time.Now().UTC()}
+	p := &export.Profile
+	var deactivatedAt sql.NullTime
+	err := db.QueryRow(`
+		SELECT username, coins, created_at, frozen, deactivated_at FROM users WHERE id = $1
+	`, user.ID).Scan(&p.Username, &p.Coins, &p.CreatedAt, &p.Frozen, &deactivatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.DeactivatedAt = nullTimePtr(deactivatedAt)
+	if p.Roles, err = GetUserRoles(user); err != nil {
+		return nil, err
+	}
+	if p.TwoFactor, err = TOTPEnabled(user.ID); err != nil {
+		return nil, err
+	}
+	if p.Language, err = GetUserLanguage(user.ID); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT m.name, i.quantity FROM user_inventory i JOIN merchandise m ON m.id = i.merchandise_id
+		WHERE i.user_id = $1 ORDER BY m.name
+	`, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var item struct {
+			Type     string `json:"type"`
+			Quantity int    `json:"quantity"`
+		}
+		if err := rows.Scan(&item.Type, &item.Quantity); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Inventory = append(export.Inventory, item)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`
+		SELECT m.name, m.price, p.purchase_time FROM purchases p JOIN merchandise m ON m.id = p.merchandise_id
+		WHERE p.user_id = $1 ORDER BY p.purchase_time
+	`, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var purchase struct {
+			Item  string    `json:"item"`
+			Price int       `json:"price"`
+			Time  time.Time `json:"time"`
+		}
+		if err := rows.Scan(&purchase.Item, &purchase.Price, &purchase.Time); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Purchases = append(export.Purchases, purchase)
+	}
+	rows.Close()
+
+	rows, err = db.Query(`
+		SELECT CASE WHEN t.sender_id = $1 THEN 'sent' ELSE 'received' END,
+			u.username, t.amount, t.transaction_time, COALESCE(t.memo, ''), COALESCE(t.category, '')
+		FROM transactions t
+		JOIN users u ON u.id = CASE WHEN t.sender_id = $1 THEN t.receiver_id ELSE t.sender_id END
+		WHERE t.sender_id = $1 OR t.receiver_id = $1
+		ORDER BY t.transaction_time
+	`, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var transfer struct {
+			Direction    string    `json:"direction"`
+			Counterparty string    `json:"counterparty"`
+			Amount       int       `json:"amount"`
+			Time         time.Time `json:"time"`
+			TransferMeta
+		}
+		if err := rows.Scan(&transfer.Direction, &transfer.Counterparty, &transfer.Amount, &transfer.Time,
+			&transfer.Memo, &transfer.Category); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		export.Transfers = append(export.Transfers, transfer)
+	}
+	rows.Close()
+
+	if export.Schedules, err = ListScheduledTransfers(user.ID); err != nil {
+		return nil, err
+	}
+	if export.Sessions, err = ListSessions(user.ID, ""); err != nil {
+		return nil, err
+	}
+	if export.APITokens, err = ListAPITokens(user.ID); err != nil {
+		return nil, err
+	}
+	return export, nil
+}
+
+// ExportAccountHandler отдаёт все данные пользователя одним JSON-файлом.
+func ExportAccountHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+	export, err := ExportUserData(user)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "export_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="merch-shop-%s-%s.json"`, user.Username, export.ExportedAt.Format("20060102")))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(export)
+}
+
+// DeactivateAccountHandler деактивирует собственный аккаунт.
+func DeactivateAccountHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value("username").(string)
+	if err := DeactivateUser(username); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "account_deactivate_failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteAccountHandler обезличивает собственный аккаунт. В теле нужно повторить
+// имя пользователя ({"confirm"}), при включённой 2FA - передать код в X-OTP.
+func DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
+	var req DeleteAccountRequest
+	username := r.Context().Value("username").(string)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Confirm != username {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "delete_confirm_required")
+		return
+	}
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+	enabled, err := TOTPEnabled(user.ID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "account_delete_failed")
+		return
+	}
+	if enabled {
+		if err := verifyStepUpCode(user, clientIP(r), r.Header.Get("X-OTP")); err != nil {
+			writeStepUpError(w, r, err)
+			return
+		}
+	}
+
+	if err := DeleteUser(username); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "account_delete_failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminDeactivateUserHandler деактивирует аккаунт уволившегося сотрудника.
+func AdminDeactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	adminAccountAction(w, r, DeactivateUser)
+}
+
+// AdminReactivateUserHandler возвращает доступ деактивированному аккаунту.
+func AdminReactivateUserHandler(w http.ResponseWriter, r *http.Request) {
+	adminAccountAction(w, r, ReactivateUser)
+}
+
+// AdminDeleteUserHandler обезличивает аккаунт.
+func AdminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	adminAccountAction(w, r, DeleteUser)
+}
+
+func adminAccountAction(w http.ResponseWriter, r *http.Request, action func(username string) error) {
+	err := action(mux.Vars(r)["username"])
+	if errors.Is(err, ErrUserNotFound) {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "account_update_failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDeleteAccountRequiresConfirm(t *testing.T) {
+	for _, body := range []string{`{}`, `{"confirm":"someone-else"}`, `not json`} {
+		req := httptest.NewRequest("DELETE", "/api/account", bytes.NewBufferString(body))
+		req = req.WithContext(context.WithValue(req.Context(), "username", "alice"))
+		rr := httptest.NewRecorder()
+		DeleteAccountHandler(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Body %s: expected 400, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestDeactivatedUserCannotReceiveOrLogin(t *testing.T) {
+	r := mux.NewRouter()
+	api := r.PathPrefix("/api").Subrouter()
+	api.Use(JWTMiddleware)
+	api.HandleFunc("/sendCoin", SendCoinHandler).Methods("POST")
+
+	senderToken := getTokenForUser(t, "lifecycle_sender")
+	_ = getTokenForUser(t, "lifecycle_leaver")
+	if err := DeactivateUser("lifecycle_leaver"); err != nil {
+		t.Fatal(err)
+	}
+
+	bodyBytes, _ := json.Marshal(SendCoinRequest{ToUser: "lifecycle_leaver", Amount: 10})
+	req := httptest.NewRequest("POST", "/api/sendCoin", bytes.NewBuffer(bodyBytes))
+	req.Header.Set("Authorization", "Bearer "+senderToken)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, got %d", rr.Code)
+	}
+	var resp ErrorResponse
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if len(resp.Errors) != 1 || resp.Errors[0].Code != PolicyRecipientInactive {
+		t.Errorf("Expected code %s, got %+v", PolicyRecipientInactive, resp.Errors)
+	}
+
+	bodyBytes, _ = json.Marshal(AuthRequest{Username: "lifecycle_leaver"})
+	rr = httptest.NewRecorder()
+	AuthHandler(rr, httptest.NewRequest("POST", "/api/auth", bytes.NewBuffer(bodyBytes)))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Login of deactivated user: expected 403, got %d", rr.Code)
+	}
+
+	if err := ReactivateUser("lifecycle_leaver"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteUserRevokesTokens(t *testing.T) {
+	requireDB(t)
+	username := uniqueUsername("delete_me")
+	user, err := RegisterUser(username, "correct-horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := CreateSession(user, "account-test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(username); err != nil {
+		t.Fatal(err)
+	}
+	expectTokenError(t, session.Token, "token_revoked")
+	if _, err := RefreshSession(session.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Expected refresh to fail after deletion, got %v", err)
+	}
+
+	// Освободившееся имя занимает другой человек: старый токен не должен дать ему доступ
+	if _, err := RegisterUser(username, "another-horse", ""); err != nil {
+		t.Fatal(err)
+	}
+	expectTokenError(t, session.Token, "token_revoked")
+
+	if err := ValidateUsername(fmt.Sprintf("deleted-%d", user.ID)); !errors.Is(err, ErrUsernameReserved) {
+		t.Errorf("Expected the anonymized name to be reserved, got %v", err)
+	}
+}
+
+func TestDeleteUserScrubsEvents(t *testing.T) {
+	requireDB(t)
+	username := uniqueUsername("delete_events")
+	user, err := RegisterUser(username, "correct-horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := RegisterUser(uniqueUsername("delete_events_peer"), "correct-horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.TransferCoins(other, 5, TransferMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.TransferCoins(user, 1, TransferMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(username); err != nil {
+		t.Fatal(err)
+	}
+
+	var own, mentions int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM user_events WHERE user_id = $1`, user.ID).Scan(&own); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM user_events WHERE strpos(payload::TEXT, $1) > 0`, username).Scan(&mentions); err != nil {
+		t.Fatal(err)
+	}
+	if own != 0 || mentions != 0 {
+		t.Errorf("Expected no events of or about the deleted user, got %d own and %d mentions", own, mentions)
+	}
+	if events, err := ListUserEvents(other.ID, 0, 10); err != nil || len(events) == 0 {
+		t.Errorf("Expected the peer to keep their events, got %d, %v", len(events), err)
+	}
+}
+
+func TestDeleteUserScrubsWebhookDeliveries(t *testing.T) {
+	requireDB(t)
+	hook, err := CreateWebhook("admin", CreateWebhookRequest{URL: "http://localhost:9/hook", Events: webhookEventTypes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DeleteWebhook(hook.ID)
+
+	username := uniqueUsername("delete_hooks")
+	user, err := RegisterUser(username, "correct-horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := RegisterUser(uniqueUsername("delete_hooks_peer"), "correct-horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.TransferCoins(other, 5, TransferMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	NewOutboxRelay(time.Second, 500, WebhookSink{}).RunOnce(context.Background())
+
+	countMentions := func() int {
+		var n int
+		if err := db.QueryRow(`
+			SELECT COUNT(*) FROM webhook_deliveries WHERE subscription_id = $1 AND strpos(payload::TEXT, $2) > 0
+		`, hook.ID, username).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if countMentions() == 0 {
+		t.Fatal("Expected deliveries mentioning the user before deletion")
+	}
+	if err := DeleteUser(username); err != nil {
+		t.Fatal(err)
+	}
+	if n := countMentions(); n != 0 {
+		t.Errorf("Expected no deliveries mentioning the deleted user, got %d", n)
+	}
+}
+
+func TestDeleteUserRedactsDomainEvents(t *testing.T) {
+	requireDB(t)
+	username := uniqueUsername("delete_journal")
+	user, err := RegisterUser(username, "correct-horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := RegisterUser(uniqueUsername("delete_journal_peer"), "correct-horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.TransferCoins(other, 5, TransferMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(username); err != nil {
+		t.Fatal(err)
+	}
+
+	var mentions, redacted int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM domain_events WHERE strpos(payload::TEXT, $1) > 0`, username).Scan(&mentions); err != nil {
+		t.Fatal(err)
+	}
+	anonymized := fmt.Sprintf("%s%d", deletedUsernamePrefix, user.ID)
+	if err := db.QueryRow(`
+		SELECT COUNT(*) FROM domain_events WHERE payload->>'username' = $1 OR payload->>'fromUser' = $1
+	`, anonymized).Scan(&redacted); err != nil {
+		t.Fatal(err)
+	}
+	if mentions != 0 || redacted < 2 {
+		t.Errorf("Expected user.created and coins.transferred to be redacted, got %d mentions and %d redacted", mentions, redacted)
+	}
+
+	// Разрешено только обезличивание payload: остальные колонки по-прежнему неизменяемы
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	tx.Exec(`SET LOCAL app.redact_domain_events = 'on'`)
+	if _, err := tx.Exec(`
+		UPDATE domain_events SET type = 'forged' WHERE payload->>'username' = $1
+	`, anonymized); err == nil {
+		t.Error("Expected the redaction path to reject changes outside payload")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Права персональных токенов
+const (
+	ScopeReadInfo  = "read:info"
+	ScopeSendCoins = "send:coins"
+	ScopeBuyMerch  = "buy:merch"
+)
+
+// apiTokenPrefix отличает персональные токены от JWT в заголовке Authorization
+const apiTokenPrefix = "msp_"
+
+// apiTokenRouteScopes - маршруты, доступные персональным токенам, и нужное для них право.
+// Остальные маршруты (сессии, токены, расписания, администрирование) принимают только JWT.
+var apiTokenRouteScopes = map[string]string{
+	"GET /api/info":            ScopeReadInfo,
+	"GET /api/limits":          ScopeReadInfo,
+	"GET /me/merch":            ScopeReadInfo,
+	"GET /me/transactions":     ScopeReadInfo,
+	"GET /api/events":          ScopeReadInfo,
+	"GET /api/events/ws":       ScopeReadInfo,
+	"POST /api/sendCoin":       ScopeSendCoins,
+	"POST /api/sendCoin/batch": ScopeSendCoins,
+	"POST /me/transfer":        ScopeSendCoins,
+	"GET /api/buy/{item}":      ScopeBuyMerch,
+	"GET /api/v2/me":           ScopeReadInfo,
+	"POST /api/v2/transfers":   ScopeSendCoins,
+	"POST /api/v2/purchases":   ScopeBuyMerch,
+	// GraphQL: мутации дополнительно требуют send:coins или buy:merch
+	"POST /graphql": ScopeReadInfo,
+	// Методы gRPC: HTTP/2 POST на /<сервис>/<метод>
+	"POST /merch.v1.MerchStore/GetInfo":     ScopeReadInfo,
+	"POST /merch.v1.MerchStore/ListCatalog": ScopeReadInfo,
+	"POST /merch.v1.MerchStore/SendCoin":    ScopeSendCoins,
+	"POST /merch.v1.MerchStore/BuyItem":     ScopeBuyMerch,
+}
+
+var ErrInvalidAPIToken = errors.New("персональный токен недействителен")
+
+// APIToken - долгоживущий токен для ботов и интеграций. В базе хранится только его хэш.
+type APIToken struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // Начало токена, чтобы отличать токены в списке
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	ExpiresAt  *time.Time `json:"expiresAt,omitempty"`
+	Token      string     `json:"token,omitempty"` // Только в ответе на создание
+}
+
+// CreateAPITokenRequest - запрос на создание токена
+type CreateAPITokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expiresInDays,omitempty"` // 0 - бессрочно
+}
+
+func isValidScope(scope string) bool {
+	return scope == ScopeReadInfo || scope == ScopeSendCoins || scope == ScopeBuyMerch
+}
+
+// CreateAPIToken выпускает токен; открытое значение возвращается один раз
+func CreateAPIToken(userID int, req CreateAPITokenRequest) (*APIToken, error) {
+	secret, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	token := &APIToken{Name: req.Name, Scopes: req.Scopes, Token: apiTokenPrefix + secret}
+	token.Prefix = token.Token[:len(apiTokenPrefix)+6]
+	var expiresAt sql.NullTime
+	if req.ExpiresInDays > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().AddDate(0, 0, req.ExpiresInDays), Valid: true}
+	}
+
+	err = db.QueryRow(`
+		INSERT INTO api_tokens (user_id, name, token_hash, prefix, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, userID, req.Name, hashToken(token.Token), token.Prefix, pq.Array(req.Scopes), expiresAt).
+		Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	token.ExpiresAt = nullTimePtr(expiresAt)
+	return token, nil
+}
+
+// ListAPITokens возвращает действующие токены пользователя
+func ListAPITokens(userID int) ([]APIToken, error) {
+	rows, err := db.Query(`
+		SELECT id, name, prefix, scopes, created_at, last_used_at, expires_at
+		FROM api_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := make([]APIToken, 0)
+	for rows.Next() {
+		var t APIToken
+		var lastUsed, expiresAt sql.NullTime
+		if err := rows.Scan(&t.ID, &t.Name, &t.Prefix, pq.Array(&t.Scopes), &t.CreatedAt, &lastUsed, &expiresAt); err != nil {
+			return nil, err
+		}
+		t.LastUsedAt, t.ExpiresAt = nullTimePtr(lastUsed), nullTimePtr(expiresAt)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken отзывает токен пользователя
+func RevokeAPIToken(userID, id int) error {
+	res, err := db.Exec(`
+		UPDATE api_tokens SET revoked_at = now() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidAPIToken
+	}
+	return nil
+}
+
+// AuthenticateAPIToken проверяет персональный токен и отмечает время использования.
+// Время пишется не чаще раза в минуту, чтобы частые запросы бота не нагружали базу.
+func AuthenticateAPIToken(token string) (*Claims, error) {
+	var id int
+	var username string
+	var scopes []string
+	var lastUsed sql.NullTime
+	err := db.QueryRow(`
+		SELECT t.id, u.username, t.scopes, t.last_used_at
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.revoked_at IS NULL AND (t.expires_at IS NULL OR t.expires_at > now())
+			AND u.deactivated_at IS NULL
+	`, hashToken(token)).Scan(&id, &username, pq.Array(&scopes), &lastUsed)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !lastUsed.Valid || time.Since(lastUsed.Time) > time.Minute {
+		db.Exec(`UPDATE api_tokens SET last_used_at = now() WHERE id = $1`, id)
+	}
+
+	// Роли персональному токену не передаются: служебные маршруты только по JWT
+	return &Claims{Username: username, Roles: []string{RoleUser}, Scopes: scopes, APITokenID: id}, nil
+}
+
+// apiTokenAllows проверяет, можно ли персональному токену с claims вызвать маршрут
+func apiTokenAllows(claims *Claims, method, pathTemplate string) bool {
+	scope, ok := apiTokenRouteScopes[method+" "+pathTemplate]
+	return ok && claimsHaveScope(claims, scope)
+}
+
+// claimsHaveScope проверяет, что персональному токену выдано право scope
+func claimsHaveScope(claims *Claims, scope string) bool {
+	for _, s := range claims.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateAPITokenHandler выпускает персональный токен.
+func CreateAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPITokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 || len(req.Scopes) == 0 || req.ExpiresInDays < 0 {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "api_token_fields_required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !isValidScope(scope) {
+			writeFieldError(w, r, "scopes", "unknown_scope", scope)
+			return
+		}
+	}
+
+	user, err := GetUserByUsername(r.Context().Value("username").(string))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+	// Долгоживущий токен не выпускается по одному украденному access-токену
+	enabled, err := TOTPEnabled(user.ID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "api_token_create_failed")
+		return
+	}
+	if enabled {
+		if err := verifyStepUpCode(user, clientIP(r), r.Header.Get("X-OTP")); err != nil {
+			writeStepUpError(w, r, err)
+			return
+		}
+	}
+	token, err := CreateAPIToken(user.ID, req)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "api_token_create_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(token)
+}
+
+// ListAPITokensHandler возвращает персональные токены пользователя без их значений.
+func ListAPITokensHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserByUsername(r.Context().Value("username").(string))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+	tokens, err := ListAPITokens(user.ID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "api_tokens_fetch_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+}
+
+// RevokeAPITokenHandler отзывает персональный токен.
+func RevokeAPITokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	user, err := GetUserByUsername(r.Context().Value("username").(string))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+	if err := RevokeAPIToken(user.ID, id); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "token_not_found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAPITokenAllows(t *testing.T) {
+	claims := &Claims{Username: "bot", Scopes: []string{ScopeReadInfo, ScopeSendCoins}}
+	cases := []struct {
+		method, path string
+		want         bool
+	}{
+		{"GET", "/api/info", true},
+		{"POST", "/api/sendCoin", true},
+		{"POST", "/me/transfer", true},
+		{"GET", "/api/buy/{item}", false}, // Нет права buy:merch
+		{"POST", "/api/tokens", false},    // Токены выпускаются только по JWT
+		{"POST", "/api/auth/logout", false},
+		{"GET", "/api/admin/fraud/report", false},
+	}
+	for _, c := range cases {
+		if got := apiTokenAllows(claims, c.method, c.path); got != c.want {
+			t.Errorf("%s %s: got %v, want %v", c.method, c.path, got, c.want)
+		}
+	}
+}
+
+func TestAPITokenAuth(t *testing.T) {
+	r := mux.NewRouter()
+	api := r.PathPrefix("/api").Subrouter()
+	api.Use(JWTMiddleware)
+	api.HandleFunc("/tokens", CreateAPITokenHandler).Methods("POST")
+	api.HandleFunc("/tokens", ListAPITokensHandler).Methods("GET")
+	api.HandleFunc("/info", InfoHandler).Methods("GET")
+	api.HandleFunc("/buy/{item}", BuyMerchHandler).Methods("GET")
+
+	jwtToken := getTokenForUser(t, "test_user_api_token")
+
+	bodyBytes, _ := json.Marshal(CreateAPITokenRequest{Name: "slack-bot", Scopes: []string{ScopeReadInfo}})
+	req, _ := http.NewRequest("POST", "/api/tokens", bytes.NewBuffer(bodyBytes))
+	req.Header.Set("Authorization", "Bearer "+jwtToken)
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", rr.Code)
+	}
+	var created APIToken
+	json.NewDecoder(rr.Body).Decode(&created)
+
+	do := func(method, path string) int {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+created.Token)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := do("GET", "/api/info"); code != http.StatusOK {
+		t.Errorf("read:info token on /api/info: expected 200, got %d", code)
+	}
+	if code := do("GET", "/api/buy/pen"); code != http.StatusForbidden {
+		t.Errorf("read:info token on /api/buy: expected 403, got %d", code)
+	}
+	if code := do("GET", "/api/tokens"); code != http.StatusForbidden {
+		t.Errorf("API token on /api/tokens: expected 403, got %d", code)
+	}
+
+	tokens, err := ListAPITokens(GetUser("test_user_api_token").ID)
+	if err != nil || len(tokens) == 0 || tokens[0].LastUsedAt == nil || tokens[0].Token != "" {
+		t.Fatalf("Expected listed token with lastUsedAt and without secret, got %+v (%v)", tokens, err)
+	}
+}
+
+func TestAPITokenRequiresStepUp(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.StepUpThreshold = 5
+
+	// Прошлый запуск мог оставить 2FA включённой, и тогда вход потребует код
+	DisableTOTP(GetUser("api_token_step_up").ID)
+	jwtToken := getTokenForUser(t, "api_token_step_up")
+	getTokenForUser(t, "api_token_step_up_to")
+	user := GetUser("api_token_step_up")
+	defer DisableTOTP(user.ID)
+
+	r := newRouter()
+	do := func(token, otp, method, path string, body interface{}) *httptest.ResponseRecorder {
+		bodyBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(bodyBytes))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if otp != "" {
+			req.Header.Set("X-OTP", otp)
+		}
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	createReq := CreateAPITokenRequest{Name: "bot", Scopes: []string{ScopeSendCoins}}
+
+	// Токен выпущен до включения 2FA, то есть без второго фактора
+	rr := do(jwtToken, "", "POST", "/api/tokens", createReq)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 without 2FA, got %d: %s", rr.Code, rr.Body)
+	}
+	var bot APIToken
+	json.NewDecoder(rr.Body).Decode(&bot)
+
+	enrollment, err := EnrollTOTP(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := base32NoPadding.DecodeString(enrollment.Secret)
+	recoveryCodes, err := ConfirmTOTP(user.ID, totpCode(secret, time.Now().Unix()/totpPeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transfer := SendCoinRequest{ToUser: "api_token_step_up_to", Amount: config.StepUpThreshold + 1}
+	before := GetUser("api_token_step_up").Coins
+	rr = do(bot.Token, "", "POST", "/api/sendCoin", transfer)
+	var resp ErrorResponse
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if rr.Code != http.StatusForbidden || len(resp.Errors) != 1 || resp.Errors[0].Code != StepUpRequired {
+		t.Fatalf("API token above the threshold: expected 403 %s, got %d %+v", StepUpRequired, rr.Code, resp.Errors)
+	}
+	if after := GetUser("api_token_step_up").Coins; after != before {
+		t.Errorf("Balance changed without the second factor: %d -> %d", before, after)
+	}
+	if rr := do(bot.Token, recoveryCodes[0], "POST", "/api/sendCoin", transfer); rr.Code != http.StatusOK {
+		t.Errorf("API token with X-OTP: expected 200, got %d: %s", rr.Code, rr.Body)
+	}
+
+	// С включённой 2FA новый токен выпускается только с кодом
+	if rr := do(jwtToken, "", "POST", "/api/tokens", createReq); rr.Code != http.StatusForbidden {
+		t.Errorf("Token without X-OTP: expected 403, got %d", rr.Code)
+	}
+	if rr := do(jwtToken, recoveryCodes[1], "POST", "/api/tokens", createReq); rr.Code != http.StatusCreated {
+		t.Errorf("Token with X-OTP: expected 201, got %d: %s", rr.Code, rr.Body)
+	}
+}
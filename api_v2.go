@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Версия API v2: ресурсы вместо действий, изменения только через POST,
+// успешный ответ всегда {"data": ...}, ошибка - тот же конверт {"errors": [...]}, что в v1.
+// Обработчики v1 и v2 вызывают одни и те же функции service.go.
+
+// DataResponse - тело успешного ответа v2
+type DataResponse struct {
+	Data interface{} `json:"data"`
+}
+
+// PurchaseRequest - запрос на покупку товара
+type PurchaseRequest struct {
+	Item string `json:"item"`
+}
+
+// PurchaseV2 - ресурс покупки с названием товара на языке запроса
+type PurchaseV2 struct {
+	*Purchase
+	DisplayName string `json:"displayName"`
+}
+
+// ProfileV2 - ресурс /api/v2/me
+type ProfileV2 struct {
+	Username string `json:"username"`
+	*InfoResponse
+}
+
+// apiV1DeprecatedAt - дата объявления v1 устаревшей, отдаётся в заголовке Deprecation
+var apiV1DeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// apiV1Successors - маршруты v1, у которых есть замена в v2
+var apiV1Successors = map[string]string{
+	"GET /api/info":        "/api/v2/me",
+	"GET /me/merch":        "/api/v2/me",
+	"GET /me/transactions": "/api/v2/me",
+	"POST /api/sendCoin":   "/api/v2/transfers",
+	"POST /me/transfer":    "/api/v2/transfers",
+	"GET /api/buy/{item}":  "/api/v2/purchases",
+}
+
+// DeprecationMiddleware помечает ответы устаревших маршрутов v1 заголовками
+// Deprecation (RFC 9745), Link на замену и Sunset, если задан API_V1_SUNSET.
+// Заголовки ставятся до обработчика, поэтому есть и в ответах с ошибкой.
+func DeprecationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			tmpl, _ := route.GetPathTemplate()
+			if successor, ok := apiV1Successors[r.Method+" "+tmpl]; ok {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(apiV1DeprecatedAt.Unix(), 10))
+				w.Header().Add("Link", "<"+successor+`>; rel="successor-version"`)
+				if !config.APIV1Sunset.IsZero() {
+					w.Header().Set("Sunset", config.APIV1Sunset.UTC().Format(http.TimeFormat))
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeData отвечает ресурсом в конверте {"data": ...}
+func writeData(w http.ResponseWriter, r *http.Request, status int, data interface{}) {
+	setContentLanguage(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(DataResponse{Data: data})
+}
+
+// GetMeV2Handler возвращает профиль, баланс, инвентарь и историю переводов (?category=).
+func GetMeV2Handler(w http.ResponseWriter, r *http.Request) {
+	actor := actorFromRequest(r)
+	info, err := GetUserInfo(actor.Username, r.URL.Query().Get("category"))
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	for i := range info.Inventory {
+		info.Inventory[i].DisplayName = itemDisplayName(r, info.Inventory[i].Type)
+	}
+	writeData(w, r, http.StatusOK, ProfileV2{Username: actor.Username, InfoResponse: info})
+}
+
+// CreateTransferV2Handler переводит монеты и возвращает созданный перевод.
+func CreateTransferV2Handler(w http.ResponseWriter, r *http.Request) {
+	var req SendCoinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+	transfer, err := SendCoins(actorFromRequest(r), req)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusCreated, transfer)
+}
+
+// CreatePurchaseV2Handler покупает товар ({"item"}) и возвращает покупку.
+func CreatePurchaseV2Handler(w http.ResponseWriter, r *http.Request) {
+	var req PurchaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Item == "" {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+	purchase, err := BuyItem(actorFromRequest(r), req.Item)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeData(w, r, http.StatusCreated, PurchaseV2{Purchase: purchase, DisplayName: itemDisplayName(r, purchase.Item)})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDeprecationHeaders(t *testing.T) {
+	r := newRouter()
+	cases := []struct {
+		method, path, body string
+		successor          string
+	}{
+		{"GET", "/api/info", "", "/api/v2/me"},
+		{"GET", "/api/buy/pen", "", "/api/v2/purchases"},
+		{"POST", "/me/transfer", `{"toUser":"bob","amount":1}`, "/api/v2/transfers"},
+		{"POST", "/api/sendCoin", `{"to":"bob"}`, "/api/v2/transfers"}, // и в ответе с ошибкой
+		{"GET", "/api/v2/me", "", ""},
+		{"GET", "/api/limits", "", ""},
+	}
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(c.method, c.path, bytes.NewBufferString(c.body)))
+		deprecation, link := rr.Header().Get("Deprecation"), rr.Header().Get("Link")
+		if c.successor == "" {
+			if deprecation != "" || link != "" {
+				t.Errorf("%s %s: unexpected deprecation headers %q, %q", c.method, c.path, deprecation, link)
+			}
+			continue
+		}
+		if !strings.HasPrefix(deprecation, "@") {
+			t.Errorf("%s %s: Deprecation = %q", c.method, c.path, deprecation)
+		}
+		if link != "<"+c.successor+`>; rel="successor-version"` {
+			t.Errorf("%s %s: Link = %q", c.method, c.path, link)
+		}
+	}
+}
+
+func TestSendCoinsRejectsEmptyRequest(t *testing.T) {
+	for _, req := range []SendCoinRequest{{}, {ToUser: "bob"}, {ToUser: "bob", Amount: -5}} {
+		_, err := SendCoins(Actor{Username: "alice"}, req)
+		if apiErr := toAPIError(err); apiErr.Code != CodeBadRequest {
+			t.Errorf("%+v: expected %s, got %+v", req, CodeBadRequest, apiErr)
+		}
+	}
+	_, err := SendCoins(Actor{Username: "alice"}, SendCoinRequest{ToUser: "bob", Amount: 5, TransferMeta: TransferMeta{Category: "bribe"}})
+	if !errors.Is(err, ErrUnknownCategory) {
+		t.Errorf("Expected ErrUnknownCategory, got %v", err)
+	}
+}
+
+func TestSendCoinsRejectsSelfTransfer(t *testing.T) {
+	for _, to := range []string{"alice", "Alice", "ALICE"} {
+		_, err := SendCoins(Actor{Username: "alice"}, SendCoinRequest{ToUser: to, Amount: 5})
+		if !errors.Is(err, ErrSelfTransfer) {
+			t.Errorf("%s: expected ErrSelfTransfer, got %v", to, err)
+		}
+	}
+}
+
+func TestCheckStepUpSkipsWithoutDatabase(t *testing.T) {
+	user := &User{ID: 1}
+	if err := checkStepUp(Actor{}, user, config.StepUpThreshold); err != nil {
+		t.Errorf("Amount at threshold: %v", err)
+	}
+
+	saved := config
+	defer func() { config = saved }()
+	config.StepUpThreshold = 0
+	if err := checkStepUp(Actor{}, user, 1000000); err != nil {
+		t.Errorf("Step-up disabled: %v", err)
+	}
+}
+
+func TestV2TransferAndPurchase(t *testing.T) {
+	r := newRouter()
+	senderToken := getTokenForUser(t, "v2_sender")
+	_ = getTokenForUser(t, "v2_recipient")
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		bodyBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(bodyBytes))
+		req.Header.Set("Authorization", "Bearer "+senderToken)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("POST", "/api/v2/transfers", SendCoinRequest{ToUser: "v2_recipient", Amount: 10})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Transfer: expected status 201, got %d: %s", rr.Code, rr.Body)
+	}
+	var transfer struct {
+		Data Transfer `json:"data"`
+	}
+	json.NewDecoder(rr.Body).Decode(&transfer)
+	if transfer.Data.ToUser != "v2_recipient" || transfer.Data.Amount != 10 {
+		t.Errorf("Unexpected transfer %+v", transfer.Data)
+	}
+
+	rr = do("POST", "/api/v2/purchases", PurchaseRequest{Item: "pen"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Purchase: expected status 201, got %d: %s", rr.Code, rr.Body)
+	}
+	var purchase struct {
+		Data PurchaseV2 `json:"data"`
+	}
+	json.NewDecoder(rr.Body).Decode(&purchase)
+	if purchase.Data.Purchase == nil || purchase.Data.Item != "pen" || purchase.Data.Balance != transfer.Data.Balance-purchase.Data.Price {
+		t.Errorf("Unexpected purchase %+v", purchase.Data)
+	}
+
+	rr = do("GET", "/api/v2/me", nil)
+	var me struct {
+		Data ProfileV2 `json:"data"`
+	}
+	json.NewDecoder(rr.Body).Decode(&me)
+	if rr.Code != http.StatusOK || me.Data.Username != "v2_sender" || me.Data.InfoResponse == nil || me.Data.Coins != purchase.Data.Balance {
+		t.Errorf("Unexpected profile %d %+v", rr.Code, me.Data)
+	}
+}
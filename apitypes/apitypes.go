@@ -0,0 +1,96 @@
+// Пакет apitypes - структуры запросов и ответов HTTP API магазина. Их использует
+// и сервер (через псевдонимы типов в models.go), и клиент app/client, поэтому
+// JSON на обеих сторонах описан в одном месте.
+package apitypes
+
+// AuthRequest - структура запроса для аутентификации
+type AuthRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	OTP      string `json:"otp,omitempty"` // Код 2FA или резервный код, если 2FA включена
+}
+
+// AuthResponse - структура ответа на аутентификацию
+type AuthResponse struct {
+	Token        string `json:"token"`                  // Короткоживущий access-токен
+	RefreshToken string `json:"refreshToken,omitempty"` // Одноразовый токен для /api/auth/refresh
+	ExpiresIn    int    `json:"expiresIn,omitempty"`    // Срок жизни access-токена в секундах
+}
+
+// RefreshRequest - запрос на обновление пары токенов
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// InventoryItem - структура для элемента инвентаря
+type InventoryItem struct {
+	Type        string `json:"type"`        // Тип предмета (например, "t-shirt")
+	DisplayName string `json:"displayName"` // Название на языке запроса
+	Quantity    int    `json:"quantity"`    // Количество предметов
+}
+
+// SendCoinRequest - структура для запроса перевода монет
+type SendCoinRequest struct {
+	ToUser       string `json:"toUser"` // Имя получателя монет
+	Amount       int    `json:"amount"` // Количество монет
+	TransferMeta        // Необязательные пояснение и категория
+}
+
+// TransferMeta - пояснение к переводу, сохраняется в transactions
+type TransferMeta struct {
+	Memo     string `json:"memo,omitempty"`     // Зачем отправлены монеты
+	Category string `json:"category,omitempty"` // thanks, bet, reimbursement или gift
+}
+
+// CoinHistory - структура для истории монет
+type CoinHistory struct {
+	Received []ReceivedTransferInfo `json:"received"` // Переводы монет, полученных пользователем
+	Sent     []SentTransferInfo     `json:"sent"`     // Переводы монет, отправленных пользователем
+}
+
+// ReceivedTransferInfo - структура для информации о полученных монетах
+type ReceivedTransferInfo struct {
+	FromUser string `json:"fromUser"` // Имя пользователя, который отправил монеты
+	Amount   int    `json:"amount"`   // Количество полученных монет
+	TransferMeta
+}
+
+// SentTransferInfo - структура для информации о отправленных монетах
+type SentTransferInfo struct {
+	ToUser string `json:"toUser"` // Имя пользователя, которому отправлены монеты
+	Amount int    `json:"amount"` // Количество отправленных монет
+	TransferMeta
+}
+
+// TransferInfo - структура для информации о переводе монет
+type TransferInfo struct {
+	FromUser string `json:"fromUser"` // Имя пользователя, который отправил монеты
+	ToUser   string `json:"toUser"`   // Имя пользователя, которому отправлены монеты
+	Amount   int    `json:"amount"`   // Количество переведенных монет
+	TransferMeta
+}
+
+// InfoResponse - структура для ответа на запрос информации о монетах и инвентаре
+type InfoResponse struct {
+	Coins       int             `json:"coins"`       // Количество монет у пользователя
+	Inventory   []InventoryItem `json:"inventory"`   // Инвентарь пользователя
+	CoinHistory CoinHistory     `json:"coinHistory"` // История монет
+}
+
+// TransactionHistory - ответ /me/transactions
+type TransactionHistory struct {
+	Incoming []TransferInfo `json:"incoming"` // Входящие переводы, заполнен FromUser
+	Outgoing []TransferInfo `json:"outgoing"` // Исходящие переводы, заполнен ToUser
+}
+
+// StatusResponse - ответ операции без данных
+type StatusResponse struct {
+	Status string `json:"status"` // Сообщение на языке запроса
+}
+
+// PurchaseResponse - ответ /api/buy/{item}
+type PurchaseResponse struct {
+	Status      string `json:"status"`      // Сообщение на языке запроса
+	Item        string `json:"item"`        // Товар из каталога
+	DisplayName string `json:"displayName"` // Название на языке запроса
+}
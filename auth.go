@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// RegisterRequest - запрос на регистрацию
+type RegisterRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	InviteCode string `json:"inviteCode,omitempty"` // Обязателен, если регистрация только по приглашениям
+}
+
+var (
+	ErrUsernameTaken      = errors.New("имя пользователя уже занято")
+	ErrInvalidCredentials = errors.New("неверное имя пользователя или пароль")
+	ErrInvalidInvite      = errors.New("приглашение недействительно")
+	ErrInvalidUsername    = errors.New("имя пользователя должно быть длиной 3-32 символа из латиницы, цифр и знаков _ . - и начинаться с буквы или цифры")
+	ErrUsernameReserved   = errors.New("имя пользователя зарезервировано")
+)
+
+// Минимальная длина пароля при регистрации
+const MinPasswordLength = 8
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{2,31}$`)
+
+// Имена, которые нельзя занять: они путаются со служебными маршрутами и ролями
+var reservedUsernames = map[string]bool{
+	"admin": true, "administrator": true, "root": true, "system": true, "support": true,
+	"api": true, "auth": true, "me": true, "null": true, "undefined": true, "shop": true,
+}
+
+// deletedUsernamePrefix - префикс имён обезличенных аккаунтов (deleted-<id>)
+const deletedUsernamePrefix = "deleted-"
+
+// ValidateUsername проверяет длину, набор символов и зарезервированные имена
+func ValidateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return &FieldError{Field: "username", Err: ErrInvalidUsername}
+	}
+	lower := strings.ToLower(username)
+	if reservedUsernames[lower] || strings.HasPrefix(lower, deletedUsernamePrefix) {
+		return &FieldError{Field: "username", Err: ErrUsernameReserved}
+	}
+	return nil
+}
+
+// HashPassword хэширует пароль bcrypt
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// noPasswordHash записывается пользователям, созданным через SSO: такой
+// пароль не совпадает ни с одним введённым
+const noPasswordHash = "!"
+
+// checkPassword сравнивает пароль с сохранённым хэшем. Старые записи с паролем
+// открытым текстом (до перехода на bcrypt) сравниваются за постоянное время.
+func checkPassword(stored, password string) (ok, legacy bool) {
+	if strings.HasPrefix(stored, noPasswordHash) {
+		return false, false
+	}
+	if strings.HasPrefix(stored, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1, true
+}
+
+// dummyHash сравнивается с паролем, когда пользователя нет, чтобы время ответа
+// не выдавало существование имени
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+// AuthenticateUser проверяет имя и пароль. Имя сравнивается без учёта регистра, как
+// при регистрации. Пароль, сохранённый открытым текстом, после успешного входа
+// перехэшируется. Деактивированный аккаунт войти не может.
+func AuthenticateUser(username, password string) (*User, error) {
+	var user User
+	var stored string
+	var deactivated bool
+	err := db.QueryRow(`
+		SELECT id, username, coins, password_hash, deactivated_at IS NOT NULL
+		FROM users WHERE LOWER(username) = LOWER($1)
+	`, username).Scan(&user.ID, &user.Username, &user.Coins, &stored, &deactivated)
+	if err == sql.ErrNoRows {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ok, legacy := checkPassword(stored, password)
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+	// О деактивации сообщаем только после верного пароля, чтобы не выдавать существование имени
+	if deactivated {
+		return nil, ErrAccountDeactivated
+	}
+	if legacy {
+		if hash, err := HashPassword(password); err == nil {
+			db.Exec(`UPDATE users SET password_hash = $1 WHERE id = $2`, hash, user.ID)
+		}
+	}
+	return &user, nil
+}
+
+// RegisterUser создаёт пользователя, при необходимости погашая приглашение
+// в той же транзакции
+func RegisterUser(username, password, inviteCode string) (*User, error) {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("ошибка при начале транзакции: %v", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(username) = LOWER($1))`, username).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrUsernameTaken
+	}
+
+	var userID int
+	err = tx.QueryRow(`
+		INSERT INTO users (username, password_hash, coins) VALUES ($1, $2, $3) RETURNING id
+	`, username, hash, 1000).Scan(&userID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return nil, ErrUsernameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if inviteCode != "" || config.RequireInvite {
+		if err := redeemInvite(tx, inviteCode, userID); err != nil {
+			return nil, err
+		}
+	}
+	if err := userCreated(tx, userID, username); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("ошибка при коммите транзакции: %v", err)
+	}
+	return GetUserByUsername(username)
+}
+
+// passwordLoginDisabled отвечает 403, если вход по паролю выключен в конфигурации
+func passwordLoginDisabled(w http.ResponseWriter, r *http.Request) bool {
+	if config.PasswordLogin {
+		return false
+	}
+	writeError(w, r, http.StatusForbidden, CodeForbidden, "password_login_disabled")
+	return true
+}
+
+// RegisterHandler регистрирует нового пользователя и сразу выдаёт токен.
+func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if passwordLoginDisabled(w, r) {
+		return
+	}
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+	if err := ValidateUsername(req.Username); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if len([]rune(req.Password)) < MinPasswordLength {
+		writeFieldError(w, r, "password", "password_too_short", MinPasswordLength)
+		return
+	}
+	if config.RequireInvite && req.InviteCode == "" {
+		writeError(w, r, http.StatusForbidden, CodeForbidden, "invite_required")
+		return
+	}
+
+	user, err := RegisterUser(req.Username, req.Password, req.InviteCode)
+	switch {
+	case errors.Is(err, ErrUsernameTaken):
+		writeError(w, r, http.StatusConflict, CodeUsernameTaken, "username_taken")
+		return
+	case errors.Is(err, ErrInvalidInvite):
+		writeError(w, r, http.StatusForbidden, CodeForbidden, "invite_invalid")
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "user_create_failed")
+		return
+	}
+
+	writeToken(w, r, user, http.StatusCreated)
+}
+
+// LoginHandler выдаёт токен существующему пользователю по имени и паролю.
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if passwordLoginDisabled(w, r) {
+		return
+	}
+	var req AuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+
+	user, err := Login(req, clientIP(r), false)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeToken(w, r, user, http.StatusOK)
+}
+
+// Login проверяет имя, пароль и второй фактор с учётом блокировок после неудачных
+// попыток. С autoRegister неизвестное имя регистрируется с этим паролем, как в
+// /api/auth. ip - адрес клиента для блокировки по адресу. Ошибки - *APIError
+// с ключами каталога или *LoginLockedError.
+func Login(req AuthRequest, ip string, autoRegister bool) (*User, error) {
+	wait, err := loginLockedFor(req.Username, ip)
+	if err != nil {
+		return nil, loginFailed(err)
+	}
+	if wait > 0 {
+		return nil, &LoginLockedError{RetryAfter: wait}
+	}
+
+	if autoRegister {
+		_, err := GetUserByUsername(req.Username)
+		if errors.Is(err, ErrUserNotFound) {
+			if err := ValidateUsername(req.Username); err != nil {
+				return nil, err
+			}
+			user, err := CreateUser(req.Username, req.Password) // Создаём нового пользователя
+			if err == nil {
+				return user, nil
+			}
+			if !errors.Is(err, ErrUsernameTaken) {
+				log.Printf("Ошибка создания пользователя %s: %v", req.Username, err)
+				return nil, &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Key: "user_create_failed"}
+			}
+			// Имя заняли параллельно или оно отличается только регистром - проверяем пароль
+		} else if err != nil {
+			log.Printf("Ошибка получения пользователя %s: %v", req.Username, err)
+			return nil, &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Key: "user_fetch_failed"}
+		}
+	}
+
+	user, err := AuthenticateUser(req.Username, req.Password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		recordLoginFailure(req.Username, ip)
+		return nil, err
+	}
+	if errors.Is(err, ErrAccountDeactivated) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, loginFailed(err)
+	}
+
+	// Второй фактор; неверный код считается неудачной попыткой входа
+	enabled, err := TOTPEnabled(user.ID)
+	if err != nil {
+		return nil, loginFailed(err)
+	}
+	if enabled {
+		if req.OTP == "" {
+			return nil, &APIError{Status: http.StatusUnauthorized, Code: OTPRequired, Key: "otp_required"}
+		}
+		if err := VerifySecondFactor(user.ID, req.OTP); err != nil {
+			recordLoginFailure(user.Username, ip)
+			return nil, &APIError{Status: http.StatusUnauthorized, Code: OTPInvalid, Key: "otp_invalid"}
+		}
+	}
+	resetLoginFailures(req.Username)
+	return user, nil
+}
+
+// loginFailed пишет причину в лог и скрывает её от клиента
+func loginFailed(err error) error {
+	log.Printf("Ошибка входа: %v", err)
+	return &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Key: "login_failed"}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// uniqueUsername возвращает имя, которого ещё нет в базе: регистрация не идемпотентна
+func uniqueUsername(prefix string) string {
+	return fmt.Sprintf("%s_%d", prefix, time.Now().UnixNano()%1e12)
+}
+
+func TestValidateUsername(t *testing.T) {
+	cases := []struct {
+		username string
+		err      error
+	}{
+		{"alice", nil},
+		{"Bob.Smith-2", nil},
+		{"a_1", nil},
+		{strings.Repeat("x", 32), nil},
+		{"ab", ErrInvalidUsername},
+		{strings.Repeat("x", 33), ErrInvalidUsername},
+		{"_alice", ErrInvalidUsername},
+		{"alice smith", ErrInvalidUsername},
+		{"алиса", ErrInvalidUsername},
+		{"alice@example.com", ErrInvalidUsername},
+		{"admin", ErrUsernameReserved},
+		{"Root", ErrUsernameReserved},
+		{"deleted-123", ErrUsernameReserved},
+		{"Deleted-alice", ErrUsernameReserved},
+		{"deleted_alice", nil},
+	}
+	for _, c := range cases {
+		err := ValidateUsername(c.username)
+		if !errors.Is(err, c.err) {
+			t.Errorf("ValidateUsername(%q): expected %v, got %v", c.username, c.err, err)
+			continue
+		}
+		var fieldErr *FieldError
+		if err != nil && (!errors.As(err, &fieldErr) || fieldErr.Field != "username") {
+			t.Errorf("ValidateUsername(%q): expected error on username, got %v", c.username, err)
+		}
+	}
+}
+
+func TestRegisterUserIgnoresCase(t *testing.T) {
+	requireDB(t)
+	username := uniqueUsername("Reg_Case")
+	user, err := RegisterUser(username, "correct-horse", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != username || user.Coins != 1000 {
+		t.Errorf("Unexpected user %+v", user)
+	}
+
+	if _, err := RegisterUser(strings.ToLower(username), "another-pass", ""); !errors.Is(err, ErrUsernameTaken) {
+		t.Errorf("Expected ErrUsernameTaken for a name differing only in case, got %v", err)
+	}
+
+	for _, login := range []string{username, strings.ToLower(username), strings.ToUpper(username)} {
+		got, err := AuthenticateUser(login, "correct-horse")
+		if err != nil {
+			t.Errorf("Login as %s: %v", login, err)
+			continue
+		}
+		if got.ID != user.ID || got.Username != username {
+			t.Errorf("Login as %s returned %+v", login, got)
+		}
+	}
+	// Получатель перевода и роли ищутся так же, как при входе
+	if got, err := GetUserByUsername(strings.ToUpper(username)); err != nil || got.ID != user.ID {
+		t.Errorf("GetUserByUsername ignoring case: got %+v, %v", got, err)
+	}
+	users, err := GetUsersByUsernames([]string{strings.ToUpper(username)})
+	if err != nil || users[strings.ToLower(username)] == nil || users[strings.ToLower(username)].ID != user.ID {
+		t.Errorf("GetUsersByUsernames ignoring case: got %+v, %v", users, err)
+	}
+	if _, err := AuthenticateUser(strings.ToLower(username), "wrong-pass"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := AuthenticateUser(uniqueUsername("reg_nobody"), "correct-horse"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Expected ErrInvalidCredentials for an unknown user, got %v", err)
+	}
+}
+
+func TestRegisterWithInvite(t *testing.T) {
+	requireDB(t)
+	saved := config
+	defer func() { config = saved }()
+	config.RequireInvite = true
+	config.PasswordLogin = true
+
+	register := func(username, invite string) (*httptest.ResponseRecorder, ErrorResponse) {
+		bodyBytes, _ := json.Marshal(RegisterRequest{Username: username, Password: "correct-horse", InviteCode: invite})
+		rr := httptest.NewRecorder()
+		RegisterHandler(rr, httptest.NewRequest("POST", "/api/register", bytes.NewBuffer(bodyBytes)))
+		var resp ErrorResponse
+		if rr.Code >= 400 {
+			json.Unmarshal(rr.Body.Bytes(), &resp)
+		}
+		return rr, resp
+	}
+
+	if rr, _ := register(uniqueUsername("inv_none"), ""); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 without an invite, got %d", rr.Code)
+	}
+
+	invite, err := CreateInvite("invite_admin", CreateInviteRequest{MaxUses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr, _ := register(uniqueUsername("inv_first"), invite.Code); rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 with a valid invite, got %d: %s", rr.Code, rr.Body)
+	}
+
+	// Одноразовый код уже погашен, и пользователь не должен появиться
+	second := uniqueUsername("inv_second")
+	if rr, _ := register(second, invite.Code); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a used invite, got %d", rr.Code)
+	}
+	if _, err := GetUserByUsername(second); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("User registered with a used invite: %v", err)
+	}
+
+	expired, err := CreateInvite("invite_admin", CreateInviteRequest{ExpiresInSec: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec(`UPDATE invite_codes SET expires_at = now() - INTERVAL '1 minute' WHERE code = $1`, expired.Code)
+	revoked, err := CreateInvite("invite_admin", CreateInviteRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeInvite(revoked.Code); err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []string{expired.Code, revoked.Code, "NOPE-NOPE-NOPE-NOPE"} {
+		if _, err := RegisterUser(uniqueUsername("inv_bad"), "correct-horse", code); !errors.Is(err, ErrInvalidInvite) {
+			t.Errorf("Invite %s: expected ErrInvalidInvite, got %v", code, err)
+		}
+	}
+}
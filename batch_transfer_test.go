@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBatchTotal(t *testing.T) {
+	total, err := batchTotal([]SendCoinRequest{{Amount: 10}, {Amount: 25}})
+	if err != nil || total != 35 {
+		t.Errorf("Expected 35, got %d, %v", total, err)
+	}
+	for _, transfers := range [][]SendCoinRequest{
+		{{Amount: math.MaxInt32}, {Amount: 1}},
+		{{Amount: math.MaxInt32 / 2}, {Amount: math.MaxInt32 / 2}, {Amount: 2}},
+		{{Amount: math.MaxInt}},
+	} {
+		if _, err := batchTotal(transfers); !errors.Is(err, ErrBatchTotalTooLarge) {
+			t.Errorf("Expected overflow for %+v, got %v", transfers, err)
+		}
+	}
+}
+
+func TestSendCoinBatchMaxRecipients(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.MaxBatchRecipients = 2
+
+	for _, body := range []string{
+		`{"toUsers":["a","b","c"],"amount":1}`,
+		`{"transfers":[]}`,
+	} {
+		rr := httptest.NewRecorder()
+		SendCoinBatchHandler(rr, httptest.NewRequest("POST", "/api/sendCoin/batch", strings.NewReader(body)))
+		var resp ErrorResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if rr.Code != http.StatusBadRequest || len(resp.Errors) != 1 || resp.Errors[0].Code != CodeBadRequest {
+			t.Errorf("Body %s: expected 400 bad_request, got %d %+v", body, rr.Code, resp.Errors)
+		}
+	}
+}
+
+// sendBatch отправляет пакетный перевод через роутер
+func sendBatch(t *testing.T, token string, body interface{}) (*httptest.ResponseRecorder, ErrorResponse) {
+	bodyBytes, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/api/sendCoin/batch", bytes.NewBuffer(bodyBytes))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	var resp ErrorResponse
+	if rr.Code != http.StatusOK {
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+	}
+	return rr, resp
+}
+
+func TestSendCoinBatchRejectsInvalidRecipients(t *testing.T) {
+	token := getTokenForUser(t, "batch_sender")
+	getTokenForUser(t, "batch_first")
+	getTokenForUser(t, "batch_second")
+	before := GetUser("batch_sender").Coins
+
+	cases := []struct {
+		name  string
+		body  BatchSendCoinRequest
+		code  string
+		field string
+	}{
+		{"unknown recipient", BatchSendCoinRequest{ToUsers: []string{"batch_first", "batch_nobody"}, Amount: 1},
+			CodeRecipientNotFound, "toUsers[1]"},
+		{"sender among recipients", BatchSendCoinRequest{Transfers: []SendCoinRequest{
+			{ToUser: "batch_first", Amount: 1}, {ToUser: "batch_sender", Amount: 1}}},
+			CodeValidationFailed, "transfers[1]"},
+		{"sender in another case", BatchSendCoinRequest{ToUsers: []string{"BATCH_SENDER"}, Amount: 1},
+			CodeValidationFailed, "toUsers[0]"},
+		{"duplicate in another case", BatchSendCoinRequest{ToUsers: []string{"batch_first", "Batch_First"}, Amount: 1},
+			CodeValidationFailed, "toUsers[1]"},
+		{"insufficient total", BatchSendCoinRequest{ToUsers: []string{"batch_first"}, Amount: before + 1},
+			CodeInsufficientFunds, ""},
+		{"total overflow", BatchSendCoinRequest{Transfers: []SendCoinRequest{
+			{ToUser: "batch_first", Amount: math.MaxInt32}, {ToUser: "batch_second", Amount: math.MaxInt32}}},
+			CodeValidationFailed, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rr, resp := sendBatch(t, token, c.body)
+			if rr.Code == http.StatusOK || len(resp.Errors) == 0 {
+				t.Fatalf("Expected an error, got %d: %s", rr.Code, rr.Body)
+			}
+			if resp.Errors[0].Code != c.code || resp.Errors[0].Field != c.field {
+				t.Errorf("Expected %s on %q, got %+v", c.code, c.field, resp.Errors[0])
+			}
+		})
+	}
+	if after := GetUser("batch_sender").Coins; after != before {
+		t.Errorf("Rejected batches changed the balance: %d -> %d", before, after)
+	}
+}
+
+func TestTransferCoinsBatchAllOrNothing(t *testing.T) {
+	getTokenForUser(t, "batch_atomic_sender")
+	getTokenForUser(t, "batch_atomic_first")
+	sender, first := GetUser("batch_atomic_sender"), GetUser("batch_atomic_first")
+
+	// Второго получателя нет в базе: первый перевод должен откатиться вместе с ним
+	missing := &User{ID: -1, Username: "batch_atomic_missing"}
+	err := sender.TransferCoinsBatch([]*User{first, missing}, []SendCoinRequest{{Amount: 5}, {Amount: 5}})
+	if err == nil {
+		t.Fatal("Expected batch with a missing recipient to fail")
+	}
+	if got := GetUser("batch_atomic_sender").Coins; got != sender.Coins {
+		t.Errorf("Sender balance changed after failed batch: %d -> %d", sender.Coins, got)
+	}
+	if got := GetUser("batch_atomic_first").Coins; got != first.Coins {
+		t.Errorf("First recipient balance changed after failed batch: %d -> %d", first.Coins, got)
+	}
+
+	if err := sender.TransferCoinsBatch([]*User{first, sender}, []SendCoinRequest{{Amount: 1}, {Amount: 1}}); !errors.Is(err, ErrSelfTransfer) {
+		t.Errorf("Expected ErrSelfTransfer, got %v", err)
+	}
+}
+
+func TestTransferCoinsBatchOppositeOrder(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.FraudAutoFreeze = false // частые встречные переводы похожи на карусель
+
+	for _, name := range []string{"batch_cross_a", "batch_cross_b", "batch_cross_c"} {
+		getTokenForUser(t, name)
+	}
+	a, b, c := GetUser("batch_cross_a"), GetUser("batch_cross_b"), GetUser("batch_cross_c")
+	total := a.Coins + b.Coins + c.Coins
+
+	// Встречные пакеты с общими получателями не должны взаимоблокироваться
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			sender := GetUser("batch_cross_a")
+			errs <- sender.TransferCoinsBatch([]*User{GetUser("batch_cross_b"), GetUser("batch_cross_c")},
+				[]SendCoinRequest{{Amount: 1}, {Amount: 1}})
+		}()
+		go func() {
+			defer wg.Done()
+			sender := GetUser("batch_cross_b")
+			errs <- sender.TransferCoinsBatch([]*User{GetUser("batch_cross_c"), GetUser("batch_cross_a")},
+				[]SendCoinRequest{{Amount: 1}, {Amount: 1}})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Batch failed: %v", err)
+		}
+	}
+	if got := GetUser("batch_cross_a").Coins + GetUser("batch_cross_b").Coins + GetUser("batch_cross_c").Coins; got != total {
+		t.Errorf("Expected total %d to be preserved, got %d", total, got)
+	}
+}
@@ -0,0 +1,403 @@
+// Пакет client - Go-клиент HTTP API магазина мерча.
+//
+//	c := client.New("http://localhost:8080")
+//	if _, err := c.Auth(ctx, apitypes.AuthRequest{Username: "ivan", Password: "secret"}); err != nil {
+//		return err
+//	}
+//	err := c.SendCoin(ctx, apitypes.SendCoinRequest{ToUser: "petr", Amount: 10})
+//	if errors.Is(err, client.ErrInsufficientFunds) {
+//		...
+//	}
+//
+// Клиент сам обновляет истёкший access-токен по refresh-токену, повторяет
+// запросы при сетевых ошибках, 5xx и 429, а переводы и покупки отправляет с
+// заголовком Idempotency-Key, поэтому повтор не спишет монеты дважды.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"app/apitypes"
+)
+
+// Коды ошибок API; сравнение с ними через errors.Is
+var (
+	ErrBadRequest         = &Error{Code: "bad_request"}
+	ErrValidationFailed   = &Error{Code: "validation_failed"}
+	ErrUnauthorized       = &Error{Code: "unauthorized"}
+	ErrInvalidToken       = &Error{Code: "invalid_token"}
+	ErrInvalidCredentials = &Error{Code: "invalid_credentials"}
+	ErrForbidden          = &Error{Code: "forbidden"}
+	ErrNotFound           = &Error{Code: "not_found"}
+	ErrConflict           = &Error{Code: "conflict"}
+	ErrRateLimited        = &Error{Code: "rate_limited"}
+	ErrInternal           = &Error{Code: "internal_error"}
+	ErrUserNotFound       = &Error{Code: "user_not_found"}
+	ErrRecipientNotFound  = &Error{Code: "recipient_not_found"}
+	ErrItemNotFound       = &Error{Code: "item_not_found"}
+	ErrInsufficientFunds  = &Error{Code: "insufficient_funds"}
+	ErrAccountDeactivated = &Error{Code: "account_deactivated"}
+	ErrLoginLocked        = &Error{Code: "login_locked"}
+)
+
+// ErrNotAuthenticated - метод требует токен, а Auth ещё не вызывался
+var ErrNotAuthenticated = errors.New("client: not authenticated")
+
+// Error - ошибка из тела ответа {"errors": [...]}
+type Error struct {
+	StatusCode int                    `json:"-"`
+	Code       string                 `json:"code"`
+	Message    string                 `json:"message"`
+	Field      string                 `json:"field,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	// Errors - все ошибки ответа; первая из них продублирована в полях выше
+	Errors []*Error `json:"-"`
+}
+
+func (e *Error) Error() string {
+	msg := e.Code
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	if e.Field != "" {
+		msg = e.Field + ": " + msg
+	}
+	return fmt.Sprintf("client: %d %s", e.StatusCode, msg)
+}
+
+// Is сравнивает ошибки по коду, чтобы работало errors.Is(err, ErrInsufficientFunds)
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Client - клиент API. Безопасен для одновременного использования.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	mu           sync.Mutex
+	token        string
+	refreshToken string
+}
+
+// Option настраивает клиент в New
+type Option func(*Client)
+
+// WithHTTPClient задаёт http.Client, например с таймаутом или своим транспортом
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries задаёт число повторов и начальную паузу между ними; пауза
+// удваивается с каждой попыткой. 0 повторов отключает повторы.
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = retries, backoff }
+}
+
+// WithToken задаёт готовый токен: JWT или персональный токен API
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// New создаёт клиент для сервера по адресу baseURL, например http://localhost:8080
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    3,
+		backoff:    200 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type idempotencyKeyCtx struct{}
+
+// WithIdempotencyKey задаёт ключ идемпотентности для SendCoin и Buy вместо
+// случайного. Повторный вызов с тем же ключом вернёт сохранённый сервером ответ.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyCtx{}, key)
+}
+
+// Token возвращает текущий access-токен
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// Auth входит по логину и паролю (и коду 2FA, если он включён) и запоминает токены
+func (c *Client) Auth(ctx context.Context, req apitypes.AuthRequest) (*apitypes.AuthResponse, error) {
+	var resp apitypes.AuthResponse
+	if err := c.do(ctx, call{method: http.MethodPost, path: "/api/auth", body: req, out: &resp}); err != nil {
+		return nil, err
+	}
+	c.setTokens(resp.Token, resp.RefreshToken)
+	return &resp, nil
+}
+
+// Info возвращает баланс, инвентарь и историю монет
+func (c *Client) Info(ctx context.Context) (*apitypes.InfoResponse, error) {
+	var resp apitypes.InfoResponse
+	if err := c.do(ctx, call{method: http.MethodGet, path: "/api/info", auth: true, out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SendCoin переводит монеты другому пользователю
+func (c *Client) SendCoin(ctx context.Context, req apitypes.SendCoinRequest) error {
+	return c.do(ctx, call{method: http.MethodPost, path: "/api/sendCoin", body: req, auth: true, idempotent: true})
+}
+
+// Buy покупает товар из каталога
+func (c *Client) Buy(ctx context.Context, item string) (*apitypes.PurchaseResponse, error) {
+	var resp apitypes.PurchaseResponse
+	err := c.do(ctx, call{method: http.MethodGet, path: "/api/buy/" + url.PathEscape(item), auth: true, idempotent: true, out: &resp})
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Transactions возвращает входящие и исходящие переводы; category
+// отбирает переводы одной категории, пустая строка - все
+func (c *Client) Transactions(ctx context.Context, category string) (*apitypes.TransactionHistory, error) {
+	path := "/me/transactions"
+	if category != "" {
+		path += "?" + url.Values{"category": {category}}.Encode()
+	}
+	var resp apitypes.TransactionHistory
+	if err := c.do(ctx, call{method: http.MethodGet, path: path, auth: true, out: &resp}); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// call - описание запроса для do
+type call struct {
+	method     string
+	path       string
+	body       interface{}
+	out        interface{}
+	auth       bool // нужен токен; на 401 клиент один раз обновляет его
+	idempotent bool // отправить Idempotency-Key, чтобы повтор был безопасен
+}
+
+// do выполняет запрос с повторами и обновлением токена
+func (c *Client) do(ctx context.Context, cl call) error {
+	var body []byte
+	if cl.body != nil {
+		var err error
+		if body, err = json.Marshal(cl.body); err != nil {
+			return err
+		}
+	}
+	var key string
+	if cl.idempotent {
+		key, _ = ctx.Value(idempotencyKeyCtx{}).(string)
+		if key == "" {
+			key = newIdempotencyKey()
+		}
+	}
+
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		token := ""
+		if cl.auth {
+			if token = c.Token(); token == "" {
+				return ErrNotAuthenticated
+			}
+		}
+		resp, err := c.send(ctx, cl.method, cl.path, body, token, key)
+		if err != nil {
+			if ctx.Err() != nil || attempt >= c.retries {
+				return err
+			}
+			if err := c.sleep(ctx, c.backoffFor(attempt, 0)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if resp.StatusCode == http.StatusUnauthorized && cl.auth && !refreshed {
+			unauthorized := decode(resp, nil)
+			refreshed = true
+			if ok, err := c.refresh(ctx, token); ctx.Err() != nil {
+				return ctx.Err()
+			} else if err != nil || !ok {
+				return unauthorized
+			}
+			attempt-- // обновление токена не считается повтором
+			continue
+		}
+
+		if retryable(resp, key != "") && attempt < c.retries {
+			wait := c.backoffFor(attempt, retryAfter(resp))
+			drain(resp)
+			if err := c.sleep(ctx, wait); err != nil {
+				return err
+			}
+			continue
+		}
+		return decode(resp, cl.out)
+	}
+}
+
+// send отправляет один запрос
+func (c *Client) send(ctx context.Context, method, path string, body []byte, token, key string) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	return c.httpClient.Do(req)
+}
+
+// refresh обменивает refresh-токен на новую пару. stale - токен, получивший
+// 401: если его уже заменил другой запрос, обновлять повторно не нужно.
+// Возвращает false, если refresh-токена нет.
+func (c *Client) refresh(ctx context.Context, stale string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != stale {
+		return true, nil
+	}
+	if c.refreshToken == "" {
+		return false, nil
+	}
+
+	body, _ := json.Marshal(apitypes.RefreshRequest{RefreshToken: c.refreshToken})
+	resp, err := c.send(ctx, http.MethodPost, "/api/auth/refresh", body, "", "")
+	if err != nil {
+		return false, err
+	}
+	var tokens apitypes.AuthResponse
+	if err := decode(resp, &tokens); err != nil {
+		// refresh-токен одноразовый: после отказа его не используем
+		c.refreshToken = ""
+		return false, err
+	}
+	c.token, c.refreshToken = tokens.Token, tokens.RefreshToken
+	return true, nil
+}
+
+func (c *Client) setTokens(token, refreshToken string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token, c.refreshToken = token, refreshToken
+}
+
+// backoffFor - пауза перед повтором: Retry-After сервера или экспоненциальная
+func (c *Client) backoffFor(attempt int, serverWait time.Duration) time.Duration {
+	if serverWait > 0 {
+		return serverWait
+	}
+	wait := c.backoff << uint(attempt)
+	if wait <= 0 || wait > c.maxBackoff {
+		wait = c.maxBackoff
+	}
+	return wait
+}
+
+// sleep ждёт d или отмены контекста
+func (c *Client) sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryable - ответы, после которых запрос стоит повторить. 409 с Retry-After
+// на запрос с ключом идемпотентности значит, что первая попытка ещё выполняется.
+func retryable(resp *http.Response, idempotent bool) bool {
+	if resp.StatusCode == http.StatusConflict {
+		return idempotent && resp.Header.Get("Retry-After") != ""
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// retryAfter читает заголовок Retry-After в секундах
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// decode разбирает успешный ответ в out, а ошибку - в *Error
+func decode(resp *http.Response, out interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		var body struct {
+			Errors []*Error `json:"errors"`
+		}
+		data, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(data, &body) != nil || len(body.Errors) == 0 {
+			return &Error{StatusCode: resp.StatusCode, Code: "http_" + strconv.Itoa(resp.StatusCode),
+				Message: strings.TrimSpace(string(data))}
+		}
+		for _, e := range body.Errors {
+			e.StatusCode = resp.StatusCode
+		}
+		first := *body.Errors[0]
+		first.Errors = body.Errors
+		return &first
+	}
+	if out == nil {
+		_, err := io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// drain дочитывает тело, чтобы соединение вернулось в пул
+func drain(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// newIdempotencyKey - случайный ключ для одного логического запроса
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"app/apitypes"
+)
+
+// writeAPIError отвечает так же, как сервер: {"errors": [...]}
+func writeAPIError(w http.ResponseWriter, status int, code, field string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code, "message": "сообщение", "field": field}},
+	})
+}
+
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts ...Option) *Client {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return New(srv.URL, append([]Option{WithRetries(3, time.Millisecond)}, opts...)...)
+}
+
+func TestAuthStoresToken(t *testing.T) {
+	var got apitypes.AuthRequest
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/auth" || r.Method != http.MethodPost {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(apitypes.AuthResponse{Token: "access", RefreshToken: "refresh", ExpiresIn: 900})
+	})
+
+	resp, err := c.Auth(context.Background(), apitypes.AuthRequest{Username: "ivan", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "ivan" || resp.Token != "access" || c.Token() != "access" {
+		t.Errorf("Unexpected auth %+v, request %+v", resp, got)
+	}
+}
+
+func TestRequiresAuthentication(t *testing.T) {
+	c := New("http://127.0.0.1:0")
+	if _, err := c.Info(context.Background()); !errors.Is(err, ErrNotAuthenticated) {
+		t.Errorf("Expected ErrNotAuthenticated, got %v", err)
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusBadRequest, "insufficient_funds", "amount")
+	}, WithToken("access"))
+
+	err := c.SendCoin(context.Background(), apitypes.SendCoinRequest{ToUser: "petr", Amount: 1000})
+	if !errors.Is(err, ErrInsufficientFunds) || errors.Is(err, ErrRecipientNotFound) {
+		t.Fatalf("Expected ErrInsufficientFunds, got %v", err)
+	}
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Field != "amount" {
+		t.Errorf("Unexpected error %+v", apiErr)
+	}
+}
+
+func TestNonJSONErrorBody(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad gateway", http.StatusBadGateway)
+	}, WithToken("access"), WithRetries(0, 0))
+
+	var apiErr *Error
+	if _, err := c.Info(context.Background()); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 error, got %v", err)
+	}
+}
+
+func TestRetriesReuseIdempotencyKey(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		switch len(keys) {
+		case 1:
+			writeAPIError(w, http.StatusServiceUnavailable, "internal_error", "")
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			writeAPIError(w, http.StatusTooManyRequests, "rate_limited", "")
+		default:
+			json.NewEncoder(w).Encode(apitypes.StatusResponse{Status: "ok"})
+		}
+	}, WithToken("access"))
+
+	if err := c.SendCoin(context.Background(), apitypes.SendCoinRequest{ToUser: "petr", Amount: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] == "" || keys[1] != keys[0] || keys[2] != keys[0] {
+		t.Errorf("Expected 3 attempts with one key, got %q", keys)
+	}
+
+	// Новый вызов - новая операция и новый ключ
+	keys = nil
+	c.SendCoin(context.Background(), apitypes.SendCoinRequest{ToUser: "petr", Amount: 5})
+	if len(keys) == 0 || keys[0] == "" {
+		t.Fatal("Expected a key on the second call")
+	}
+	first := keys[0]
+	keys = nil
+	c.SendCoin(context.Background(), apitypes.SendCoinRequest{ToUser: "petr", Amount: 5})
+	if keys[0] == first {
+		t.Error("Expected separate calls to use different keys")
+	}
+}
+
+func TestWithIdempotencyKey(t *testing.T) {
+	var key string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		key = r.Header.Get("Idempotency-Key")
+		json.NewEncoder(w).Encode(apitypes.PurchaseResponse{Status: "ok", Item: "cup"})
+	}, WithToken("access"))
+
+	ctx := WithIdempotencyKey(context.Background(), "order-42")
+	resp, err := c.Buy(ctx, "cup")
+	if err != nil || resp.Item != "cup" {
+		t.Fatalf("Unexpected purchase %+v, %v", resp, err)
+	}
+	if key != "order-42" {
+		t.Errorf("Expected key order-42, got %q", key)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	attempts := 0
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		writeAPIError(w, http.StatusInternalServerError, "internal_error", "")
+	}, WithToken("access"), WithRetries(2, time.Millisecond))
+
+	if _, err := c.Info(context.Background()); !errors.Is(err, ErrInternal) {
+		t.Errorf("Expected ErrInternal, got %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestClientErrorsAreNotRetried(t *testing.T) {
+	attempts := 0
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		writeAPIError(w, http.StatusBadRequest, "item_not_found", "")
+	}, WithToken("access"))
+
+	if _, err := c.Buy(context.Background(), "yacht"); !errors.Is(err, ErrItemNotFound) || attempts != 1 {
+		t.Errorf("Expected one attempt with ErrItemNotFound, got %d, %v", attempts, err)
+	}
+}
+
+func TestRefreshesExpiredToken(t *testing.T) {
+	var mu sync.Mutex
+	refreshes := 0
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/api/auth":
+			json.NewEncoder(w).Encode(apitypes.AuthResponse{Token: "old", RefreshToken: "refresh-1"})
+		case "/api/auth/refresh":
+			var req apitypes.RefreshRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.RefreshToken != "refresh-1" {
+				writeAPIError(w, http.StatusUnauthorized, "invalid_token", "")
+				return
+			}
+			refreshes++
+			json.NewEncoder(w).Encode(apitypes.AuthResponse{Token: "new", RefreshToken: "refresh-2"})
+		default:
+			if r.Header.Get("Authorization") != "Bearer new" {
+				writeAPIError(w, http.StatusUnauthorized, "invalid_token", "")
+				return
+			}
+			json.NewEncoder(w).Encode(apitypes.TransactionHistory{
+				Incoming: []apitypes.TransferInfo{{FromUser: "petr", Amount: 3}},
+			})
+		}
+	})
+
+	if _, err := c.Auth(context.Background(), apitypes.AuthRequest{Username: "ivan", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			history, err := c.Transactions(context.Background(), "")
+			if err != nil || len(history.Incoming) != 1 {
+				t.Errorf("Unexpected history %+v, %v", history, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if refreshes != 1 || c.Token() != "new" {
+		t.Errorf("Expected one refresh to token new, got %d refreshes, token %s", refreshes, c.Token())
+	}
+}
+
+func TestUnauthorizedWithoutRefreshToken(t *testing.T) {
+	attempts := 0
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		writeAPIError(w, http.StatusUnauthorized, "invalid_token", "")
+	}, WithToken("revoked"))
+
+	if _, err := c.Info(context.Background()); !errors.Is(err, ErrInvalidToken) || attempts != 1 {
+		t.Errorf("Expected one attempt with ErrInvalidToken, got %d, %v", attempts, err)
+	}
+}
+
+func TestTransactionsCategory(t *testing.T) {
+	var category string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		category = r.URL.Query().Get("category")
+		json.NewEncoder(w).Encode(apitypes.TransactionHistory{})
+	}, WithToken("access"))
+
+	if _, err := c.Transactions(context.Background(), "thanks"); err != nil || category != "thanks" {
+		t.Errorf("Expected category thanks, got %q, %v", category, err)
+	}
+}
+
+func TestContextCancellation(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		writeAPIError(w, http.StatusTooManyRequests, "rate_limited", "")
+	}, WithToken("access"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Info(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context deadline, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Client kept waiting after the context was done")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"app/apitypes"
+	"app/client"
+)
+
+func TestIdempotencyKeyTooLong(t *testing.T) {
+	called := false
+	handler := IdempotencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	req := httptest.NewRequest("POST", "/api/sendCoin", strings.NewReader(`{}`))
+	req.Header.Set(idempotencyHeader, strings.Repeat("k", maxIdempotencyKeyLength+1))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest || called {
+		t.Errorf("Expected 400 without calling the handler, got %d: %s", rr.Code, rr.Body)
+	}
+}
+
+func TestIdempotencyOnlyForTransfersAndPurchases(t *testing.T) {
+	r := newRouter()
+	token := getTokenForUser(t, "idempotency_scope")
+	do := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(`{}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set(idempotencyHeader, strings.Repeat("k", maxIdempotencyKeyLength+1))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Слишком длинный ключ отклоняется только там, где работает middleware
+	for _, route := range [][2]string{{"POST", "/api/sendCoin"}, {"GET", "/api/buy/pen"}, {"POST", "/me/transfer"}, {"POST", "/api/v2/transfers"}} {
+		if rr := do(route[0], route[1]); rr.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: expected 400 for the key, got %d", route[0], route[1], rr.Code)
+		}
+	}
+	for _, route := range [][2]string{{"GET", "/api/info"}, {"GET", "/api/tokens"}, {"GET", "/api/2fa"}, {"GET", "/api/v2/me"}} {
+		if rr := do(route[0], route[1]); rr.Code != http.StatusOK {
+			t.Errorf("%s %s: expected the key to be ignored, got %d: %s", route[0], route[1], rr.Code, rr.Body)
+		}
+	}
+}
+
+func TestClientAgainstRouter(t *testing.T) {
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	ctx := context.Background()
+
+	getTokenForUser(t, "client_recipient")
+	c := client.New(srv.URL)
+	if _, err := c.Auth(ctx, apitypes.AuthRequest{Username: "client_sender"}); err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	before, err := c.Info(ctx)
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+
+	// Повтор с тем же ключом не переводит монеты второй раз
+	keyed := client.WithIdempotencyKey(ctx, fmt.Sprintf("client-test-%d", time.Now().UnixNano()))
+	req := apitypes.SendCoinRequest{ToUser: "client_recipient", Amount: 3, TransferMeta: apitypes.TransferMeta{Category: "thanks"}}
+	for i := 0; i < 2; i++ {
+		if err := c.SendCoin(keyed, req); err != nil {
+			t.Fatalf("SendCoin #%d: %v", i+1, err)
+		}
+	}
+	after, err := c.Info(ctx)
+	if err != nil {
+		t.Fatalf("Info: %v", err)
+	}
+	if after.Coins != before.Coins-3 {
+		t.Errorf("Expected balance %d, got %d", before.Coins-3, after.Coins)
+	}
+	purchase, err := c.Buy(ctx, "pen")
+	if err != nil || purchase.Item != "pen" {
+		t.Fatalf("Buy: %+v, %v", purchase, err)
+	}
+	history, err := c.Transactions(ctx, "thanks")
+	if err != nil || len(history.Outgoing) == 0 {
+		t.Errorf("Expected outgoing thanks transfers, got %+v, %v", history, err)
+	}
+
+	err = c.SendCoin(ctx, apitypes.SendCoinRequest{ToUser: "client_recipient", Amount: after.Coins + 1})
+	if !errors.Is(err, client.ErrInsufficientFunds) {
+		t.Errorf("Expected ErrInsufficientFunds, got %v", err)
+	}
+	if _, err := c.Buy(ctx, "yacht"); !errors.Is(err, client.ErrItemNotFound) {
+		t.Errorf("Expected ErrItemNotFound, got %v", err)
+	}
+}
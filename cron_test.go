@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("Expected error for %q", expr)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// Среда, 15 января 2025
+	from := time.Date(2025, 1, 15, 10, 30, 0, 0, time.UTC)
+	cases := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2025, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2025, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9 * * 1", time.Date(2025, 1, 20, 9, 0, 0, 0, time.UTC)}, // Каждый понедельник в 9:00
+		{"0 0 1 * *", time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 10 15 1 *", time.Date(2026, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{"0 12 * * 7", time.Date(2025, 1, 19, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2025, 1, 16, 0, 0, 0, 0, time.UTC)},
+		// День месяца и день недели заданы оба: подходит любой из них
+		{"0 9 20 * 3", time.Date(2025, 1, 20, 9, 0, 0, 0, time.UTC)},
+		// "*/n" не ограничивает день: нужны нечётный день и понедельник одновременно
+		{"0 9 */2 * 1", time.Date(2025, 1, 27, 9, 0, 0, 0, time.UTC)},
+		{"0 9 1 * */2", time.Date(2025, 2, 1, 9, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		s, err := ParseCron(c.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", c.expr, err)
+		}
+		if got := s.Next(from); !got.Equal(c.want) {
+			t.Errorf("Next(%q) = %v, want %v", c.expr, got, c.want)
+		}
+	}
+}
+
+func TestCronNextNever(t *testing.T) {
+	s, err := ParseCron("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Next(time.Now()); !got.IsZero() {
+		t.Fatalf("Expected no next run, got %v", got)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrNotLoaded - fetch не вернул значение для ключа
+var ErrNotLoaded = errors.New("значение не найдено")
+
+// Loader откладывает загрузку по ключу: резолверы GraphQL одного уровня запроса
+// регистрируют ключи, а первый, кому нужен результат, загружает их все одним
+// запросом к базе. Результаты кэшируются на время запроса, поэтому Loader
+// создаётся заново для каждого запроса.
+type Loader[K comparable, V any] struct {
+	fetch func(keys []K) (map[K]V, error)
+
+	mu      sync.Mutex
+	pending []K
+	queued  map[K]bool
+	results map[K]V
+	errs    map[K]error
+}
+
+// NewLoader создаёт Loader; fetch получает ключи без повторов и возвращает
+// найденные значения. Ключа нет в ответе - значение не найдено.
+func NewLoader[K comparable, V any](fetch func(keys []K) (map[K]V, error)) *Loader[K, V] {
+	return &Loader[K, V]{
+		fetch:   fetch,
+		queued:  map[K]bool{},
+		results: map[K]V{},
+		errs:    map[K]error{},
+	}
+}
+
+// Load ставит ключ в очередь и возвращает функцию, которая дождётся загрузки
+func (l *Loader[K, V]) Load(key K) func() (V, error) {
+	l.mu.Lock()
+	if _, done := l.results[key]; !done && l.errs[key] == nil && !l.queued[key] {
+		l.queued[key] = true
+		l.pending = append(l.pending, key)
+	}
+	l.mu.Unlock()
+
+	return func() (V, error) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.queued[key] {
+			l.flush()
+		}
+		if err := l.errs[key]; err != nil {
+			var zero V
+			return zero, err
+		}
+		return l.results[key], nil
+	}
+}
+
+// flush загружает все ключи из очереди. Вызывается под l.mu.
+func (l *Loader[K, V]) flush() {
+	keys := l.pending
+	l.pending = nil
+	for _, key := range keys {
+		delete(l.queued, key)
+	}
+
+	values, err := l.fetch(keys)
+	for _, key := range keys {
+		if err != nil {
+			l.errs[key] = err
+		} else if value, ok := values[key]; ok {
+			l.results[key] = value
+		} else {
+			l.errs[key] = fmt.Errorf("%w: %v", ErrNotLoaded, key)
+		}
+	}
+}
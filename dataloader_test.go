@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"testing"
+)
+
+func TestLoaderBatchesKeys(t *testing.T) {
+	var calls [][]int
+	loader := NewLoader(func(keys []int) (map[int]string, error) {
+		calls = append(calls, append([]int(nil), keys...))
+		res := map[int]string{}
+		for _, k := range keys {
+			if k != 404 {
+				res[k] = "user"
+			}
+		}
+		return res, nil
+	})
+
+	// Резолверы одного уровня регистрируют ключи, затем читают результаты
+	thunks := []func() (string, error){loader.Load(1), loader.Load(2), loader.Load(1), loader.Load(404)}
+	for i, thunk := range thunks[:3] {
+		if v, err := thunk(); err != nil || v != "user" {
+			t.Errorf("thunk %d: %q, %v", i, v, err)
+		}
+	}
+	if _, err := thunks[3](); !errors.Is(err, ErrNotLoaded) {
+		t.Errorf("Expected ErrNotLoaded for missing key, got %v", err)
+	}
+	if len(calls) != 1 {
+		t.Fatalf("Expected one batch, got %v", calls)
+	}
+	sort.Ints(calls[0])
+	if len(calls[0]) != 3 || calls[0][0] != 1 || calls[0][1] != 2 || calls[0][2] != 404 {
+		t.Errorf("Expected keys [1 2 404], got %v", calls[0])
+	}
+
+	// Загруженные ключи берутся из кэша, новые уходят следующей пачкой
+	if v, err := loader.Load(2)(); err != nil || v != "user" {
+		t.Errorf("Cached key: %q, %v", v, err)
+	}
+	loader.Load(3)()
+	if len(calls) != 2 || len(calls[1]) != 1 || calls[1][0] != 3 {
+		t.Errorf("Expected second batch [3], got %v", calls)
+	}
+}
+
+func TestLoaderFetchError(t *testing.T) {
+	fail := errors.New("нет соединения")
+	loader := NewLoader(func(keys []int) (map[int]string, error) { return nil, fail })
+	a, b := loader.Load(1), loader.Load(2)
+	if _, err := a(); err != fail {
+		t.Errorf("Expected fetch error, got %v", err)
+	}
+	if _, err := b(); err != fail {
+		t.Errorf("Expected fetch error for the whole batch, got %v", err)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Коды ошибок API. Код не меняется между версиями и предназначен для программ,
+// текст сообщения - для человека.
+const (
+	CodeBadRequest         = "bad_request"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeInvalidToken       = "invalid_token"
+	CodeInvalidCredentials = "invalid_credentials"
+	CodeForbidden          = "forbidden"
+	CodeNotFound           = "not_found"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeConflict           = "conflict"
+	CodeRateLimited        = "rate_limited"
+	CodeInternal           = "internal_error"
+	CodeUpstream           = "upstream_error"
+
+	CodeUserNotFound       = "user_not_found"
+	CodeRecipientNotFound  = "recipient_not_found"
+	CodeItemNotFound       = "item_not_found"
+	CodeInsufficientFunds  = "insufficient_funds"
+	CodeUsernameTaken      = "username_taken"
+	CodeAccountDeactivated = "account_deactivated"
+	CodeLoginLocked        = "login_locked"
+)
+
+// APIError - одна ошибка в ответе. Field указывает на поле запроса, к которому
+// относится ошибка, Details - дополнительные машиночитаемые данные. Message
+// заполняется при ответе из каталога по Key на языке запроса.
+type APIError struct {
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Field   string                 `json:"field,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	Key     string                 `json:"-"`
+	Args    []interface{}          `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return T(config.DefaultLanguage, e.Key, e.Args...)
+	}
+	return e.Message
+}
+
+// ErrorResponse - тело любого ответа с ошибкой: {"errors": [...]}
+type ErrorResponse struct {
+	Errors []*APIError `json:"errors"`
+}
+
+// FieldError привязывает ошибку к полю запроса
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string { return e.Field + ": " + e.Err.Error() }
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// apiErrorCodes - статус, код и сообщение каталога для ошибок предметной области.
+// Проверяются по порядку через errors.Is, поэтому обёрнутые ошибки тоже распознаются.
+var apiErrorCodes = []struct {
+	err    error
+	status int
+	code   string
+	key    string
+	args   []interface{}
+}{
+	{ErrInsufficientFunds, http.StatusBadRequest, CodeInsufficientFunds, "insufficient_funds", nil},
+	{ErrUserNotFound, http.StatusNotFound, CodeUserNotFound, "user_not_found", nil},
+	{ErrRecipientNotFound, http.StatusNotFound, CodeRecipientNotFound, "recipient_not_found", nil},
+	{ErrItemNotFound, http.StatusNotFound, CodeItemNotFound, "item_not_found", nil},
+	{ErrMemoTooLong, http.StatusBadRequest, CodeValidationFailed, "memo_too_long", []interface{}{MaxMemoLength}},
+	{ErrUnknownCategory, http.StatusBadRequest, CodeValidationFailed, "unknown_category", nil},
+	{ErrSelfTransfer, http.StatusBadRequest, CodeValidationFailed, "self_transfer", nil},
+	{ErrBatchTotalTooLarge, http.StatusBadRequest, CodeValidationFailed, "batch_total_too_large", nil},
+	{ErrInvalidUsername, http.StatusBadRequest, CodeValidationFailed, "invalid_username", nil},
+	{ErrUsernameReserved, http.StatusBadRequest, CodeValidationFailed, "username_reserved", nil},
+	{ErrInvalidSchedule, http.StatusBadRequest, CodeValidationFailed, "invalid_schedule", nil},
+	{ErrUsernameTaken, http.StatusConflict, CodeUsernameTaken, "username_taken", nil},
+	{ErrInvalidCredentials, http.StatusUnauthorized, CodeInvalidCredentials, "invalid_credentials", nil},
+	{ErrAccountDeactivated, http.StatusForbidden, CodeAccountDeactivated, "account_deactivated", nil},
+	{ErrInvalidInvite, http.StatusForbidden, CodeForbidden, "invite_invalid", nil},
+	{ErrInvalidAPIToken, http.StatusUnauthorized, CodeInvalidToken, "token_invalid", nil},
+	{ErrInvalidRefreshToken, http.StatusUnauthorized, CodeInvalidToken, "refresh_token_invalid", nil},
+	{ErrScheduleNotFound, http.StatusNotFound, CodeNotFound, "schedule_not_found", nil},
+	{ErrScheduleSameState, http.StatusNotFound, CodeNotFound, "schedule_not_found_or_same_state", nil},
+	{ErrInviteNotFound, http.StatusNotFound, CodeNotFound, "invite_not_found", nil},
+	{ErrFindingNotFound, http.StatusNotFound, CodeNotFound, "finding_not_found", nil},
+	{ErrPolicyNotFound, http.StatusNotFound, CodeNotFound, "limits_not_found", nil},
+	{ErrInvalidLimit, http.StatusBadRequest, CodeValidationFailed, "invalid_limit", nil},
+	{ErrUnknownRole, http.StatusBadRequest, CodeValidationFailed, "unknown_role", nil},
+	{ErrRoleNotAssigned, http.StatusNotFound, CodeNotFound, "role_not_assigned", nil},
+	{ErrTOTPNotEnrolled, http.StatusConflict, CodeConflict, "totp_enroll_first", nil},
+	{ErrTOTPEnabled, http.StatusConflict, CodeConflict, "totp_already_enabled", nil},
+	{ErrInvalidOTP, http.StatusForbidden, OTPInvalid, "otp_invalid", nil},
+	{ErrInvalidEventID, http.StatusBadRequest, CodeValidationFailed, "invalid_event_id", nil},
+	{ErrWebhookNotFound, http.StatusNotFound, CodeNotFound, "webhook_not_found", nil},
+	{ErrDeliveryNotFound, http.StatusNotFound, CodeNotFound, "webhook_delivery_not_found", nil},
+	{ErrInvalidWebhookURL, http.StatusBadRequest, CodeValidationFailed, "invalid_webhook_url", nil},
+	{ErrWebhookSecretTooShort, http.StatusBadRequest, CodeValidationFailed, "webhook_secret_too_short", []interface{}{minWebhookSecretLength}},
+	{ErrOIDCNotConfigured, http.StatusNotFound, CodeNotFound, "sso_not_configured", nil},
+}
+
+// writeErrors отвечает конвертом {"errors": [...]} на языке запроса
+func writeErrors(w http.ResponseWriter, r *http.Request, status int, errs ...*APIError) {
+	lang := requestLanguage(r)
+	for _, e := range errs {
+		if e.Key != "" {
+			e.Message = T(lang, e.Key, e.Args...)
+		}
+	}
+	setContentLanguage(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Errors: errs})
+}
+
+// writeError отвечает одной ошибкой с кодом и сообщением каталога
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, key string, args ...interface{}) {
+	writeErrors(w, r, status, &APIError{Code: code, Key: key, Args: args})
+}
+
+// writeFieldError отвечает ошибкой проверки одного поля запроса
+func writeFieldError(w http.ResponseWriter, r *http.Request, field, key string, args ...interface{}) {
+	writeErrors(w, r, http.StatusBadRequest, &APIError{Code: CodeValidationFailed, Field: field, Key: key, Args: args})
+}
+
+// toAPIError сопоставляет ошибку со статусом и кодом. Неизвестные ошибки
+// считаются внутренними: их текст пишется в лог и клиенту не отдаётся.
+func toAPIError(err error) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.Status == 0 {
+			apiErr.Status = http.StatusBadRequest
+		}
+		return apiErr
+	}
+	// Ошибки со своим представлением в ответе: PolicyViolation, LoginLockedError
+	var converter interface{ APIError() *APIError }
+	if errors.As(err, &converter) {
+		return converter.APIError()
+	}
+
+	for _, e := range apiErrorCodes {
+		if errors.Is(err, e.err) {
+			res := &APIError{Status: e.status, Code: e.code, Key: e.key, Args: e.args}
+			var fieldErr *FieldError
+			if errors.As(err, &fieldErr) {
+				res.Field = fieldErr.Field
+			}
+			return res
+		}
+	}
+
+	log.Printf("Внутренняя ошибка: %v", err)
+	return &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Key: "internal_error"}
+}
+
+// writeAPIError отвечает ошибкой, возвращённой моделью или сервисом; для
+// блокировки после неудачных попыток добавляет Retry-After
+func writeAPIError(w http.ResponseWriter, r *http.Request, err error) {
+	var locked *LoginLockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", strconv.Itoa(locked.retryAfterSeconds()))
+	}
+	apiErr := toAPIError(err)
+	writeErrors(w, r, apiErr.Status, apiErr)
+}
+
+// NotFoundHandler и MethodNotAllowedHandler заменяют текстовые ответы маршрутизатора
+func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, CodeNotFound, "route_not_found", r.URL.Path)
+}
+
+func MethodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, CodeMethodNotAllowed, "method_not_allowed", r.Method)
+}
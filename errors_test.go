@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestToAPIError(t *testing.T) {
+	_, memoErr := normalizeTransferMeta(TransferMeta{Memo: strings.Repeat("я", MaxMemoLength+1)})
+
+	cases := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+		field  string
+	}{
+		{"sentinel", ErrUserNotFound, http.StatusNotFound, CodeUserNotFound, ""},
+		{"wrapped", fmt.Errorf("%w для перевода", ErrInsufficientFunds), http.StatusBadRequest, CodeInsufficientFunds, ""},
+		{"batch recipient", fmt.Errorf("bob: %w", &PolicyViolation{Code: PolicyDailyLimit, Limit: 1000, Current: 1200}),
+			http.StatusForbidden, PolicyDailyLimit, ""},
+		{"field", memoErr, http.StatusBadRequest, CodeValidationFailed, "memo"},
+		{"username", ValidateUsername("admin"), http.StatusBadRequest, CodeValidationFailed, "username"},
+		{"schedule same state", ErrScheduleSameState, http.StatusNotFound, CodeNotFound, ""},
+		{"unknown", errors.New("pq: connection refused"), http.StatusInternalServerError, CodeInternal, ""},
+	}
+	for _, c := range cases {
+		got := toAPIError(c.err)
+		if got.Status != c.status || got.Code != c.code || got.Field != c.field {
+			t.Errorf("%s: got %d %s %q, want %d %s %q", c.name, got.Status, got.Code, got.Field, c.status, c.code, c.field)
+		}
+	}
+
+	if key := toAPIError(errors.New("pq: password authentication failed")).Key; key != "internal_error" {
+		t.Errorf("Internal error text leaked to client: %q", key)
+	}
+}
+
+func TestWriteAPIErrorEnvelope(t *testing.T) {
+	rr := httptest.NewRecorder()
+	writeAPIError(rr, httptest.NewRequest("POST", "/api/sendCoin", nil), &PolicyViolation{Code: PolicyWeeklyLimit, Message: "Превышен недельный лимит", Limit: 5000, Current: 5100})
+
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected status 403, got %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", ct)
+	}
+	var resp struct {
+		Errors []struct {
+			Code    string           `json:"code"`
+			Message string           `json:"message"`
+			Details map[string]int64 `json:"details"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Errors) != 1 || resp.Errors[0].Code != PolicyWeeklyLimit || resp.Errors[0].Details["limit"] != 5000 {
+		t.Errorf("Unexpected envelope: %+v", resp)
+	}
+}
+
+func TestDecodeErrorsAreJSON(t *testing.T) {
+	rr := httptest.NewRecorder()
+	SendCoinHandler(rr, httptest.NewRequest("POST", "/api/sendCoin", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", rr.Code)
+	}
+	var resp ErrorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || len(resp.Errors) != 1 || resp.Errors[0].Code != CodeBadRequest {
+		t.Errorf("Expected bad_request envelope, got %+v (%v)", resp, err)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+// События пользователя для клиентов, которые не хотят опрашивать /api/info.
+// Событие пишется в user_events в той же транзакции, что и перевод или покупка,
+// и там же вызывается pg_notify: уведомление уходит только после коммита и
+// доходит до всех экземпляров. Уведомление лишь будит подписчиков, а сами события
+// читаются из таблицы по id, поэтому клиент после переподключения получает
+// пропущенное по Last-Event-ID, пока события не удалены по EVENT_RETENTION.
+
+// Типы событий
+const (
+	EventTransferReceived  = "transfer.received"
+	EventPurchaseCompleted = "purchase.completed"
+	EventBalanceChanged    = "balance.changed"
+)
+
+// eventsChannel - канал LISTEN/NOTIFY; в уведомлении передаётся id пользователя
+const eventsChannel = "user_events"
+
+// eventsBatchSize - сколько событий читается из базы за раз
+const eventsBatchSize = 100
+
+var ErrInvalidEventID = errors.New("неверный id события")
+
+// UserEvent - событие в потоке пользователя
+type UserEvent struct {
+	ID        int64           `json:"id"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// EventParty - участник перевода: имя и баланс после перевода
+type EventParty struct {
+	ID       int
+	Username string
+	Balance  int
+}
+
+// TransferReceivedEvent - data события transfer.received
+type TransferReceivedEvent struct {
+	TransferID int    `json:"transferId"`
+	FromUser   string `json:"fromUser"`
+	Amount     int    `json:"amount"`
+	TransferMeta
+}
+
+// PurchaseCompletedEvent - data события purchase.completed
+type PurchaseCompletedEvent struct {
+	Item  string `json:"item"`
+	Price int    `json:"price"`
+}
+
+// BalanceChangedEvent - data события balance.changed
+type BalanceChangedEvent struct {
+	Balance      int    `json:"balance"`
+	Delta        int    `json:"delta"`
+	Reason       string `json:"reason"` // transfer_sent, transfer_received или purchase
+	Counterparty string `json:"counterparty,omitempty"`
+}
+
+// publishEvent записывает событие в транзакции tx и уведомляет подписчиков после коммита
+func publishEvent(tx *sql.Tx, userID int, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO user_events (user_id, type, payload) VALUES ($1, $2, $3)
+	`, userID, eventType, payload); err != nil {
+		return fmt.Errorf("ошибка при записи события: %w", err)
+	}
+	// Одинаковые уведомления одной транзакции Postgres доставляет один раз
+	if _, err := tx.Exec(`SELECT pg_notify($1, $2)`, eventsChannel, strconv.Itoa(userID)); err != nil {
+		return fmt.Errorf("ошибка при отправке уведомления: %w", err)
+	}
+	return nil
+}
+
+// publishTransferEvents - события перевода для получателя и отправителя
+func publishTransferEvents(tx *sql.Tx, transferID int, sender, recipient EventParty, amount int, meta TransferMeta) error {
+	if err := publishEvent(tx, recipient.ID, EventTransferReceived, TransferReceivedEvent{
+		TransferID: transferID, FromUser: sender.Username, Amount: amount, TransferMeta: meta,
+	}); err != nil {
+		return err
+	}
+	if err := publishEvent(tx, recipient.ID, EventBalanceChanged, BalanceChangedEvent{
+		Balance: recipient.Balance, Delta: amount, Reason: "transfer_received", Counterparty: sender.Username,
+	}); err != nil {
+		return err
+	}
+	return publishEvent(tx, sender.ID, EventBalanceChanged, BalanceChangedEvent{
+		Balance: sender.Balance, Delta: -amount, Reason: "transfer_sent", Counterparty: recipient.Username,
+	})
+}
+
+// publishPurchaseEvents - события покупки; balance - монет после покупки
+func publishPurchaseEvents(tx *sql.Tx, userID int, item *Merchandise, balance int) error {
+	if err := publishEvent(tx, userID, EventPurchaseCompleted, PurchaseCompletedEvent{Item: item.Name, Price: item.Price}); err != nil {
+		return err
+	}
+	return publishEvent(tx, userID, EventBalanceChanged, BalanceChangedEvent{
+		Balance: balance, Delta: -item.Price, Reason: "purchase",
+	})
+}
+
+// ListUserEvents возвращает события пользователя после afterID по порядку
+func ListUserEvents(userID int, afterID int64, limit int) ([]UserEvent, error) {
+	rows, err := db.Query(`
+		SELECT id, type, payload, created_at
+		FROM user_events
+		WHERE user_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3
+	`, userID, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []UserEvent
+	for rows.Next() {
+		var e UserEvent
+		if err := rows.Scan(&e.ID, &e.Type, &e.Data, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// LatestUserEventID - id последнего события пользователя, 0 - событий нет
+func LatestUserEventID(userID int) (int64, error) {
+	var id int64
+	err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM user_events WHERE user_id = $1`, userID).Scan(&id)
+	return id, err
+}
+
+// EventHub будит потоки этого экземпляра, когда у их пользователя появились события
+type EventHub struct {
+	mu   sync.Mutex
+	subs map[int]map[chan struct{}]bool
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{subs: map[int]map[chan struct{}]bool{}}
+}
+
+var events = NewEventHub()
+
+// Subscribe возвращает канал пробуждений для пользователя и функцию отписки.
+// Пробуждения не копятся: пока поток читает события, новые сливаются в одно.
+func (h *EventHub) Subscribe(userID int) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = map[chan struct{}]bool{}
+	}
+	h.subs[userID][ch] = true
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[userID], ch)
+		if len(h.subs[userID]) == 0 {
+			delete(h.subs, userID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// Notify будит потоки пользователя
+func (h *EventHub) Notify(userID int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[userID] {
+		wake(ch)
+	}
+}
+
+// NotifyAll будит все потоки: после переподключения к базе уведомления могли потеряться
+func (h *EventHub) NotifyAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, chans := range h.subs {
+		for ch := range chans {
+			wake(ch)
+		}
+	}
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Run слушает канал user_events до отмены контекста и удаляет события старше
+// EVENT_RETENTION. pq.Listener сам переподключается к базе.
+func (h *EventHub) Run(ctx context.Context) {
+	listener := pq.NewListener(config.DatabaseURL, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Ошибка подписки на события: %v", err)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(eventsChannel); err != nil {
+		log.Printf("Не удалось подписаться на %s: %v", eventsChannel, err)
+	}
+
+	cleanup := time.NewTicker(time.Minute)
+	defer cleanup.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-listener.Notify:
+			if n == nil {
+				h.NotifyAll()
+				continue
+			}
+			if userID, err := strconv.Atoi(n.Extra); err == nil {
+				h.Notify(userID)
+			}
+		case <-cleanup.C:
+			go listener.Ping()
+			db.Exec(`DELETE FROM user_events WHERE created_at < now() - $1::INTERVAL`, pgInterval(config.EventRetention))
+		}
+	}
+}
+
+// streamEvents отправляет события пользователя после lastID, затем ждёт новых.
+// ping вызывается раз в EVENTS_HEARTBEAT, чтобы прокси не закрыли соединение.
+// Поток завершается с контекстом, с истечением или отзывом токена.
+func streamEvents(ctx context.Context, claims *Claims, userID int, lastID int64, send func(UserEvent) error, ping func() error) error {
+	if claims.ExpiresAt > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, time.Unix(claims.ExpiresAt, 0))
+		defer cancel()
+	}
+	// Подписка до чтения, чтобы не пропустить уведомление между чтением и ожиданием
+	wakeup, unsubscribe := events.Subscribe(userID)
+	defer unsubscribe()
+	heartbeat := time.NewTicker(config.EventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		batch, err := ListUserEvents(userID, lastID, eventsBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, e := range batch {
+			if err := send(e); err != nil {
+				return err
+			}
+			lastID = e.ID
+		}
+		if len(batch) == eventsBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wakeup:
+		case <-heartbeat.C:
+			if revocations.IsRevoked(claims) {
+				return nil
+			}
+			if err := ping(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// lastEventID - с какого события продолжить: заголовок Last-Event-ID (его шлёт
+// EventSource при переподключении) или ?lastEventId=. Без них - только новые события.
+func lastEventID(r *http.Request, userID int) (int64, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("lastEventId")
+	}
+	if value == "" {
+		return LatestUserEventID(userID)
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, &FieldError{Field: "lastEventId", Err: ErrInvalidEventID}
+	}
+	return id, nil
+}
+
+// writeSSE пишет событие в формате text/event-stream
+func writeSSE(w io.Writer, e UserEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+	return err
+}
+
+// EventsHandler - поток событий пользователя (Server-Sent Events)
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "streaming_unsupported")
+		return
+	}
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+	lastID, err := lastEventID(r, user.ID)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx не должен копить поток
+	w.WriteHeader(http.StatusOK)
+	// Клиенту без Last-Event-ID подсказываем, откуда продолжить после обрыва
+	fmt.Fprintf(w, "retry: %d\nid: %d\n\n", config.EventsHeartbeat.Milliseconds(), lastID)
+	flusher.Flush()
+
+	claims := r.Context().Value("claims").(*Claims)
+	err = streamEvents(r.Context(), claims, user.ID, lastID, func(e UserEvent) error {
+		if err := writeSSE(w, e); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}, func() error {
+		_, err := io.WriteString(w, ": ping\n\n")
+		flusher.Flush()
+		return err
+	})
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Поток событий %s прерван: %v", user.Username, err)
+	}
+}
+
+var eventsUpgrader = websocket.Upgrader{}
+
+// EventsWebSocketHandler - тот же поток событий через WebSocket: каждое событие -
+// JSON-сообщение UserEvent. Сообщения клиента не ожидаются и отбрасываются.
+func EventsWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+	lastID, err := lastEventID(r, user.ID)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	conn, err := eventsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade уже ответил клиенту
+	}
+	defer conn.Close()
+
+	// Чтение нужно, чтобы заметить закрытие соединения клиентом
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	claims := r.Context().Value("claims").(*Claims)
+	err = streamEvents(ctx, claims, user.ID, lastID, func(e UserEvent) error {
+		return conn.WriteJSON(e)
+	}, func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Поток событий %s прерван: %v", user.Username, err)
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+}
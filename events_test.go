@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventHubWakesSubscribers(t *testing.T) {
+	hub := NewEventHub()
+	first, cancelFirst := hub.Subscribe(1)
+	second, cancelSecond := hub.Subscribe(2)
+	defer cancelSecond()
+
+	// Несколько уведомлений подряд сливаются в одно пробуждение
+	hub.Notify(1)
+	hub.Notify(1)
+	select {
+	case <-first:
+	default:
+		t.Fatal("Expected subscriber 1 to be woken")
+	}
+	select {
+	case <-first:
+		t.Fatal("Expected wakeups to coalesce")
+	case <-second:
+		t.Fatal("Subscriber 2 must not be woken by user 1 events")
+	default:
+	}
+
+	hub.NotifyAll()
+	select {
+	case <-second:
+	default:
+		t.Fatal("Expected NotifyAll to wake subscriber 2")
+	}
+
+	cancelFirst()
+	if _, ok := hub.subs[1]; ok {
+		t.Error("Expected user 1 to be removed after unsubscribe")
+	}
+}
+
+func TestLastEventID(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/events?lastEventId=7", nil)
+	req.Header.Set("Last-Event-ID", "42")
+	if id, err := lastEventID(req, 1); err != nil || id != 42 {
+		t.Errorf("Expected header to win, got %d, %v", id, err)
+	}
+
+	req = httptest.NewRequest("GET", "/api/events?lastEventId=7", nil)
+	if id, err := lastEventID(req, 1); err != nil || id != 7 {
+		t.Errorf("Expected 7 from query, got %d, %v", id, err)
+	}
+
+	req = httptest.NewRequest("GET", "/api/events", nil)
+	req.Header.Set("Last-Event-ID", "abc")
+	_, err := lastEventID(req, 1)
+	if !errors.Is(err, ErrInvalidEventID) || toAPIError(err).Field != "lastEventId" {
+		t.Errorf("Expected invalid lastEventId, got %v", err)
+	}
+}
+
+func TestWriteSSE(t *testing.T) {
+	var buf bytes.Buffer
+	writeSSE(&buf, UserEvent{ID: 5, Type: EventBalanceChanged, Data: json.RawMessage(`{"balance":990}`)})
+	expected := "id: 5\nevent: balance.changed\ndata: {\"balance\":990}\n\n"
+	if buf.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestEventsRequireToken(t *testing.T) {
+	for _, path := range []string{"/api/events", "/api/events/ws"} {
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", path, rr.Code)
+		}
+	}
+}
+
+func TestEventsStreamTransfer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go events.Run(ctx)
+
+	senderToken := getTokenForUser(t, "events_sender")
+	recipientToken := getTokenForUser(t, "events_recipient")
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/api/events", nil)
+	req.Header.Set("Authorization", "Bearer "+recipientToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	body := `{"toUser": "events_recipient", "amount": 15}`
+	sendReq, _ := http.NewRequest("POST", server.URL+"/api/sendCoin", strings.NewReader(body))
+	sendReq.Header.Set("Authorization", "Bearer "+senderToken)
+	sendResp, err := http.DefaultClient.Do(sendReq)
+	if err != nil || sendResp.StatusCode != http.StatusOK {
+		t.Fatalf("sendCoin failed: %v", err)
+	}
+	sendResp.Body.Close()
+
+	// Ждём transfer.received и balance.changed получателя
+	received := map[string]string{}
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		var event string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "event: ") {
+				event = strings.TrimPrefix(line, "event: ")
+			} else if strings.HasPrefix(line, "data: ") {
+				lines <- event + " " + strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	timeout := time.After(5 * time.Second)
+	for len(received) < 2 {
+		select {
+		case line := <-lines:
+			event, data, _ := strings.Cut(line, " ")
+			received[event] = data
+		case <-timeout:
+			t.Fatalf("Timed out waiting for events, got %v", received)
+		}
+	}
+
+	var transfer TransferReceivedEvent
+	json.Unmarshal([]byte(received[EventTransferReceived]), &transfer)
+	if transfer.FromUser != "events_sender" || transfer.Amount != 15 {
+		t.Errorf("Unexpected transfer event %+v", transfer)
+	}
+	var balance BalanceChangedEvent
+	json.Unmarshal([]byte(received[EventBalanceChanged]), &balance)
+	if balance.Balance != GetUser("events_recipient").Coins || balance.Delta != 15 {
+		t.Errorf("Unexpected balance event %+v", balance)
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Правила антифрода
+const (
+	FraudRuleFanIn    = "fan_in_new_accounts" // Получатель собирает монеты со свежих аккаунтов
+	FraudRuleCircular = "circular_transfer"   // Монеты вернулись к отправителю по цепочке
+	FraudRuleBurst    = "transfer_burst"      // Много переводов за короткое время
+)
+
+// Статусы находок
+const (
+	FindingOpen      = "open"
+	FindingConfirmed = "confirmed"
+	FindingDismissed = "dismissed"
+)
+
+// PolicyAccountFrozen - код отказа для замороженного аккаунта
+const PolicyAccountFrozen = "account_frozen"
+
+var ErrFindingNotFound = errors.New("открытая находка не найдена")
+
+// FraudFinding - подозрительная активность, найденная антифродом
+type FraudFinding struct {
+	ID            int                    `json:"id"`
+	Username      string                 `json:"username"`
+	Rule          string                 `json:"rule"`
+	Score         int                    `json:"score"`
+	Details       map[string]interface{} `json:"details"`
+	TransactionID *int                   `json:"transactionId,omitempty"`
+	Status        string                 `json:"status"`
+	ReviewedBy    string                 `json:"reviewedBy,omitempty"`
+	CreatedAt     time.Time              `json:"createdAt"`
+}
+
+// AccountRisk - суммарная оценка риска аккаунта по открытым находкам
+type AccountRisk struct {
+	Username     string `json:"username"`
+	Score        int    `json:"score"`
+	OpenFindings int    `json:"openFindings"`
+	Frozen       bool   `json:"frozen"`
+	FrozenReason string `json:"frozenReason,omitempty"`
+}
+
+// FraudReport - отчёт антифрода для администратора
+type FraudReport struct {
+	Accounts []AccountRisk  `json:"accounts"` // Аккаунты с открытыми находками, самые рискованные сначала
+	Findings []FraudFinding `json:"findings"`
+}
+
+// checkNotFrozen запрещает операции с монетами замороженному аккаунту
+func checkNotFrozen(q queryRower, userID int) error {
+	var frozen bool
+	if err := q.QueryRow(`SELECT frozen FROM users WHERE id = $1`, userID).Scan(&frozen); err != nil {
+		return fmt.Errorf("ошибка при проверке аккаунта: %v", err)
+	}
+	if frozen {
+		return &PolicyViolation{Code: PolicyAccountFrozen, Message: "Аккаунт заморожен до проверки"}
+	}
+	return nil
+}
+
+// recordFinding сохраняет находку, если такой же открытой находки по этому правилу
+// за последний час ещё нет, чтобы серия переводов не порождала дубликаты.
+func recordFinding(tx *sql.Tx, userID int, rule string, score int, details map[string]interface{}, transactionID int) (bool, error) {
+	detailsJSON, err := json.Marshal(details)
+	if err != nil {
+		return false, err
+	}
+	res, err := tx.Exec(`
+		INSERT INTO fraud_findings (user_id, rule, score, details, transaction_id)
+		SELECT $1, $2, $3, $4, $5
+		WHERE NOT EXISTS (
+			SELECT 1 FROM fraud_findings
+			WHERE user_id = $1 AND rule = $2 AND status = 'open'
+				AND created_at > now() - INTERVAL '1 hour'
+		)
+	`, userID, rule, score, detailsJSON, transactionID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// fraudEventMaxAge - переводы старше не проверяются: окна правил отсчитываются от
+// текущего момента, и после долгого простоя relay старые переводы дали бы ложные находки
+const fraudEventMaxAge = 24 * time.Hour
+
+// FraudSink проверяет переводы по правилам антифрода по событиям coins.transferred.
+// Проверка идёт после коммита перевода, поэтому запросы по истории переводов не
+// держат блокировки строк пользователей, а находки пишутся в транзакции курсора relay.
+type FraudSink struct{}
+
+func (FraudSink) Name() string { return "antifraud" }
+
+func (s FraudSink) Publish(ctx context.Context, events []DomainEvent) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.PublishTx(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (FraudSink) PublishTx(tx *sql.Tx, events []DomainEvent) error {
+	for _, e := range events {
+		if e.Type != DomainCoinsTransferred || time.Since(e.OccurredAt) > fraudEventMaxAge {
+			continue
+		}
+		var senderID, recipientID int
+		err := tx.QueryRow(`
+			SELECT sender_id, receiver_id FROM transactions WHERE id = $1
+		`, e.AggregateID).Scan(&senderID, &recipientID)
+		if err != nil {
+			return fmt.Errorf("антифрод: перевод %d: %v", e.AggregateID, err)
+		}
+		if err := evaluateTransferFraud(tx, senderID, recipientID, e.AggregateID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evaluateTransferFraud проверяет записанный перевод по правилам антифрода. Находки накапливаются на аккаунте, и если его оценка достигает
+// FraudFreezeScore, аккаунт замораживается до ручной проверки.
+func evaluateTransferFraud(tx *sql.Tx, senderID, recipientID, transactionID int) error {
+	flagged := map[int]bool{}
+
+	// Много разных свежих отправителей у одного получателя за сутки
+	var freshSenders int
+	err := tx.QueryRow(`
+		SELECT COUNT(DISTINCT t.sender_id)
+		FROM transactions t
+		JOIN users s ON s.id = t.sender_id
+		WHERE t.receiver_id = $1
+			AND t.transaction_time > now() - INTERVAL '1 day'
+			AND s.created_at > now() - $2::INTERVAL
+	`, recipientID, pgInterval(config.FraudNewAccountAge)).Scan(&freshSenders)
+	if err != nil {
+		return fmt.Errorf("антифрод: %v", err)
+	}
+	if freshSenders >= config.FraudFanInThreshold {
+		score := 40 + 10*(freshSenders-config.FraudFanInThreshold)
+		created, err := recordFinding(tx, recipientID, FraudRuleFanIn, score,
+			map[string]interface{}{"freshSenders": freshSenders}, transactionID)
+		if err != nil {
+			return fmt.Errorf("антифрод: %v", err)
+		}
+		flagged[recipientID] = flagged[recipientID] || created
+	}
+
+	// Цепочка переводов за неделю длиной до 4 звеньев, вернувшая монеты отправителю
+	var cycleLength sql.NullInt64
+	err = tx.QueryRow(`
+		WITH RECURSIVE chain (user_id, depth) AS (
+			SELECT $2::INTEGER, 1
+			UNION
+			SELECT t.receiver_id, c.depth + 1
+			FROM chain c
+			JOIN transactions t ON t.sender_id = c.user_id
+			WHERE c.depth < 4 AND t.transaction_time > now() - INTERVAL '7 days'
+		)
+		SELECT MIN(depth) FROM chain WHERE user_id = $1
+	`, senderID, recipientID).Scan(&cycleLength)
+	if err != nil {
+		return fmt.Errorf("антифрод: %v", err)
+	}
+	if cycleLength.Valid && senderID != recipientID {
+		details := map[string]interface{}{"cycleLength": cycleLength.Int64}
+		for _, userID := range []int{senderID, recipientID} {
+			created, err := recordFinding(tx, userID, FraudRuleCircular, 30, details, transactionID)
+			if err != nil {
+				return fmt.Errorf("антифрод: %v", err)
+			}
+			flagged[userID] = flagged[userID] || created
+		}
+	}
+
+	// Всплеск переводов от одного отправителя
+	var recent int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM transactions
+		WHERE sender_id = $1 AND transaction_time > now() - $2::INTERVAL
+	`, senderID, pgInterval(config.FraudBurstWindow)).Scan(&recent)
+	if err != nil {
+		return fmt.Errorf("антифрод: %v", err)
+	}
+	if recent >= config.FraudBurstCount {
+		created, err := recordFinding(tx, senderID, FraudRuleBurst, 20,
+			map[string]interface{}{"transfers": recent, "windowSeconds": int(config.FraudBurstWindow.Seconds())}, transactionID)
+		if err != nil {
+			return fmt.Errorf("антифрод: %v", err)
+		}
+		flagged[senderID] = flagged[senderID] || created
+	}
+
+	if !config.FraudAutoFreeze {
+		return nil
+	}
+	for userID, created := range flagged {
+		if !created {
+			continue
+		}
+		_, err := tx.Exec(`
+			UPDATE users SET frozen = TRUE, frozen_at = now(), frozen_reason = 'antifraud'
+			WHERE id = $1 AND NOT frozen AND (
+				SELECT COALESCE(SUM(score), 0) FROM fraud_findings
+				WHERE user_id = $1 AND status = 'open'
+			) >= $2
+		`, userID, config.FraudFreezeScore)
+		if err != nil {
+			return fmt.Errorf("антифрод: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetFraudReport собирает оценки риска аккаунтов и последние находки с заданным статусом
+func GetFraudReport(status string) (*FraudReport, error) {
+	report := &FraudReport{Accounts: make([]AccountRisk, 0), Findings: make([]FraudFinding, 0)}
+
+	rows, err := db.Query(`
+		SELECT u.username, COALESCE(SUM(f.score), 0), COUNT(f.id), u.frozen, COALESCE(u.frozen_reason, '')
+		FROM users u
+		LEFT JOIN fraud_findings f ON f.user_id = u.id AND f.status = 'open'
+		GROUP BY u.id
+		HAVING COUNT(f.id) > 0 OR u.frozen
+		ORDER BY 2 DESC, u.username
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a AccountRisk
+		if err := rows.Scan(&a.Username, &a.Score, &a.OpenFindings, &a.Frozen, &a.FrozenReason); err != nil {
+			return nil, err
+		}
+		report.Accounts = append(report.Accounts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(`
+		SELECT f.id, u.username, f.rule, f.score, f.details, f.transaction_id, f.status,
+			COALESCE(f.reviewed_by, ''), f.created_at
+		FROM fraud_findings f
+		JOIN users u ON u.id = f.user_id
+		WHERE f.status = $1
+		ORDER BY f.id DESC
+		LIMIT 500
+	`, status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f FraudFinding
+		var details []byte
+		var transactionID sql.NullInt64
+		if err := rows.Scan(&f.ID, &f.Username, &f.Rule, &f.Score, &details, &transactionID,
+			&f.Status, &f.ReviewedBy, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(details, &f.Details); err != nil {
+			return nil, fmt.Errorf("находка %d: %v", f.ID, err)
+		}
+		if transactionID.Valid {
+			id := int(transactionID.Int64)
+			f.TransactionID = &id
+		}
+		report.Findings = append(report.Findings, f)
+	}
+	return report, rows.Err()
+}
+
+// ReviewFinding закрывает находку решением администратора
+func ReviewFinding(id int, status, reviewer string) error {
+	res, err := db.Exec(`
+		UPDATE fraud_findings SET status = $1, reviewed_by = $2, reviewed_at = now()
+		WHERE id = $3 AND status = 'open'
+	`, status, reviewer, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrFindingNotFound
+	}
+	return nil
+}
+
+// SetUserFrozen замораживает или размораживает аккаунт
+func SetUserFrozen(username string, frozen bool, reason string) error {
+	res, err := db.Exec(`
+		UPDATE users SET frozen = $1,
+			frozen_at = CASE WHEN $1 THEN now() END,
+			frozen_reason = CASE WHEN $1 THEN $2 END
+		WHERE LOWER(username) = LOWER($3)
+	`, frozen, reason, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// FraudReportHandler возвращает отчёт антифрода (?status=open|confirmed|dismissed).
+func FraudReportHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = FindingOpen
+	}
+	if status != FindingOpen && status != FindingConfirmed && status != FindingDismissed {
+		writeError(w, r, http.StatusBadRequest, CodeValidationFailed, "unknown_status")
+		return
+	}
+
+	report, err := GetFraudReport(status)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "report_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// ReviewFindingHandler подтверждает или отклоняет находку.
+func ReviewFindingHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Status string `json:"status"` // confirmed или dismissed
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		(req.Status != FindingConfirmed && req.Status != FindingDismissed) {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+
+	reviewer := r.Context().Value("username").(string)
+	if err := ReviewFinding(id, req.Status, reviewer); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "finding_not_found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": req.Status})
+}
+
+// FreezeUserHandler замораживает аккаунт вручную.
+func FreezeUserHandler(w http.ResponseWriter, r *http.Request) {
+	setUserFrozen(w, r, true)
+}
+
+// UnfreezeUserHandler снимает заморозку после проверки.
+func UnfreezeUserHandler(w http.ResponseWriter, r *http.Request) {
+	setUserFrozen(w, r, false)
+}
+
+func setUserFrozen(w http.ResponseWriter, r *http.Request, frozen bool) {
+	username := mux.Vars(r)["username"]
+	reviewer := r.Context().Value("username").(string)
+	if err := SetUserFrozen(username, frozen, "manual:"+reviewer); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"username": username, "frozen": frozen})
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// resetFraud снимает заморозку и закрывает открытые находки, оставшиеся от прошлых запусков
+func resetFraud(t *testing.T, users ...*User) {
+	for _, u := range users {
+		if _, err := db.Exec(`UPDATE users SET frozen = FALSE, frozen_at = NULL, frozen_reason = NULL WHERE id = $1`, u.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`UPDATE fraud_findings SET status = 'dismissed' WHERE user_id = $1 AND status = 'open'`, u.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fraudUsers регистрирует пользователей и сбрасывает их состояние антифрода
+func fraudUsers(t *testing.T, names ...string) []*User {
+	users := make([]*User, len(names))
+	for i, name := range names {
+		getTokenForUser(t, name)
+		users[i] = GetUser(name)
+	}
+	resetFraud(t, users...)
+	return users
+}
+
+// checkLastTransfer прогоняет через антифрод последний перевод отправителя
+func checkLastTransfer(t *testing.T, sender *User) {
+	var id int
+	if err := db.QueryRow(`SELECT MAX(id) FROM transactions WHERE sender_id = $1`, sender.ID).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	events := []DomainEvent{{Type: DomainCoinsTransferred, AggregateType: AggregateTransfer, AggregateID: id, OccurredAt: time.Now()}}
+	if err := (FraudSink{}).Publish(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func hasOpenFinding(t *testing.T, u *User, rule string) bool {
+	var n int
+	if err := db.QueryRow(`
+		SELECT COUNT(*) FROM fraud_findings WHERE user_id = $1 AND rule = $2 AND status = 'open'
+	`, u.ID, rule).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n > 0
+}
+
+func transfer(t *testing.T, from, to *User, amount int) {
+	if err := GetUser(from.Username).TransferCoins(to, amount, TransferMeta{}); err != nil {
+		t.Fatalf("%s -> %s: %v", from.Username, to.Username, err)
+	}
+}
+
+func TestFraudSinkSkipsEvents(t *testing.T) {
+	// Без обращений к базе: события других типов и устаревшие переводы пропускаются
+	events := []DomainEvent{
+		{Type: DomainMerchPurchased, AggregateID: 1, OccurredAt: time.Now()},
+		{Type: DomainCoinsTransferred, AggregateID: 2, OccurredAt: time.Now().Add(-fraudEventMaxAge - time.Minute)},
+	}
+	if err := (FraudSink{}).PublishTx(nil, events); err != nil {
+		t.Errorf("Expected skipped events, got %v", err)
+	}
+}
+
+func TestFraudFanIn(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.FraudAutoFreeze = false
+	config.FraudNewAccountAge = 100 * 365 * 24 * time.Hour // Тестовые аккаунты живут между запусками
+
+	users := fraudUsers(t, "fraud_fanin_target", "fraud_fanin_a", "fraud_fanin_b", "fraud_fanin_c")
+	target := users[0]
+
+	// Переводы прошлых запусков тоже попадают в сутки, поэтому сначала порог недостижим
+	config.FraudFanInThreshold = 10
+	transfer(t, users[1], target, 1)
+	checkLastTransfer(t, users[1])
+	if hasOpenFinding(t, target, FraudRuleFanIn) {
+		t.Fatal("Fan-in flagged below the threshold")
+	}
+
+	config.FraudFanInThreshold = 3
+	for _, sender := range users[2:] {
+		transfer(t, sender, target, 1)
+		checkLastTransfer(t, sender)
+	}
+	if !hasOpenFinding(t, target, FraudRuleFanIn) {
+		t.Error("Expected fan-in finding for the recipient")
+	}
+	for _, sender := range users[1:] {
+		if hasOpenFinding(t, sender, FraudRuleFanIn) {
+			t.Errorf("Sender %s must not be flagged", sender.Username)
+		}
+	}
+}
+
+func TestFraudCircular(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.FraudAutoFreeze = false
+
+	users := fraudUsers(t, "fraud_circle_a", "fraud_circle_b", "fraud_circle_c", "fraud_circle_outsider")
+	a, b, c, outsider := users[0], users[1], users[2], users[3]
+
+	transfer(t, a, b, 1)
+	transfer(t, b, c, 1)
+	checkLastTransfer(t, b)
+	if hasOpenFinding(t, b, FraudRuleCircular) {
+		t.Error("Open chain must not be flagged")
+	}
+	transfer(t, c, a, 1)
+	checkLastTransfer(t, c)
+	for _, u := range []*User{a, c} {
+		if !hasOpenFinding(t, u, FraudRuleCircular) {
+			t.Errorf("Expected circular finding for %s", u.Username)
+		}
+	}
+	transfer(t, outsider, a, 1)
+	checkLastTransfer(t, outsider)
+	if hasOpenFinding(t, outsider, FraudRuleCircular) {
+		t.Error("Outsider is not part of the cycle")
+	}
+}
+
+func TestFraudBurstAutoFreeze(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.FraudAutoFreeze = true
+	config.FraudBurstWindow = time.Hour
+	config.FraudFreezeScore = 20
+
+	users := fraudUsers(t, "fraud_burst_sender", "fraud_burst_recipient")
+	sender, recipient := users[0], users[1]
+	// Переводы прошлых запусков тоже попадают в окно, поэтому считаем от текущего числа
+	var recent int
+	db.QueryRow(`SELECT COUNT(*) FROM transactions WHERE sender_id = $1 AND transaction_time > now() - INTERVAL '1 hour'`,
+		sender.ID).Scan(&recent)
+	config.FraudBurstCount = recent + 2
+
+	transfer(t, sender, recipient, 1)
+	checkLastTransfer(t, sender)
+	if hasOpenFinding(t, sender, FraudRuleBurst) {
+		t.Fatal("Burst flagged too early")
+	}
+	if err := checkNotFrozen(db, sender.ID); err != nil {
+		t.Fatalf("Expected active account, got %v", err)
+	}
+
+	transfer(t, sender, recipient, 1)
+	checkLastTransfer(t, sender)
+	if !hasOpenFinding(t, sender, FraudRuleBurst) {
+		t.Fatal("Expected burst finding")
+	}
+
+	var violation *PolicyViolation
+	if err := checkNotFrozen(db, sender.ID); !errors.As(err, &violation) || violation.Code != PolicyAccountFrozen {
+		t.Fatalf("Expected frozen account, got %v", err)
+	}
+	if err := GetUser(sender.Username).TransferCoins(recipient, 1, TransferMeta{}); !errors.As(err, &violation) || violation.Code != PolicyAccountFrozen {
+		t.Errorf("Expected frozen account to be unable to transfer, got %v", err)
+	}
+	// Замороженный получатель может принимать монеты
+	transfer(t, recipient, sender, 1)
+
+	report, err := GetFraudReport(FindingOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, a := range report.Accounts {
+		if a.Username == sender.Username {
+			found = a.Frozen && a.FrozenReason == "antifraud" && a.Score >= config.FraudFreezeScore
+		}
+	}
+	if !found {
+		t.Errorf("Expected frozen %s in the report, got %+v", sender.Username, report.Accounts)
+	}
+	resetFraud(t, sender)
+}
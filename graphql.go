@@ -0,0 +1,760 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"github.com/lib/pq"
+)
+
+// /graphql отдаёт за один запрос любой набор данных пользователя и каталога, например
+// баланс, инвентарь, последние переводы и товары для дашборда. Изменения выполняются
+// функциями service.go, как в REST и gRPC. Связанные объекты (участники переводов,
+// товары покупок) загружаются пачками через Loader, а не запросом на каждую строку.
+// Стоимость запроса оценивается до выполнения и ограничена GRAPHQL_MAX_COMPLEXITY.
+
+// Коды отказа в выполнении запроса
+const (
+	CodeQueryTooComplex = "query_too_complex"
+	CodeQueryTooDeep    = "query_too_deep"
+)
+
+// Размер списков: limit по умолчанию и наибольший допустимый
+const (
+	graphQLDefaultLimit = 20
+	graphQLMaxLimit     = 100
+)
+
+// graphQLListFields - поля-списки; для оценки сложности их вложенные поля
+// умножаются на limit, а без него - на graphQLDefaultLimit
+var graphQLListFields = map[string]bool{
+	"merchandise": true,
+	"inventory":   true,
+	"transfers":   true,
+	"purchases":   true,
+}
+
+// GraphQLRequest - тело запроса к /graphql
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// TransferRecord - перевод из истории пользователя
+type TransferRecord struct {
+	ID         int        `json:"id"`
+	SenderID   int        `json:"-"`
+	ReceiverID int        `json:"-"`
+	Amount     int        `json:"amount"`
+	Memo       *string    `json:"memo"`
+	Category   *string    `json:"category"`
+	CreatedAt  *time.Time `json:"createdAt"`
+	Direction  string     `json:"direction"` // IN - получен пользователем, OUT - отправлен им
+}
+
+// PurchaseRecord - покупка из истории пользователя
+type PurchaseRecord struct {
+	ID            int        `json:"id"`
+	MerchandiseID int        `json:"-"`
+	PurchasedAt   *time.Time `json:"purchasedAt"`
+}
+
+// InventoryRecord - товар в инвентаре и сколько раз он куплен
+type InventoryRecord struct {
+	MerchandiseID int `json:"-"`
+	Quantity      int `json:"quantity"`
+}
+
+// graphQLContext - общие для резолверов данные одного запроса
+type graphQLContext struct {
+	actor       Actor
+	claims      *Claims
+	lang        string
+	users       *Loader[int, *User]
+	merchandise *Loader[int, *Merchandise]
+}
+
+func newGraphQLContext(r *http.Request) *graphQLContext {
+	claims, _ := r.Context().Value("claims").(*Claims)
+	return &graphQLContext{
+		actor:       actorFromRequest(r),
+		claims:      claims,
+		lang:        requestLanguage(r),
+		users:       NewLoader(loadUsersByID),
+		merchandise: NewLoader(loadMerchandiseByID),
+	}
+}
+
+func graphQLFrom(p graphql.ResolveParams) *graphQLContext {
+	return p.Context.Value("graphql").(*graphQLContext)
+}
+
+// graphQLError - ошибка резолвера; код API попадает в extensions.code
+type graphQLError struct {
+	message string
+	code    string
+	field   string
+}
+
+func (e *graphQLError) Error() string { return e.message }
+
+func (e *graphQLError) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": e.code}
+	if e.field != "" {
+		ext["field"] = e.field
+	}
+	return ext
+}
+
+// fail переводит ошибку сервиса в ошибку GraphQL на языке запроса
+func (c *graphQLContext) fail(err error) error {
+	apiErr := toAPIError(err)
+	message := apiErr.Message
+	if apiErr.Key != "" {
+		message = T(c.lang, apiErr.Key, apiErr.Args...)
+	}
+	return &graphQLError{message: message, code: apiErr.Code, field: apiErr.Field}
+}
+
+// requireScope не даёт персональному токену выполнить мутацию без нужного права
+func (c *graphQLContext) requireScope(scope string) error {
+	if c.claims == nil || c.claims.APITokenID == 0 || claimsHaveScope(c.claims, scope) {
+		return nil
+	}
+	return c.fail(&APIError{Status: http.StatusForbidden, Code: CodeForbidden, Key: "token_scope_denied"})
+}
+
+// loadUser и loadItem возвращают отложенное значение для резолвера
+func (c *graphQLContext) loadUser(id int) func() (interface{}, error) {
+	thunk := c.users.Load(id)
+	return func() (interface{}, error) {
+		user, err := thunk()
+		if err != nil {
+			return nil, c.fail(err)
+		}
+		return user, nil
+	}
+}
+
+func (c *graphQLContext) loadItem(id int) func() (interface{}, error) {
+	thunk := c.merchandise.Load(id)
+	return func() (interface{}, error) {
+		item, err := thunk()
+		if err != nil {
+			return nil, c.fail(err)
+		}
+		return item, nil
+	}
+}
+
+// limitArg - аргумент limit списка в пределах 1..graphQLMaxLimit
+func limitArg(p graphql.ResolveParams) (int, error) {
+	limit, _ := p.Args["limit"].(int)
+	if limit < 1 || limit > graphQLMaxLimit {
+		return 0, &APIError{Code: CodeValidationFailed, Field: "limit", Key: "limit_out_of_range", Args: []interface{}{graphQLMaxLimit}}
+	}
+	return limit, nil
+}
+
+// stringOrNil - пустая строка как null в ответе
+func stringOrNil(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// optionalString - необязательный строковый аргумент
+func optionalString(p graphql.ResolveParams, name string) string {
+	s, _ := p.Args[name].(string)
+	return s
+}
+
+var graphQLUserType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "User",
+	Description: "Участник перевода",
+	Fields: graphql.Fields{
+		"username": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+var graphQLMerchandiseType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Merchandise",
+	Fields: graphql.Fields{
+		"id":    &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		"name":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"price": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"displayName": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.String),
+			Description: "Название на языке запроса",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return localizedItemName(graphQLFrom(p).lang, p.Source.(*Merchandise).Name), nil
+			},
+		},
+	},
+})
+
+var graphQLInventoryItemType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "InventoryItem",
+	Fields: graphql.Fields{
+		"quantity": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"item": &graphql.Field{
+			Type: graphql.NewNonNull(graphQLMerchandiseType),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return graphQLFrom(p).loadItem(p.Source.(InventoryRecord).MerchandiseID), nil
+			},
+		},
+	},
+})
+
+var graphQLDirectionType = graphql.NewEnum(graphql.EnumConfig{
+	Name: "TransferDirection",
+	Values: graphql.EnumValueConfigMap{
+		"IN":  &graphql.EnumValueConfig{Value: "IN", Description: "Полученные переводы"},
+		"OUT": &graphql.EnumValueConfig{Value: "OUT", Description: "Отправленные переводы"},
+		"ALL": &graphql.EnumValueConfig{Value: "ALL"},
+	},
+})
+
+var graphQLTransferType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Transfer",
+	Fields: graphql.Fields{
+		"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		"amount":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"memo":      &graphql.Field{Type: graphql.String},
+		"category":  &graphql.Field{Type: graphql.String},
+		"createdAt": &graphql.Field{Type: graphql.DateTime},
+		"direction": &graphql.Field{Type: graphql.NewNonNull(graphQLDirectionType)},
+		"from": &graphql.Field{
+			Type: graphql.NewNonNull(graphQLUserType),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return graphQLFrom(p).loadUser(p.Source.(TransferRecord).SenderID), nil
+			},
+		},
+		"to": &graphql.Field{
+			Type: graphql.NewNonNull(graphQLUserType),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return graphQLFrom(p).loadUser(p.Source.(TransferRecord).ReceiverID), nil
+			},
+		},
+	},
+})
+
+var graphQLPurchaseType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Purchase",
+	Fields: graphql.Fields{
+		"id":          &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		"purchasedAt": &graphql.Field{Type: graphql.DateTime},
+		"item": &graphql.Field{
+			Type: graphql.NewNonNull(graphQLMerchandiseType),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return graphQLFrom(p).loadItem(p.Source.(PurchaseRecord).MerchandiseID), nil
+			},
+		},
+	},
+})
+
+var graphQLAccountType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "Account",
+	Description: "Текущий пользователь: баланс, инвентарь и история",
+	Fields: graphql.Fields{
+		"username": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"coins":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"inventory": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphQLInventoryItemType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				items, err := ListInventory(p.Source.(*User).ID)
+				if err != nil {
+					return nil, graphQLFrom(p).fail(err)
+				}
+				return items, nil
+			},
+		},
+		"transfers": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphQLTransferType))),
+			Description: "Переводы от новых к старым",
+			Args: graphql.FieldConfigArgument{
+				"direction": &graphql.ArgumentConfig{Type: graphQLDirectionType, DefaultValue: "ALL"},
+				"category":  &graphql.ArgumentConfig{Type: graphql.String},
+				"limit":     &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphQLDefaultLimit},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				c := graphQLFrom(p)
+				limit, err := limitArg(p)
+				if err != nil {
+					return nil, c.fail(err)
+				}
+				category := optionalString(p, "category")
+				if !IsValidCategory(category) {
+					return nil, c.fail(&FieldError{Field: "category", Err: ErrUnknownCategory})
+				}
+				transfers, err := ListTransfers(p.Source.(*User).ID, optionalString(p, "direction"), category, limit)
+				if err != nil {
+					return nil, c.fail(err)
+				}
+				return transfers, nil
+			},
+		},
+		"purchases": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphQLPurchaseType))),
+			Description: "Покупки от новых к старым",
+			Args: graphql.FieldConfigArgument{
+				"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphQLDefaultLimit},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				c := graphQLFrom(p)
+				limit, err := limitArg(p)
+				if err != nil {
+					return nil, c.fail(err)
+				}
+				purchases, err := ListPurchases(p.Source.(*User).ID, limit)
+				if err != nil {
+					return nil, c.fail(err)
+				}
+				return purchases, nil
+			},
+		},
+	},
+})
+
+var graphQLTransferResultType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "TransferResult",
+	Fields: graphql.Fields{
+		"fromUser": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"toUser":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"amount":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"balance":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Монет у отправителя после перевода"},
+		"memo": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return stringOrNil(p.Source.(*Transfer).Memo), nil
+			},
+		},
+		"category": &graphql.Field{
+			Type: graphql.String,
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return stringOrNil(p.Source.(*Transfer).Category), nil
+			},
+		},
+	},
+})
+
+var graphQLPurchaseResultType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "PurchaseResult",
+	Fields: graphql.Fields{
+		"item":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"price":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"balance": &graphql.Field{Type: graphql.NewNonNull(graphql.Int), Description: "Монет у покупателя после покупки"},
+		"displayName": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.String),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return localizedItemName(graphQLFrom(p).lang, p.Source.(*Purchase).Item), nil
+			},
+		},
+	},
+})
+
+var graphQLQueryType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Query",
+	Fields: graphql.Fields{
+		"me": &graphql.Field{
+			Type: graphql.NewNonNull(graphQLAccountType),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				c := graphQLFrom(p)
+				user, err := GetUserByUsername(c.actor.Username)
+				if err != nil {
+					return nil, c.fail(err)
+				}
+				return user, nil
+			},
+		},
+		"merchandise": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphQLMerchandiseType))),
+			Description: "Каталог магазина от дешёвых товаров к дорогим",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				items, err := ListMerchandise()
+				if err != nil {
+					return nil, graphQLFrom(p).fail(err)
+				}
+				res := make([]*Merchandise, len(items))
+				for i := range items {
+					res[i] = &items[i]
+				}
+				return res, nil
+			},
+		},
+	},
+})
+
+var graphQLMutationType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Mutation",
+	Fields: graphql.Fields{
+		"sendCoin": &graphql.Field{
+			Type: graphql.NewNonNull(graphQLTransferResultType),
+			Args: graphql.FieldConfigArgument{
+				"toUser":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"amount":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				"memo":     &graphql.ArgumentConfig{Type: graphql.String},
+				"category": &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				c := graphQLFrom(p)
+				if err := c.requireScope(ScopeSendCoins); err != nil {
+					return nil, err
+				}
+				amount, _ := p.Args["amount"].(int)
+				transfer, err := SendCoins(c.actor, SendCoinRequest{
+					ToUser:       optionalString(p, "toUser"),
+					Amount:       amount,
+					TransferMeta: TransferMeta{Memo: optionalString(p, "memo"), Category: optionalString(p, "category")},
+				})
+				if err != nil {
+					return nil, c.fail(err)
+				}
+				return transfer, nil
+			},
+		},
+		"buy": &graphql.Field{
+			Type: graphql.NewNonNull(graphQLPurchaseResultType),
+			Args: graphql.FieldConfigArgument{
+				"item": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				c := graphQLFrom(p)
+				if err := c.requireScope(ScopeBuyMerch); err != nil {
+					return nil, err
+				}
+				purchase, err := BuyItem(c.actor, optionalString(p, "item"))
+				if err != nil {
+					return nil, c.fail(err)
+				}
+				return purchase, nil
+			},
+		},
+	},
+})
+
+var graphQLSchema = mustGraphQLSchema()
+
+func mustGraphQLSchema() graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: graphQLQueryType, Mutation: graphQLMutationType})
+	if err != nil {
+		panic(fmt.Sprintf("GraphQL-схема: %v", err))
+	}
+	return schema
+}
+
+// loadUsersByID загружает имена пользователей для участников переводов
+func loadUsersByID(ids []int) (map[int]*User, error) {
+	rows, err := db.Query(`SELECT id, username FROM users WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := make(map[int]*User, len(ids))
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username); err != nil {
+			return nil, err
+		}
+		users[user.ID] = &user
+	}
+	return users, rows.Err()
+}
+
+// loadMerchandiseByID загружает товары покупок и инвентаря
+func loadMerchandiseByID(ids []int) (map[int]*Merchandise, error) {
+	rows, err := db.Query(`SELECT id, name, price FROM merchandise WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make(map[int]*Merchandise, len(ids))
+	for rows.Next() {
+		var item Merchandise
+		if err := rows.Scan(&item.ID, &item.Name, &item.Price); err != nil {
+			return nil, err
+		}
+		items[item.ID] = &item
+	}
+	return items, rows.Err()
+}
+
+// ListTransfers возвращает последние переводы пользователя. direction - IN, OUT
+// или ALL, пустая category - переводы всех категорий.
+func ListTransfers(userID int, direction, category string, limit int) ([]TransferRecord, error) {
+	where := "(sender_id = $1 OR receiver_id = $1)"
+	switch direction {
+	case "IN":
+		where = "receiver_id = $1"
+	case "OUT":
+		where = "sender_id = $1"
+	}
+	rows, err := db.Query(`
+		SELECT id, sender_id, receiver_id, amount, memo, category, transaction_time
+		FROM transactions
+		WHERE `+where+` AND ($2::text = '' OR category = $2)
+		ORDER BY transaction_time DESC, id DESC
+		LIMIT $3
+	`, userID, category, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	transfers := make([]TransferRecord, 0)
+	for rows.Next() {
+		var t TransferRecord
+		if err := rows.Scan(&t.ID, &t.SenderID, &t.ReceiverID, &t.Amount, &t.Memo, &t.Category, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		t.Direction = "OUT"
+		if t.ReceiverID == userID {
+			t.Direction = "IN"
+		}
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+// ListPurchases возвращает последние покупки пользователя
+func ListPurchases(userID, limit int) ([]PurchaseRecord, error) {
+	rows, err := db.Query(`
+		SELECT id, merchandise_id, purchase_time
+		FROM purchases
+		WHERE user_id = $1
+		ORDER BY purchase_time DESC, id DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	purchases := make([]PurchaseRecord, 0)
+	for rows.Next() {
+		var p PurchaseRecord
+		if err := rows.Scan(&p.ID, &p.MerchandiseID, &p.PurchasedAt); err != nil {
+			return nil, err
+		}
+		purchases = append(purchases, p)
+	}
+	return purchases, rows.Err()
+}
+
+// ListInventory возвращает купленные пользователем товары с количеством
+func ListInventory(userID int) ([]InventoryRecord, error) {
+	rows, err := db.Query(`
+		SELECT merchandise_id, COUNT(*)
+		FROM purchases
+		WHERE user_id = $1
+		GROUP BY merchandise_id
+		ORDER BY merchandise_id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]InventoryRecord, 0)
+	for rows.Next() {
+		var item InventoryRecord
+		if err := rows.Scan(&item.MerchandiseID, &item.Quantity); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// queryCost оценивает операцию до выполнения: каждое поле стоит 1, а поле-список
+// умножает стоимость вложенных полей на limit. Возвращает стоимость и глубину.
+// Поля интроспекции (__schema, __type) не считаются: их объём ограничен схемой.
+func queryCost(doc *ast.Document, op *ast.OperationDefinition, variables map[string]interface{}) (cost, depth int) {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[f.Name.Value] = f
+		}
+	}
+
+	var walk func(set *ast.SelectionSet) (int, int)
+	walk = func(set *ast.SelectionSet) (cost, depth int) {
+		if set == nil {
+			return 0, 0
+		}
+		for _, sel := range set.Selections {
+			var c, d int
+			switch sel := sel.(type) {
+			case *ast.Field:
+				if strings.HasPrefix(sel.Name.Value, "__") {
+					continue
+				}
+				childCost, childDepth := walk(sel.SelectionSet)
+				c, d = 1+listSize(sel, variables)*childCost, 1+childDepth
+			case *ast.InlineFragment:
+				c, d = walk(sel.SelectionSet)
+			case *ast.FragmentSpread:
+				// Циклы фрагментов отсекает проверка документа до оценки
+				if f := fragments[sel.Name.Value]; f != nil {
+					c, d = walk(f.SelectionSet)
+				}
+			}
+			cost += c
+			if d > depth {
+				depth = d
+			}
+		}
+		return cost, depth
+	}
+	return walk(op.SelectionSet)
+}
+
+// rootFieldCount - сколько полей верхнего уровня выполнит операция, с учётом
+// псевдонимов и фрагментов
+func rootFieldCount(doc *ast.Document, op *ast.OperationDefinition) int {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok {
+			fragments[f.Name.Value] = f
+		}
+	}
+
+	var count func(set *ast.SelectionSet) int
+	count = func(set *ast.SelectionSet) (n int) {
+		if set == nil {
+			return 0
+		}
+		for _, sel := range set.Selections {
+			switch sel := sel.(type) {
+			case *ast.Field:
+				if !strings.HasPrefix(sel.Name.Value, "__") {
+					n++
+				}
+			case *ast.InlineFragment:
+				n += count(sel.SelectionSet)
+			case *ast.FragmentSpread:
+				if f := fragments[sel.Name.Value]; f != nil {
+					n += count(f.SelectionSet)
+				}
+			}
+		}
+		return n
+	}
+	return count(op.SelectionSet)
+}
+
+// listSize - сколько элементов может вернуть поле; для обычных полей 1
+func listSize(field *ast.Field, variables map[string]interface{}) int {
+	if !graphQLListFields[field.Name.Value] {
+		return 1
+	}
+	for _, arg := range field.Arguments {
+		if arg.Name.Value != "limit" {
+			continue
+		}
+		switch v := arg.Value.(type) {
+		case *ast.IntValue:
+			if n, err := strconv.Atoi(v.Value); err == nil && n > 0 && n <= graphQLMaxLimit {
+				return n
+			}
+		case *ast.Variable:
+			if n, ok := variables[v.Name.Value].(float64); ok && n > 0 && n <= graphQLMaxLimit {
+				return int(n)
+			}
+		}
+		// Значение, которое резолвер всё равно отклонит, оценивается по максимуму
+		return graphQLMaxLimit
+	}
+	return graphQLDefaultLimit
+}
+
+// graphQLOperation - операция документа, которую попросил выполнить клиент
+func graphQLOperation(doc *ast.Document, name string) *ast.OperationDefinition {
+	for _, def := range doc.Definitions {
+		if op, ok := def.(*ast.OperationDefinition); ok && (name == "" || op.Name != nil && op.Name.Value == name) {
+			return op
+		}
+	}
+	return nil
+}
+
+// writeGraphQL отвечает результатом в формате GraphQL: {"data": ..., "errors": [...]}
+func writeGraphQL(w http.ResponseWriter, r *http.Request, status int, result *graphql.Result) {
+	setContentLanguage(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// graphQLRejected - ответ на запрос, который не будет выполнен
+func graphQLRejected(r *http.Request, code, key string, args ...interface{}) *graphql.Result {
+	e := gqlerrors.NewFormattedError(tr(r, key, args...))
+	e.Extensions = map[string]interface{}{"code": code}
+	return &graphql.Result{Errors: []gqlerrors.FormattedError{e}}
+}
+
+// GraphQLHandler выполняет запрос GraphQL. Документ разбирается и проверяется
+// по схеме, затем оценивается его сложность, и только потом выполняется.
+// Лимит запросов - группа read для запросов и write для мутаций, где каждое
+// поле мутации списывает отдельный токен.
+func GraphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var req GraphQLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Query == "" {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+		Body: []byte(req.Query),
+		Name: "GraphQL request",
+	})})
+	if err != nil {
+		writeGraphQL(w, r, http.StatusBadRequest, &graphql.Result{Errors: gqlerrors.FormatErrors(err)})
+		return
+	}
+	if res := graphql.ValidateDocument(&graphQLSchema, doc, nil); !res.IsValid {
+		writeGraphQL(w, r, http.StatusBadRequest, &graphql.Result{Errors: res.Errors})
+		return
+	}
+
+	group, charge := RateGroupRead, 1
+	if op := graphQLOperation(doc, req.OperationName); op != nil {
+		cost, depth := queryCost(doc, op, req.Variables)
+		if depth > config.GraphQLMaxDepth {
+			writeGraphQL(w, r, http.StatusBadRequest, graphQLRejected(r, CodeQueryTooDeep, "query_too_deep", depth, config.GraphQLMaxDepth))
+			return
+		}
+		if cost > config.GraphQLMaxComplexity {
+			writeGraphQL(w, r, http.StatusBadRequest, graphQLRejected(r, CodeQueryTooComplex, "query_too_complex", cost, config.GraphQLMaxComplexity))
+			return
+		}
+		if op.Operation == ast.OperationTypeMutation {
+			// Каждое поле мутации - отдельный перевод или покупка, включая поля под псевдонимами
+			group, charge = RateGroupWrite, rootFieldCount(doc, op)
+		}
+	}
+	username, _ := r.Context().Value("username").(string)
+	for i := 0; i < charge; i++ {
+		if !applyRateLimit(w, r, group+":user:"+username, config.RateLimits[group]) {
+			return
+		}
+	}
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        graphQLSchema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       context.WithValue(r.Context(), "graphql", newGraphQLContext(r)),
+	})
+	writeGraphQL(w, r, http.StatusOK, result)
+}
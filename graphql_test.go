@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func TestQueryCost(t *testing.T) {
+	cases := []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		cost      int
+		depth     int
+	}{
+		{"scalar", `{ me { coins } }`, nil, 2, 2},
+		// transfers: 1 + 5 * (amount + from{username}) = 1 + 5*3
+		{"limited list", `{ me { transfers(limit: 5) { amount from { username } } } }`, nil, 17, 4},
+		{"default limit", `{ merchandise { name } }`, nil, 1 + graphQLDefaultLimit, 2},
+		{"limit variable", `query($n: Int) { me { purchases(limit: $n) { id } } }`, map[string]interface{}{"n": float64(3)}, 5, 3},
+		{"limit out of range", `{ me { purchases(limit: 100000) { id } } }`, nil, 2 + graphQLMaxLimit, 3},
+		{"fragment", `{ me { ...Balance } } fragment Balance on Account { coins username }`, nil, 3, 2},
+		{"introspection", `{ __schema { types { name fields { name type { ofType { name } } } } } }`, nil, 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			doc, err := parser.Parse(parser.ParseParams{Source: c.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cost, depth := queryCost(doc, graphQLOperation(doc, ""), c.variables)
+			if cost != c.cost || depth != c.depth {
+				t.Errorf("Expected cost %d depth %d, got %d %d", c.cost, c.depth, cost, depth)
+			}
+		})
+	}
+}
+
+// graphQLRequest выполняет запрос от имени alice без обращения к базе
+func graphQLRequest(t *testing.T, body GraphQLRequest) (int, map[string]interface{}) {
+	bodyBytes, _ := json.Marshal(body)
+	req := httptest.NewRequest("POST", "/graphql", bytes.NewBuffer(bodyBytes))
+	req.Header.Set("Accept-Language", "en")
+	req = req.WithContext(context.WithValue(req.Context(), "username", "alice"))
+	rr := httptest.NewRecorder()
+	GraphQLHandler(rr, req)
+	var resp map[string]interface{}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, resp
+}
+
+// errorCodes - extensions.code ошибок ответа GraphQL
+func errorCodes(resp map[string]interface{}) []string {
+	var codes []string
+	errs, _ := resp["errors"].([]interface{})
+	for _, e := range errs {
+		ext, _ := e.(map[string]interface{})["extensions"].(map[string]interface{})
+		code, _ := ext["code"].(string)
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+func TestGraphQLRejectsExpensiveQueries(t *testing.T) {
+	status, resp := graphQLRequest(t, GraphQLRequest{Query: `{ me { transfers(limit: 100) { from { username } to { username } memo } purchases(limit: 100) { item { name price displayName } } } }`})
+	if codes := errorCodes(resp); status != http.StatusBadRequest || len(codes) != 1 || codes[0] != CodeQueryTooComplex {
+		t.Errorf("Expected 400 %s, got %d %v", CodeQueryTooComplex, status, resp)
+	}
+
+	deep := `{ me { transfers { from { username } } } }`
+	old := config.GraphQLMaxDepth
+	config.GraphQLMaxDepth = 3
+	defer func() { config.GraphQLMaxDepth = old }()
+	status, resp = graphQLRequest(t, GraphQLRequest{Query: deep})
+	if codes := errorCodes(resp); status != http.StatusBadRequest || len(codes) != 1 || codes[0] != CodeQueryTooDeep {
+		t.Errorf("Expected 400 %s, got %d %v", CodeQueryTooDeep, status, resp)
+	}
+}
+
+func TestGraphQLChargesEachMutationField(t *testing.T) {
+	cases := map[string]int{
+		`mutation { sendCoin(toUser: "bob", amount: 1) { balance } }`:                                                                                                                       1,
+		`mutation { a: sendCoin(toUser: "bob", amount: 1) { balance } b: sendCoin(toUser: "bob", amount: 1) { balance } }`:                                                                  2,
+		`mutation { ...Pay buy(item: "pen") { balance } } fragment Pay on Mutation { a: sendCoin(toUser: "bob", amount: 1) { balance } b: sendCoin(toUser: "bob", amount: 1) { balance } }`: 3,
+		`mutation { buy(item: "pen") { balance } __typename }`:                                                                                                                              1,
+	}
+	for query, want := range cases {
+		doc, err := parser.Parse(parser.ParseParams{Source: query})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rootFieldCount(doc, graphQLOperation(doc, "")); got != want {
+			t.Errorf("%s: expected %d fields, got %d", query, want, got)
+		}
+	}
+
+	savedLimiter, savedLimits := rateLimiter, config.RateLimits
+	defer func() { rateLimiter, config.RateLimits = savedLimiter, savedLimits }()
+	rateLimiter = NewMemoryRateLimiter()
+	config.RateLimits = map[string]RateLimit{RateGroupWrite: {Rate: 0.1, Burst: 2}}
+
+	// Три перевода под псевдонимами не укладываются в запас из двух токенов и не выполняются
+	status, resp := graphQLRequest(t, GraphQLRequest{Query: `mutation {
+		a: sendCoin(toUser: "bob", amount: 1) { balance }
+		b: sendCoin(toUser: "bob", amount: 1) { balance }
+		c: sendCoin(toUser: "bob", amount: 1) { balance }
+	}`})
+	errs, _ := resp["errors"].([]interface{})
+	if status != http.StatusTooManyRequests || len(errs) != 1 || errs[0].(map[string]interface{})["code"] != CodeRateLimited {
+		t.Errorf("Expected 429 %s, got %d %v", CodeRateLimited, status, resp)
+	}
+}
+
+func TestGraphQLValidatesDocument(t *testing.T) {
+	for _, query := range []string{`{ me { password } }`, `{ me { coins }`, `mutation { sendCoin(amount: 5) { balance } }`} {
+		status, resp := graphQLRequest(t, GraphQLRequest{Query: query})
+		if errs, _ := resp["errors"].([]interface{}); status != http.StatusBadRequest || len(errs) == 0 {
+			t.Errorf("%s: expected 400 with errors, got %d %v", query, status, resp)
+		}
+	}
+}
+
+func TestGraphQLRequiresToken(t *testing.T) {
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("POST", "/graphql", bytes.NewBufferString(`{"query":"{ me { coins } }"}`)))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", rr.Code)
+	}
+}
+
+func TestGraphQLDashboard(t *testing.T) {
+	r := newRouter()
+	token := getTokenForUser(t, "gql_sender")
+	_ = getTokenForUser(t, "gql_recipient")
+
+	do := func(body GraphQLRequest, out interface{}) {
+		bodyBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", "/graphql", bytes.NewBuffer(bodyBytes))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body)
+		}
+		if err := json.NewDecoder(rr.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var sent struct {
+		Data struct {
+			SendCoin Transfer `json:"sendCoin"`
+			Buy      Purchase `json:"buy"`
+		} `json:"data"`
+		Errors []interface{} `json:"errors"`
+	}
+	do(GraphQLRequest{
+		Query:     `mutation($to: String!) { sendCoin(toUser: $to, amount: 7, memo: "обед") { toUser amount balance } buy(item: "pen") { item balance } }`,
+		Variables: map[string]interface{}{"to": "gql_recipient"},
+	}, &sent)
+	if len(sent.Errors) != 0 || sent.Data.SendCoin.Amount != 7 || sent.Data.Buy.Item != "pen" {
+		t.Fatalf("Unexpected mutation result %+v", sent)
+	}
+
+	var dashboard struct {
+		Data struct {
+			Me struct {
+				Coins     int `json:"coins"`
+				Inventory []struct {
+					Quantity int `json:"quantity"`
+					Item     struct {
+						Name string `json:"name"`
+					} `json:"item"`
+				} `json:"inventory"`
+				Transfers []struct {
+					Amount int    `json:"amount"`
+					Memo   string `json:"memo"`
+					To     struct {
+						Username string `json:"username"`
+					} `json:"to"`
+				} `json:"transfers"`
+			} `json:"me"`
+			Merchandise []Merchandise `json:"merchandise"`
+		} `json:"data"`
+		Errors []interface{} `json:"errors"`
+	}
+	do(GraphQLRequest{Query: `{
+		me { coins inventory { quantity item { name } } transfers(limit: 5, direction: OUT) { amount memo to { username } } }
+		merchandise { name price }
+	}`}, &dashboard)
+	me := dashboard.Data.Me
+	if len(dashboard.Errors) != 0 || me.Coins != sent.Data.Buy.Balance || len(dashboard.Data.Merchandise) == 0 {
+		t.Fatalf("Unexpected dashboard %+v", dashboard)
+	}
+	if len(me.Transfers) == 0 || me.Transfers[0].To.Username != "gql_recipient" || me.Transfers[0].Memo != "обед" {
+		t.Errorf("Unexpected transfers %+v", me.Transfers)
+	}
+	if len(me.Inventory) == 0 || me.Inventory[0].Item.Name == "" {
+		t.Errorf("Unexpected inventory %+v", me.Inventory)
+	}
+}
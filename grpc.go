@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	merchv1 "app/merch/v1"
+)
+
+// gRPC-сервис merch.v1.MerchStore повторяет основные операции HTTP API и вызывает
+// те же функции service.go. Контракт - merch/v1/merch.proto, код в merch/v1
+// сгенерирован protoc-gen-go и protoc-gen-go-grpc.
+// Токен передаётся в метаданных authorization: "Bearer <токен>", код 2FA - в x-otp.
+
+//go:generate protoc --go_out=. --go_opt=module=app --go-grpc_out=. --go-grpc_opt=module=app merch/v1/merch.proto
+
+const grpcServiceName = "merch.v1.MerchStore"
+
+// grpcPublicMethods - методы, доступные без токена
+var grpcPublicMethods = map[string]bool{
+	merchv1.MerchStore_Auth_FullMethodName: true,
+}
+
+// merchStoreServer переводит сообщения merch.v1 в структуры service.go и обратно
+type merchStoreServer struct {
+	merchv1.UnimplementedMerchStoreServer
+}
+
+// newGRPCServer создаёт сервер с сервисом магазина
+func newGRPCServer() *grpc.Server {
+	s := grpc.NewServer(grpc.UnaryInterceptor(grpcAuthInterceptor))
+	merchv1.RegisterMerchStoreServer(s, merchStoreServer{})
+	return s
+}
+
+// serveGRPC принимает соединения gRPC на addr
+func serveGRPC(addr string) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Ошибка запуска gRPC-сервера: %v", err)
+	}
+	log.Printf("Запуск gRPC-сервера на %s", addr)
+	if err := newGRPCServer().Serve(lis); err != nil {
+		log.Fatalf("Ошибка gRPC-сервера: %v", err)
+	}
+}
+
+// grpcAuthInterceptor проверяет токен так же, как JWTMiddleware, права персонального
+// токена по apiTokenRouteScopes и лимиты запросов по rateLimitRouteGroups.
+// Username и claims кладутся в контекст под теми же ключами, что и в HTTP.
+func grpcAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if grpcPublicMethods[info.FullMethod] {
+		if err := grpcRateLimit(ctx, RateGroupAuth+":ip:"+grpcClientIP(ctx), config.RateLimits[RateGroupAuth]); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+
+	claims, apiErr := authenticateBearer(grpcMetadata(ctx, "authorization"))
+	if apiErr != nil {
+		return nil, grpcError(ctx, apiErr)
+	}
+	if claims.APITokenID != 0 && !apiTokenAllows(claims, http.MethodPost, info.FullMethod) {
+		return nil, grpcError(ctx, &APIError{Status: http.StatusForbidden, Code: CodeForbidden, Key: "token_scope_denied"})
+	}
+	ctx = context.WithValue(ctx, "username", claims.Username)
+	ctx = context.WithValue(ctx, "claims", claims)
+
+	group, ok := rateLimitRouteGroups[http.MethodPost+" "+info.FullMethod]
+	if !ok {
+		group = RateGroupDefault
+	}
+	if err := grpcRateLimit(ctx, group+":user:"+claims.Username, config.RateLimits[group]); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// grpcRateLimit списывает токен лимитера; при отказе возвращает ResourceExhausted
+func grpcRateLimit(ctx context.Context, key string, limit RateLimit) error {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	res, err := rateLimiter.Allow(key, limit)
+	if err != nil {
+		// Недоступность хранилища лимитов не должна останавливать магазин
+		log.Printf("Ошибка лимитера запросов: %v", err)
+		return nil
+	}
+	if res.Allowed {
+		return nil
+	}
+	return grpcErrorRetry(ctx, &APIError{Status: http.StatusTooManyRequests, Code: CodeRateLimited, Key: "rate_limited"}, res.RetryAfter)
+}
+
+// grpcMetadata - первое значение ключа метаданных запроса
+func grpcMetadata(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// grpcClientIP - адрес клиента для блокировок входа и лимитов
+func grpcClientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcActor - пользователь из токена вызова
+func grpcActor(ctx context.Context) Actor {
+	actor := Actor{OTP: grpcMetadata(ctx, "x-otp"), IP: grpcClientIP(ctx)}
+	actor.Username, _ = ctx.Value("username").(string)
+	return actor
+}
+
+// grpcLanguage выбирает язык сообщений так же, как requestLanguage для HTTP
+func grpcLanguage(ctx context.Context) string {
+	if claims, _ := ctx.Value("claims").(*Claims); claims != nil && isSupportedLanguage(claims.Language) {
+		return claims.Language
+	}
+	if lang := negotiateLanguage(grpcMetadata(ctx, "accept-language")); lang != "" {
+		return lang
+	}
+	return config.DefaultLanguage
+}
+
+// grpcCodes - код gRPC для HTTP-статуса ошибки API
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:            codes.InvalidArgument,
+	http.StatusUnauthorized:          codes.Unauthenticated,
+	http.StatusForbidden:             codes.PermissionDenied,
+	http.StatusNotFound:              codes.NotFound,
+	http.StatusConflict:              codes.FailedPrecondition,
+	http.StatusRequestEntityTooLarge: codes.InvalidArgument,
+	http.StatusTooManyRequests:       codes.ResourceExhausted,
+	http.StatusBadGateway:            codes.Unavailable,
+}
+
+// grpcError переводит ошибку сервиса в статус gRPC. Сообщение - из каталога на
+// языке клиента, код ошибки API - в ErrorInfo.Reason, поле запроса - в Metadata.
+func grpcError(ctx context.Context, err error) error {
+	var wait time.Duration
+	var locked *LoginLockedError
+	if errors.As(err, &locked) {
+		wait = locked.RetryAfter
+	}
+	return grpcErrorRetry(ctx, err, wait)
+}
+
+// grpcErrorRetry - grpcError с подсказкой RetryInfo, если retryAfter больше нуля
+func grpcErrorRetry(ctx context.Context, err error, retryAfter time.Duration) error {
+	apiErr := toAPIError(err)
+	code, ok := grpcCodes[apiErr.Status]
+	if !ok {
+		code = codes.Internal
+	}
+	message := apiErr.Message
+	if apiErr.Key != "" {
+		message = T(grpcLanguage(ctx), apiErr.Key, apiErr.Args...)
+	}
+
+	info := &errdetails.ErrorInfo{Reason: apiErr.Code, Domain: grpcServiceName}
+	if apiErr.Field != "" {
+		info.Metadata = map[string]string{"field": apiErr.Field}
+	}
+	st, _ := status.New(code, message).WithDetails(info)
+	if retryAfter > 0 {
+		seconds := time.Duration(math.Ceil(retryAfter.Seconds())) * time.Second
+		st, _ = st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(seconds)})
+	}
+	return st.Err()
+}
+
+// Auth выдаёт пару токенов, как /api/auth (с AUTO_REGISTER - и регистрирует)
+func (merchStoreServer) Auth(ctx context.Context, req *merchv1.AuthRequest) (*merchv1.AuthResponse, error) {
+	if !config.PasswordLogin {
+		return nil, grpcError(ctx, &APIError{Status: http.StatusForbidden, Code: CodeForbidden, Key: "password_login_disabled"})
+	}
+	if strings.TrimSpace(req.Username) == "" {
+		return nil, grpcError(ctx, &APIError{Code: CodeBadRequest, Key: "bad_request"})
+	}
+	ip := grpcClientIP(ctx)
+	login := AuthRequest{Username: req.Username, Password: req.Password, OTP: req.Otp}
+	user, err := Login(login, ip, config.AutoRegister && !config.RequireInvite)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	resp, err := CreateSession(user, grpcMetadata(ctx, "user-agent"), ip)
+	if err != nil {
+		return nil, grpcError(ctx, &APIError{Status: http.StatusInternalServerError, Code: CodeInternal, Key: "token_create_failed"})
+	}
+	return &merchv1.AuthResponse{Token: resp.Token, RefreshToken: resp.RefreshToken, ExpiresIn: int32(resp.ExpiresIn)}, nil
+}
+
+// GetInfo возвращает баланс, инвентарь и историю переводов
+func (merchStoreServer) GetInfo(ctx context.Context, req *merchv1.GetInfoRequest) (*merchv1.GetInfoResponse, error) {
+	info, err := GetUserInfo(grpcActor(ctx).Username, req.Category)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	lang := grpcLanguage(ctx)
+	resp := &merchv1.GetInfoResponse{Coins: int32(info.Coins), CoinHistory: &merchv1.CoinHistory{}}
+	for _, item := range info.Inventory {
+		resp.Inventory = append(resp.Inventory, &merchv1.InventoryItem{
+			Type: item.Type, DisplayName: localizedItemName(lang, item.Type), Quantity: int32(item.Quantity),
+		})
+	}
+	for _, t := range info.CoinHistory.Received {
+		resp.CoinHistory.Received = append(resp.CoinHistory.Received, &merchv1.ReceivedTransfer{
+			FromUser: t.FromUser, Amount: int32(t.Amount), Memo: t.Memo, Category: t.Category,
+		})
+	}
+	for _, t := range info.CoinHistory.Sent {
+		resp.CoinHistory.Sent = append(resp.CoinHistory.Sent, &merchv1.SentTransfer{
+			ToUser: t.ToUser, Amount: int32(t.Amount), Memo: t.Memo, Category: t.Category,
+		})
+	}
+	return resp, nil
+}
+
+// SendCoin переводит монеты и возвращает перевод
+func (merchStoreServer) SendCoin(ctx context.Context, req *merchv1.SendCoinRequest) (*merchv1.SendCoinResponse, error) {
+	transfer, err := SendCoins(grpcActor(ctx), SendCoinRequest{
+		ToUser: req.ToUser, Amount: int(req.Amount),
+		TransferMeta: TransferMeta{Memo: req.Memo, Category: req.Category},
+	})
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &merchv1.SendCoinResponse{
+		FromUser: transfer.FromUser, ToUser: transfer.ToUser, Amount: int32(transfer.Amount),
+		Balance: int32(transfer.Balance), Memo: transfer.Memo, Category: transfer.Category,
+	}, nil
+}
+
+// BuyItem покупает товар и возвращает покупку
+func (merchStoreServer) BuyItem(ctx context.Context, req *merchv1.BuyItemRequest) (*merchv1.BuyItemResponse, error) {
+	if req.Item == "" {
+		return nil, grpcError(ctx, &APIError{Code: CodeBadRequest, Key: "bad_request"})
+	}
+	purchase, err := BuyItem(grpcActor(ctx), req.Item)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return &merchv1.BuyItemResponse{
+		Item: purchase.Item, DisplayName: localizedItemName(grpcLanguage(ctx), purchase.Item),
+		Price: int32(purchase.Price), Balance: int32(purchase.Balance),
+	}, nil
+}
+
+// ListCatalog возвращает ассортимент магазина
+func (merchStoreServer) ListCatalog(ctx context.Context, _ *merchv1.ListCatalogRequest) (*merchv1.ListCatalogResponse, error) {
+	items, err := ListMerchandise()
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	lang := grpcLanguage(ctx)
+	resp := &merchv1.ListCatalogResponse{Items: make([]*merchv1.CatalogItem, 0, len(items))}
+	for _, item := range items {
+		resp.Items = append(resp.Items, &merchv1.CatalogItem{
+			Id: int32(item.ID), Name: item.Name, Price: int32(item.Price), DisplayName: localizedItemName(lang, item.Name),
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	merchv1 "app/merch/v1"
+)
+
+// startGRPC поднимает сервер в памяти и возвращает соединение с ним
+func startGRPC(t *testing.T) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	srv := newGRPCServer()
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// errorReason - код ошибки API из ErrorInfo в статусе gRPC
+func errorReason(err error) string {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.ErrorInfo); ok {
+			return info.Reason
+		}
+	}
+	return ""
+}
+
+func TestGRPCRequiresToken(t *testing.T) {
+	client := merchv1.NewMerchStoreClient(startGRPC(t))
+	cases := []struct {
+		name   string
+		auth   string
+		reason string
+	}{
+		{"no token", "", CodeUnauthorized},
+		{"malformed", "Token abc", CodeInvalidToken},
+		{"invalid jwt", "Bearer abc.def.ghi", CodeInvalidToken},
+		{"invalid api token", "Bearer " + apiTokenPrefix + "nope", CodeInvalidToken},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			if c.auth != "" {
+				ctx = metadata.AppendToOutgoingContext(ctx, "authorization", c.auth)
+			}
+			_, err := client.GetInfo(ctx, &merchv1.GetInfoRequest{})
+			if status.Code(err) != codes.Unauthenticated || errorReason(err) != c.reason {
+				t.Errorf("Expected Unauthenticated/%s, got %v (%s)", c.reason, err, errorReason(err))
+			}
+		})
+	}
+}
+
+func TestGRPCAuthValidatesRequest(t *testing.T) {
+	client := merchv1.NewMerchStoreClient(startGRPC(t))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "accept-language", "en")
+	_, err := client.Auth(ctx, &merchv1.AuthRequest{Password: "secret"})
+	if status.Code(err) != codes.InvalidArgument || errorReason(err) != CodeBadRequest {
+		t.Fatalf("Expected InvalidArgument/bad_request, got %v", err)
+	}
+	if msg := status.Convert(err).Message(); msg != T("en", "bad_request") {
+		t.Errorf("Expected English message, got %q", msg)
+	}
+}
+
+func TestGRPCUnknownMethod(t *testing.T) {
+	conn := startGRPC(t)
+	err := conn.Invoke(context.Background(), "/"+grpcServiceName+"/DropTables", &merchv1.ListCatalogRequest{}, &merchv1.ListCatalogResponse{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected Unimplemented, got %v", err)
+	}
+}
+
+func TestGRPCTransferAndPurchase(t *testing.T) {
+	requireDB(t)
+	client := merchv1.NewMerchStoreClient(startGRPC(t))
+	auth, err := client.Auth(context.Background(), &merchv1.AuthRequest{Username: "grpc_sender"})
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if _, err := client.Auth(context.Background(), &merchv1.AuthRequest{Username: "grpc_recipient"}); err != nil {
+		t.Fatalf("Auth recipient: %v", err)
+	}
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+auth.Token)
+
+	catalog, err := client.ListCatalog(ctx, &merchv1.ListCatalogRequest{})
+	if err != nil || len(catalog.Items) == 0 {
+		t.Fatalf("ListCatalog: %v, %+v", err, catalog)
+	}
+
+	transfer, err := client.SendCoin(ctx, &merchv1.SendCoinRequest{ToUser: "grpc_recipient", Amount: 10, Category: CategoryThanks})
+	if err != nil {
+		t.Fatalf("SendCoin: %v", err)
+	}
+	if transfer.ToUser != "grpc_recipient" || transfer.Amount != 10 || transfer.Category != CategoryThanks {
+		t.Errorf("Unexpected transfer %+v", transfer)
+	}
+	_, err = client.SendCoin(ctx, &merchv1.SendCoinRequest{ToUser: "grpc_nobody", Amount: 10})
+	if status.Code(err) != codes.NotFound || errorReason(err) != CodeRecipientNotFound {
+		t.Errorf("Expected NotFound/recipient_not_found, got %v", err)
+	}
+
+	purchase, err := client.BuyItem(ctx, &merchv1.BuyItemRequest{Item: "pen"})
+	if err != nil {
+		t.Fatalf("BuyItem: %v", err)
+	}
+	if purchase.Item != "pen" || purchase.DisplayName == "" || purchase.Balance != transfer.Balance-purchase.Price {
+		t.Errorf("Unexpected purchase %+v", purchase)
+	}
+
+	info, err := client.GetInfo(ctx, &merchv1.GetInfoRequest{})
+	if err != nil {
+		t.Fatalf("GetInfo: %v", err)
+	}
+	if info.Coins != purchase.Balance || len(info.CoinHistory.GetSent()) == 0 {
+		t.Errorf("Expected %d coins and sent history, got %+v", purchase.Balance, info)
+	}
+}
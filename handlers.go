@@ -2,217 +2,196 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
-	"time"
+	"strings"
 
-	"github.com/golang-jwt/jwt"
 	"github.com/gorilla/mux"
 )
 
-// AuthHandler выполняет аутентификацию/регистрацию и создание JWT токена.
+// AuthHandler выполняет аутентификацию и создание JWT токена.
+// Для обратной совместимости при AUTO_REGISTER неизвестное имя регистрируется
+// автоматически; новым клиентам следует использовать /api/register и /api/login.
 func AuthHandler(w http.ResponseWriter, r *http.Request) {
+	if passwordLoginDisabled(w, r) {
+		return
+	}
 	var req AuthRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Неверный запрос", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
 		return
 	}
 
-	// Получаем или создаём пользователя
-	user, err := GetUserByUsername(req.Username)
-	if err != nil {
-		user, err = CreateUser(req.Username, req.Password) // Создаём нового пользователя
-		if err != nil {
-			http.Error(w, "Ошибка при создании пользователя", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	// Создание JWT токена
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		Username: user.Username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	user, err := Login(req, clientIP(r), config.AutoRegister && !config.RequireInvite)
 	if err != nil {
-		http.Error(w, "Не удалось создать токен", http.StatusInternalServerError)
+		writeAPIError(w, r, err)
 		return
 	}
-
-	// Отправляем токен пользователю
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(AuthResponse{Token: tokenString})
+	writeToken(w, r, user, http.StatusOK)
 }
 
 // InfoHandler возвращает информацию о монетах, инвентаре и истории транзакций.
 func InfoHandler(w http.ResponseWriter, r *http.Request) {
-	//username := r.Context().Value("username").(string)
 	username, ok := r.Context().Value("username").(string)
 	if !ok || username == "" {
-    		http.Error(w, "Не удалось извлечь имя пользователя", http.StatusUnauthorized)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "username_missing")
 		return
 	}
 
-	user, err := GetUserByUsername(username)
+	// Историю переводов можно отфильтровать по категории
+	info, err := GetUserInfo(username, r.URL.Query().Get("category"))
 	if err != nil {
-		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+		writeAPIError(w, r, err)
 		return
 	}
+	for i := range info.Inventory {
+		info.Inventory[i].DisplayName = itemDisplayName(r, info.Inventory[i].Type)
+	}
 
-	// Получаем информацию о монетах и инвентаре
-	coins := user.Coins
-	inventory := make([]InventoryItem, 0)
-	coinHistory := CoinHistory{}
+	setContentLanguage(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
 
-	// Получаем инвентарь (купленные товары)
-	rows, err := db.Query(`
-		SELECT m.name, COUNT(*) 
-		FROM merchandise m
-		JOIN purchases p ON m.id = p.merchandise_id
-		WHERE p.user_id = $1
-		GROUP BY m.name
-	`, user.ID)
-	if err != nil {
-		http.Error(w, "Ошибка при получении инвентаря", http.StatusInternalServerError)
+// SendCoinHandler выполняет перевод монет между пользователями.
+// Обслуживает /api/sendCoin и /me/transfer; замена - POST /api/v2/transfers.
+func SendCoinHandler(w http.ResponseWriter, r *http.Request) {
+	var req SendCoinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var item InventoryItem
-		if err := rows.Scan(&item.Type, &item.Quantity); err != nil {
-			http.Error(w, "Ошибка при сканировании инвентаря", http.StatusInternalServerError)
-			return
-		}
-		inventory = append(inventory, item)
-	}
-
-	// Получаем полученные переводы 
-	rows, err = db.Query(`
-		SELECT u.username, t.amount 
-		FROM transactions t
-		JOIN users u ON u.id = t.sender_id
-		WHERE t.receiver_id = $1
-	`, user.ID)
-	if err != nil {
-		http.Error(w, "Ошибка при получении истории монет", http.StatusInternalServerError)
+	if _, err := SendCoins(actorFromRequest(r), req); err != nil {
+		writeAPIError(w, r, err)
 		return
 	}
 
-	for rows.Next() {
-		var transfer ReceivedTransferInfo
-		if err := rows.Scan(&transfer.FromUser, &transfer.Amount); err != nil {
-			http.Error(w, "Ошибка при сканировании истории монет", http.StatusInternalServerError)
-			return
-		}
-		coinHistory.Received = append(coinHistory.Received, transfer)
-	}
+	setContentLanguage(w, r)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StatusResponse{Status: tr(r, "transfer_done")})
+}
 
-	// Получаем переводы монет, которые отправил пользователь
-	rows, err = db.Query(`
-		SELECT u.username, t.amount 
-		FROM transactions t
-		JOIN users u ON u.id = t.receiver_id
-		WHERE t.sender_id = $1
-	`, user.ID)
-	if err != nil {
-		http.Error(w, "Ошибка при получении истории монет", http.StatusInternalServerError)
+// SendCoinBatchHandler переводит монеты нескольким получателям за один запрос.
+// Все получатели и общая сумма проверяются заранее, переводы выполняются атомарно.
+func SendCoinBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req BatchSendCoinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
 		return
 	}
 
-	for rows.Next() {
-		var transfer SentTransferInfo
-		if err := rows.Scan(&transfer.ToUser, &transfer.Amount); err != nil {
-			http.Error(w, "Ошибка при сканировании истории монет", http.StatusInternalServerError)
+	transfers := req.Transfers
+	if len(req.ToUsers) > 0 {
+		if len(transfers) > 0 {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "batch_form_conflict")
 			return
 		}
-		coinHistory.Sent = append(coinHistory.Sent, transfer)
-	}
-
-	// Формируем ответ
-	infoResponse := InfoResponse{
-		Coins:     coins,
-		Inventory: inventory,
-		CoinHistory: coinHistory,
+		for _, toUser := range req.ToUsers {
+			transfers = append(transfers, SendCoinRequest{ToUser: toUser, Amount: req.Amount, TransferMeta: req.TransferMeta})
+		}
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(infoResponse)
-}
-
-// SendCoinHandler выполняет перевод монет между пользователями.
-func SendCoinHandler(w http.ResponseWriter, r *http.Request) {
-	var req SendCoinRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ToUser == "" || req.Amount <= 0 {
-		http.Error(w, "Неверный запрос", http.StatusBadRequest)
+	if len(transfers) == 0 || len(transfers) > config.MaxBatchRecipients {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "batch_size", config.MaxBatchRecipients)
 		return
 	}
 
 	senderUsername := r.Context().Value("username").(string)
 	sender, err := GetUserByUsername(senderUsername)
 	if err != nil {
-		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
 		return
 	}
 
-	recipient, err := GetUserByUsername(req.ToUser)
+	usernames := make([]string, len(transfers))
+	for i, t := range transfers {
+		usernames[i] = t.ToUser
+	}
+	users, err := GetUsersByUsernames(usernames)
 	if err != nil {
-		http.Error(w, "Получатель не найден", http.StatusNotFound)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "recipients_fetch_failed")
 		return
 	}
 
-	if sender.Coins < req.Amount {
-		http.Error(w, "Недостаточно монет для перевода", http.StatusBadRequest)
-		return
+	// Проверяем всех получателей до перевода и сообщаем обо всех ошибках сразу;
+	// field указывает на получателя в запросе, например transfers[2]
+	field := "transfers"
+	if len(req.ToUsers) > 0 {
+		field = "toUsers"
+	}
+	results := make([]BatchTransferResult, len(transfers))
+	recipients := make([]*User, len(transfers))
+	seen := make(map[string]bool, len(transfers))
+	var errs []*APIError
+	for i, t := range transfers {
+		results[i] = BatchTransferResult{ToUser: t.ToUser, Amount: t.Amount, Status: "ok"}
+		key := strings.ToLower(t.ToUser)
+		meta, metaErr := normalizeTransferMeta(t.TransferMeta)
+		transfers[i].TransferMeta = meta
+		var e *APIError
+		switch {
+		case t.ToUser == "" || t.Amount <= 0:
+			e = &APIError{Code: CodeValidationFailed, Key: "batch_invalid_entry"}
+		case seen[key]:
+			e = &APIError{Code: CodeValidationFailed, Key: "batch_duplicate_recipient"}
+		case users[key] == nil:
+			e = &APIError{Code: CodeRecipientNotFound, Key: "recipient_not_found"}
+		case users[key].ID == sender.ID:
+			e = &APIError{Code: CodeValidationFailed, Key: "self_transfer"}
+		case metaErr != nil:
+			e = toAPIError(metaErr)
+		}
+		seen[key] = true
+		if e != nil {
+			e.Field = fmt.Sprintf("%s[%d]", field, i)
+			e.Details = map[string]interface{}{"toUser": t.ToUser}
+			errs = append(errs, e)
+		}
+		recipients[i] = users[key]
 	}
 
-	// Перевод монет
-	err = sender.TransferCoins(recipient, req.Amount)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if len(errs) > 0 {
+		writeErrors(w, r, http.StatusBadRequest, errs...)
 		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "Перевод выполнен"})
-}
-
-// BuyMerchHandler выполняет покупку товара за монеты.
-func BuyMerchHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	itemName := vars["item"]
-
-	// Получаем товар из базы
-	item, err := GetMerchandiseByName(itemName)
+	total, err := batchTotal(transfers)
 	if err != nil {
-		http.Error(w, "Товар не найден", http.StatusBadRequest)
+		writeAPIError(w, r, err)
 		return
 	}
-
-	username := r.Context().Value("username").(string)
-	user, err := GetUserByUsername(username)
-	if err != nil {
-		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+	if sender.Coins < total {
+		writeError(w, r, http.StatusBadRequest, CodeInsufficientFunds, "insufficient_funds_transfer")
+		return
+	}
+	if !stepUpVerified(w, r, sender, total) {
 		return
 	}
 
-	if user.Coins < item.Price {
-		http.Error(w, "Недостаточно монет для покупки", http.StatusBadRequest)
+	err = sender.TransferCoinsBatch(recipients, transfers)
+	if err != nil {
+		writeAPIError(w, r, err)
 		return
 	}
 
-	// Покупка товара
-	err = user.BuyMerch(item)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BatchSendCoinResponse{Total: total, Results: results})
+}
+
+// BuyMerchHandler выполняет покупку товара за монеты.
+// Покупка через GET оставлена для совместимости; замена - POST /api/v2/purchases.
+func BuyMerchHandler(w http.ResponseWriter, r *http.Request) {
+	purchase, err := BuyItem(actorFromRequest(r), mux.Vars(r)["item"])
 	if err != nil {
-		http.Error(w, "Ошибка при покупке товара", http.StatusInternalServerError)
+		writeAPIError(w, r, err)
 		return
 	}
 
+	setContentLanguage(w, r)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "Покупка совершена", "item": item.Name})
+	json.NewEncoder(w).Encode(PurchaseResponse{
+		Status:      tr(r, "purchase_done"),
+		Item:        purchase.Item,
+		DisplayName: itemDisplayName(r, purchase.Item),
+	})
 }
 
 // GetUserMerchHandler возвращает список купленных пользователем товаров.
@@ -220,7 +199,7 @@ func GetUserMerchHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.Context().Value("username").(string)
 	user, err := GetUserByUsername(username)
 	if err != nil {
-		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
 		return
 	}
 
@@ -234,70 +213,39 @@ func GetUserMerchHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(purchasedMerch)
 }
 
-// TransferHandler выполняет перевод монет между пользователями.
-func TransferHandler(w http.ResponseWriter, r *http.Request) {
-	var req SendCoinRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ToUser == "" || req.Amount <= 0 {
-		http.Error(w, "Неверный запрос", http.StatusBadRequest)
-		return
-	}
-
-	senderUsername := r.Context().Value("username").(string)
-	sender, err := GetUserByUsername(senderUsername)
-	if err != nil {
-		http.Error(w, "Пользователь не найден", http.StatusNotFound)
-		return
-	}
-
-	recipient, err := GetUserByUsername(req.ToUser)
-	if err != nil {
-		http.Error(w, "Получатель не найден", http.StatusNotFound)
-		return
-	}
-
-	if sender.Coins < req.Amount {
-		http.Error(w, "Недостаточно монет для перевода", http.StatusBadRequest)
-		return
-	}
-
-	// Перевод монет
-	err = sender.TransferCoins(recipient, req.Amount)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+// GetTransactionsHandler возвращает историю транзакций (входящие и исходящие).
+func GetTransactionsHandler(w http.ResponseWriter, r *http.Request) {
+	category := r.URL.Query().Get("category")
+	if !IsValidCategory(category) {
+		writeFieldError(w, r, "category", "unknown_category")
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "Перевод выполнен"})
-}
-
-// GetTransactionsHandler возвращает историю транзакций (входящие и исходящие).
-func GetTransactionsHandler(w http.ResponseWriter, r *http.Request) {
 	username := r.Context().Value("username").(string)
 	user, err := GetUserByUsername(username)
 	if err != nil {
-		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
 		return
 	}
 
 	// Получаем входящие переводы
 	incomingTransfers := make([]TransferInfo, 0)
 	rows, err := db.Query(`
-		SELECT u.username, t.amount
+		SELECT u.username, t.amount, COALESCE(t.memo, ''), COALESCE(t.category, '')
 		FROM transactions t
 		JOIN users u ON u.id = t.sender_id
-		WHERE t.receiver_id = $1
-	`, user.ID)
+		WHERE t.receiver_id = $1 AND ($2::text = '' OR t.category = $2)
+	`, user.ID, category)
 	if err != nil {
-		http.Error(w, "Ошибка при получении входящих переводов", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "incoming_fetch_failed")
 		return
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var transfer TransferInfo
-		if err := rows.Scan(&transfer.FromUser, &transfer.Amount); err != nil {
-			http.Error(w, "Ошибка при сканировании входящих переводов", http.StatusInternalServerError)
+		if err := rows.Scan(&transfer.FromUser, &transfer.Amount, &transfer.Memo, &transfer.Category); err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "incoming_scan_failed")
 			return
 		}
 		incomingTransfers = append(incomingTransfers, transfer)
@@ -306,33 +254,48 @@ func GetTransactionsHandler(w http.ResponseWriter, r *http.Request) {
 	// Получаем исходящие переводы
 	outgoingTransfers := make([]TransferInfo, 0)
 	rows, err = db.Query(`
-		SELECT u.username, t.amount
+		SELECT u.username, t.amount, COALESCE(t.memo, ''), COALESCE(t.category, '')
 		FROM transactions t
 		JOIN users u ON u.id = t.receiver_id
-		WHERE t.sender_id = $1
-	`, user.ID)
+		WHERE t.sender_id = $1 AND ($2::text = '' OR t.category = $2)
+	`, user.ID, category)
 	if err != nil {
-		http.Error(w, "Ошибка при получении исходящих переводов", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "outgoing_fetch_failed")
 		return
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var transfer TransferInfo
-		if err := rows.Scan(&transfer.ToUser, &transfer.Amount); err != nil {
-			http.Error(w, "Ошибка при сканировании исходящих переводов", http.StatusInternalServerError)
+		if err := rows.Scan(&transfer.ToUser, &transfer.Amount, &transfer.Memo, &transfer.Category); err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "outgoing_scan_failed")
 			return
 		}
 		outgoingTransfers = append(outgoingTransfers, transfer)
 	}
 
-	// Формируем ответ
-	transactionHistory := map[string]interface{}{
-		"incoming": incomingTransfers,
-		"outgoing": outgoingTransfers,
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TransactionHistory{Incoming: incomingTransfers, Outgoing: outgoingTransfers})
+}
+
+
+// SetMerchPriceHandler задаёт цену товара или добавляет новый товар ({"price"}).
+func SetMerchPriceHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Price int `json:"price"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Price <= 0 {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+
+	actor := r.Context().Value("username").(string)
+	item, err := SetMerchandisePrice(actor, mux.Vars(r)["item"], req.Price)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "merch_update_failed")
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(transactionHistory)
+	json.NewEncoder(w).Encode(item)
 }
-
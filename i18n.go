@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// isSupportedLanguage проверяет, есть ли каталог сообщений для языка
+func isSupportedLanguage(lang string) bool {
+	_, ok := catalogs[lang]
+	return ok
+}
+
+// negotiateLanguage выбирает язык по заголовку Accept-Language с учётом весов q.
+// Регион не учитывается: en-US и en-GB дают en. Возвращает "", если ни один язык не подходит.
+func negotiateLanguage(header string) string {
+	type candidate struct {
+		lang string
+		q    float64
+	}
+	var candidates []candidate
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		candidates = append(candidates, candidate{primary, q})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, c := range candidates {
+		if c.lang == "*" {
+			return config.DefaultLanguage
+		}
+		if isSupportedLanguage(c.lang) {
+			return c.lang
+		}
+	}
+	return ""
+}
+
+// requestLanguage - язык ответа: сохранённый в профиле (попадает в токен),
+// затем Accept-Language, затем DEFAULT_LANGUAGE
+func requestLanguage(r *http.Request) string {
+	if r == nil {
+		return config.DefaultLanguage
+	}
+	if claims, _ := r.Context().Value("claims").(*Claims); claims != nil && isSupportedLanguage(claims.Language) {
+		return claims.Language
+	}
+	if lang := negotiateLanguage(r.Header.Get("Accept-Language")); lang != "" {
+		return lang
+	}
+	return config.DefaultLanguage
+}
+
+// T возвращает сообщение каталога. Если ключа нет в каталоге языка, берётся язык
+// по умолчанию, а если нет и там - сам ключ.
+func T(lang, key string, args ...interface{}) string {
+	msg, ok := catalogs[lang][key]
+	if !ok {
+		if msg, ok = catalogs[config.DefaultLanguage][key]; !ok {
+			msg = key
+		}
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(msg, args...)
+	}
+	return msg
+}
+
+// tr переводит сообщение на язык запроса
+func tr(r *http.Request, key string, args ...interface{}) string {
+	return T(requestLanguage(r), key, args...)
+}
+
+// setContentLanguage сообщает язык ответа; Vary нужен кэширующим прокси
+func setContentLanguage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Language", requestLanguage(r))
+	w.Header().Add("Vary", "Accept-Language")
+}
+
+// itemDisplayName - название товара на языке запроса, для новых товаров без перевода - имя
+func itemDisplayName(r *http.Request, name string) string {
+	return localizedItemName(requestLanguage(r), name)
+}
+
+// localizedItemName - название товара на языке lang
+func localizedItemName(lang, name string) string {
+	key := "item." + name
+	if _, ok := catalogs[config.DefaultLanguage][key]; !ok {
+		return name
+	}
+	return T(lang, key)
+}
+
+// SetUserLanguage сохраняет язык пользователя; пустая строка сбрасывает выбор
+func SetUserLanguage(userID int, lang string) error {
+	_, err := db.Exec(`UPDATE users SET language = $1 WHERE id = $2`, nullIfEmpty(lang), userID)
+	return err
+}
+
+// GetUserLanguage возвращает сохранённый язык пользователя или ""
+func GetUserLanguage(userID int) (string, error) {
+	var lang string
+	err := db.QueryRow(`SELECT COALESCE(language, '') FROM users WHERE id = $1`, userID).Scan(&lang)
+	return lang, err
+}
+
+// SetLanguageHandler сохраняет язык сообщений ({"language": "en"}, "" - по Accept-Language).
+// Выбор попадает в токен, поэтому действует после обновления access-токена.
+func SetLanguageHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Language string `json:"language"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+	req.Language = strings.ToLower(strings.TrimSpace(req.Language))
+	if req.Language != "" && !isSupportedLanguage(req.Language) {
+		writeFieldError(w, r, "language", "language_unsupported")
+		return
+	}
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+	if err := SetUserLanguage(user.ID, req.Language); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "account_update_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"language": req.Language})
+}
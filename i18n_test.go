@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCatalogsComplete(t *testing.T) {
+	base := catalogs[config.DefaultLanguage]
+	if base == nil {
+		t.Fatalf("No catalog for default language %q", config.DefaultLanguage)
+	}
+	for lang, catalog := range catalogs {
+		for key, msg := range base {
+			other, ok := catalog[key]
+			if !ok {
+				t.Errorf("%s: missing key %q", lang, key)
+				continue
+			}
+			if other == "" {
+				t.Errorf("%s: empty message for %q", lang, key)
+			}
+			if strings.Count(other, "%") != strings.Count(msg, "%") {
+				t.Errorf("%s: %q has different placeholders than %s", lang, key, config.DefaultLanguage)
+			}
+		}
+		for key := range catalog {
+			if _, ok := base[key]; !ok {
+				t.Errorf("%s: key %q is not in %s catalog", lang, key, config.DefaultLanguage)
+			}
+		}
+	}
+}
+
+// TestMessageKeysExist ищет в исходниках ключи, переданные writeError, writeFieldError,
+// tr и T, и ключи в литералах APIError, и проверяет, что они есть во всех каталогах
+func TestMessageKeysExist(t *testing.T) {
+	keyArg := map[string]int{"writeError": 4, "writeFieldError": 3, "tr": 1, "T": 1}
+	used := map[string]token.Position{}
+
+	files, _ := filepath.Glob("*.go")
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			var lit ast.Expr
+			switch n := n.(type) {
+			case *ast.CallExpr:
+				if fn, ok := n.Fun.(*ast.Ident); ok {
+					if i, ok := keyArg[fn.Name]; ok && len(n.Args) > i {
+						lit = n.Args[i]
+					}
+				}
+			case *ast.KeyValueExpr:
+				if k, ok := n.Key.(*ast.Ident); ok && k.Name == "Key" {
+					lit = n.Value
+				}
+			}
+			if bl, ok := lit.(*ast.BasicLit); ok && bl.Kind == token.STRING {
+				key, _ := strconv.Unquote(bl.Value)
+				used[key] = fset.Position(bl.Pos())
+			}
+			return true
+		})
+	}
+	for _, e := range apiErrorCodes {
+		used[e.key] = token.Position{Filename: "errors.go"}
+	}
+	// Коды отказов политики переводов служат ключами каталога
+	for _, code := range []string{PolicyMaxPerTransfer, PolicyDailyLimit, PolicyWeeklyLimit, PolicyHourlyCount,
+		PolicyAccountTooNew, PolicyAccountFrozen, PolicyAccountDeactivated, PolicyRecipientInactive} {
+		used[code] = token.Position{Filename: "policy.go"}
+	}
+
+	if len(used) < 50 {
+		t.Fatalf("Found only %d message keys, source scan is broken", len(used))
+	}
+	for key, pos := range used {
+		for lang, catalog := range catalogs {
+			if _, ok := catalog[key]; !ok {
+				t.Errorf("%s: key %q is missing in %s catalog", pos, key, lang)
+			}
+		}
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	cases := map[string]string{
+		"":                        "",
+		"en":                      "en",
+		"en-US,en;q=0.9":          "en",
+		"de-DE,de;q=0.9,en;q=0.5": "en",
+		"en;q=0.3,ru;q=0.8":       "ru",
+		"RU":                      "ru",
+		"fr, *;q=0.1":             config.DefaultLanguage,
+		"de":                      "",
+		"en;q=0":                  "",
+		"en;q=abc, ru-RU":         "ru",
+	}
+	for header, want := range cases {
+		if got := negotiateLanguage(header); got != want {
+			t.Errorf("%q: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestRequestLanguagePrefersProfile(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/info", nil)
+	req.Header.Set("Accept-Language", "ru")
+	if got := requestLanguage(req); got != "ru" {
+		t.Errorf("Accept-Language: got %q", got)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), "claims", &Claims{Username: "u", Language: "en"}))
+	if got := requestLanguage(req); got != "en" {
+		t.Errorf("Profile language should win over Accept-Language, got %q", got)
+	}
+}
+
+func TestErrorMessageLocalized(t *testing.T) {
+	for lang, want := range map[string]string{"en": "Recipient not found", "ru": "Получатель не найден"} {
+		req := httptest.NewRequest("POST", "/api/sendCoin", nil)
+		req.Header.Set("Accept-Language", lang)
+		rr := httptest.NewRecorder()
+		writeAPIError(rr, req, ErrRecipientNotFound)
+
+		var resp ErrorResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if rr.Code != http.StatusNotFound || len(resp.Errors) != 1 || resp.Errors[0].Message != want {
+			t.Errorf("%s: got %d %+v, want %q", lang, rr.Code, resp.Errors, want)
+		}
+		if got := rr.Header().Get("Content-Language"); got != lang {
+			t.Errorf("%s: Content-Language %q", lang, got)
+		}
+	}
+}
+
+func TestItemDisplayName(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/info", nil)
+	req.Header.Set("Accept-Language", "en-GB")
+	if got := itemDisplayName(req, "pink-hoody"); got != "Pink hoodie" {
+		t.Errorf("Got %q", got)
+	}
+	if got := itemDisplayName(req, "sticker"); got != "sticker" {
+		t.Errorf("Item without translation should keep its name, got %q", got)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Повтор запроса с тем же заголовком Idempotency-Key не выполняет операцию ещё
+// раз, а возвращает сохранённый ответ. Так клиент может повторить перевод или
+// покупку после таймаута, не рискуя списать монеты дважды. Ключ действует
+// IDEMPOTENCY_TTL и привязан к пользователю, методу, пути и телу запроса.
+//
+// Middleware ставится только на маршруты переводов и покупок: ответы остальных
+// маршрутов могут содержать секреты (токены, секрет 2FA, резервные коды), которые
+// нельзя хранить в базе, а потоковые ответы не переживут копирование.
+
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength - наибольшая длина ключа
+const maxIdempotencyKeyLength = 255
+
+// idempotentResponse - сохранённый ответ; StatusCode 0 - запрос ещё выполняется
+type idempotentResponse struct {
+	Fingerprint string
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// requestFingerprint - хэш метода, пути и тела: ключ нельзя использовать для другого запроса
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.Path+"\n")
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// claimIdempotencyKey занимает ключ; если он уже занят, возвращает сохранённое
+func claimIdempotencyKey(username, key, fingerprint string) (*idempotentResponse, error) {
+	if _, err := db.Exec(`
+		DELETE FROM idempotency_keys WHERE username = $1 AND key = $2 AND created_at < now() - $3::INTERVAL
+	`, username, key, pgInterval(config.IdempotencyTTL)); err != nil {
+		return nil, err
+	}
+	res, err := db.Exec(`
+		INSERT INTO idempotency_keys (username, key, fingerprint) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`, username, key, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil, nil
+	}
+
+	var stored idempotentResponse
+	var status sql.NullInt64
+	var contentType sql.NullString
+	err = db.QueryRow(`
+		SELECT fingerprint, status_code, content_type, body FROM idempotency_keys WHERE username = $1 AND key = $2
+	`, username, key).Scan(&stored.Fingerprint, &status, &contentType, &stored.Body)
+	if err != nil {
+		return nil, err
+	}
+	stored.StatusCode, stored.ContentType = int(status.Int64), contentType.String
+	return &stored, nil
+}
+
+// idempotencyRecorder пишет ответ клиенту и сохраняет его копию
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// IdempotencyMiddleware выполняет запрос с Idempotency-Key не больше одного раза.
+// Ответы 5xx и 429 не сохраняются: такой запрос можно повторить с тем же ключом.
+func IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeFieldError(w, r, idempotencyHeader, "idempotency_key_invalid", maxIdempotencyKeyLength)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		username := r.Context().Value("username").(string)
+		fingerprint := requestFingerprint(r, body)
+		stored, err := claimIdempotencyKey(username, key, fingerprint)
+		if err != nil {
+			writeAPIError(w, r, err)
+			return
+		}
+		switch {
+		case stored == nil:
+		case stored.Fingerprint != fingerprint:
+			writeErrors(w, r, http.StatusUnprocessableEntity,
+				&APIError{Code: CodeValidationFailed, Field: idempotencyHeader, Key: "idempotency_key_reused"})
+			return
+		case stored.StatusCode == 0:
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusConflict, CodeConflict, "idempotency_in_progress")
+			return
+		default:
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		if rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests {
+			_, err = db.Exec(`DELETE FROM idempotency_keys WHERE username = $1 AND key = $2`, username, key)
+		} else {
+			_, err = db.Exec(`
+				UPDATE idempotency_keys SET status_code = $3, content_type = $4, body = $5
+				WHERE username = $1 AND key = $2
+			`, username, key, rec.status, w.Header().Get("Content-Type"), rec.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("Не удалось сохранить ответ для ключа идемпотентности %s/%s: %v", username, key, err)
+		}
+	})
+}
+
+// idempotent оборачивает обработчик перевода или покупки в IdempotencyMiddleware
+func idempotent(h http.HandlerFunc) http.Handler {
+	return IdempotencyMiddleware(h)
+}
+
+// RunIdempotencyCleanup удаляет просроченные ключи до отмены контекста
+func RunIdempotencyCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := db.Exec(`DELETE FROM idempotency_keys WHERE created_at < now() - $1::INTERVAL`, pgInterval(config.IdempotencyTTL)); err != nil {
+				log.Printf("Ошибка очистки ключей идемпотентности: %v", err)
+			}
+		}
+	}
+}
@@ -3,9 +3,19 @@ CREATE TABLE IF NOT EXISTS users (
     id SERIAL PRIMARY KEY,
     username VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
-    coins INTEGER DEFAULT 1000 NOT NULL
+    coins INTEGER DEFAULT 1000 NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    frozen BOOLEAN DEFAULT FALSE NOT NULL, -- Заморожен антифродом или администратором
+    frozen_at TIMESTAMPTZ,
+    frozen_reason VARCHAR(255),
+    deactivated_at TIMESTAMPTZ, -- Вход и получение монет заблокированы
+    deleted_at TIMESTAMPTZ, -- Аккаунт обезличен, строка сохранена ради истории переводов
+    language VARCHAR(8) -- Язык сообщений API; NULL - по Accept-Language
 );
 
+-- Имена пользователей уникальны без учёта регистра
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_idx ON users (LOWER(username));
+
 -- Создание таблицы товаров (мерча)
 CREATE TABLE IF NOT EXISTS merchandise (
     id SERIAL PRIMARY KEY,
@@ -30,7 +40,7 @@ ON CONFLICT (name) DO NOTHING; -- Не вставлять дубли, если 
 -- Создание таблицы покупок (связь пользователя и товаров)
 CREATE TABLE IF NOT EXISTS purchases (
     id SERIAL PRIMARY KEY,
-    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    user_id INTEGER REFERENCES users(id) ON DELETE RESTRICT, -- Пользователи не удаляются, а обезличиваются
     merchandise_id INTEGER REFERENCES merchandise(id) ON DELETE CASCADE,
     purchase_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
@@ -46,13 +56,17 @@ CREATE TABLE IF NOT EXISTS user_inventory (
 -- Создание таблицы переводов монет между пользователями
 CREATE TABLE IF NOT EXISTS transactions (
     id SERIAL PRIMARY KEY,
-    sender_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
-    receiver_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    sender_id INTEGER REFERENCES users(id) ON DELETE RESTRICT, -- История переводов не должна теряться
+    receiver_id INTEGER REFERENCES users(id) ON DELETE RESTRICT,
     amount INTEGER NOT NULL,
-    transaction_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+    transaction_time TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    memo VARCHAR(200), -- Пояснение отправителя
+    category VARCHAR(20) CHECK (category IN ('thanks', 'bet', 'reimbursement', 'gift'))
     -- Добавление уникального ограничения на комбинацию sender_id и receiver_id
 );
 
+CREATE INDEX IF NOT EXISTS transactions_category_idx ON transactions (category);
+
 -- Пример вставки данных в таблицу пользователей
 INSERT INTO users (username, password_hash, coins) VALUES
     ('user1', 'password_hash_1', 1000),
@@ -71,3 +85,320 @@ INSERT INTO purchases (user_id, merchandise_id) VALUES
     (1, 3),  -- user1 покупает book
     (2, 2);  -- user2 покупает cup
 
+
+-- Запланированные переводы: разовые (cron_expr IS NULL) и регулярные по cron-расписанию
+CREATE TABLE IF NOT EXISTS scheduled_transfers (
+    id SERIAL PRIMARY KEY,
+    sender_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    receiver_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    amount INTEGER NOT NULL CHECK (amount > 0),
+    cron_expr VARCHAR(100),
+    next_run_at TIMESTAMPTZ, -- NULL, когда расписание больше не сработает
+    status VARCHAR(20) NOT NULL DEFAULT 'active', -- active, paused, completed, failed
+    last_run_at TIMESTAMPTZ,
+    last_error TEXT,
+    failure_count INTEGER NOT NULL DEFAULT 0, -- Ошибок подряд
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    memo VARCHAR(200),
+    category VARCHAR(20)
+);
+
+CREATE INDEX IF NOT EXISTS scheduled_transfers_due_idx
+    ON scheduled_transfers (next_run_at) WHERE status = 'active';
+
+-- История запусков запланированных переводов
+CREATE TABLE IF NOT EXISTS scheduled_transfer_runs (
+    id SERIAL PRIMARY KEY,
+    schedule_id INTEGER REFERENCES scheduled_transfers(id) ON DELETE CASCADE,
+    run_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    success BOOLEAN NOT NULL,
+    error TEXT
+);
+
+-- Лимиты исходящих переводов. Строка с user_id IS NULL - глобальная политика,
+-- остальные - персональные. NULL в колонке означает "как уровнем выше", 0 - без ограничения.
+CREATE TABLE IF NOT EXISTS transfer_policies (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER UNIQUE REFERENCES users(id) ON DELETE CASCADE,
+    max_per_transfer INTEGER,
+    daily_limit INTEGER,
+    weekly_limit INTEGER,
+    max_transfers_per_hour INTEGER,
+    min_account_age INTERVAL,
+    updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS transfer_policies_global_idx
+    ON transfer_policies ((user_id IS NULL)) WHERE user_id IS NULL;
+
+CREATE INDEX IF NOT EXISTS transactions_sender_time_idx
+    ON transactions (sender_id, transaction_time);
+
+CREATE INDEX IF NOT EXISTS transactions_receiver_time_idx
+    ON transactions (receiver_id, transaction_time);
+
+-- Находки антифрода по аккаунтам
+CREATE TABLE IF NOT EXISTS fraud_findings (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    rule VARCHAR(50) NOT NULL, -- fan_in_new_accounts, circular_transfer, transfer_burst
+    score INTEGER NOT NULL,
+    details JSONB,
+    transaction_id INTEGER REFERENCES transactions(id) ON DELETE SET NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'open', -- open, confirmed, dismissed
+    reviewed_by VARCHAR(255),
+    reviewed_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS fraud_findings_user_idx ON fraud_findings (user_id, status);
+
+-- Приглашения для регистрации (max_uses IS NULL - без ограничения)
+CREATE TABLE IF NOT EXISTS invite_codes (
+    code VARCHAR(32) PRIMARY KEY,
+    created_by VARCHAR(255) NOT NULL,
+    max_uses INTEGER CHECK (max_uses > 0),
+    uses INTEGER NOT NULL DEFAULT 0,
+    expires_at TIMESTAMPTZ,
+    revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS invite_redemptions (
+    code VARCHAR(32) REFERENCES invite_codes(code),
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    redeemed_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (code, user_id)
+);
+
+-- Сессии пользователей; refresh-токены ротируются внутри сессии
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    user_agent TEXT,
+    ip VARCHAR(64),
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id);
+CREATE INDEX IF NOT EXISTS sessions_revoked_idx ON sessions (revoked_at) WHERE revoked_at IS NOT NULL;
+
+-- Хэши refresh-токенов; used_at заполняется при ротации, повторное предъявление отзывает сессию
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash CHAR(64) PRIMARY KEY,
+    session_id VARCHAR(64) REFERENCES sessions(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+-- Отозванные до истечения срока access-токены (по jti)
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Ключи подписи JWT (PKCS#8 PEM). Активен ключ с retired_at IS NULL,
+-- после ротации ключ проверяет токены до expires_at и публикуется в JWKS
+CREATE TABLE IF NOT EXISTS signing_keys (
+    kid VARCHAR(64) PRIMARY KEY,
+    alg VARCHAR(16) NOT NULL,
+    private_key BYTEA NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    retired_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ
+);
+
+-- Внешние учётные записи (OIDC): пара (issuer, sub) привязана к пользователю магазина
+CREATE TABLE IF NOT EXISTS user_identities (
+    issuer VARCHAR(255) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (issuer, subject)
+);
+
+-- Незавершённые входы через OIDC: state, nonce и PKCE code_verifier до колбэка
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    state VARCHAR(64) PRIMARY KEY,
+    nonce VARCHAR(64) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+-- Назначенные роли (роль user есть у всех и не хранится)
+CREATE TABLE IF NOT EXISTS user_roles (
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    role VARCHAR(32) NOT NULL CHECK (role IN ('merch_manager', 'treasurer', 'admin')),
+    granted_by VARCHAR(255) NOT NULL,
+    granted_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, role)
+);
+
+-- Журнал назначения и снятия ролей
+CREATE TABLE IF NOT EXISTS role_audit (
+    id SERIAL PRIMARY KEY,
+    actor VARCHAR(255) NOT NULL,
+    username VARCHAR(255) NOT NULL,
+    role VARCHAR(32) NOT NULL,
+    action VARCHAR(16) NOT NULL CHECK (action IN ('grant', 'revoke')),
+    reason TEXT,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS role_audit_username_idx ON role_audit (username);
+
+-- Персональные токены для ботов и интеграций (хранится SHA-256 токена)
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) UNIQUE NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS api_tokens_user_idx ON api_tokens (user_id);
+
+-- TOTP-секреты (RFC 6238). last_used_step не даёт предъявить код повторно
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret VARCHAR(64) NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    enabled_at TIMESTAMPTZ,
+    last_used_step BIGINT
+);
+
+-- Одноразовые резервные коды 2FA (хранится SHA-256)
+CREATE TABLE IF NOT EXISTS totp_recovery_codes (
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, code_hash)
+);
+
+-- Неудачные попытки входа по имени (user:<имя>) и по адресу (ip:<адрес>)
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key VARCHAR(300) PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL,
+    locked_until TIMESTAMPTZ
+);
+
+-- Корзины лимитера запросов при RATE_LIMIT_BACKEND=postgres
+CREATE TABLE IF NOT EXISTS rate_limit_buckets (
+    key VARCHAR(300) PRIMARY KEY,
+    tokens DOUBLE PRECISION NOT NULL,
+    allowed BOOLEAN NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+-- События пользователя для /api/events; хранятся EVENT_RETENTION для переподключения
+CREATE TABLE IF NOT EXISTS user_events (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS user_events_user_idx ON user_events (user_id, id);
+CREATE INDEX IF NOT EXISTS user_events_created_idx ON user_events (created_at);
+
+-- Подписки на вебхуки; секрет нужен для подписи, поэтому хранится открытым
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id SERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    event_types TEXT[] NOT NULL,
+    secret VARCHAR(100) NOT NULL,
+    created_by VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now() NOT NULL
+);
+
+-- Доставки вебхуков: строки пишет relay доменных событий, статус pending, delivered или dead
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id INTEGER NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+    event_type VARCHAR(50) NOT NULL,
+    payload JSONB NOT NULL,
+    status VARCHAR(20) DEFAULT 'pending' NOT NULL,
+    attempts INTEGER DEFAULT 0 NOT NULL,
+    next_attempt_at TIMESTAMPTZ DEFAULT now() NOT NULL,
+    last_error TEXT,
+    created_at TIMESTAMPTZ DEFAULT now() NOT NULL,
+    delivered_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription_idx ON webhook_deliveries (subscription_id, id);
+
+-- Журнал попыток доставки вебхуков
+CREATE TABLE IF NOT EXISTS webhook_delivery_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+    attempted_at TIMESTAMPTZ DEFAULT now() NOT NULL,
+    status_code INTEGER,
+    error TEXT,
+    duration_ms INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS webhook_delivery_attempts_delivery_idx ON webhook_delivery_attempts (delivery_id);
+
+-- Журнал доменных событий; txid - транзакция, записавшая событие (курсор relay)
+CREATE TABLE IF NOT EXISTS domain_events (
+    id BIGSERIAL PRIMARY KEY,
+    txid XID8 DEFAULT pg_current_xact_id() NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    aggregate_type VARCHAR(50) NOT NULL,
+    aggregate_id INTEGER NOT NULL,
+    payload JSONB NOT NULL,
+    occurred_at TIMESTAMPTZ DEFAULT now() NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS domain_events_txid_idx ON domain_events (txid, id);
+
+-- События неизменяемы: изменение или удаление строки журнала - ошибка. Единственное
+-- исключение - обезличивание payload при удалении аккаунта: транзакция включает его
+-- через SET LOCAL app.redact_domain_events = 'on', остальные колонки менять нельзя.
+CREATE OR REPLACE FUNCTION domain_events_immutable() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND current_setting('app.redact_domain_events', true) = 'on'
+        AND (NEW.id, NEW.txid, NEW.type, NEW.aggregate_type, NEW.aggregate_id, NEW.occurred_at)
+            IS NOT DISTINCT FROM (OLD.id, OLD.txid, OLD.type, OLD.aggregate_type, OLD.aggregate_id, OLD.occurred_at) THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'domain_events is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS domain_events_immutable ON domain_events;
+CREATE TRIGGER domain_events_immutable BEFORE UPDATE OR DELETE ON domain_events
+    FOR EACH ROW EXECUTE FUNCTION domain_events_immutable();
+
+-- Ответы на запросы с Idempotency-Key; status_code NULL - запрос ещё выполняется
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    username VARCHAR(255) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    status_code INTEGER,
+    content_type VARCHAR(100),
+    body BYTEA,
+    created_at TIMESTAMPTZ DEFAULT now() NOT NULL,
+    PRIMARY KEY (username, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_idx ON idempotency_keys (created_at);
+
+-- Курсоры приёмников доменных событий
+CREATE TABLE IF NOT EXISTS outbox_offsets (
+    sink VARCHAR(255) PRIMARY KEY,
+    last_txid XID8 DEFAULT '0' NOT NULL,
+    last_id BIGINT DEFAULT 0 NOT NULL,
+    updated_at TIMESTAMPTZ DEFAULT now() NOT NULL
+);
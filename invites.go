@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var ErrInviteNotFound = errors.New("приглашение не найдено")
+
+// InviteCode - приглашение для регистрации
+type InviteCode struct {
+	Code      string     `json:"code"`
+	CreatedBy string     `json:"createdBy"`
+	MaxUses   *int       `json:"maxUses,omitempty"` // nil - без ограничения
+	Uses      int        `json:"uses"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	Revoked   bool       `json:"revoked"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
+
+// CreateInviteRequest - запрос на создание приглашения.
+// MaxUses = 1 даёт одноразовый код, 0 - многоразовый без ограничения.
+type CreateInviteRequest struct {
+	MaxUses      int   `json:"maxUses"`
+	ExpiresInSec int64 `json:"expiresInSeconds,omitempty"` // 0 - бессрочно
+}
+
+// generateInviteCode возвращает случайный код вида "ABCD-EFGH-IJKL-MNOP"
+func generateInviteCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := base32.StdEncoding.EncodeToString(b)
+	return s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16], nil
+}
+
+// CreateInvite создаёт приглашение от имени администратора
+func CreateInvite(createdBy string, req CreateInviteRequest) (*InviteCode, error) {
+	code, err := generateInviteCode()
+	if err != nil {
+		return nil, err
+	}
+	var maxUses sql.NullInt64
+	if req.MaxUses > 0 {
+		maxUses = sql.NullInt64{Int64: int64(req.MaxUses), Valid: true}
+	}
+	var expiresAt sql.NullTime
+	if req.ExpiresInSec > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(time.Duration(req.ExpiresInSec) * time.Second), Valid: true}
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO invite_codes (code, created_by, max_uses, expires_at) VALUES ($1, $2, $3, $4)
+	`, code, createdBy, maxUses, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &InviteCode{Code: code, CreatedBy: createdBy, MaxUses: nullIntPtr(maxUses),
+		ExpiresAt: nullTimePtr(expiresAt), CreatedAt: time.Now()}, nil
+}
+
+// ListInvites возвращает все приглашения, новые сначала
+func ListInvites() ([]InviteCode, error) {
+	rows, err := db.Query(`
+		SELECT code, created_by, max_uses, uses, expires_at, revoked, created_at
+		FROM invite_codes ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := make([]InviteCode, 0)
+	for rows.Next() {
+		var inv InviteCode
+		var maxUses sql.NullInt64
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&inv.Code, &inv.CreatedBy, &maxUses, &inv.Uses, &expiresAt, &inv.Revoked, &inv.CreatedAt); err != nil {
+			return nil, err
+		}
+		inv.MaxUses, inv.ExpiresAt = nullIntPtr(maxUses), nullTimePtr(expiresAt)
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// RevokeInvite отзывает приглашение; уже зарегистрированные по нему пользователи остаются
+func RevokeInvite(code string) error {
+	res, err := db.Exec(`UPDATE invite_codes SET revoked = TRUE WHERE code = $1`, code)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// redeemInvite атомарно увеличивает счётчик использований, если код ещё действует
+func redeemInvite(tx *sql.Tx, code string, userID int) error {
+	res, err := tx.Exec(`
+		UPDATE invite_codes SET uses = uses + 1
+		WHERE code = $1 AND NOT revoked
+			AND (max_uses IS NULL OR uses < max_uses)
+			AND (expires_at IS NULL OR expires_at > now())
+	`, code)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidInvite
+	}
+	_, err = tx.Exec(`INSERT INTO invite_redemptions (code, user_id) VALUES ($1, $2)`, code, userID)
+	return err
+}
+
+func nullIntPtr(v sql.NullInt64) *int {
+	if !v.Valid {
+		return nil
+	}
+	n := int(v.Int64)
+	return &n
+}
+
+func nullTimePtr(v sql.NullTime) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	return &v.Time
+}
+
+// CreateInviteHandler создаёт одноразовое или многоразовое приглашение.
+func CreateInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateInviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MaxUses < 0 || req.ExpiresInSec < 0 {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+
+	admin := r.Context().Value("username").(string)
+	invite, err := CreateInvite(admin, req)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "invite_create_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(invite)
+}
+
+// ListInvitesHandler возвращает все приглашения.
+func ListInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	invites, err := ListInvites()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "invites_fetch_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invites)
+}
+
+// RevokeInviteHandler отзывает приглашение.
+func RevokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	if err := RevokeInvite(mux.Vars(r)["code"]); err != nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "invite_not_found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// SigningKey - ключ подписи JWT. Пока ключ активен, им подписываются новые токены;
+// после ротации он ещё GracePeriod проверяет выданные ранее токены и публикуется в JWKS.
+type SigningKey struct {
+	Kid       string
+	Alg       string // RS256 или EdDSA
+	Private   crypto.Signer
+	Public    crypto.PublicKey
+	CreatedAt time.Time
+	RetiredAt *time.Time // Когда перестал подписывать
+	ExpiresAt *time.Time // Когда перестал проверять
+}
+
+// JWK - открытый ключ в формате RFC 7517
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA: модуль
+	E   string `json:"e,omitempty"`   // RSA: экспонента
+	Crv string `json:"crv,omitempty"` // OKP: кривая
+	X   string `json:"x,omitempty"`   // OKP: открытый ключ
+}
+
+// KeyManager хранит ключи подписи в базе, чтобы все экземпляры подписывали
+// и проверяли токены одним набором ключей, и ротирует их по расписанию.
+type KeyManager struct {
+	mu   sync.RWMutex
+	keys map[string]*SigningKey
+	// active - ключ, которым подписываются новые токены
+	active *SigningKey
+}
+
+var keyManager = &KeyManager{keys: map[string]*SigningKey{}}
+
+// hmacKid - kid для токенов, подписанных общим секретом HS256
+const hmacKid = "hs256"
+
+// generateSigningKey создаёт новую пару ключей для алгоритма
+func generateSigningKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "EdDSA":
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("неподдерживаемый алгоритм подписи %q", alg)
+}
+
+// Load перечитывает ключи из базы и выбирает активный
+func (m *KeyManager) Load() error {
+	rows, err := db.Query(`
+		SELECT kid, alg, private_key, created_at, retired_at, expires_at
+		FROM signing_keys
+		WHERE expires_at IS NULL OR expires_at > now()
+		ORDER BY created_at
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	keys := map[string]*SigningKey{}
+	var active *SigningKey
+	for rows.Next() {
+		var k SigningKey
+		var privatePEM []byte
+		var retiredAt, expiresAt sql.NullTime
+		if err := rows.Scan(&k.Kid, &k.Alg, &privatePEM, &k.CreatedAt, &retiredAt, &expiresAt); err != nil {
+			return err
+		}
+		block, _ := pem.Decode(privatePEM)
+		if block == nil {
+			return fmt.Errorf("ключ %s: неверный PEM", k.Kid)
+		}
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("ключ %s: %v", k.Kid, err)
+		}
+		k.Private = priv.(crypto.Signer)
+		k.Public = k.Private.Public()
+		k.RetiredAt, k.ExpiresAt = nullTimePtr(retiredAt), nullTimePtr(expiresAt)
+		keys[k.Kid] = &k
+		if k.RetiredAt == nil && k.Alg == config.JWTAlg {
+			active = &k
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.keys, m.active = keys, active
+	m.mu.Unlock()
+	return nil
+}
+
+// Rotate создаёт новый активный ключ, а прежние переводит в режим проверки
+// на JWTKeyGracePeriod
+func (m *KeyManager) Rotate() error {
+	return m.rotate(true)
+}
+
+// ensureFresh создаёт ключ, если активного нет или он старше интервала ротации
+func (m *KeyManager) ensureFresh() error {
+	if config.JWTAlg == "HS256" {
+		return nil
+	}
+	m.mu.RLock()
+	active := m.active
+	m.mu.RUnlock()
+	if active != nil && time.Since(active.CreatedAt) < config.JWTKeyRotation {
+		return nil
+	}
+	return m.rotate(false)
+}
+
+// rotate выполняется под advisory-блокировкой, чтобы несколько экземпляров
+// не ротировали ключ одновременно. Без force ротация пропускается, если другой
+// экземпляр уже создал свежий ключ.
+func (m *KeyManager) rotate(force bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('signing_keys'))`); err != nil {
+		return err
+	}
+	if !force {
+		var fresh bool
+		err = tx.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM signing_keys
+				WHERE retired_at IS NULL AND alg = $1 AND created_at > now() - $2::INTERVAL)
+		`, config.JWTAlg, pgInterval(config.JWTKeyRotation)).Scan(&fresh)
+		if err != nil {
+			return err
+		}
+		if fresh {
+			tx.Rollback()
+			return m.Load()
+		}
+	}
+
+	signer, err := generateSigningKey(config.JWTAlg)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return err
+	}
+	kid, err := randomToken(12)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE signing_keys SET retired_at = now(), expires_at = now() + $1::INTERVAL
+		WHERE retired_at IS NULL
+	`, pgInterval(config.JWTKeyGracePeriod))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO signing_keys (kid, alg, private_key) VALUES ($1, $2, $3)
+	`, kid, config.JWTAlg, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Новый ключ подписи JWT %s (%s)", kid, config.JWTAlg)
+	return m.Load()
+}
+
+// Init загружает ключи и при необходимости создаёт первый
+func (m *KeyManager) Init() error {
+	if err := m.Load(); err != nil {
+		return err
+	}
+	return m.ensureFresh()
+}
+
+// Run периодически подхватывает ключи других экземпляров и ротирует устаревший
+func (m *KeyManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := m.Load(); err != nil {
+			log.Printf("Ошибка загрузки ключей подписи: %v", err)
+			continue
+		}
+		if err := m.ensureFresh(); err != nil {
+			log.Printf("Ошибка ротации ключей подписи: %v", err)
+		}
+	}
+}
+
+// Sign подписывает claims активным ключом и указывает его kid в заголовке
+func (m *KeyManager) Sign(claims jwt.Claims) (string, error) {
+	if config.JWTAlg == "HS256" {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		token.Header["kid"] = hmacKid
+		return token.SignedString(config.JWTSecret)
+	}
+
+	m.mu.RLock()
+	active := m.active
+	m.mu.RUnlock()
+	if active == nil {
+		return "", fmt.Errorf("нет активного ключа подписи")
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(active.Alg), claims)
+	token.Header["kid"] = active.Kid
+	return token.SignedString(active.Private)
+}
+
+// Keyfunc выбирает ключ проверки по kid и не даёт подменить алгоритм:
+// алгоритм токена обязан совпадать с алгоритмом ключа.
+func (m *KeyManager) Keyfunc(t *jwt.Token) (interface{}, error) {
+	alg := t.Method.Alg()
+	kid, _ := t.Header["kid"].(string)
+
+	if alg == "HS256" {
+		// Токены без kid выданы до появления ротации ключей
+		if (kid == "" || kid == hmacKid) && (config.JWTAlg == "HS256" || config.JWTAcceptHS256) {
+			return config.JWTSecret, nil
+		}
+		return nil, fmt.Errorf("HS256 не принимается")
+	}
+
+	m.mu.RLock()
+	key := m.keys[kid]
+	m.mu.RUnlock()
+	if key == nil {
+		return nil, fmt.Errorf("неизвестный kid %q", kid)
+	}
+	if key.Alg != alg {
+		return nil, fmt.Errorf("алгоритм %s не совпадает с ключом %s", alg, kid)
+	}
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return nil, fmt.Errorf("ключ %s больше не действует", kid)
+	}
+	return key.Public, nil
+}
+
+// ParseToken проверяет подпись и срок действия токена
+func (m *KeyManager) ParseToken(tokenStr string, claims jwt.Claims) (*jwt.Token, error) {
+	parser := &jwt.Parser{ValidMethods: []string{"RS256", "EdDSA", "HS256"}}
+	return parser.ParseWithClaims(tokenStr, claims, m.Keyfunc)
+}
+
+// JWKS возвращает открытые ключи, которыми могут быть подписаны действующие токены
+func (m *KeyManager) JWKS() []JWK {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	jwks := make([]JWK, 0, len(m.keys))
+	for _, k := range m.keys {
+		jwk := JWK{Kid: k.Kid, Use: "sig", Alg: k.Alg}
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty, jwk.Crv = "OKP", "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		default:
+			continue
+		}
+		jwks = append(jwks, jwk)
+	}
+	return jwks
+}
+
+// JWKSHandler публикует открытые ключи для проверки токенов магазина другими сервисами.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string][]JWK{"keys": keyManager.JWKS()})
+}
+
+// RotateKeysHandler досрочно ротирует ключ подписи.
+func RotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if config.JWTAlg == "HS256" {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "key_rotation_unsupported")
+		return
+	}
+	if err := keyManager.Rotate(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "key_rotation_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]JWK{"keys": keyManager.JWKS()})
+}
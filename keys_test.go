@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// newTestKey создаёт ключ подписи в памяти, без базы
+func newTestKey(t *testing.T, kid, alg string) *SigningKey {
+	signer, err := generateSigningKey(alg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SigningKey{Kid: kid, Alg: alg, Private: signer, Public: signer.Public(), CreatedAt: time.Now()}
+}
+
+func newTestKeyManager(active *SigningKey, others ...*SigningKey) *KeyManager {
+	m := &KeyManager{keys: map[string]*SigningKey{active.Kid: active}, active: active}
+	for _, k := range others {
+		m.keys[k.Kid] = k
+	}
+	return m
+}
+
+func testClaims() *Claims {
+	return &Claims{Username: "alice", StandardClaims: jwt.StandardClaims{
+		Issuer: config.JWTIssuer, ExpiresAt: time.Now().Add(time.Hour).Unix(),
+	}}
+}
+
+func signWith(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	token := jwt.NewWithClaims(method, testClaims())
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestKeyfuncRejectsAlgorithmConfusion(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.JWTAlg = "RS256"
+	config.JWTAcceptHS256 = false
+
+	rsaKey := newTestKey(t, "rsa-key", "RS256")
+	edKey := newTestKey(t, "ed-key", "EdDSA")
+	expired := newTestKey(t, "expired-key", "RS256")
+	past := time.Now().Add(-time.Minute)
+	expired.RetiredAt, expired.ExpiresAt = &past, &past
+	m := newTestKeyManager(rsaKey, edKey, expired)
+
+	der, err := x509.MarshalPKIXPublicKey(rsaKey.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	valid, err := m.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ParseToken(valid, &Claims{}); err != nil {
+		t.Fatalf("Valid token rejected: %v", err)
+	}
+
+	cases := map[string]string{
+		// Классическая атака: открытый ключ RSA как секрет HMAC
+		"HS256 signed with the public key": signWith(t, jwt.SigningMethodHS256, rsaKey.Kid, publicPEM),
+		"HS256 with the shared secret":     signWith(t, jwt.SigningMethodHS256, "", config.JWTSecret),
+		"HS256 with the hmac kid":          signWith(t, jwt.SigningMethodHS256, hmacKid, config.JWTSecret),
+		"EdDSA key under an RS256 kid":     signWith(t, jwt.SigningMethodEdDSA, rsaKey.Kid, edKey.Private),
+		"RS256 token under an EdDSA kid":   signWith(t, jwt.SigningMethodRS256, edKey.Kid, rsaKey.Private),
+		"unknown kid":                      signWith(t, jwt.SigningMethodRS256, "missing", rsaKey.Private),
+		"no kid":                           signWith(t, jwt.SigningMethodRS256, "", rsaKey.Private),
+		"expired key":                      signWith(t, jwt.SigningMethodRS256, expired.Kid, expired.Private),
+		"alg none":                         signWith(t, jwt.SigningMethodNone, rsaKey.Kid, jwt.UnsafeAllowNoneSignatureType),
+	}
+	for name, token := range cases {
+		if _, err := m.ParseToken(token, &Claims{}); err == nil {
+			t.Errorf("%s: expected the token to be rejected", name)
+		}
+	}
+
+	// На время миграции HS256 принимается, но только с общим секретом
+	config.JWTAcceptHS256 = true
+	if _, err := m.ParseToken(cases["HS256 with the shared secret"], &Claims{}); err != nil {
+		t.Errorf("Legacy HS256 token rejected during migration: %v", err)
+	}
+	if _, err := m.ParseToken(cases["HS256 signed with the public key"], &Claims{}); err == nil {
+		t.Error("HS256 token with an RSA kid accepted during migration")
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	rsaKey := newTestKey(t, "rsa-key", "RS256")
+	edKey := newTestKey(t, "ed-key", "EdDSA")
+	jwks := newTestKeyManager(rsaKey, edKey).JWKS()
+	if len(jwks) != 2 {
+		t.Fatalf("Expected 2 keys, got %+v", jwks)
+	}
+
+	for _, jwk := range jwks {
+		if jwk.Use != "sig" {
+			t.Errorf("%s: expected use sig, got %q", jwk.Kid, jwk.Use)
+		}
+		switch jwk.Kid {
+		case rsaKey.Kid:
+			pub := rsaKey.Public.(*rsa.PublicKey)
+			n, _ := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, _ := base64.RawURLEncoding.DecodeString(jwk.E)
+			if jwk.Kty != "RSA" || jwk.Alg != "RS256" || new(big.Int).SetBytes(n).Cmp(pub.N) != 0 ||
+				int(new(big.Int).SetBytes(e).Int64()) != pub.E {
+				t.Errorf("Unexpected RSA JWK %+v", jwk)
+			}
+		case edKey.Kid:
+			x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+			if jwk.Kty != "OKP" || jwk.Crv != "Ed25519" || jwk.Alg != "EdDSA" ||
+				!edKey.Public.(ed25519.PublicKey).Equal(ed25519.PublicKey(x)) {
+				t.Errorf("Unexpected Ed25519 JWK %+v", jwk)
+			}
+		default:
+			t.Errorf("Unexpected kid %s", jwk.Kid)
+		}
+		if jwk.N != "" && jwk.X != "" {
+			t.Errorf("%s: mixed RSA and OKP fields", jwk.Kid)
+		}
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	requireDB(t)
+	if config.JWTAlg == "HS256" {
+		t.Skip("HS256 не ротируется")
+	}
+	before, err := keyManager.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKid := keyManager.active.Kid
+
+	if err := keyManager.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	newKid := keyManager.active.Kid
+	if newKid == oldKid {
+		t.Fatal("Rotation kept the same active key")
+	}
+	if old := keyManager.keys[oldKid]; old == nil || old.RetiredAt == nil || old.ExpiresAt == nil {
+		t.Fatalf("Expected the old key to be retired with a grace period, got %+v", old)
+	}
+
+	// Выданные до ротации токены действуют до конца GracePeriod
+	if _, err := keyManager.ParseToken(before, &Claims{}); err != nil {
+		t.Errorf("Token signed before rotation rejected: %v", err)
+	}
+	after, err := keyManager.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := keyManager.ParseToken(after, &Claims{})
+	if err != nil || token.Header["kid"] != newKid {
+		t.Errorf("Expected a token signed by %s, got %v (%v)", newKid, token, err)
+	}
+
+	kids := map[string]bool{}
+	for _, jwk := range keyManager.JWKS() {
+		kids[jwk.Kid] = true
+	}
+	if !kids[oldKid] || !kids[newKid] {
+		t.Errorf("Expected JWKS to publish %s and %s, got %v", oldKid, newKid, kids)
+	}
+
+	// Другой экземпляр подхватывает ключи из базы
+	other := &KeyManager{keys: map[string]*SigningKey{}}
+	if err := other.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if other.active == nil || other.active.Kid != newKid {
+		t.Errorf("Expected %s to be active after Load, got %+v", newKid, other.active)
+	}
+	if _, err := other.ParseToken(before, &Claims{}); err != nil {
+		t.Errorf("Other instance rejected a token signed before rotation: %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// LoginLockout - действующая блокировка входа
+type LoginLockout struct {
+	Key         string    `json:"key"` // user:<имя> или ip:<адрес>
+	Failures    int       `json:"failures"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// Счётчики ведутся по имени (без учёта регистра) и по адресу клиента. Имя учитывается
+// одинаково, существует пользователь или нет, поэтому ответы не выдают существование имени.
+func usernameLockKey(username string) string { return "user:" + strings.ToLower(username) }
+func ipLockKey(ip string) string             { return "ip:" + ip }
+
+// lockoutDuration - экспоненциальная задержка: после threshold неудач блокировка
+// LoginLockoutBase, дальше каждая неудача удваивает её до LoginLockoutMax
+func lockoutDuration(failures, threshold int) time.Duration {
+	if threshold <= 0 || failures < threshold {
+		return 0
+	}
+	exp := failures - threshold
+	if exp > 30 {
+		return config.LoginLockoutMax
+	}
+	d := time.Duration(float64(config.LoginLockoutBase) * math.Pow(2, float64(exp)))
+	if d > config.LoginLockoutMax {
+		return config.LoginLockoutMax
+	}
+	return d
+}
+
+// loginLockedFor возвращает, сколько ещё ждать до следующей попытки входа
+func loginLockedFor(username, ip string) (time.Duration, error) {
+	var until sql.NullTime
+	err := db.QueryRow(`
+		SELECT MAX(locked_until) FROM login_attempts
+		WHERE key IN ($1, $2) AND locked_until > now()
+	`, usernameLockKey(username), ipLockKey(ip)).Scan(&until)
+	if err != nil || !until.Valid {
+		return 0, err
+	}
+	return time.Until(until.Time), nil
+}
+
+// recordFailure атомарно увеличивает счётчик ключа. Счётчик сбрасывается, если с прошлой
+// неудачи прошло больше LoginFailureWindow. Upsert выполняется одной командой, поэтому
+// несколько экземпляров приложения считают неудачи вместе.
+func recordFailure(key string, threshold int) error {
+	var failures int
+	err := db.QueryRow(`
+		INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, now())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_attempts.last_failure_at < now() - $2::INTERVAL
+				THEN 1 ELSE login_attempts.failures + 1 END,
+			last_failure_at = now()
+		RETURNING failures
+	`, key, pgInterval(config.LoginFailureWindow)).Scan(&failures)
+	if err != nil {
+		return err
+	}
+	if lock := lockoutDuration(failures, threshold); lock > 0 {
+		_, err = db.Exec(`
+			UPDATE login_attempts SET locked_until = GREATEST(locked_until, now() + $2::INTERVAL) WHERE key = $1
+		`, key, pgInterval(lock))
+	}
+	return err
+}
+
+// recordLoginFailure учитывает неудачный вход по имени и по адресу; пустой адрес
+// (неизвестен) не учитывается
+func recordLoginFailure(username, ip string) {
+	if err := recordFailure(usernameLockKey(username), config.LoginMaxFailures); err != nil {
+		log.Printf("Ошибка учёта попытки входа: %v", err)
+	}
+	if ip == "" {
+		return
+	}
+	if err := recordFailure(ipLockKey(ip), config.LoginIPMaxFailures); err != nil {
+		log.Printf("Ошибка учёта попытки входа: %v", err)
+	}
+}
+
+// verifyStepUpCode проверяет код второго фактора для операции уже вошедшего
+// пользователя. Неверный код считается неудачной попыткой входа: иначе по
+// украденному access-токену 6-значный код можно было бы перебирать без ограничений.
+// Пропущенный код попыткой не считается. Пока имя или адрес заблокированы, код
+// не проверяется и возвращается *LoginLockedError.
+func verifyStepUpCode(user *User, ip, code string) error {
+	wait, err := loginLockedFor(user.Username, ip)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &LoginLockedError{RetryAfter: wait}
+	}
+	err = VerifySecondFactor(user.ID, code)
+	if errors.Is(err, ErrInvalidOTP) && code != "" {
+		recordLoginFailure(user.Username, ip)
+	}
+	return err
+}
+
+// resetLoginFailures сбрасывает счётчик имени после успешного входа. Счётчик адреса
+// не сбрасывается: иначе перебор можно было бы чередовать со входом в свой аккаунт.
+func resetLoginFailures(username string) {
+	db.Exec(`DELETE FROM login_attempts WHERE key = $1`, usernameLockKey(username))
+}
+
+// UnlockLogin снимает блокировку входа с имени пользователя или адреса
+func UnlockLogin(key string) (bool, error) {
+	res, err := db.Exec(`DELETE FROM login_attempts WHERE key = $1`, key)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// ListLoginLockouts возвращает действующие блокировки
+func ListLoginLockouts() ([]LoginLockout, error) {
+	rows, err := db.Query(`
+		SELECT key, failures, locked_until FROM login_attempts
+		WHERE locked_until > now() ORDER BY locked_until DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lockouts := make([]LoginLockout, 0)
+	for rows.Next() {
+		var l LoginLockout
+		if err := rows.Scan(&l.Key, &l.Failures, &l.LockedUntil); err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
+
+// LoginLockedError - отказ во входе, пока имя или адрес заблокированы
+type LoginLockedError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("вход заблокирован ещё на %s", e.RetryAfter)
+}
+
+// APIError переводит блокировку в ответ 429
+func (e *LoginLockedError) APIError() *APIError {
+	return &APIError{Status: http.StatusTooManyRequests, Code: CodeLoginLocked, Key: "login_locked"}
+}
+
+// retryAfterSeconds - значение заголовка Retry-After, округлённое вверх
+func (e *LoginLockedError) retryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// UnlockUserHandler снимает блокировку входа с пользователя.
+func UnlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["username"]
+	unlocked, err := UnlockLogin(usernameLockKey(username))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "unlock_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"username": username, "unlocked": unlocked})
+}
+
+// UnlockIPHandler снимает блокировку входа с адреса.
+func UnlockIPHandler(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	unlocked, err := UnlockLogin(ipLockKey(ip))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "unlock_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ip": ip, "unlocked": unlocked})
+}
+
+// ListLockoutsHandler возвращает действующие блокировки входа.
+func ListLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := ListLoginLockouts()
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "lockouts_fetch_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lockouts)
+}
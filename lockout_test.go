@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.LoginLockoutBase = 30 * time.Second
+	config.LoginLockoutMax = time.Hour
+
+	cases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{4, 0},
+		{5, 30 * time.Second},
+		{6, time.Minute},
+		{8, 4 * time.Minute},
+		{12, time.Hour}, // 30с * 2^7 = 64 минуты, ограничено максимумом
+		{1000, time.Hour},
+	}
+	for _, c := range cases {
+		if got := lockoutDuration(c.failures, 5); got != c.want {
+			t.Errorf("%d failures: got %v, want %v", c.failures, got, c.want)
+		}
+	}
+	if got := lockoutDuration(100, 0); got != 0 {
+		t.Errorf("Zero threshold should disable lockout, got %v", got)
+	}
+}
+
+func TestUsernameLockKeyIgnoresCase(t *testing.T) {
+	if usernameLockKey("Ivan") != usernameLockKey("ivan") {
+		t.Error("Lockout key must not depend on username case")
+	}
+}
+
+func TestStepUpCodeLockout(t *testing.T) {
+	requireDB(t)
+	saved := config
+	defer func() { config = saved }()
+	config.StepUpThreshold = 5
+	config.LoginMaxFailures = 3
+	config.LoginIPMaxFailures = 0
+	config.LoginLockoutBase = time.Minute
+
+	DisableTOTP(GetUser("step_up_lockout").ID)
+	token := getTokenForUser(t, "step_up_lockout")
+	getTokenForUser(t, "step_up_lockout_to")
+	user := GetUser("step_up_lockout")
+	defer DisableTOTP(user.ID)
+	defer UnlockLogin(usernameLockKey(user.Username))
+
+	enrollment, err := EnrollTOTP(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := base32NoPadding.DecodeString(enrollment.Secret)
+	recoveryCodes, err := ConfirmTOTP(user.ID, totpCode(secret, time.Now().Unix()/totpPeriod))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newRouter()
+	send := func(otp string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(SendCoinRequest{ToUser: "step_up_lockout_to", Amount: config.StepUpThreshold + 1})
+		req := httptest.NewRequest("POST", "/api/sendCoin", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("X-OTP", otp)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Неудача с номером LoginMaxFailures включает блокировку
+	for i := 1; i <= config.LoginMaxFailures; i++ {
+		if rr := send("bad-code"); rr.Code != http.StatusForbidden {
+			t.Fatalf("Wrong code #%d: expected 403, got %d: %s", i, rr.Code, rr.Body)
+		}
+	}
+
+	// Теперь отклоняется даже верный код, а счётчик общий со входом
+	rr := send(recoveryCodes[0])
+	var resp ErrorResponse
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if rr.Code != http.StatusTooManyRequests || len(resp.Errors) != 1 || resp.Errors[0].Code != CodeLoginLocked {
+		t.Fatalf("Expected 429 %s after %d wrong codes, got %d: %s", CodeLoginLocked, config.LoginMaxFailures, rr.Code, rr.Body)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After on a locked step-up")
+	}
+	if wait, err := loginLockedFor(user.Username, ""); err != nil || wait <= 0 {
+		t.Errorf("Expected the login to be locked as well, got %v, %v", wait, err)
+	}
+}
+
+// newAuthInstance - отдельный экземпляр приложения: свой роутер и свой лимитер
+// запросов в памяти, общая только база
+func newAuthInstance() http.Handler {
+	rateLimiter = NewMemoryRateLimiter()
+	return newRouter()
+}
+
+func TestLoginLockoutThroughAuth(t *testing.T) {
+	requireDB(t)
+	saved, savedLimiter := config, rateLimiter
+	defer func() { config, rateLimiter = saved, savedLimiter }()
+	config.AutoRegister = false // иначе /api/auth зарегистрирует несуществующее имя
+	config.LoginMaxFailures = 3
+	config.LoginIPMaxFailures = 0
+	config.LoginLockoutBase = time.Minute
+
+	name := uniqueUsername("lockout")
+	if _, err := CreateUser(name, "right-password"); err != nil {
+		t.Fatal(err)
+	}
+	ghost := uniqueUsername("lockout_ghost")
+	defer UnlockLogin(usernameLockKey(name))
+	defer UnlockLogin(usernameLockKey(ghost))
+
+	auth := func(h http.Handler, username, password, ip string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(AuthRequest{Username: username, Password: password})
+		req := httptest.NewRequest("POST", "/api/auth", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = ip + ":1234"
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+	same := func(a, b *httptest.ResponseRecorder) bool {
+		return a.Code == b.Code && a.Body.String() == b.Body.String()
+	}
+
+	// Неудачи с разных адресов и в разном регистре имени копятся в одном счётчике.
+	// Ответы для существующего и несуществующего имени совпадают.
+	first := newAuthInstance()
+	spellings := []string{strings.ToUpper(name), name, strings.ToUpper(name[:1]) + name[1:]}
+	for i := 0; i < config.LoginMaxFailures; i++ {
+		ip := fmt.Sprintf("198.51.100.%d", i+1)
+		rr := auth(first, spellings[i%len(spellings)], "wrong-password", ip)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("Wrong password #%d: expected 401, got %d: %s", i+1, rr.Code, rr.Body)
+		}
+		if other := auth(first, ghost, "wrong-password", ip); !same(rr, other) {
+			t.Errorf("Unknown username is distinguishable: %d %s vs %d %s", rr.Code, rr.Body, other.Code, other.Body)
+		}
+	}
+
+	// Второй экземпляр видит блокировку через общую таблицу login_attempts
+	second := newAuthInstance()
+	locked := auth(second, name, "right-password", "203.0.113.7")
+	if locked.Code != http.StatusTooManyRequests || locked.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected 429 with Retry-After on another instance, got %d: %s", locked.Code, locked.Body)
+	}
+
+	// Во время блокировки не видно ни верности пароля, ни существования имени
+	if wrong := auth(second, strings.ToUpper(name), "wrong-password", "203.0.113.8"); !same(locked, wrong) {
+		t.Errorf("Locked responses differ by password: %d %s vs %d %s", locked.Code, locked.Body, wrong.Code, wrong.Body)
+	}
+	if other := auth(second, ghost, "wrong-password", "203.0.113.9"); !same(locked, other) {
+		t.Errorf("Locked responses differ by username: %d %s vs %d %s", locked.Code, locked.Body, other.Code, other.Body)
+	}
+
+	// Снятие блокировки по имени в любом регистре возвращает вход
+	if unlocked, err := UnlockLogin(usernameLockKey(strings.ToUpper(name))); err != nil || !unlocked {
+		t.Fatalf("Expected the lockout to be removed, got %v, %v", unlocked, err)
+	}
+	if rr := auth(second, name, "right-password", "203.0.113.7"); rr.Code != http.StatusOK {
+		t.Errorf("Expected 200 after unlock, got %d: %s", rr.Code, rr.Body)
+	}
+}
@@ -0,0 +1,288 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: merch/v1/merch.proto
+
+// Сервис магазина мерча: основные операции HTTP API поверх gRPC.
+// Токен передаётся в метаданных authorization: "Bearer <токен>", код 2FA - в x-otp,
+// язык сообщений об ошибках - в accept-language. Код ошибки API приходит
+// в google.rpc.ErrorInfo.reason, поле запроса с ошибкой - в metadata["field"].
+
+package merchv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	MerchStore_Auth_FullMethodName        = "/merch.v1.MerchStore/Auth"
+	MerchStore_GetInfo_FullMethodName     = "/merch.v1.MerchStore/GetInfo"
+	MerchStore_SendCoin_FullMethodName    = "/merch.v1.MerchStore/SendCoin"
+	MerchStore_BuyItem_FullMethodName     = "/merch.v1.MerchStore/BuyItem"
+	MerchStore_ListCatalog_FullMethodName = "/merch.v1.MerchStore/ListCatalog"
+)
+
+// MerchStoreClient is the client API for MerchStore service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MerchStoreClient interface {
+	// Пара токенов по имени и паролю, как /api/auth (с AUTO_REGISTER - и регистрация)
+	Auth(ctx context.Context, in *AuthRequest, opts ...grpc.CallOption) (*AuthResponse, error)
+	// Баланс, инвентарь и история переводов
+	GetInfo(ctx context.Context, in *GetInfoRequest, opts ...grpc.CallOption) (*GetInfoResponse, error)
+	// Перевод монет; дороже STEP_UP_THRESHOLD нужен x-otp
+	SendCoin(ctx context.Context, in *SendCoinRequest, opts ...grpc.CallOption) (*SendCoinResponse, error)
+	// Покупка товара; дороже STEP_UP_THRESHOLD нужен x-otp
+	BuyItem(ctx context.Context, in *BuyItemRequest, opts ...grpc.CallOption) (*BuyItemResponse, error)
+	// Ассортимент магазина
+	ListCatalog(ctx context.Context, in *ListCatalogRequest, opts ...grpc.CallOption) (*ListCatalogResponse, error)
+}
+
+type merchStoreClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMerchStoreClient(cc grpc.ClientConnInterface) MerchStoreClient {
+	return &merchStoreClient{cc}
+}
+
+func (c *merchStoreClient) Auth(ctx context.Context, in *AuthRequest, opts ...grpc.CallOption) (*AuthResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AuthResponse)
+	err := c.cc.Invoke(ctx, MerchStore_Auth_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *merchStoreClient) GetInfo(ctx context.Context, in *GetInfoRequest, opts ...grpc.CallOption) (*GetInfoResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetInfoResponse)
+	err := c.cc.Invoke(ctx, MerchStore_GetInfo_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *merchStoreClient) SendCoin(ctx context.Context, in *SendCoinRequest, opts ...grpc.CallOption) (*SendCoinResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SendCoinResponse)
+	err := c.cc.Invoke(ctx, MerchStore_SendCoin_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *merchStoreClient) BuyItem(ctx context.Context, in *BuyItemRequest, opts ...grpc.CallOption) (*BuyItemResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(BuyItemResponse)
+	err := c.cc.Invoke(ctx, MerchStore_BuyItem_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *merchStoreClient) ListCatalog(ctx context.Context, in *ListCatalogRequest, opts ...grpc.CallOption) (*ListCatalogResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListCatalogResponse)
+	err := c.cc.Invoke(ctx, MerchStore_ListCatalog_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MerchStoreServer is the server API for MerchStore service.
+// All implementations must embed UnimplementedMerchStoreServer
+// for forward compatibility.
+type MerchStoreServer interface {
+	// Пара токенов по имени и паролю, как /api/auth (с AUTO_REGISTER - и регистрация)
+	Auth(context.Context, *AuthRequest) (*AuthResponse, error)
+	// Баланс, инвентарь и история переводов
+	GetInfo(context.Context, *GetInfoRequest) (*GetInfoResponse, error)
+	// Перевод монет; дороже STEP_UP_THRESHOLD нужен x-otp
+	SendCoin(context.Context, *SendCoinRequest) (*SendCoinResponse, error)
+	// Покупка товара; дороже STEP_UP_THRESHOLD нужен x-otp
+	BuyItem(context.Context, *BuyItemRequest) (*BuyItemResponse, error)
+	// Ассортимент магазина
+	ListCatalog(context.Context, *ListCatalogRequest) (*ListCatalogResponse, error)
+	mustEmbedUnimplementedMerchStoreServer()
+}
+
+// UnimplementedMerchStoreServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedMerchStoreServer struct{}
+
+func (UnimplementedMerchStoreServer) Auth(context.Context, *AuthRequest) (*AuthResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Auth not implemented")
+}
+func (UnimplementedMerchStoreServer) GetInfo(context.Context, *GetInfoRequest) (*GetInfoResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetInfo not implemented")
+}
+func (UnimplementedMerchStoreServer) SendCoin(context.Context, *SendCoinRequest) (*SendCoinResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendCoin not implemented")
+}
+func (UnimplementedMerchStoreServer) BuyItem(context.Context, *BuyItemRequest) (*BuyItemResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BuyItem not implemented")
+}
+func (UnimplementedMerchStoreServer) ListCatalog(context.Context, *ListCatalogRequest) (*ListCatalogResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListCatalog not implemented")
+}
+func (UnimplementedMerchStoreServer) mustEmbedUnimplementedMerchStoreServer() {}
+func (UnimplementedMerchStoreServer) testEmbeddedByValue()                    {}
+
+// UnsafeMerchStoreServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MerchStoreServer will
+// result in compilation errors.
+type UnsafeMerchStoreServer interface {
+	mustEmbedUnimplementedMerchStoreServer()
+}
+
+func RegisterMerchStoreServer(s grpc.ServiceRegistrar, srv MerchStoreServer) {
+	// If the following call pancis, it indicates UnimplementedMerchStoreServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&MerchStore_ServiceDesc, srv)
+}
+
+func _MerchStore_Auth_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MerchStoreServer).Auth(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MerchStore_Auth_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MerchStoreServer).Auth(ctx, req.(*AuthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MerchStore_GetInfo_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetInfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MerchStoreServer).GetInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MerchStore_GetInfo_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MerchStoreServer).GetInfo(ctx, req.(*GetInfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MerchStore_SendCoin_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendCoinRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MerchStoreServer).SendCoin(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MerchStore_SendCoin_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MerchStoreServer).SendCoin(ctx, req.(*SendCoinRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MerchStore_BuyItem_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BuyItemRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MerchStoreServer).BuyItem(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MerchStore_BuyItem_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MerchStoreServer).BuyItem(ctx, req.(*BuyItemRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MerchStore_ListCatalog_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListCatalogRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MerchStoreServer).ListCatalog(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MerchStore_ListCatalog_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MerchStoreServer).ListCatalog(ctx, req.(*ListCatalogRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// MerchStore_ServiceDesc is the grpc.ServiceDesc for MerchStore service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var MerchStore_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "merch.v1.MerchStore",
+	HandlerType: (*MerchStoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Auth",
+			Handler:    _MerchStore_Auth_Handler,
+		},
+		{
+			MethodName: "GetInfo",
+			Handler:    _MerchStore_GetInfo_Handler,
+		},
+		{
+			MethodName: "SendCoin",
+			Handler:    _MerchStore_SendCoin_Handler,
+		},
+		{
+			MethodName: "BuyItem",
+			Handler:    _MerchStore_BuyItem_Handler,
+		},
+		{
+			MethodName: "ListCatalog",
+			Handler:    _MerchStore_ListCatalog_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "merch/v1/merch.proto",
+}
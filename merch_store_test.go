@@ -2,14 +2,73 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
-	"github.com/gorilla/mux"
+	"time"
 )
 
+// dbAvailable - удалось ли подключиться к базе; без неё интеграционные тесты пропускаются
+var dbAvailable bool
+
+func TestMain(m *testing.M) {
+	db, _ = sql.Open("postgres", config.DatabaseURL)
+	if err := db.Ping(); err != nil {
+		// Без базы работают только модульные тесты; токены для них подписывает ключ в памяти
+		log.Printf("База данных недоступна, интеграционные тесты пропускаются: %v", err)
+		if err := useEphemeralSigningKey(); err != nil {
+			log.Fatalf("Ошибка создания ключа подписи: %v", err)
+		}
+		os.Exit(m.Run())
+	}
+	dbAvailable = true
+	// С базой ошибка загрузки ключей - настоящая поломка, а не повод пропустить тесты
+	if err := keyManager.Init(); err != nil {
+		log.Fatalf("Ошибка инициализации ключей подписи: %v", err)
+	}
+	os.Exit(m.Run())
+}
+
+// useEphemeralSigningKey делает активным ключ подписи, который живёт только в памяти
+func useEphemeralSigningKey() error {
+	if config.JWTAlg == "HS256" {
+		return nil
+	}
+	signer, err := generateSigningKey(config.JWTAlg)
+	if err != nil {
+		return err
+	}
+	key := &SigningKey{Kid: "ephemeral", Alg: config.JWTAlg, Private: signer, Public: signer.Public(), CreatedAt: time.Now()}
+	keyManager.mu.Lock()
+	keyManager.keys, keyManager.active = map[string]*SigningKey{key.Kid: key}, key
+	keyManager.mu.Unlock()
+	return nil
+}
+
+// requireDB пропускает тест, которому нужна база
+func requireDB(t *testing.T) {
+	t.Helper()
+	if !dbAvailable {
+		t.Skip("нужна база данных")
+	}
+}
+
+// GetUser возвращает пользователя из базы для проверки баланса в тестах
+func GetUser(username string) *User {
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return &User{}
+	}
+	return user
+}
+
 func getTokenForUser(t *testing.T, username string) string {
+	requireDB(t)
 	// Создаем запрос для авторизации
 	body := map[string]string{"username": username}
 	bodyBytes, _ := json.Marshal(body)
@@ -35,20 +94,13 @@ func getTokenForUser(t *testing.T, username string) string {
 }
 
 func TestBuyMerch(t *testing.T) {
-	// Инициализация маршрутизатора
-	r := mux.NewRouter()
-	r.HandleFunc("/auth", AuthHandler).Methods("POST")
-	api := r.PathPrefix("/me").Subrouter()
-	api.Use(JWTMiddleware)
-	api.HandleFunc("/buy", BuyMerchHandler).Methods("POST")
+	r := newRouter()
 
 	// Авторизуем пользователя
 	token := getTokenForUser(t, "test_user_buy")
 
 	// Покупка существующего товара
-	body := map[string]string{"item": "t-shirt"}
-	bodyBytes, _ := json.Marshal(body)
-	req, err := http.NewRequest("POST", "/me/buy", bytes.NewBuffer(bodyBytes))
+	req, err := http.NewRequest("GET", "/api/buy/t-shirt", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -61,11 +113,7 @@ func TestBuyMerch(t *testing.T) {
 }
 
 func TestTransferCoins(t *testing.T) {
-	r := mux.NewRouter()
-	r.HandleFunc("/auth", AuthHandler).Methods("POST")
-	api := r.PathPrefix("/me").Subrouter()
-	api.Use(JWTMiddleware)
-	api.HandleFunc("/transfer", TransferHandler).Methods("POST")
+	r := newRouter()
 
 	// Авторизуем отправителя
 	senderToken := getTokenForUser(t, "sender")
@@ -73,11 +121,7 @@ func TestTransferCoins(t *testing.T) {
 	_ = getTokenForUser(t, "recipient")
 
 	// Перевод монеток
-	body := map[string]interface{}{
-		"to":    "recipient",
-		"coins": 100,
-	}
-	bodyBytes, _ := json.Marshal(body)
+	bodyBytes, _ := json.Marshal(SendCoinRequest{ToUser: "recipient", Amount: 100})
 	req, err := http.NewRequest("POST", "/me/transfer", bytes.NewBuffer(bodyBytes))
 	if err != nil {
 		t.Fatal(err)
@@ -102,3 +146,34 @@ func TestTransferCoins(t *testing.T) {
 	}
 }
 
+
+func TestBuyMerchWithStaleBalance(t *testing.T) {
+	getTokenForUser(t, "test_user_stale_buy")
+	item, err := GetMerchandiseByName("pen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE users SET coins = $1 WHERE username = $2`, 2*item.Price, "test_user_stale_buy"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Две копии пользователя, прочитанные до покупок, как в параллельных запросах
+	first, second := GetUser("test_user_stale_buy"), GetUser("test_user_stale_buy")
+	if err := first.BuyMerch(item); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.BuyMerch(item); err != nil {
+		t.Fatal(err)
+	}
+	if second.Coins != 0 || GetUser("test_user_stale_buy").Coins != 0 {
+		t.Errorf("Expected both purchases to be charged, got %d in memory and %d stored", second.Coins, GetUser("test_user_stale_buy").Coins)
+	}
+
+	// Устаревший баланс не позволяет купить в долг
+	if err := first.BuyMerch(item); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("Expected ErrInsufficientFunds, got %v", err)
+	}
+	if got := GetUser("test_user_stale_buy").Coins; got != 0 {
+		t.Errorf("Balance went to %d", got)
+	}
+}
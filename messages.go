@@ -0,0 +1,320 @@
+package main
+
+// Каталоги сообщений API. Ключи во всех каталогах должны совпадать,
+// это проверяет TestCatalogsComplete.
+var catalogs = map[string]map[string]string{
+	"ru": {
+		// Ошибки
+		"bad_request":                      "Неверный запрос",
+		"user_not_found":                   "Пользователь не найден",
+		"recipient_not_found":              "Получатель не найден",
+		"item_not_found":                   "Товар не найден",
+		"insufficient_funds":               "Недостаточно монет",
+		"insufficient_funds_transfer":      "Недостаточно монет для перевода",
+		"insufficient_funds_purchase":      "Недостаточно монет для покупки",
+		"memo_too_long":                    "Пояснение к переводу не длиннее %d символов",
+		"unknown_category":                 "Неизвестная категория",
+		"invalid_username":                 "Имя пользователя должно быть длиной 3-32 символа из латиницы, цифр и знаков _ . - и начинаться с буквы или цифры",
+		"username_reserved":                "Имя пользователя зарезервировано",
+		"username_taken":                   "Имя пользователя уже занято",
+		"password_too_short":               "Пароль должен быть не короче %d символов",
+		"invalid_credentials":              "Неверное имя пользователя или пароль",
+		"account_deactivated":              "Аккаунт деактивирован",
+		"invite_required":                  "Регистрация только по приглашению",
+		"invite_invalid":                   "Приглашение недействительно",
+		"invite_not_found":                 "Приглашение не найдено",
+		"password_login_disabled":          "Вход по паролю отключён, используйте /api/oidc/login",
+		"login_locked":                     "Слишком много неудачных попыток входа, повторите позже",
+		"rate_limited":                     "Слишком много запросов, повторите позже",
+		"token_missing":                    "Нет токена",
+		"token_malformed":                  "Неверный формат токена",
+		"token_invalid":                    "Неверный токен",
+		"token_revoked":                    "Токен отозван",
+		"token_not_found":                  "Токен не найден",
+		"token_scope_denied":               "Недостаточно прав у токена",
+		"token_create_failed":              "Не удалось создать токен",
+		"token_refresh_failed":             "Не удалось обновить токен",
+		"refresh_token_invalid":            "Refresh-токен недействителен",
+		"username_missing":                 "Не удалось извлечь имя пользователя",
+		"forbidden":                        "Доступ запрещён",
+		"unknown_role":                     "Неизвестная роль",
+		"role_not_assigned":                "Роль не назначена",
+		"unknown_status":                   "Неизвестный статус",
+		"unknown_scope":                    "Неизвестное право: %s",
+		"api_token_fields_required":        "Укажите название и хотя бы одно право",
+		"finding_not_found":                "Находка не найдена",
+		"schedule_not_found":               "Расписание не найдено",
+		"schedule_not_found_or_same_state": "Расписание не найдено или уже в этом состоянии",
+		"invalid_schedule":                 "Неверное расписание",
+		"schedule_kind_required":           "Нужно указать либо runAt, либо cron",
+		"run_at_in_past":                   "Время перевода должно быть в будущем",
+		"batch_form_conflict":              "Нужно указать либо transfers, либо toUsers с amount",
+		"batch_size":                       "Количество получателей должно быть от 1 до %d",
+		"batch_invalid_entry":              "Неверный получатель или сумма",
+		"batch_duplicate_recipient":        "Получатель указан повторно",
+		"batch_total_too_large":            "Сумма пакетного перевода слишком большая",
+		"self_transfer":                    "Нельзя перевести монеты самому себе",
+		"recipient_inactive":               "Получатель деактивирован и не может принимать монеты",
+		"account_frozen":                   "Аккаунт заморожен до проверки",
+		"account_too_new":                  "Аккаунт слишком новый для отправки монет",
+		"max_per_transfer_exceeded":        "Превышена максимальная сумма одного перевода",
+		"hourly_transfer_count_exceeded":   "Превышено количество переводов в час",
+		"daily_limit_exceeded":             "Превышен дневной лимит переводов",
+		"weekly_limit_exceeded":            "Превышен недельный лимит переводов",
+		"delete_confirm_required":          "Подтвердите удаление, указав имя пользователя в поле confirm",
+		"otp_required":                     "Введите код из приложения-аутентификатора (поле otp)",
+		"otp_invalid":                      "Неверный код подтверждения",
+		"otp_header_required":              "Передайте код подтверждения в заголовке X-OTP",
+		"step_up_required":                 "Для операций дороже %d монет передайте код в заголовке X-OTP",
+		"totp_already_enabled":             "Двухфакторная аутентификация уже включена",
+		"totp_not_enabled":                 "Двухфакторная аутентификация не включена",
+		"totp_enroll_first":                "Сначала вызовите /api/2fa/enroll",
+		"sso_not_configured":               "Вход через SSO не настроен",
+		"sso_denied":                       "Провайдер SSO отклонил вход: %s",
+		"sso_unavailable":                  "Провайдер SSO недоступен",
+		"sso_state_invalid":                "Неверный или устаревший state",
+		"sso_verify_failed":                "Не удалось подтвердить вход через SSO",
+		"sso_login_failed":                 "Ошибка при входе через SSO",
+		"key_rotation_unsupported":         "Ротация недоступна для HS256",
+		"route_not_found":                  "Маршрут %s не найден",
+		"method_not_allowed":               "Метод %s не поддерживается",
+		"language_unsupported":             "Неподдерживаемый язык",
+		"request_body_required":            "Нужно тело запроса в формате JSON",
+		"request_too_large":                "Слишком большое тело запроса",
+		"schema_required":                  "Обязательное поле",
+		"schema_type":                      "Ожидается значение типа %s",
+		"schema_enum":                      "Допустимые значения: %s",
+		"schema_minimum":                   "Значение должно быть не меньше %s",
+		"schema_maximum":                   "Значение должно быть не больше %s",
+		"schema_min_length":                "Не короче %d символов",
+		"schema_max_length":                "Не длиннее %d символов",
+		"schema_min_items":                 "Нужно не меньше %d элементов",
+		"schema_max_items":                 "Допускается не больше %d элементов",
+		"schema_pattern":                   "Значение не соответствует формату",
+		"schema_format":                    "Ожидается значение в формате %s",
+		"query_too_complex":                "Запрос слишком сложный: оценка %d при пределе %d",
+		"query_too_deep":                   "Слишком глубокая вложенность запроса: %d при пределе %d",
+		"limit_out_of_range":               "limit должен быть от 1 до %d",
+		"invalid_event_id":                 "Неверный id события",
+		"streaming_unsupported":            "Сервер не поддерживает потоковые ответы",
+		"webhook_not_found":                "Подписка на вебхуки не найдена",
+		"webhook_delivery_not_found":       "Доставка не найдена или не в состоянии dead",
+		"invalid_webhook_url":              "Адрес вебхука должен быть абсолютным http(s) URL",
+		"webhook_events_required":          "Укажите хотя бы один тип события",
+		"unknown_webhook_event":            "Неизвестный тип события: %s",
+		"webhook_secret_too_short":         "Секрет подписи должен быть не короче %d символов",
+		"unknown_delivery_status":          "Неизвестное состояние доставки: %s",
+		"idempotency_key_invalid":          "Idempotency-Key должен быть не длиннее %d символов",
+		"idempotency_key_reused":           "Idempotency-Key уже использован для другого запроса",
+		"idempotency_in_progress":          "Запрос с этим Idempotency-Key ещё выполняется",
+		"internal_error":                   "Внутренняя ошибка сервера",
+		"login_failed":                     "Ошибка при входе",
+		"logout_failed":                    "Ошибка при выходе",
+		"user_create_failed":               "Ошибка при создании пользователя",
+		"user_fetch_failed":                "Ошибка при получении пользователя",
+		"recipients_fetch_failed":          "Ошибка при получении получателей",
+		"incoming_fetch_failed":            "Ошибка при получении входящих переводов",
+		"incoming_scan_failed":             "Ошибка при сканировании входящих переводов",
+		"outgoing_fetch_failed":            "Ошибка при получении исходящих переводов",
+		"outgoing_scan_failed":             "Ошибка при сканировании исходящих переводов",
+		"limits_fetch_failed":              "Ошибка при получении лимитов",
+		"limits_update_failed":             "Ошибка при изменении лимитов",
+		"limits_not_found":                 "Лимиты на этом уровне не заданы",
+		"invalid_limit":                    "Лимит не может быть отрицательным",
+		"merch_update_failed":              "Ошибка при изменении товара",
+		"account_delete_failed":            "Ошибка при удалении аккаунта",
+		"account_deactivate_failed":        "Ошибка при деактивации",
+		"account_update_failed":            "Ошибка при изменении аккаунта",
+		"export_failed":                    "Ошибка при выгрузке данных",
+		"unlock_failed":                    "Ошибка при снятии блокировки",
+		"lockouts_fetch_failed":            "Ошибка при получении блокировок",
+		"report_failed":                    "Ошибка при формировании отчёта",
+		"api_token_create_failed":          "Ошибка при создании токена",
+		"api_tokens_fetch_failed":          "Ошибка при получении токенов",
+		"invite_create_failed":             "Ошибка при создании приглашения",
+		"invites_fetch_failed":             "Ошибка при получении приглашений",
+		"recovery_codes_failed":            "Ошибка при создании кодов",
+		"key_rotation_failed":              "Ошибка при ротации ключа",
+		"status_fetch_failed":              "Ошибка при получении статуса",
+		"sessions_fetch_failed":            "Ошибка при получении сессий",
+		"roles_fetch_failed":               "Ошибка при получении ролей",
+		"role_update_failed":               "Ошибка при изменении роли",
+		"audit_fetch_failed":               "Ошибка при получении журнала",
+		"schedules_fetch_failed":           "Ошибка при получении расписаний",
+		"totp_enroll_failed":               "Ошибка при подключении",
+		"totp_disable_failed":              "Ошибка при отключении",
+
+		// Статусы выполненных операций
+		"transfer_done": "Перевод выполнен",
+		"purchase_done": "Покупка совершена",
+
+		// Названия товаров; товары без перевода показываются под своим именем
+		"item.t-shirt":    "Футболка",
+		"item.cup":        "Кружка",
+		"item.book":       "Книга",
+		"item.pen":        "Ручка",
+		"item.powerbank":  "Пауэрбанк",
+		"item.hoody":      "Худи",
+		"item.umbrella":   "Зонт",
+		"item.socks":      "Носки",
+		"item.wallet":     "Кошелёк",
+		"item.pink-hoody": "Розовое худи",
+	},
+	"en": {
+		// Ошибки
+		"bad_request":                      "Invalid request",
+		"user_not_found":                   "User not found",
+		"recipient_not_found":              "Recipient not found",
+		"item_not_found":                   "Item not found",
+		"insufficient_funds":               "Not enough coins",
+		"insufficient_funds_transfer":      "Not enough coins for the transfer",
+		"insufficient_funds_purchase":      "Not enough coins for the purchase",
+		"memo_too_long":                    "Transfer memo must be at most %d characters",
+		"unknown_category":                 "Unknown category",
+		"invalid_username":                 "Username must be 3-32 characters of Latin letters, digits and _ . - and start with a letter or digit",
+		"username_reserved":                "This username is reserved",
+		"username_taken":                   "Username is already taken",
+		"password_too_short":               "Password must be at least %d characters",
+		"invalid_credentials":              "Invalid username or password",
+		"account_deactivated":              "Account is deactivated",
+		"invite_required":                  "Registration is by invitation only",
+		"invite_invalid":                   "Invitation is invalid",
+		"invite_not_found":                 "Invitation not found",
+		"password_login_disabled":          "Password login is disabled, use /api/oidc/login",
+		"login_locked":                     "Too many failed login attempts, try again later",
+		"rate_limited":                     "Too many requests, try again later",
+		"token_missing":                    "Missing token",
+		"token_malformed":                  "Malformed token",
+		"token_invalid":                    "Invalid token",
+		"token_revoked":                    "Token has been revoked",
+		"token_not_found":                  "Token not found",
+		"token_scope_denied":               "Token lacks the required scope",
+		"token_create_failed":              "Failed to create token",
+		"token_refresh_failed":             "Failed to refresh token",
+		"refresh_token_invalid":            "Refresh token is invalid",
+		"username_missing":                 "Could not determine the user",
+		"forbidden":                        "Access denied",
+		"unknown_role":                     "Unknown role",
+		"role_not_assigned":                "Role is not assigned",
+		"unknown_status":                   "Unknown status",
+		"unknown_scope":                    "Unknown scope: %s",
+		"api_token_fields_required":        "Provide a name and at least one scope",
+		"finding_not_found":                "Finding not found",
+		"schedule_not_found":               "Schedule not found",
+		"schedule_not_found_or_same_state": "Schedule not found or already in this state",
+		"invalid_schedule":                 "Invalid schedule",
+		"schedule_kind_required":           "Specify either runAt or cron",
+		"run_at_in_past":                   "Transfer time must be in the future",
+		"batch_form_conflict":              "Specify either transfers or toUsers with amount",
+		"batch_size":                       "Number of recipients must be between 1 and %d",
+		"batch_invalid_entry":              "Invalid recipient or amount",
+		"batch_duplicate_recipient":        "Recipient is listed more than once",
+		"batch_total_too_large":            "Batch transfer total is too large",
+		"self_transfer":                    "You cannot send coins to yourself",
+		"recipient_inactive":               "Recipient is deactivated and cannot receive coins",
+		"account_frozen":                   "Account is frozen pending review",
+		"account_too_new":                  "Account is too new to send coins",
+		"max_per_transfer_exceeded":        "Maximum amount per transfer exceeded",
+		"hourly_transfer_count_exceeded":   "Hourly transfer count exceeded",
+		"daily_limit_exceeded":             "Daily transfer limit exceeded",
+		"weekly_limit_exceeded":            "Weekly transfer limit exceeded",
+		"delete_confirm_required":          "Confirm deletion by passing your username in the confirm field",
+		"otp_required":                     "Enter the code from your authenticator app (otp field)",
+		"otp_invalid":                      "Invalid verification code",
+		"otp_header_required":              "Pass a verification code in the X-OTP header",
+		"step_up_required":                 "Operations above %d coins require a code in the X-OTP header",
+		"totp_already_enabled":             "Two-factor authentication is already enabled",
+		"totp_not_enabled":                 "Two-factor authentication is not enabled",
+		"totp_enroll_first":                "Call /api/2fa/enroll first",
+		"sso_not_configured":               "SSO login is not configured",
+		"sso_denied":                       "SSO provider denied the login: %s",
+		"sso_unavailable":                  "SSO provider is unavailable",
+		"sso_state_invalid":                "Invalid or expired state",
+		"sso_verify_failed":                "Could not verify the SSO login",
+		"sso_login_failed":                 "SSO login failed",
+		"key_rotation_unsupported":         "Key rotation is not available for HS256",
+		"route_not_found":                  "Route %s not found",
+		"method_not_allowed":               "Method %s is not allowed",
+		"language_unsupported":             "Unsupported language",
+		"request_body_required":            "A JSON request body is required",
+		"request_too_large":                "Request body is too large",
+		"schema_required":                  "Field is required",
+		"schema_type":                      "Expected a value of type %s",
+		"schema_enum":                      "Allowed values: %s",
+		"schema_minimum":                   "Value must be at least %s",
+		"schema_maximum":                   "Value must be at most %s",
+		"schema_min_length":                "Must be at least %d characters long",
+		"schema_max_length":                "Must be at most %d characters long",
+		"schema_min_items":                 "At least %d items are required",
+		"schema_max_items":                 "At most %d items are allowed",
+		"schema_pattern":                   "Value does not match the expected format",
+		"schema_format":                    "Expected a value in %s format",
+		"query_too_complex":                "Query is too complex: cost %d exceeds the limit of %d",
+		"query_too_deep":                   "Query is nested too deeply: %d exceeds the limit of %d",
+		"limit_out_of_range":               "limit must be between 1 and %d",
+		"invalid_event_id":                 "Invalid event id",
+		"streaming_unsupported":            "Streaming responses are not supported",
+		"webhook_not_found":                "Webhook subscription not found",
+		"webhook_delivery_not_found":       "Delivery not found or not in the dead state",
+		"invalid_webhook_url":              "Webhook URL must be an absolute http(s) URL",
+		"webhook_events_required":          "Specify at least one event type",
+		"unknown_webhook_event":            "Unknown event type: %s",
+		"webhook_secret_too_short":         "Signing secret must be at least %d characters long",
+		"unknown_delivery_status":          "Unknown delivery status: %s",
+		"idempotency_key_invalid":          "Idempotency-Key must be at most %d characters long",
+		"idempotency_key_reused":           "Idempotency-Key was already used for a different request",
+		"idempotency_in_progress":          "A request with this Idempotency-Key is still in progress",
+		"internal_error":                   "Internal server error",
+		"login_failed":                     "Login failed",
+		"logout_failed":                    "Logout failed",
+		"user_create_failed":               "Failed to create user",
+		"user_fetch_failed":                "Failed to load user",
+		"recipients_fetch_failed":          "Failed to load recipients",
+		"incoming_fetch_failed":            "Failed to load incoming transfers",
+		"incoming_scan_failed":             "Failed to read incoming transfers",
+		"outgoing_fetch_failed":            "Failed to load outgoing transfers",
+		"outgoing_scan_failed":             "Failed to read outgoing transfers",
+		"limits_fetch_failed":              "Failed to load limits",
+		"limits_update_failed":             "Failed to update limits",
+		"limits_not_found":                 "No limits are set at this level",
+		"invalid_limit":                    "Limit cannot be negative",
+		"merch_update_failed":              "Failed to update item",
+		"account_delete_failed":            "Failed to delete account",
+		"account_deactivate_failed":        "Failed to deactivate account",
+		"account_update_failed":            "Failed to update account",
+		"export_failed":                    "Failed to export data",
+		"unlock_failed":                    "Failed to remove lockout",
+		"lockouts_fetch_failed":            "Failed to load lockouts",
+		"report_failed":                    "Failed to build report",
+		"api_token_create_failed":          "Failed to create token",
+		"api_tokens_fetch_failed":          "Failed to load tokens",
+		"invite_create_failed":             "Failed to create invitation",
+		"invites_fetch_failed":             "Failed to load invitations",
+		"recovery_codes_failed":            "Failed to create codes",
+		"key_rotation_failed":              "Failed to rotate key",
+		"status_fetch_failed":              "Failed to load status",
+		"sessions_fetch_failed":            "Failed to load sessions",
+		"roles_fetch_failed":               "Failed to load roles",
+		"role_update_failed":               "Failed to update role",
+		"audit_fetch_failed":               "Failed to load audit log",
+		"schedules_fetch_failed":           "Failed to load schedules",
+		"totp_enroll_failed":               "Failed to enroll",
+		"totp_disable_failed":              "Failed to disable",
+
+		// Статусы выполненных операций
+		"transfer_done": "Transfer completed",
+		"purchase_done": "Purchase completed",
+
+		// Названия товаров; товары без перевода показываются под своим именем
+		"item.t-shirt":    "T-shirt",
+		"item.cup":        "Cup",
+		"item.book":       "Book",
+		"item.pen":        "Pen",
+		"item.powerbank":  "Power bank",
+		"item.hoody":      "Hoodie",
+		"item.umbrella":   "Umbrella",
+		"item.socks":      "Socks",
+		"item.wallet":     "Wallet",
+		"item.pink-hoody": "Pink hoodie",
+	},
+}
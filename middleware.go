@@ -5,37 +5,64 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/golang-jwt/jwt"
+	"github.com/gorilla/mux"
 )
 
-// JWTMiddleware проверяет валидность JWT токена
+// JWTMiddleware проверяет валидность JWT токена или персонального токена
 func JWTMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Нет токена", http.StatusUnauthorized)
+		claims, apiErr := authenticateBearer(r.Header.Get("Authorization"))
+		if apiErr != nil {
+			writeErrors(w, r, apiErr.Status, apiErr)
 			return
 		}
-		parts := strings.Split(authHeader, "Bearer ")
-		if len(parts) != 2 {
-			http.Error(w, "Неверный формат токена", http.StatusUnauthorized)
-			return
-		}
-		tokenStr := parts[1]
-
-		claims := &Claims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
-			return jwtKey, nil
-		})
-
-		if err != nil || !token.Valid {
-			http.Error(w, "Неверный токен", http.StatusUnauthorized)
-			return
+		if claims.APITokenID != 0 {
+			// Персональный токен: доступ только к маршрутам из его прав
+			tmpl := ""
+			if route := mux.CurrentRoute(r); route != nil {
+				tmpl, _ = route.GetPathTemplate()
+			}
+			if !apiTokenAllows(claims, r.Method, tmpl) {
+				writeError(w, r, http.StatusForbidden, CodeForbidden, "token_scope_denied")
+				return
+			}
 		}
 
-		// Добавляем username в контекст запроса
+		// Добавляем username и claims в контекст запроса
 		ctx := context.WithValue(r.Context(), "username", claims.Username)
+		ctx = context.WithValue(ctx, "claims", claims)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// authenticateBearer проверяет значение "Bearer <токен>" из заголовка Authorization
+// или метаданных gRPC. Права персонального токена проверяет вызывающий.
+func authenticateBearer(authHeader string) (*Claims, *APIError) {
+	if authHeader == "" {
+		return nil, &APIError{Status: http.StatusUnauthorized, Code: CodeUnauthorized, Key: "token_missing"}
+	}
+	parts := strings.Split(authHeader, "Bearer ")
+	if len(parts) != 2 {
+		return nil, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Key: "token_malformed"}
+	}
+	tokenStr := parts[1]
+
+	if strings.HasPrefix(tokenStr, apiTokenPrefix) {
+		claims, err := AuthenticateAPIToken(tokenStr)
+		if err != nil {
+			return nil, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Key: "token_invalid"}
+		}
+		return claims, nil
+	}
+
+	claims := &Claims{}
+	// Ключ выбирается по kid, алгоритм токена должен совпадать с алгоритмом ключа
+	token, err := keyManager.ParseToken(tokenStr, claims)
+	if err != nil || !token.Valid {
+		return nil, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Key: "token_invalid"}
+	}
+	if revocations.IsRevoked(claims) {
+		return nil, &APIError{Status: http.StatusUnauthorized, Code: CodeInvalidToken, Key: "token_revoked"}
+	}
+	return claims, nil
+}
@@ -2,64 +2,112 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 	//"log"
+
+	"github.com/lib/pq"
+
+	"app/apitypes"
 )
 
-// AuthRequest - структура запроса для аутентификации
-type AuthRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-}
+// Структуры запросов и ответов API описаны в пакете apitypes, чтобы их
+// использовал и клиент app/client
+type (
+	AuthRequest          = apitypes.AuthRequest
+	AuthResponse         = apitypes.AuthResponse
+	RefreshRequest       = apitypes.RefreshRequest
+	InventoryItem        = apitypes.InventoryItem
+	SendCoinRequest      = apitypes.SendCoinRequest
+	TransferMeta         = apitypes.TransferMeta
+	CoinHistory          = apitypes.CoinHistory
+	ReceivedTransferInfo = apitypes.ReceivedTransferInfo
+	SentTransferInfo     = apitypes.SentTransferInfo
+	TransferInfo         = apitypes.TransferInfo
+	InfoResponse         = apitypes.InfoResponse
+	TransactionHistory   = apitypes.TransactionHistory
+	StatusResponse       = apitypes.StatusResponse
+	PurchaseResponse     = apitypes.PurchaseResponse
+)
 
-// AuthResponse - структура ответа на аутентификацию
-type AuthResponse struct {
-	Token string `json:"token"`
-}
+// Категории переводов
+const (
+	CategoryThanks        = "thanks"
+	CategoryBet           = "bet"
+	CategoryReimbursement = "reimbursement"
+	CategoryGift          = "gift"
+)
 
-// InventoryItem - структура для элемента инвентаря
-type InventoryItem struct {
-	Type     string `json:"type"`     // Тип предмета (например, "t-shirt")
-	Quantity int    `json:"quantity"` // Количество предметов
-}
+// MaxMemoLength - максимальная длина пояснения к переводу в символах
+const MaxMemoLength = 200
 
-// SendCoinRequest - структура для запроса перевода монет
-type SendCoinRequest struct {
-    ToUser string `json:"toUser"` // Имя получателя монет
-    Amount int    `json:"amount"` // Количество монет
+// IsValidCategory проверяет, что категория пустая или входит в список известных
+func IsValidCategory(category string) bool {
+	switch category {
+	case "", CategoryThanks, CategoryBet, CategoryReimbursement, CategoryGift:
+		return true
+	}
+	return false
 }
 
+// normalizeTransferMeta очищает пояснение от управляющих и невидимых символов,
+// схлопывает пробелы и проверяет длину и категорию.
+func normalizeTransferMeta(m TransferMeta) (TransferMeta, error) {
+	cleaned := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, m.Memo)
+	m.Memo = strings.Join(strings.Fields(cleaned), " ")
+	if utf8.RuneCountInString(m.Memo) > MaxMemoLength {
+		return m, &FieldError{Field: "memo", Err: fmt.Errorf("%w: не больше %d символов", ErrMemoTooLong, MaxMemoLength)}
+	}
+	m.Category = strings.ToLower(strings.TrimSpace(m.Category))
+	if !IsValidCategory(m.Category) {
+		return m, &FieldError{Field: "category", Err: fmt.Errorf("%w %q", ErrUnknownCategory, m.Category)}
+	}
+	return m, nil
+}
 
-// CoinHistory - структура для истории монет
-type CoinHistory struct {
-    Received []ReceivedTransferInfo `json:"received"` // Переводы монет, полученных пользователем
-    Sent     []SentTransferInfo     `json:"sent"`     // Переводы монет, отправленных пользователем
+// nullIfEmpty сохраняет пустую строку в базе как NULL
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
 }
 
-// ReceivedTransferInfo - структура для информации о полученных монетах
-type ReceivedTransferInfo struct {
-    FromUser string `json:"fromUser"` // Имя пользователя, который отправил монеты
-    Amount   int    `json:"amount"`   // Количество полученных монет
+// pgInterval передаёт длительность в запрос как значение для $n::INTERVAL
+func pgInterval(d time.Duration) string {
+	return fmt.Sprintf("%d seconds", int64(d/time.Second))
 }
 
-// SentTransferInfo - структура для информации о отправленных монетах
-type SentTransferInfo struct {
-    ToUser string `json:"toUser"`   // Имя пользователя, которому отправлены монеты
-    Amount int    `json:"amount"`   // Количество отправленных монет
+// BatchSendCoinRequest - запрос на перевод монет нескольким получателям.
+// Можно перечислить переводы в Transfers или указать одну сумму Amount для всех ToUsers.
+type BatchSendCoinRequest struct {
+	Transfers []SendCoinRequest `json:"transfers,omitempty"` // Получатели с индивидуальными суммами
+	ToUsers   []string          `json:"toUsers,omitempty"`   // Получатели одной и той же суммы
+	Amount    int               `json:"amount,omitempty"`    // Сумма для каждого из ToUsers
+	TransferMeta                                          // Пояснение для каждого из ToUsers
 }
 
-// TransferInfo - структура для информации о переводе монет
-type TransferInfo struct {
-        FromUser string `json:"fromUser"` // Имя пользователя, который отправил монеты
-        ToUser   string `json:"toUser"`   // Имя пользователя, которому отправлены монеты
-        Amount   int    `json:"amount"`   // Количество переведенных монет
+// BatchTransferResult - результат перевода одному получателю из пакета
+type BatchTransferResult struct {
+	ToUser string `json:"toUser"`
+	Amount int    `json:"amount"`
+	Status string `json:"status"` // "ok"; ошибки по получателям возвращаются в конверте errors
 }
 
-// InfoResponse - структура для ответа на запрос информации о монетах и инвентаре
-type InfoResponse struct {
-	Coins      int            `json:"coins"`      // Количество монет у пользователя
-	Inventory  []InventoryItem `json:"inventory"`  // Инвентарь пользователя
-	CoinHistory CoinHistory   `json:"coinHistory"` // История монет
+// BatchSendCoinResponse - ответ на пакетный перевод
+type BatchSendCoinResponse struct {
+	Total   int                   `json:"total"` // Сумма всех переводов
+	Results []BatchTransferResult `json:"results"`
 }
 
 // Merchandise - структура для товара
@@ -81,68 +129,199 @@ type User struct {
 }
 
 // TransferCoins - метод для перевода монет от одного пользователя другому
-func (u *User) TransferCoins(recipient *User, coins int) error {
+func (u *User) TransferCoins(recipient *User, coins int, meta TransferMeta) error {
+    if recipient.ID == u.ID {
+        return ErrSelfTransfer
+    }
     if u.Coins < coins {
-        return fmt.Errorf("недостаточно монет для перевода")
+        return fmt.Errorf("%w для перевода", ErrInsufficientFunds)
     }
-    u.Coins -= coins
-    recipient.Coins += coins
-    // Обновляем данные пользователей в базе данных
-    _, err := db.Exec(`
-        UPDATE users SET coins = $1 WHERE id = $2
-    `, u.Coins, u.ID)
-    if err != nil {
-        return fmt.Errorf("ошибка при обновлении монет отправителя в базе данных: %v", err)
-    }    
 
-    _, err = db.Exec(`
-        UPDATE users SET coins = $1 WHERE id = $2
-    `, recipient.Coins, recipient.ID)
+    tx, err := db.Begin()
     if err != nil {
-        return fmt.Errorf("ошибка при обновлении монет получателя в базе данных: %v", err)
+        return fmt.Errorf("ошибка при начале транзакции: %w", err)
     }
+    defer tx.Rollback()
 
-    // Добавляем запись о транзакции в историю
-    _, err = db.Exec(`
-        INSERT INTO transactions (sender_id, receiver_id, amount) 
-        VALUES ($1, $2, $3)
-    `, u.ID, recipient.ID, coins)
-    if err != nil {
-        return fmt.Errorf("ошибка при записи транзакции в базу данных: %v", err)
+    if err := transferCoinsTx(tx, u.ID, recipient.ID, coins, meta); err != nil {
+        return err
     }
 
+    if err := tx.Commit(); err != nil {
+        return fmt.Errorf("ошибка при коммите транзакции: %w", err)
+    }
+
+    u.Coins -= coins
+    recipient.Coins += coins
     return nil
 }
 
+// transferCoinsTx переводит монеты внутри переданной транзакции.
+// Баланс проверяется и списывается одним UPDATE, поэтому параллельные переводы
+// не могут увести его в минус. Используется обработчиками и планировщиком.
+func transferCoinsTx(tx *sql.Tx, senderID, recipientID, coins int, meta TransferMeta) error {
+	// Блокируем обе строки в порядке id, чтобы встречные переводы не взаимоблокировались
+	if _, err := tx.Exec(`
+		SELECT id FROM users WHERE id IN ($1, $2) ORDER BY id FOR UPDATE
+	`, senderID, recipientID); err != nil {
+		return fmt.Errorf("ошибка при блокировке пользователей: %w", err)
+	}
+
+	if err := checkNotFrozen(tx, senderID); err != nil {
+		return err
+	}
+	if err := checkAccountsActive(tx, senderID, recipientID); err != nil {
+		return err
+	}
+	// Лимиты проверяем после блокировки, чтобы учесть уже выполненные переводы
+	if err := checkTransferPolicy(tx, senderID, coins); err != nil {
+		return err
+	}
+
+	sender := EventParty{ID: senderID}
+	err := tx.QueryRow(`
+		UPDATE users SET coins = coins - $1 WHERE id = $2 AND coins >= $1
+		RETURNING username, coins
+	`, coins, senderID).Scan(&sender.Username, &sender.Balance)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w для перевода", ErrInsufficientFunds)
+	}
+	if err != nil {
+		return fmt.Errorf("ошибка при обновлении монет отправителя в базе данных: %w", err)
+	}
+
+	recipient := EventParty{ID: recipientID}
+	err = tx.QueryRow(`
+		UPDATE users SET coins = coins + $1 WHERE id = $2
+		RETURNING username, coins
+	`, coins, recipientID).Scan(&recipient.Username, &recipient.Balance)
+	if err != nil {
+		return fmt.Errorf("ошибка при обновлении монет получателя в базе данных: %w", err)
+	}
+
+	// Добавляем запись о транзакции в историю
+	var transactionID int
+	err = tx.QueryRow(`
+		INSERT INTO transactions (sender_id, receiver_id, amount, memo, category)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, senderID, recipientID, coins, nullIfEmpty(meta.Memo), nullIfEmpty(meta.Category)).Scan(&transactionID)
+	if err != nil {
+		return fmt.Errorf("ошибка при записи транзакции в базу данных: %w", err)
+	}
+
+	// События уходят подписчикам /api/events только после коммита
+	if err := publishTransferEvents(tx, transactionID, sender, recipient, coins, meta); err != nil {
+		return err
+	}
+	transfer := TransferCompletedEvent{
+		TransferID: transactionID, FromUser: sender.Username, ToUser: recipient.Username, Amount: coins, TransferMeta: meta,
+	}
+	// Антифрод и вебхуки получают перевод после коммита по доменному событию, см. FraudSink и WebhookSink
+	return recordDomainEvent(tx, DomainCoinsTransferred, AggregateTransfer, transactionID, transfer)
+}
+
+// TransferCoinsBatch переводит монеты нескольким получателям в одной транзакции:
+// либо выполняются все переводы, либо ни одного.
+func (u *User) TransferCoinsBatch(recipients []*User, transfers []SendCoinRequest) error {
+	total, err := batchTotal(transfers)
+	if err != nil {
+		return err
+	}
+	if u.Coins < total {
+		return fmt.Errorf("%w для перевода", ErrInsufficientFunds)
+	}
+	ids := []int64{int64(u.ID)}
+	for _, recipient := range recipients {
+		if recipient.ID == u.ID {
+			return fmt.Errorf("%s: %w", recipient.Username, ErrSelfTransfer)
+		}
+		ids = append(ids, int64(recipient.ID))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("ошибка при начале транзакции: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Блокируем отправителя и всех получателей сразу в порядке id: иначе пакеты
+	// со встречными получателями брали бы блокировки в разном порядке
+	if _, err := tx.Exec(`
+		SELECT id FROM users WHERE id = ANY($1) ORDER BY id FOR UPDATE
+	`, pq.Array(ids)); err != nil {
+		return fmt.Errorf("ошибка при блокировке пользователей: %w", err)
+	}
+
+	for i, recipient := range recipients {
+		if err := transferCoinsTx(tx, u.ID, recipient.ID, transfers[i].Amount, transfers[i].TransferMeta); err != nil {
+			return fmt.Errorf("%s: %w", recipient.Username, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("ошибка при коммите транзакции: %w", err)
+	}
+
+	u.Coins -= total
+	for i, recipient := range recipients {
+		recipient.Coins += transfers[i].Amount
+	}
+	return nil
+}
+
+// batchTotal - сумма пакетного перевода; она не должна выходить за INTEGER баланса
+func batchTotal(transfers []SendCoinRequest) (int, error) {
+	total := 0
+	for _, t := range transfers {
+		if t.Amount < 0 || t.Amount > math.MaxInt32-total {
+			return 0, ErrBatchTotalTooLarge
+		}
+		total += t.Amount
+	}
+	return total, nil
+}
+
 // BuyMerch - метод для покупки товара пользователем
 func (u *User) BuyMerch(item *Merchandise) error {
     if u.Coins < item.Price {
-        return fmt.Errorf("недостаточно монет для покупки")
+        return fmt.Errorf("%w для покупки", ErrInsufficientFunds)
     }
 
     // Начинаем транзакцию
     tx, err := db.Begin()
     if err != nil {
-        return fmt.Errorf("ошибка при начале транзакции: %v", err)
+        return fmt.Errorf("ошибка при начале транзакции: %w", err)
     }
 
     // Откатываем транзакцию в случае ошибки
     defer tx.Rollback()
 
-    // Сначала обновляем количество монет пользователя в базе данных
-    _, err = tx.Exec(`
-        UPDATE users SET coins = $1 WHERE id = $2
-    `, u.Coins-item.Price, u.ID)
+    if err := checkNotFrozen(tx, u.ID); err != nil {
+        return err
+    }
+
+    // Списываем монеты одним UPDATE с проверкой баланса: u.Coins мог устареть,
+    // и параллельные покупки не должны увести баланс в минус
+    var balance int
+    err = tx.QueryRow(`
+        UPDATE users SET coins = coins - $1 WHERE id = $2 AND coins >= $1
+        RETURNING coins
+    `, item.Price, u.ID).Scan(&balance)
+    if err == sql.ErrNoRows {
+        return fmt.Errorf("%w для покупки", ErrInsufficientFunds)
+    }
     if err != nil {
-        return fmt.Errorf("ошибка при обновлении монет в базе данных: %v", err)
+        return fmt.Errorf("ошибка при обновлении монет в базе данных: %w", err)
     }
 
     // Добавляем товар в список покупок пользователя
-    _, err = tx.Exec(`
-        INSERT INTO purchases (user_id, merchandise_id) VALUES ($1, $2)
-    `, u.ID, item.ID)
+    var purchaseID int
+    err = tx.QueryRow(`
+        INSERT INTO purchases (user_id, merchandise_id) VALUES ($1, $2) RETURNING id
+    `, u.ID, item.ID).Scan(&purchaseID)
     if err != nil {
-        return fmt.Errorf("ошибка при записи покупки в базе данных: %v", err)
+        return fmt.Errorf("ошибка при записи покупки в базе данных: %w", err)
     }
 
     // Обновляем количество товара в инвентаре пользователя (если он уже есть)
@@ -153,42 +332,107 @@ func (u *User) BuyMerch(item *Merchandise) error {
         DO UPDATE SET quantity = user_inventory.quantity + 1
     `, u.ID, item.ID)
     if err != nil {
-        return fmt.Errorf("ошибка при обновлении количества товара в инвентаре: %v", err)
+        return fmt.Errorf("ошибка при обновлении количества товара в инвентаре: %w", err)
+    }
+
+    // События покупки и нового баланса для /api/events
+    if err := publishPurchaseEvents(tx, u.ID, item, balance); err != nil {
+        return err
+    }
+    if err := recordDomainEvent(tx, DomainMerchPurchased, AggregatePurchase, purchaseID, MerchPurchasedEvent{
+        UserID: u.ID, Username: u.Username, Item: item.Name, Price: item.Price, Balance: balance,
+    }); err != nil {
+        return err
     }
 
     // Если все прошло успешно, коммитим транзакцию
     err = tx.Commit()
     if err != nil {
-        return fmt.Errorf("ошибка при коммите транзакции: %v", err)
+        return fmt.Errorf("ошибка при коммите транзакции: %w", err)
     }
 
     // Обновляем информацию в памяти (если нужно)
-    u.Coins -= item.Price
+    u.Coins = balance
     u.PurchasedMerch = append(u.PurchasedMerch, *item)
 
     return nil
 }
 
 
+// Ошибки переводов и покупок. Статус и код ответа для них задаёт apiErrorCodes.
+var (
+	ErrUserNotFound       = errors.New("пользователь не найден")
+	ErrRecipientNotFound  = errors.New("получатель не найден")
+	ErrItemNotFound       = errors.New("товар не найден")
+	ErrInsufficientFunds  = errors.New("недостаточно монет")
+	ErrMemoTooLong        = errors.New("пояснение слишком длинное")
+	ErrUnknownCategory    = errors.New("неизвестная категория")
+	ErrSelfTransfer       = errors.New("нельзя перевести монеты самому себе")
+	ErrBatchTotalTooLarge = errors.New("сумма пакетного перевода слишком большая")
+)
+
+// GetUserByUsername ищет пользователя без учёта регистра имени, как вход и регистрация
 func GetUserByUsername(username string) (*User, error) {
 	var user User
-	err := db.QueryRow("SELECT id, username, coins FROM users WHERE username = $1", username).Scan(&user.ID, &user.Username, &user.Coins)
+	err := db.QueryRow("SELECT id, username, coins FROM users WHERE LOWER(username) = LOWER($1)", username).Scan(&user.ID, &user.Username, &user.Coins)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("пользователь не найден")
+			return nil, ErrUserNotFound
 		}
 		return nil, err
 	}
 	return &user, nil
 }
 
+// GetUsersByUsernames загружает пользователей одним запросом без учёта регистра.
+// Результат индексирован по имени в нижнем регистре; отсутствующих пользователей в нём нет.
+func GetUsersByUsernames(usernames []string) (map[string]*User, error) {
+	lower := make([]string, len(usernames))
+	for i, name := range usernames {
+		lower[i] = strings.ToLower(name)
+	}
+	rows, err := db.Query("SELECT id, username, coins FROM users WHERE LOWER(username) = ANY($1)", pq.Array(lower))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[string]*User, len(usernames))
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.Coins); err != nil {
+			return nil, err
+		}
+		users[strings.ToLower(user.Username)] = &user
+	}
+	return users, rows.Err()
+}
+
 func CreateUser(username, password string) (*User, error) {
-	// Генерация хеша пароля должна быть сделана безопасно
-	// Для примера, не будем добавлять хеширование
-	_, err := db.Exec("INSERT INTO users (username, password_hash, coins) VALUES ($1, $2, $3)", username, password, 1000)
+	hash, err := HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.Begin()
 	if err != nil {
 		return nil, err
 	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow("INSERT INTO users (username, password_hash, coins) VALUES ($1, $2, $3) RETURNING id", username, hash, 1000).Scan(&userID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return nil, ErrUsernameTaken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := userCreated(tx, userID, username); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
 	return GetUserByUsername(username)
 }
 
@@ -197,8 +441,60 @@ func GetMerchandiseByName(name string) (*Merchandise, error) {
 	err := db.QueryRow("SELECT id, name, price FROM merchandise WHERE name = $1", name).Scan(&item.ID, &item.Name, &item.Price)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("товар не найден")
+			return nil, ErrItemNotFound
+		}
+		return nil, err
+	}
+	return &item, nil
+}
+
+// ListMerchandise возвращает ассортимент магазина от дешёвых товаров к дорогим
+func ListMerchandise() ([]Merchandise, error) {
+	rows, err := db.Query("SELECT id, name, price FROM merchandise ORDER BY price, name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := make([]Merchandise, 0)
+	for rows.Next() {
+		var item Merchandise
+		if err := rows.Scan(&item.ID, &item.Name, &item.Price); err != nil {
+			return nil, err
 		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+// SetMerchandisePrice задаёт цену товара, добавляя его в ассортимент, если его ещё нет
+func SetMerchandisePrice(actor, name string, price int) (*Merchandise, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var oldPrice sql.NullInt64
+	err = tx.QueryRow(`SELECT price FROM merchandise WHERE name = $1 FOR UPDATE`, name).Scan(&oldPrice)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	item := Merchandise{Name: name, Price: price}
+	err = tx.QueryRow(`
+		INSERT INTO merchandise (name, price) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET price = EXCLUDED.price
+		RETURNING id
+	`, name, price).Scan(&item.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordDomainEvent(tx, DomainPriceChanged, AggregateMerchandise, item.ID, PriceChangedEvent{
+		Item: name, OldPrice: nullIntPtr(oldPrice), NewPrice: price, ChangedBy: actor,
+	}); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
 	return &item, nil
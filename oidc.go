@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// OIDCProvider - провайдер OpenID Connect (корпоративный SSO).
+// Метаданные и ключи загружаются лениво и кэшируются.
+type OIDCProvider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	HTTPClient   *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCIdentity - данные о пользователе из проверенного ID-токена
+type OIDCIdentity struct {
+	Subject           string
+	PreferredUsername string
+	Email             string
+}
+
+// oidcClaims - поля ID-токена, которые нам нужны
+type oidcClaims struct {
+	Nonce             string      `json:"nonce"`
+	PreferredUsername string      `json:"preferred_username"`
+	Email             string      `json:"email"`
+	Audience          interface{} `json:"aud"` // Строка или массив строк
+	jwt.StandardClaims
+}
+
+var ErrOIDCNotConfigured = errors.New("вход через SSO не настроен")
+
+// oidcProvider - провайдер из конфигурации; nil, если SSO выключен
+var oidcProvider = newOIDCProviderFromConfig()
+
+func newOIDCProviderFromConfig() *OIDCProvider {
+	if config.OIDCIssuer == "" {
+		return nil
+	}
+	return &OIDCProvider{
+		Issuer:       config.OIDCIssuer,
+		ClientID:     config.OIDCClientID,
+		ClientSecret: config.OIDCClientSecret,
+		RedirectURL:  config.OIDCRedirectURL,
+		Scopes:       []string{"openid", "profile", "email"},
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *OIDCProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.HTTPClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: статус %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// metadata загружает /.well-known/openid-configuration провайдера
+func (p *OIDCProvider) metadata() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := p.getJSON(strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.Issuer {
+		return nil, fmt.Errorf("issuer провайдера %q не совпадает с настроенным %q", d.Issuer, p.Issuer)
+	}
+	p.discovery = &d
+	return &d, nil
+}
+
+// publicKey возвращает ключ провайдера по kid, перечитывая JWKS при незнакомом kid
+func (p *OIDCProvider) publicKey(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key := p.keys[kid]
+	p.mu.Unlock()
+	if key != nil {
+		return key, nil
+	}
+
+	d, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+		e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	if keys[kid] == nil {
+		return nil, fmt.Errorf("неизвестный kid %q", kid)
+	}
+	return keys[kid], nil
+}
+
+// pkceChallenge - code_challenge для метода S256
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL строит адрес страницы входа провайдера
+func (p *OIDCProvider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	d, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange меняет код авторизации на ID-токен и проверяет его
+func (p *OIDCProvider) Exchange(code, verifier, nonce string) (*OIDCIdentity, error) {
+	d, err := p.metadata()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"client_id":     {p.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("обмен кода: статус %d", resp.StatusCode)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("провайдер не вернул id_token")
+	}
+	return p.VerifyIDToken(tokens.IDToken, nonce)
+}
+
+// VerifyIDToken проверяет подпись, издателя, аудиторию, срок и nonce ID-токена
+func (p *OIDCProvider) VerifyIDToken(idToken, nonce string) (*OIDCIdentity, error) {
+	claims := &oidcClaims{}
+	parser := &jwt.Parser{ValidMethods: []string{"RS256"}}
+	_, err := parser.ParseWithClaims(idToken, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.publicKey(kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ID-токен недействителен: %v", err)
+	}
+	if claims.Issuer != p.Issuer {
+		return nil, fmt.Errorf("ID-токен выдан другим издателем %q", claims.Issuer)
+	}
+	if !audienceContains(claims.Audience, p.ClientID) {
+		return nil, fmt.Errorf("ID-токен выдан не для этого клиента")
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("у ID-токена нет срока действия")
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("nonce ID-токена не совпадает")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("в ID-токене нет sub")
+	}
+	return &OIDCIdentity{Subject: claims.Subject, PreferredUsername: claims.PreferredUsername, Email: claims.Email}, nil
+}
+
+func audienceContains(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// saveOIDCState запоминает параметры входа до возврата пользователя от провайдера.
+// Состояние хранится в базе, чтобы колбэк мог прийти на другой экземпляр.
+func saveOIDCState(state, nonce, verifier string) error {
+	_, err := db.Exec(`
+		INSERT INTO oidc_login_states (state, nonce, code_verifier) VALUES ($1, $2, $3)
+	`, state, nonce, verifier)
+	return err
+}
+
+// takeOIDCState одноразово извлекает параметры входа; устаревшие не принимаются
+func takeOIDCState(state string) (nonce, verifier string, err error) {
+	err = db.QueryRow(`
+		DELETE FROM oidc_login_states
+		WHERE state = $1 AND created_at > now() - INTERVAL '10 minutes'
+		RETURNING nonce, code_verifier
+	`, state).Scan(&nonce, &verifier)
+	return nonce, verifier, err
+}
+
+var usernameUnsafeChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]+`)
+
+// oidcUsernameCandidate делает из preferred_username допустимое имя пользователя
+func oidcUsernameCandidate(identity *OIDCIdentity) string {
+	name := identity.PreferredUsername
+	if name == "" {
+		name = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+	name = usernameUnsafeChars.ReplaceAllString(name, "-")
+	name = strings.Trim(name, "-_.")
+	if len(name) > 28 {
+		name = name[:28]
+	}
+	if ValidateUsername(name) != nil {
+		name = "sso-user"
+	}
+	return name
+}
+
+// FindOrCreateOIDCUser находит пользователя по (issuer, sub) или создаёт его при первом входе.
+// Пароль такому пользователю не задаётся: вход только через SSO.
+func FindOrCreateOIDCUser(issuer string, identity *OIDCIdentity) (*User, error) {
+	var username string
+	err := db.QueryRow(`
+		SELECT u.username FROM user_identities i JOIN users u ON u.id = i.user_id
+		WHERE i.issuer = $1 AND i.subject = $2
+	`, issuer, identity.Subject).Scan(&username)
+	if err == nil {
+		return GetUserByUsername(username)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	base := oidcUsernameCandidate(identity)
+	for attempt := 1; attempt <= 20; attempt++ {
+		candidate := base
+		if attempt > 1 || reservedUsernames[strings.ToLower(base)] {
+			candidate = fmt.Sprintf("%s-%d", base, attempt)
+		}
+		user, err := createOIDCUser(issuer, identity.Subject, candidate)
+		if errors.Is(err, ErrUsernameTaken) {
+			continue
+		}
+		return user, err
+	}
+	return nil, ErrUsernameTaken
+}
+
+func createOIDCUser(issuer, subject, username string) (*User, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(username) = LOWER($1))`, username).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, ErrUsernameTaken
+	}
+	var userID int
+	err = tx.QueryRow(`
+		INSERT INTO users (username, password_hash, coins) VALUES ($1, $2, $3) RETURNING id
+	`, username, noPasswordHash, 1000).Scan(&userID)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO user_identities (issuer, subject, user_id) VALUES ($1, $2, $3)
+	`, issuer, subject, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := userCreated(tx, userID, username); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetUserByUsername(username)
+}
+
+// OIDCLoginHandler перенаправляет пользователя на страницу входа провайдера
+// (authorization code flow с PKCE).
+func OIDCLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "sso_not_configured")
+		return
+	}
+
+	state, err1 := randomToken(24)
+	nonce, err2 := randomToken(24)
+	verifier, err3 := randomToken(48)
+	if err1 != nil || err2 != nil || err3 != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "sso_login_failed")
+		return
+	}
+	if err := saveOIDCState(state, nonce, verifier); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "sso_login_failed")
+		return
+	}
+	authURL, err := oidcProvider.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		log.Printf("OIDC: %v", err)
+		writeError(w, r, http.StatusBadGateway, CodeUpstream, "sso_unavailable")
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallbackHandler принимает код от провайдера и выдаёт токены магазина,
+// как AuthHandler.
+func OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "sso_not_configured")
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("error") != "" {
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "sso_denied", q.Get("error"))
+		return
+	}
+
+	nonce, verifier, err := takeOIDCState(q.Get("state"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "sso_state_invalid")
+		return
+	}
+
+	identity, err := oidcProvider.Exchange(q.Get("code"), verifier, nonce)
+	if err != nil {
+		log.Printf("OIDC: %v", err)
+		writeError(w, r, http.StatusUnauthorized, CodeUnauthorized, "sso_verify_failed")
+		return
+	}
+
+	user, err := FindOrCreateOIDCUser(oidcProvider.Issuer, identity)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "user_create_failed")
+		return
+	}
+	if inactive, err := isDeactivated(user.ID); err != nil || inactive {
+		writeError(w, r, http.StatusForbidden, CodeAccountDeactivated, "account_deactivated")
+		return
+	}
+
+	writeToken(w, r, user, http.StatusOK)
+}
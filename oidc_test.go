@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// mockOIDCProvider - локальный провайдер OIDC для тестов: выдаёт код сразу,
+// без страницы входа, и проверяет PKCE при обмене кода
+type mockOIDCProvider struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	subject  string
+	username string
+
+	mu    sync.Mutex
+	codes map[string]url.Values // код -> параметры запроса авторизации
+}
+
+func newMockOIDCProvider(t *testing.T, clientID string) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{key: key, clientID: clientID, codes: map[string]url.Values{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]JWK{"keys": {{
+			Kty: "RSA", Kid: "mock", Use: "sig", Alg: "RS256",
+			N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code, _ := randomToken(16)
+		p.mu.Lock()
+		p.codes[code] = q
+		p.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		auth, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		p.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || auth.Get("code_challenge") != base64.RawURLEncoding.EncodeToString(sum[:]) {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		idToken := p.idToken(t, auth.Get("nonce"), clientID, time.Hour)
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *mockOIDCProvider) idToken(t *testing.T, nonce, audience string, ttl time.Duration) string {
+	claims := oidcClaims{
+		Nonce:             nonce,
+		PreferredUsername: p.username,
+		Audience:          audience,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    p.URL,
+			Subject:   p.subject,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(ttl).Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "mock"
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (p *mockOIDCProvider) client(redirectURL string) *OIDCProvider {
+	return &OIDCProvider{
+		Issuer:      p.URL,
+		ClientID:    p.clientID,
+		RedirectURL: redirectURL,
+		Scopes:      []string{"openid", "profile"},
+		HTTPClient:  p.Server.Client(),
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	mock := newMockOIDCProvider(t, "merch-shop")
+	mock.subject, mock.username = "sub-1", "ivan.petrov"
+	provider := mock.client("http://shop/api/oidc/callback")
+
+	identity, err := provider.VerifyIDToken(mock.idToken(t, "n1", "merch-shop", time.Hour), "n1")
+	if err != nil {
+		t.Fatalf("Valid ID token rejected: %v", err)
+	}
+	if identity.Subject != "sub-1" || identity.PreferredUsername != "ivan.petrov" {
+		t.Fatalf("Unexpected identity: %+v", identity)
+	}
+
+	invalid := map[string]string{
+		"wrong nonce":    mock.idToken(t, "other", "merch-shop", time.Hour),
+		"wrong audience": mock.idToken(t, "n1", "other-client", time.Hour),
+		"expired":        mock.idToken(t, "n1", "merch-shop", -time.Minute),
+	}
+	stranger := newMockOIDCProvider(t, "merch-shop")
+	stranger.subject = "sub-1"
+	invalid["foreign issuer"] = stranger.idToken(t, "n1", "merch-shop", time.Hour)
+	for name, token := range invalid {
+		if _, err := provider.VerifyIDToken(token, "n1"); err == nil {
+			t.Errorf("%s: ID token accepted", name)
+		}
+	}
+}
+
+func TestOIDCUsernameCandidate(t *testing.T) {
+	cases := map[OIDCIdentity]string{
+		{PreferredUsername: "ivan.petrov"}:        "ivan.petrov",
+		{PreferredUsername: "Иван Петров"}:        "sso-user",
+		{PreferredUsername: "ivan petrov"}:        "ivan-petrov",
+		{Email: "maria@example.com"}:              "maria",
+		{PreferredUsername: "ab"}:                 "sso-user",
+		{PreferredUsername: "x@corp.example.com"}: "x-corp.example.com",
+	}
+	for identity, want := range cases {
+		identity := identity
+		if got := oidcUsernameCandidate(&identity); got != want {
+			t.Errorf("%+v: got %q, want %q", identity, got, want)
+		}
+	}
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	requireDB(t)
+	mock := newMockOIDCProvider(t, "merch-shop")
+	mock.subject, mock.username = "oidc-flow-subject", "oidc_flow_user"
+
+	saved := oidcProvider
+	oidcProvider = mock.client("http://shop.test/api/oidc/callback")
+	defer func() { oidcProvider = saved }()
+
+	login := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		OIDCLoginHandler(rr, httptest.NewRequest("GET", "/api/oidc/login", nil))
+		if rr.Code != http.StatusFound {
+			t.Fatalf("Expected redirect to provider, got %d", rr.Code)
+		}
+		noRedirect := mock.Server.Client()
+		noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		resp, err := noRedirect.Get(rr.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		callback, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr = httptest.NewRecorder()
+		OIDCCallbackHandler(rr, httptest.NewRequest("GET", "/api/oidc/callback?"+callback.RawQuery, nil))
+		return rr
+	}
+
+	rr := login()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp AuthResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil || resp.Token == "" {
+		t.Fatalf("Token not returned: %v", err)
+	}
+	claims := &Claims{}
+	if _, err := keyManager.ParseToken(resp.Token, claims); err != nil {
+		t.Fatalf("Shop token invalid: %v", err)
+	}
+
+	// Повторный вход находит того же пользователя по sub, даже если имя у провайдера сменилось
+	mock.username = "renamed_user"
+	rr = login()
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 on second login, got %d", rr.Code)
+	}
+	second := &Claims{}
+	json.NewDecoder(rr.Body).Decode(&resp)
+	keyManager.ParseToken(resp.Token, second)
+	if second.Username != claims.Username {
+		t.Fatalf("Second login mapped to %q, want %q", second.Username, claims.Username)
+	}
+
+	// Пароль у пользователя SSO не задан, войти по паролю нельзя
+	if _, err := AuthenticateUser(claims.Username, noPasswordHash); err == nil {
+		t.Fatal("Password login succeeded for SSO user")
+	}
+
+	// Неизвестный или уже использованный state не принимается
+	rr = httptest.NewRecorder()
+	OIDCCallbackHandler(rr, httptest.NewRequest("GET", "/api/oidc/callback?code=x&state=unknown", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for unknown state, got %d", rr.Code)
+	}
+}
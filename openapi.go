@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// openAPISpec - контракт API. Каждый маршрут из newRouter должен быть описан
+// в нём, это проверяет TestOpenAPICoversRoutes.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// maxValidatedBody - наибольшее тело запроса, которое проверяется по схеме
+const maxValidatedBody = 1 << 20
+
+// OpenAPISchema - подмножество JSON Schema, которое проверяет ValidateRequestMiddleware:
+// type, required, properties, items, enum, minimum/maximum, длины строк и массивов,
+// pattern и format date-time. Остальные ключевые слова только документируют API.
+type OpenAPISchema struct {
+	Ref        string                    `json:"$ref"`
+	Type       string                    `json:"type"`
+	Format     string                    `json:"format"`
+	Nullable   bool                      `json:"nullable"`
+	Required   []string                  `json:"required"`
+	Properties map[string]*OpenAPISchema `json:"properties"`
+	Items      *OpenAPISchema            `json:"items"`
+	Enum       []interface{}             `json:"enum"`
+	Minimum    *float64                  `json:"minimum"`
+	Maximum    *float64                  `json:"maximum"`
+	MinLength  *int                      `json:"minLength"`
+	MaxLength  *int                      `json:"maxLength"`
+	MinItems   *int                      `json:"minItems"`
+	MaxItems   *int                      `json:"maxItems"`
+	Pattern    string                    `json:"pattern"`
+}
+
+// OpenAPIParameter - параметр пути, строки запроса или заголовка
+type OpenAPIParameter struct {
+	Ref      string         `json:"$ref"`
+	Name     string         `json:"name"`
+	In       string         `json:"in"`
+	Required bool           `json:"required"`
+	Schema   *OpenAPISchema `json:"schema"`
+}
+
+// OpenAPIOperation - описание одного метода маршрута
+type OpenAPIOperation struct {
+	OperationID string              `json:"operationId"`
+	Parameters  []*OpenAPIParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *OpenAPISchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// OpenAPI - разобранная спецификация: операции по "METHOD /path" и общие компоненты
+type OpenAPI struct {
+	Operations map[string]*OpenAPIOperation
+	Schemas    map[string]*OpenAPISchema
+	Parameters map[string]*OpenAPIParameter
+}
+
+var openAPI = mustLoadOpenAPI(openAPISpec)
+
+var openAPIMethods = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true, "patch": true, "head": true, "options": true,
+}
+
+// LoadOpenAPI разбирает документ OpenAPI 3 в формате JSON
+func LoadOpenAPI(data []byte) (*OpenAPI, error) {
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Schemas    map[string]*OpenAPISchema    `json:"schemas"`
+			Parameters map[string]*OpenAPIParameter `json:"parameters"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	spec := &OpenAPI{
+		Operations: make(map[string]*OpenAPIOperation),
+		Schemas:    doc.Components.Schemas,
+		Parameters: doc.Components.Parameters,
+	}
+	for path, item := range doc.Paths {
+		for method, raw := range item {
+			if !openAPIMethods[method] {
+				continue
+			}
+			var op OpenAPIOperation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return nil, fmt.Errorf("%s %s: %v", method, path, err)
+			}
+			for i, p := range op.Parameters {
+				if p.Ref == "" {
+					continue
+				}
+				resolved, ok := spec.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+				if !ok {
+					return nil, fmt.Errorf("%s %s: неизвестный параметр %s", method, path, p.Ref)
+				}
+				op.Parameters[i] = resolved
+			}
+			spec.Operations[strings.ToUpper(method)+" "+path] = &op
+		}
+	}
+	return spec, nil
+}
+
+func mustLoadOpenAPI(data []byte) *OpenAPI {
+	spec, err := LoadOpenAPI(data)
+	if err != nil {
+		log.Fatalf("Ошибка в спецификации OpenAPI: %v", err)
+	}
+	return spec
+}
+
+var routeVarPattern = regexp.MustCompile(`\{(\w+):[^}]*\}`)
+
+// openAPIPath переводит шаблон маршрута mux в путь OpenAPI: /tokens/{id:[0-9]+} -> /tokens/{id}
+func openAPIPath(tmpl string) string {
+	return routeVarPattern.ReplaceAllString(tmpl, "{$1}")
+}
+
+// Operation возвращает описание метода по шаблону маршрута mux
+func (s *OpenAPI) Operation(method, tmpl string) *OpenAPIOperation {
+	return s.Operations[method+" "+openAPIPath(tmpl)]
+}
+
+func (s *OpenAPI) resolve(schema *OpenAPISchema) *OpenAPISchema {
+	for schema != nil && schema.Ref != "" {
+		schema = s.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+// validateValue проверяет значение из JSON по схеме; field - путь к значению
+// в запросе (transfers[0].toUser), пустой для тела целиком
+func (s *OpenAPI) validateValue(schema *OpenAPISchema, v interface{}, field string) []*APIError {
+	schema = s.resolve(schema)
+	if schema == nil {
+		return nil
+	}
+	fail := func(key string, args ...interface{}) []*APIError {
+		return []*APIError{{Code: CodeValidationFailed, Field: field, Key: key, Args: args}}
+	}
+	if v == nil {
+		if schema.Nullable {
+			return nil
+		}
+		return fail("schema_type", schema.Type)
+	}
+	if len(schema.Enum) > 0 && !enumContains(schema.Enum, v) {
+		return fail("schema_enum", enumString(schema.Enum))
+	}
+
+	switch schema.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fail("schema_type", schema.Type)
+		}
+		var errs []*APIError
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, &APIError{Code: CodeValidationFailed, Field: joinField(field, name), Key: "schema_required"})
+			}
+		}
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names) // Ошибки в одном и том же порядке
+		for _, name := range names {
+			if value, ok := obj[name]; ok {
+				errs = append(errs, s.validateValue(schema.Properties[name], value, joinField(field, name))...)
+			}
+		}
+		return errs
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return fail("schema_type", schema.Type)
+		}
+		if schema.MinItems != nil && len(arr) < *schema.MinItems {
+			return fail("schema_min_items", *schema.MinItems)
+		}
+		if schema.MaxItems != nil && len(arr) > *schema.MaxItems {
+			return fail("schema_max_items", *schema.MaxItems)
+		}
+		var errs []*APIError
+		for i, item := range arr {
+			errs = append(errs, s.validateValue(schema.Items, item, fmt.Sprintf("%s[%d]", field, i))...)
+		}
+		return errs
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fail("schema_type", schema.Type)
+		}
+		length := len([]rune(str))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			return fail("schema_min_length", *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return fail("schema_max_length", *schema.MaxLength)
+		}
+		if schema.Pattern != "" {
+			if re, err := regexp.Compile(schema.Pattern); err == nil && !re.MatchString(str) {
+				return fail("schema_pattern")
+			}
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fail("schema_format", schema.Format)
+			}
+		}
+	case "integer", "number":
+		num, ok := v.(json.Number)
+		if !ok {
+			return fail("schema_type", schema.Type)
+		}
+		f, err := num.Float64()
+		if err != nil || (schema.Type == "integer" && f != math.Trunc(f)) {
+			return fail("schema_type", schema.Type)
+		}
+		if schema.Minimum != nil && f < *schema.Minimum {
+			return fail("schema_minimum", formatNumber(*schema.Minimum))
+		}
+		if schema.Maximum != nil && f > *schema.Maximum {
+			return fail("schema_maximum", formatNumber(*schema.Maximum))
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fail("schema_type", schema.Type)
+		}
+	}
+	return nil
+}
+
+// validateParameter проверяет параметр пути, строки запроса или заголовка.
+// Значения приходят строками и приводятся к типу схемы.
+func (s *OpenAPI) validateParameter(r *http.Request, p *OpenAPIParameter) []*APIError {
+	var raw string
+	var present bool
+	switch p.In {
+	case "path":
+		raw, present = mux.Vars(r)[p.Name]
+	case "query":
+		raw, present = r.URL.Query().Get(p.Name), r.URL.Query().Has(p.Name)
+	case "header":
+		raw = r.Header.Get(p.Name)
+		present = raw != ""
+	default:
+		return nil
+	}
+	if !present {
+		if p.Required {
+			return []*APIError{{Code: CodeValidationFailed, Field: p.Name, Key: "schema_required"}}
+		}
+		return nil
+	}
+
+	var value interface{} = raw
+	switch schema := s.resolve(p.Schema); {
+	case schema == nil:
+		return nil
+	case schema.Type == "integer" || schema.Type == "number":
+		value = json.Number(raw)
+	case schema.Type == "boolean":
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return []*APIError{{Code: CodeValidationFailed, Field: p.Name, Key: "schema_type", Args: []interface{}{schema.Type}}}
+		}
+		value = b
+	}
+	return s.validateValue(p.Schema, value, p.Name)
+}
+
+// ValidateRequest проверяет параметры и тело запроса по описанию операции.
+// Тело читается целиком и подменяется копией, чтобы обработчик прочитал его снова.
+func (s *OpenAPI) ValidateRequest(r *http.Request, op *OpenAPIOperation) []*APIError {
+	var errs []*APIError
+	for _, p := range op.Parameters {
+		errs = append(errs, s.validateParameter(r, p)...)
+	}
+	if op.RequestBody == nil {
+		return errs
+	}
+
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxValidatedBody+1))
+		r.Body.Close()
+		if err != nil || len(body) > maxValidatedBody {
+			return []*APIError{{Status: http.StatusRequestEntityTooLarge, Code: CodeBadRequest, Key: "request_too_large"}}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			errs = append(errs, &APIError{Code: CodeValidationFailed, Key: "request_body_required"})
+		}
+		return errs
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return append(errs, &APIError{Code: CodeBadRequest, Key: "bad_request"})
+	}
+	if media, ok := op.RequestBody.Content["application/json"]; ok {
+		errs = append(errs, s.validateValue(media.Schema, value, "")...)
+	}
+	return errs
+}
+
+// ValidateRequestMiddleware отклоняет запросы, не соответствующие спецификации,
+// ответом 400 со всеми найденными ошибками. Маршруты без описания пропускаются.
+func ValidateRequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tmpl, _ := route.GetPathTemplate()
+		op := openAPI.Operation(r.Method, tmpl)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if errs := openAPI.ValidateRequest(r, op); len(errs) > 0 {
+			status := http.StatusBadRequest
+			if errs[0].Status != 0 {
+				status = errs[0].Status
+			}
+			writeErrors(w, r, status, errs...)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// OpenAPIHandler отдаёт спецификацию API
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+func joinField(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+func enumContains(enum []interface{}, v interface{}) bool {
+	if num, ok := v.(json.Number); ok {
+		f, err := num.Float64()
+		if err != nil {
+			return false
+		}
+		v = f
+	}
+	for _, e := range enum {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func enumString(enum []interface{}) string {
+	values := make([]string, len(enum))
+	for i, e := range enum {
+		values[i] = fmt.Sprint(e)
+		if values[i] == "" {
+			values[i] = `""`
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+func formatNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
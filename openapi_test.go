@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestOpenAPICoversRoutes проверяет, что каждый зарегистрированный маршрут описан
+// в спецификации, а в спецификации нет маршрутов, которых нет в сервисе
+func TestOpenAPICoversRoutes(t *testing.T) {
+	registered := map[string]bool{}
+	err := newRouter().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil // PathPrefix подроутера, а не конечный маршрут
+		}
+		for _, method := range methods {
+			key := method + " " + openAPIPath(tmpl)
+			registered[key] = true
+			if openAPI.Operations[key] == nil {
+				t.Errorf("Route %s is missing from openapi.json", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(registered) == 0 {
+		t.Fatal("No routes registered")
+	}
+	for key := range openAPI.Operations {
+		if !registered[key] {
+			t.Errorf("openapi.json describes %s, but the route is not registered", key)
+		}
+	}
+}
+
+func TestOpenAPIRefsResolve(t *testing.T) {
+	var check func(where string, s *OpenAPISchema)
+	check = func(where string, s *OpenAPISchema) {
+		if s == nil {
+			return
+		}
+		if s.Ref != "" && openAPI.resolve(s) == nil {
+			t.Errorf("%s: unresolved %s", where, s.Ref)
+		}
+		for name, prop := range s.Properties {
+			check(where+"."+name, prop)
+		}
+		check(where+"[]", s.Items)
+	}
+	for key, op := range openAPI.Operations {
+		for _, p := range op.Parameters {
+			check(key+" "+p.Name, p.Schema)
+		}
+		if op.RequestBody != nil {
+			for _, media := range op.RequestBody.Content {
+				check(key+" body", media.Schema)
+			}
+		}
+	}
+	for name, s := range openAPI.Schemas {
+		check(name, s)
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, httptest.NewRequest("GET", "/api/openapi.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+	var doc struct {
+		OpenAPI string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") || doc.Paths["/api/sendCoin"] == nil {
+		t.Errorf("Unexpected document: %+v", doc)
+	}
+}
+
+// TestValidateRequest проходит через настоящий маршрутизатор: запрос, не прошедший
+// проверку, получает 400 до авторизации, а корректный доходит до JWTMiddleware (401)
+func TestValidateRequest(t *testing.T) {
+	r := newRouter()
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		fields []string
+	}{
+		{"old transfer fields", "POST", "/me/transfer", `{"to":"bob","coins":100}`, http.StatusBadRequest, []string{"toUser", "amount"}},
+		{"wrong types", "POST", "/api/sendCoin", `{"toUser":42,"amount":"100"}`, http.StatusBadRequest, []string{"amount", "toUser"}},
+		{"fractional amount", "POST", "/api/sendCoin", `{"toUser":"bob","amount":1.5}`, http.StatusBadRequest, []string{"amount"}},
+		{"non-positive amount", "POST", "/api/sendCoin", `{"toUser":"bob","amount":0}`, http.StatusBadRequest, []string{"amount"}},
+		{"nested batch item", "POST", "/api/sendCoin/batch", `{"transfers":[{"toUser":"bob","amount":5},{"toUser":"eve"}]}`, http.StatusBadRequest, []string{"transfers[1].amount"}},
+		{"unknown scope", "POST", "/api/tokens", `{"name":"bot","scopes":["admin"]}`, http.StatusBadRequest, []string{"scopes[0]"}},
+		{"bad date", "POST", "/api/schedules", `{"toUser":"bob","amount":5,"runAt":"tomorrow"}`, http.StatusBadRequest, []string{"runAt"}},
+		{"bad query enum", "GET", "/api/info?category=bribe", "", http.StatusBadRequest, []string{"category"}},
+		{"missing body", "POST", "/api/sendCoin", "", http.StatusBadRequest, []string{""}},
+		{"invalid json", "POST", "/api/sendCoin", `{"toUser":`, http.StatusBadRequest, []string{""}},
+		{"valid transfer", "POST", "/api/sendCoin", `{"toUser":"bob","amount":100,"memo":"спасибо"}`, http.StatusUnauthorized, nil},
+		{"valid empty category", "GET", "/api/info?category=", "", http.StatusUnauthorized, nil},
+		{"optional body omitted", "PUT", "/api/admin/users/bob/roles/treasurer", "", http.StatusUnauthorized, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(c.method, c.path, bytes.NewBufferString(c.body))
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+			if rr.Code != c.status {
+				t.Fatalf("Expected status %d, got %d: %s", c.status, rr.Code, rr.Body)
+			}
+			if c.fields == nil {
+				return
+			}
+			var resp ErrorResponse
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			var fields []string
+			for _, e := range resp.Errors {
+				fields = append(fields, e.Field)
+				if e.Message == "" {
+					t.Errorf("Empty message for %+v", e)
+				}
+			}
+			if strings.Join(fields, ",") != strings.Join(c.fields, ",") {
+				t.Errorf("Expected errors for %v, got %+v", c.fields, resp.Errors)
+			}
+		})
+	}
+}
+
+func TestValidateRequestKeepsBody(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(ValidateRequestMiddleware)
+	var got SendCoinRequest
+	r.HandleFunc("/api/sendCoin", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+	}).Methods("POST")
+
+	req := httptest.NewRequest("POST", "/api/sendCoin", bytes.NewBufferString(`{"toUser":"bob","amount":7}`))
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	if got.ToUser != "bob" || got.Amount != 7 {
+		t.Errorf("Handler got %+v after validation", got)
+	}
+}
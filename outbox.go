@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Доменные события - неизменяемый журнал изменений состояния для аналитики.
+// Событие пишется в domain_events в транзакции самой операции, а OutboxRelay
+// отдаёт журнал в приёмники (stdout, файл, брокер). У каждого приёмника свой
+// курсор в outbox_offsets, поэтому сломанный приёмник не задерживает остальные.
+// Доставка "хотя бы один раз": после сбоя пачка может повториться, потребители
+// отбрасывают дубликаты по id.
+//
+// Курсор - пара (txid, id), а не только id: id выдаётся последовательностью до
+// коммита, и транзакция с меньшим id может закоммититься позже, чем курсор его
+// прошёл. Поэтому события читаются только из транзакций старше самой старой
+// незавершённой (pg_snapshot_xmin) - новых событий с меньшим txid уже не будет.
+
+// Типы доменных событий
+const (
+	DomainUserCreated      = "user.created"
+	DomainCoinsTransferred = "coins.transferred"
+	DomainMerchPurchased   = "merch.purchased"
+	DomainPriceChanged     = "merch.price_changed"
+)
+
+// Типы агрегатов: к чему относится aggregateId события
+const (
+	AggregateUser        = "user"
+	AggregateTransfer    = "transfer"
+	AggregatePurchase    = "purchase"
+	AggregateMerchandise = "merchandise"
+)
+
+// DomainEvent - событие журнала
+type DomainEvent struct {
+	ID            int64           `json:"id"`
+	Type          string          `json:"type"`
+	AggregateType string          `json:"aggregateType"`
+	AggregateID   int             `json:"aggregateId"`
+	Data          json.RawMessage `json:"data"`
+	OccurredAt    time.Time       `json:"occurredAt"`
+}
+
+// MerchPurchasedEvent - data события merch.purchased
+type MerchPurchasedEvent struct {
+	UserID   int    `json:"userId"`
+	Username string `json:"username"`
+	Item     string `json:"item"`
+	Price    int    `json:"price"`
+	Balance  int    `json:"balance"` // Монет после покупки
+}
+
+// PriceChangedEvent - data события merch.price_changed
+type PriceChangedEvent struct {
+	Item      string `json:"item"`
+	OldPrice  *int   `json:"oldPrice"` // nil - товар добавлен в ассортимент
+	NewPrice  int    `json:"newPrice"`
+	ChangedBy string `json:"changedBy"`
+}
+
+// recordDomainEvent добавляет событие в журнал в транзакции операции
+func recordDomainEvent(tx *sql.Tx, eventType, aggregateType string, aggregateID int, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO domain_events (type, aggregate_type, aggregate_id, payload) VALUES ($1, $2, $3, $4)
+	`, eventType, aggregateType, aggregateID, payload)
+	if err != nil {
+		return fmt.Errorf("ошибка при записи доменного события: %w", err)
+	}
+	return nil
+}
+
+// userCreated записывает событие регистрации в журнал
+func userCreated(tx *sql.Tx, userID int, username string) error {
+	return recordDomainEvent(tx, DomainUserCreated, AggregateUser, userID, UserCreatedEvent{UserID: userID, Username: username})
+}
+
+// EventSink - приёмник доменных событий. Name - ключ курсора в outbox_offsets,
+// поэтому он не должен меняться между запусками.
+type EventSink interface {
+	Name() string
+	Publish(ctx context.Context, events []DomainEvent) error
+}
+
+// TxEventSink - приёмник, который пишет в ту же базу. Пачка обрабатывается в
+// транзакции сдвига курсора, поэтому каждое событие применяется ровно один раз.
+type TxEventSink interface {
+	EventSink
+	PublishTx(tx *sql.Tx, events []DomainEvent) error
+}
+
+// JSONLinesSink пишет события по одному JSON на строку
+type JSONLinesSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+	sync func() error // Сброс на диск после пачки; nil - не нужен
+}
+
+// NewStdoutSink - приёмник в стандартный вывод
+func NewStdoutSink() *JSONLinesSink {
+	return &JSONLinesSink{name: "stdout", w: os.Stdout}
+}
+
+// NewFileSink - приёмник, дописывающий события в файл
+func NewFileSink(path string) (*JSONLinesSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONLinesSink{name: "file:" + path, w: f, sync: f.Sync}, nil
+}
+
+func (s *JSONLinesSink) Name() string { return s.name }
+
+// Publish пишет пачку одним вызовом Write, чтобы строки не перемежались с чужим выводом
+func (s *JSONLinesSink) Publish(ctx context.Context, events []DomainEvent) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if s.sync != nil {
+		return s.sync()
+	}
+	return nil
+}
+
+// Broker - брокер сообщений (Kafka, NATS и т.п.). key задаёт порядок: сообщения
+// с одним ключом брокер должен доставлять по порядку.
+type Broker interface {
+	Publish(ctx context.Context, topic, key string, value []byte) error
+}
+
+// BrokerSink публикует события в топик брокера; ключ - агрегат события
+type BrokerSink struct {
+	name   string
+	broker Broker
+	topic  string
+}
+
+func NewBrokerSink(name string, broker Broker, topic string) *BrokerSink {
+	return &BrokerSink{name: name, broker: broker, topic: topic}
+}
+
+func (s *BrokerSink) Name() string { return s.name }
+
+func (s *BrokerSink) Publish(ctx context.Context, events []DomainEvent) error {
+	for _, e := range events {
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		key := e.AggregateType + ":" + strconv.Itoa(e.AggregateID)
+		if err := s.broker.Publish(ctx, s.topic, key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BrokerMessage - сообщение в MemoryBroker
+type BrokerMessage struct {
+	Topic string
+	Key   string
+	Value []byte
+}
+
+// MemoryBroker - брокер в памяти процесса: хранит все сообщения и раздаёт их
+// подписчикам. Для тестов и потребителей внутри приложения.
+type MemoryBroker struct {
+	mu       sync.Mutex
+	messages []BrokerMessage
+	subs     map[string]map[chan BrokerMessage]bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{subs: map[string]map[chan BrokerMessage]bool{}}
+}
+
+// eventBroker - брокер приёмника memory из OUTBOX_SINKS
+var eventBroker = NewMemoryBroker()
+
+// Publish сохраняет сообщение и ждёт, пока его примут все подписчики топика
+func (b *MemoryBroker) Publish(ctx context.Context, topic, key string, value []byte) error {
+	msg := BrokerMessage{Topic: topic, Key: key, Value: value}
+	b.mu.Lock()
+	b.messages = append(b.messages, msg)
+	subs := make([]chan BrokerMessage, 0, len(b.subs[topic]))
+	for ch := range b.subs[topic] {
+		subs = append(subs, ch)
+	}
+	b.mu.Unlock()
+
+	for _, ch := range subs {
+		select {
+		case ch <- msg:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Messages возвращает все сообщения топика по порядку публикации
+func (b *MemoryBroker) Messages(topic string) []BrokerMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var result []BrokerMessage
+	for _, m := range b.messages {
+		if m.Topic == topic {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// Subscribe возвращает канал новых сообщений топика и функцию отписки.
+// Медленный подписчик задерживает Publish, а не теряет сообщения.
+func (b *MemoryBroker) Subscribe(topic string, buffer int) (<-chan BrokerMessage, func()) {
+	ch := make(chan BrokerMessage, buffer)
+	b.mu.Lock()
+	if b.subs[topic] == nil {
+		b.subs[topic] = map[chan BrokerMessage]bool{}
+	}
+	b.subs[topic][ch] = true
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		delete(b.subs[topic], ch)
+		b.mu.Unlock()
+	}
+}
+
+// parseEventSinks разбирает OUTBOX_SINKS: список через запятую из stdout,
+// file:<путь> и memory
+func parseEventSinks(spec string) ([]EventSink, error) {
+	var sinks []EventSink
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+		case part == "stdout":
+			sinks = append(sinks, NewStdoutSink())
+		case part == "memory":
+			sinks = append(sinks, NewBrokerSink("memory", eventBroker, config.OutboxTopic))
+		case strings.HasPrefix(part, "file:") && len(part) > len("file:"):
+			sink, err := NewFileSink(strings.TrimPrefix(part, "file:"))
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		default:
+			return nil, fmt.Errorf("приёмник событий %q: ожидается stdout, file:<путь> или memory", part)
+		}
+	}
+	return sinks, nil
+}
+
+// OutboxRelay отдаёт доменные события в приёмники
+type OutboxRelay struct {
+	interval time.Duration
+	batch    int
+	sinks    []EventSink
+}
+
+// NewOutboxRelay создаёт relay с интервалом опроса базы и размером пачки
+func NewOutboxRelay(interval time.Duration, batch int, sinks ...EventSink) *OutboxRelay {
+	return &OutboxRelay{interval: interval, batch: batch, sinks: sinks}
+}
+
+// Run работает до отмены контекста
+func (r *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.RunOnce(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce отдаёт каждому приёмнику все готовые события
+func (r *OutboxRelay) RunOnce(ctx context.Context) {
+	for _, sink := range r.sinks {
+		for ctx.Err() == nil {
+			n, err := relayBatch(ctx, sink, r.batch)
+			if err != nil {
+				log.Printf("Ошибка отправки событий в %s: %v", sink.Name(), err)
+				break
+			}
+			if n < r.batch {
+				break
+			}
+		}
+	}
+}
+
+// relayBatch отдаёт приёмнику следующую пачку и сдвигает его курсор. Строка
+// курсора заблокирована до коммита, поэтому несколько экземпляров приложения
+// не отправят одну пачку одновременно.
+func relayBatch(ctx context.Context, sink EventSink, limit int) (int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO outbox_offsets (sink) VALUES ($1) ON CONFLICT DO NOTHING`, sink.Name()); err != nil {
+		return 0, err
+	}
+	var lastTxID, lastID int64
+	err = tx.QueryRow(`
+		SELECT last_txid::text, last_id FROM outbox_offsets WHERE sink = $1 FOR UPDATE
+	`, sink.Name()).Scan(&lastTxID, &lastID)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, txid::text, type, aggregate_type, aggregate_id, payload, occurred_at
+		FROM domain_events
+		WHERE (txid, id) > ($1::text::xid8, $2)
+			AND txid < pg_snapshot_xmin(pg_current_snapshot())
+		ORDER BY txid, id
+		LIMIT $3
+	`, strconv.FormatInt(lastTxID, 10), lastID, limit)
+	if err != nil {
+		return 0, err
+	}
+	var events []DomainEvent
+	for rows.Next() {
+		var e DomainEvent
+		if err := rows.Scan(&e.ID, &lastTxID, &e.Type, &e.AggregateType, &e.AggregateID, &e.Data, &e.OccurredAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		lastID = e.ID
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if txSink, ok := sink.(TxEventSink); ok {
+		err = txSink.PublishTx(tx, events)
+	} else {
+		err = sink.Publish(ctx, events)
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`
+		UPDATE outbox_offsets SET last_txid = $2::text::xid8, last_id = $3, updated_at = now() WHERE sink = $1
+	`, sink.Name(), strconv.FormatInt(lastTxID, 10), lastID)
+	if err != nil {
+		return 0, err
+	}
+	return len(events), tx.Commit()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLinesSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := &JSONLinesSink{name: "buffer", w: &buf}
+	events := []DomainEvent{
+		{ID: 1, Type: DomainUserCreated, AggregateType: AggregateUser, AggregateID: 10, Data: json.RawMessage(`{"username":"ivan"}`)},
+		{ID: 2, Type: DomainCoinsTransferred, AggregateType: AggregateTransfer, AggregateID: 5, Data: json.RawMessage(`{"amount":3}`)},
+	}
+	if err := sink.Publish(context.Background(), events); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", buf.String())
+	}
+	var e DomainEvent
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil || e.ID != 2 || e.Type != DomainCoinsTransferred {
+		t.Errorf("Unexpected line %s", lines[1])
+	}
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	for id := int64(1); id <= 2; id++ {
+		sink, err := NewFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Publish(context.Background(), []DomainEvent{{ID: id, Type: DomainUserCreated, Data: json.RawMessage(`{}`)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 2 {
+		t.Errorf("Expected 2 events in file, got %d: %s", n, data)
+	}
+}
+
+func TestBrokerSinkPublishesToMemoryBroker(t *testing.T) {
+	broker := NewMemoryBroker()
+	messages, cancel := broker.Subscribe("events", 1)
+	defer cancel()
+
+	sink := NewBrokerSink("memory", broker, "events")
+	event := DomainEvent{ID: 3, Type: DomainMerchPurchased, AggregateType: AggregatePurchase, AggregateID: 7, Data: json.RawMessage(`{}`)}
+	if err := sink.Publish(context.Background(), []DomainEvent{event}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-messages:
+		if msg.Key != "purchase:7" {
+			t.Errorf("Expected key purchase:7, got %s", msg.Key)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Subscriber did not receive the message")
+	}
+	if got := broker.Messages("events"); len(got) != 1 {
+		t.Errorf("Expected 1 stored message, got %d", len(got))
+	}
+	if got := broker.Messages("other"); len(got) != 0 {
+		t.Errorf("Expected no messages in other topic, got %d", len(got))
+	}
+}
+
+func TestMemoryBrokerPublishRespectsContext(t *testing.T) {
+	broker := NewMemoryBroker()
+	_, cancel := broker.Subscribe("events", 0) // никто не читает
+	defer cancel()
+
+	ctx, stop := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer stop()
+	if err := broker.Publish(ctx, "events", "k", []byte("{}")); err == nil {
+		t.Error("Expected Publish to a stuck subscriber to fail with the context")
+	}
+}
+
+func TestParseEventSinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	sinks, err := parseEventSinks("stdout, file:" + path + ",memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, s := range sinks {
+		names = append(names, s.Name())
+	}
+	if strings.Join(names, ",") != "stdout,file:"+path+",memory" {
+		t.Errorf("Unexpected sinks %v", names)
+	}
+
+	if sinks, err := parseEventSinks(""); err != nil || len(sinks) != 0 {
+		t.Errorf("Expected no sinks for empty spec, got %v, %v", sinks, err)
+	}
+	for _, spec := range []string{"kafka", "file:"} {
+		if _, err := parseEventSinks(spec); err == nil {
+			t.Errorf("Expected error for %q", spec)
+		}
+	}
+}
+
+func TestOutboxRelayPublishesDomainEvents(t *testing.T) {
+	getTokenForUser(t, "outbox_sender")
+	getTokenForUser(t, "outbox_recipient")
+	sender, recipient := GetUser("outbox_sender"), GetUser("outbox_recipient")
+
+	broker := NewMemoryBroker()
+	sink := NewBrokerSink("test-"+time.Now().Format(time.RFC3339Nano), broker, "events")
+	relay := NewOutboxRelay(time.Second, 100, sink)
+	relay.RunOnce(context.Background()) // события до теста
+
+	skip := len(broker.Messages("events"))
+	if err := sender.TransferCoins(recipient, 4, TransferMeta{}); err != nil {
+		t.Fatalf("TransferCoins: %v", err)
+	}
+	relay.RunOnce(context.Background())
+	relay.RunOnce(context.Background()) // повторный запуск не дублирует события
+
+	var transfers []DomainEvent
+	for _, msg := range broker.Messages("events")[skip:] {
+		var e DomainEvent
+		json.Unmarshal(msg.Value, &e)
+		if e.Type == DomainCoinsTransferred {
+			transfers = append(transfers, e)
+		}
+	}
+	if len(transfers) != 1 {
+		t.Fatalf("Expected one coins.transferred event, got %+v", transfers)
+	}
+	var data TransferCompletedEvent
+	json.Unmarshal(transfers[0].Data, &data)
+	if data.FromUser != "outbox_sender" || data.ToUser != "outbox_recipient" || data.Amount != 4 {
+		t.Errorf("Unexpected payload %+v", data)
+	}
+
+	if _, err := db.Exec(`UPDATE domain_events SET payload = '{}' WHERE id = $1`, transfers[0].ID); err == nil {
+		t.Error("Expected domain events to be immutable")
+	}
+}
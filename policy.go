@@ -0,0 +1,385 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Коды причин отказа в переводе
+const (
+	PolicyMaxPerTransfer = "max_per_transfer_exceeded"
+	PolicyDailyLimit     = "daily_limit_exceeded"
+	PolicyWeeklyLimit    = "weekly_limit_exceeded"
+	PolicyHourlyCount    = "hourly_transfer_count_exceeded"
+	PolicyAccountTooNew  = "account_too_new"
+)
+
+// TransferPolicy - ограничения на исходящие переводы. Нулевое значение означает "без ограничения".
+// Дневной и недельный лимиты считаются по скользящему окну (24 часа и 7 суток).
+type TransferPolicy struct {
+	MaxPerTransfer      int           `json:"maxPerTransfer"`      // Максимум монет в одном переводе
+	DailyLimit          int           `json:"dailyLimit"`          // Максимум монет за 24 часа
+	WeeklyLimit         int           `json:"weeklyLimit"`         // Максимум монет за 7 суток
+	MaxTransfersPerHour int           `json:"maxTransfersPerHour"` // Максимум переводов за час
+	MinAccountAge       time.Duration `json:"-"`                   // Минимальный возраст аккаунта для отправки
+}
+
+// MarshalJSON отдаёт минимальный возраст аккаунта в секундах
+func (p TransferPolicy) MarshalJSON() ([]byte, error) {
+	type plain TransferPolicy
+	return json.Marshal(struct {
+		plain
+		MinAccountAgeSeconds int64 `json:"minAccountAgeSeconds"`
+	}{plain(p), int64(p.MinAccountAge / time.Second)})
+}
+
+// TransferUsage - использованная часть лимитов
+type TransferUsage struct {
+	SentLastDay       int   `json:"sentLastDay"`
+	SentLastWeek      int   `json:"sentLastWeek"`
+	TransfersLastHour int   `json:"transfersLastHour"`
+	AccountAgeSeconds int64 `json:"accountAgeSeconds"`
+}
+
+// PolicyViolation - отказ в переводе из-за политики
+type PolicyViolation struct {
+	Code    string // Машиночитаемая причина
+	Message string // Описание для человека
+	Limit   int64  // Значение нарушенного ограничения
+	Current int64  // Сколько уже использовано (с учётом этого перевода)
+}
+
+func (v *PolicyViolation) Error() string {
+	return v.Message
+}
+
+// APIError переводит отказ в ошибку ответа; лимит и использование попадают в details
+func (v *PolicyViolation) APIError() *APIError {
+	// Коды отказов совпадают с ключами каталога сообщений
+	e := &APIError{Status: http.StatusForbidden, Code: v.Code, Key: v.Code}
+	if v.Limit != 0 || v.Current != 0 {
+		e.Details = map[string]interface{}{"limit": v.Limit, "current": v.Current}
+	}
+	return e
+}
+
+// queryRower - общее у *sql.DB и *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// PolicyOverride - строка transfer_policies: глобальная или для одного пользователя.
+// nil в поле означает "взять значение уровнем выше".
+type PolicyOverride struct {
+	MaxPerTransfer       *int   `json:"maxPerTransfer"`
+	DailyLimit           *int   `json:"dailyLimit"`
+	WeeklyLimit          *int   `json:"weeklyLimit"`
+	MaxTransfersPerHour  *int   `json:"maxTransfersPerHour"`
+	MinAccountAgeSeconds *int64 `json:"minAccountAgeSeconds"`
+}
+
+// ErrInvalidLimit - отрицательное значение лимита
+var ErrInvalidLimit = errors.New("лимит не может быть отрицательным")
+
+// ErrPolicyNotFound - своих лимитов на этом уровне нет
+var ErrPolicyNotFound = errors.New("лимиты не заданы")
+
+// Validate проверяет, что заданные лимиты не отрицательные
+func (o PolicyOverride) Validate() error {
+	ints := []struct {
+		field string
+		value *int
+	}{
+		{"maxPerTransfer", o.MaxPerTransfer},
+		{"dailyLimit", o.DailyLimit},
+		{"weeklyLimit", o.WeeklyLimit},
+		{"maxTransfersPerHour", o.MaxTransfersPerHour},
+	}
+	for _, v := range ints {
+		if v.value != nil && *v.value < 0 {
+			return &FieldError{Field: v.field, Err: ErrInvalidLimit}
+		}
+	}
+	if o.MinAccountAgeSeconds != nil && *o.MinAccountAgeSeconds < 0 {
+		return &FieldError{Field: "minAccountAgeSeconds", Err: ErrInvalidLimit}
+	}
+	return nil
+}
+
+// apply накладывает заданные значения на base
+func (o *PolicyOverride) apply(base TransferPolicy) TransferPolicy {
+	if o == nil {
+		return base
+	}
+	if o.MaxPerTransfer != nil {
+		base.MaxPerTransfer = *o.MaxPerTransfer
+	}
+	if o.DailyLimit != nil {
+		base.DailyLimit = *o.DailyLimit
+	}
+	if o.WeeklyLimit != nil {
+		base.WeeklyLimit = *o.WeeklyLimit
+	}
+	if o.MaxTransfersPerHour != nil {
+		base.MaxTransfersPerHour = *o.MaxTransfersPerHour
+	}
+	if o.MinAccountAgeSeconds != nil {
+		base.MinAccountAge = time.Duration(*o.MinAccountAgeSeconds) * time.Second
+	}
+	return base
+}
+
+// policyWhere - условие на строку transfer_policies; userID nil - глобальная строка
+func policyWhere(userID *int) (string, []interface{}) {
+	if userID == nil {
+		return "user_id IS NULL", nil
+	}
+	return "user_id = $1", []interface{}{*userID}
+}
+
+// GetPolicyOverride читает строку transfer_policies; nil, если её нет
+func GetPolicyOverride(q queryRower, userID *int) (*PolicyOverride, error) {
+	where, args := policyWhere(userID)
+	var maxPer, daily, weekly, perHour, minAge sql.NullInt64
+	err := q.QueryRow(`
+		SELECT max_per_transfer, daily_limit, weekly_limit, max_transfers_per_hour,
+			EXTRACT(EPOCH FROM min_account_age)::BIGINT
+		FROM transfer_policies WHERE `+where, args...).Scan(&maxPer, &daily, &weekly, &perHour, &minAge)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	nullInt := func(v sql.NullInt64) *int {
+		if !v.Valid {
+			return nil
+		}
+		i := int(v.Int64)
+		return &i
+	}
+	o := &PolicyOverride{
+		MaxPerTransfer:      nullInt(maxPer),
+		DailyLimit:          nullInt(daily),
+		WeeklyLimit:         nullInt(weekly),
+		MaxTransfersPerHour: nullInt(perHour),
+	}
+	if minAge.Valid {
+		o.MinAccountAgeSeconds = &minAge.Int64
+	}
+	return o, nil
+}
+
+// SetPolicyOverride заменяет строку transfer_policies целиком
+func SetPolicyOverride(userID *int, o PolicyOverride) error {
+	if err := o.Validate(); err != nil {
+		return err
+	}
+	var minAge interface{}
+	if o.MinAccountAgeSeconds != nil {
+		minAge = pgInterval(time.Duration(*o.MinAccountAgeSeconds) * time.Second)
+	}
+	conflict := "(user_id)"
+	if userID == nil {
+		conflict = "((user_id IS NULL)) WHERE user_id IS NULL"
+	}
+	_, err := db.Exec(`
+		INSERT INTO transfer_policies (user_id, max_per_transfer, daily_limit, weekly_limit, max_transfers_per_hour, min_account_age)
+		VALUES ($1, $2, $3, $4, $5, $6::INTERVAL)
+		ON CONFLICT `+conflict+` DO UPDATE SET
+			max_per_transfer = EXCLUDED.max_per_transfer,
+			daily_limit = EXCLUDED.daily_limit,
+			weekly_limit = EXCLUDED.weekly_limit,
+			max_transfers_per_hour = EXCLUDED.max_transfers_per_hour,
+			min_account_age = EXCLUDED.min_account_age,
+			updated_at = CURRENT_TIMESTAMP
+	`, userID, o.MaxPerTransfer, o.DailyLimit, o.WeeklyLimit, o.MaxTransfersPerHour, minAge)
+	return err
+}
+
+// DeletePolicyOverride удаляет строку transfer_policies: действуют лимиты уровнем выше
+func DeletePolicyOverride(userID *int) error {
+	where, args := policyWhere(userID)
+	res, err := db.Exec(`DELETE FROM transfer_policies WHERE `+where, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPolicyNotFound
+	}
+	return nil
+}
+
+// GetTransferPolicy возвращает действующую политику пользователя:
+// значения по умолчанию из конфигурации, поверх них глобальная строка
+// transfer_policies (user_id IS NULL), поверх неё персональная.
+func GetTransferPolicy(q queryRower, userID int) (TransferPolicy, error) {
+	policy := config.TransferPolicy
+	for _, id := range []*int{nil, &userID} {
+		o, err := GetPolicyOverride(q, id)
+		if err != nil {
+			return policy, err
+		}
+		policy = o.apply(policy)
+	}
+	return policy, nil
+}
+
+// GetTransferUsage считает исходящие переводы пользователя за окна лимитов
+func GetTransferUsage(q queryRower, userID int) (TransferUsage, error) {
+	var usage TransferUsage
+	err := q.QueryRow(`
+		SELECT
+			COALESCE(SUM(t.amount) FILTER (WHERE t.transaction_time > now() - INTERVAL '1 day'), 0),
+			COALESCE(SUM(t.amount), 0),
+			COUNT(*) FILTER (WHERE t.transaction_time > now() - INTERVAL '1 hour'),
+			(SELECT EXTRACT(EPOCH FROM now() - created_at)::BIGINT FROM users WHERE id = $1)
+		FROM transactions t
+		WHERE t.sender_id = $1 AND t.transaction_time > now() - INTERVAL '7 days'
+	`, userID).Scan(&usage.SentLastDay, &usage.SentLastWeek, &usage.TransfersLastHour, &usage.AccountAgeSeconds)
+	return usage, err
+}
+
+// checkTransferPolicy проверяет перевод по политике отправителя. Вызывается внутри
+// транзакции перевода после блокировки строки отправителя, поэтому параллельные
+// переводы одного пользователя не могут вместе превысить лимиты.
+func checkTransferPolicy(tx *sql.Tx, senderID, coins int) error {
+	policy, err := GetTransferPolicy(tx, senderID)
+	if err != nil {
+		return fmt.Errorf("ошибка при получении лимитов переводов: %v", err)
+	}
+	usage, err := GetTransferUsage(tx, senderID)
+	if err != nil {
+		return fmt.Errorf("ошибка при подсчёте переводов: %v", err)
+	}
+
+	switch {
+	case policy.MinAccountAge > 0 && usage.AccountAgeSeconds < int64(policy.MinAccountAge/time.Second):
+		return &PolicyViolation{PolicyAccountTooNew, "Аккаунт слишком новый для отправки монет",
+			int64(policy.MinAccountAge / time.Second), usage.AccountAgeSeconds}
+	case policy.MaxPerTransfer > 0 && coins > policy.MaxPerTransfer:
+		return &PolicyViolation{PolicyMaxPerTransfer, "Превышена максимальная сумма одного перевода",
+			int64(policy.MaxPerTransfer), int64(coins)}
+	case policy.MaxTransfersPerHour > 0 && usage.TransfersLastHour+1 > policy.MaxTransfersPerHour:
+		return &PolicyViolation{PolicyHourlyCount, "Превышено количество переводов в час",
+			int64(policy.MaxTransfersPerHour), int64(usage.TransfersLastHour + 1)}
+	case policy.DailyLimit > 0 && usage.SentLastDay+coins > policy.DailyLimit:
+		return &PolicyViolation{PolicyDailyLimit, "Превышен дневной лимит переводов",
+			int64(policy.DailyLimit), int64(usage.SentLastDay + coins)}
+	case policy.WeeklyLimit > 0 && usage.SentLastWeek+coins > policy.WeeklyLimit:
+		return &PolicyViolation{PolicyWeeklyLimit, "Превышен недельный лимит переводов",
+			int64(policy.WeeklyLimit), int64(usage.SentLastWeek + coins)}
+	}
+	return nil
+}
+
+// LimitsHandler возвращает действующие лимиты переводов пользователя и их использование.
+func LimitsHandler(w http.ResponseWriter, r *http.Request) {
+	username := r.Context().Value("username").(string)
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+
+	policy, err := GetTransferPolicy(db, user.ID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "limits_fetch_failed")
+		return
+	}
+	usage, err := GetTransferUsage(db, user.ID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "limits_fetch_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"limits": policy, "usage": usage})
+}
+
+// PolicyOverrideResponse - лимиты уровня и итоговые значения с учётом уровней выше
+type PolicyOverrideResponse struct {
+	Override  *PolicyOverride `json:"override"`  // null - своих значений нет
+	Effective TransferPolicy  `json:"effective"` // Действующие лимиты
+}
+
+// policyTarget - пользователь из пути или nil для глобальных лимитов
+func policyTarget(r *http.Request) (*int, error) {
+	username, ok := mux.Vars(r)["username"]
+	if !ok {
+		return nil, nil
+	}
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	return &user.ID, nil
+}
+
+// GetPolicyOverrideHandler возвращает глобальные лимиты или лимиты пользователя.
+func GetPolicyOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := policyTarget(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	override, err := GetPolicyOverride(db, userID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "limits_fetch_failed")
+		return
+	}
+	effective := override.apply(config.TransferPolicy)
+	if userID != nil {
+		if effective, err = GetTransferPolicy(db, *userID); err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "limits_fetch_failed")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PolicyOverrideResponse{Override: override, Effective: effective})
+}
+
+// SetPolicyOverrideHandler задаёт глобальные лимиты или лимиты пользователя;
+// null в поле оставляет значение уровня выше.
+func SetPolicyOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	var req PolicyOverride
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	userID, err := policyTarget(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := SetPolicyOverride(userID, req); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "limits_update_failed")
+		return
+	}
+	GetPolicyOverrideHandler(w, r)
+}
+
+// DeletePolicyOverrideHandler сбрасывает лимиты уровня к значениям уровня выше.
+func DeletePolicyOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := policyTarget(r)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	if err := DeletePolicyOverride(userID); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
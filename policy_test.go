@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func intPtr(i int) *int { return &i }
+
+func TestPolicyOverrideValidate(t *testing.T) {
+	negAge := int64(-1)
+	cases := []struct {
+		override PolicyOverride
+		field    string
+	}{
+		{PolicyOverride{}, ""},
+		{PolicyOverride{DailyLimit: intPtr(0), WeeklyLimit: intPtr(5000)}, ""},
+		{PolicyOverride{MaxPerTransfer: intPtr(-1)}, "maxPerTransfer"},
+		{PolicyOverride{MaxTransfersPerHour: intPtr(-5)}, "maxTransfersPerHour"},
+		{PolicyOverride{MinAccountAgeSeconds: &negAge}, "minAccountAgeSeconds"},
+	}
+	for _, c := range cases {
+		err := c.override.Validate()
+		if c.field == "" {
+			if err != nil {
+				t.Errorf("%+v: expected no error, got %v", c.override, err)
+			}
+			continue
+		}
+		var fieldErr *FieldError
+		if !errors.As(err, &fieldErr) || fieldErr.Field != c.field || !errors.Is(err, ErrInvalidLimit) {
+			t.Errorf("%+v: expected error on %s, got %v", c.override, c.field, err)
+		}
+	}
+}
+
+func TestPolicyOverrideApply(t *testing.T) {
+	base := TransferPolicy{MaxPerTransfer: 100, DailyLimit: 500}
+	age := int64(3600)
+
+	var none *PolicyOverride
+	if got := none.apply(base); got != base {
+		t.Errorf("nil override changed the policy: %+v", got)
+	}
+	got := (&PolicyOverride{DailyLimit: intPtr(0), MinAccountAgeSeconds: &age}).apply(base)
+	want := TransferPolicy{MaxPerTransfer: 100, DailyLimit: 0, MinAccountAge: time.Hour}
+	if got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestTransferPolicyViolations(t *testing.T) {
+	getTokenForUser(t, "policy_recipient")
+	recipient := GetUser("policy_recipient")
+
+	yearAge := int64(365 * 24 * 3600)
+	cases := []struct {
+		name     string
+		override func(usage TransferUsage) PolicyOverride
+		first    int // Сумма разрешённого перевода; 0 - сразу ожидаем отказ
+		second   int
+		code     string
+	}{
+		{"max per transfer", func(TransferUsage) PolicyOverride {
+			return PolicyOverride{MaxPerTransfer: intPtr(5)}
+		}, 5, 6, PolicyMaxPerTransfer},
+		{"daily", func(u TransferUsage) PolicyOverride {
+			return PolicyOverride{DailyLimit: intPtr(u.SentLastDay + 5)}
+		}, 3, 3, PolicyDailyLimit},
+		{"weekly", func(u TransferUsage) PolicyOverride {
+			return PolicyOverride{WeeklyLimit: intPtr(u.SentLastWeek + 5)}
+		}, 3, 3, PolicyWeeklyLimit},
+		{"per hour", func(u TransferUsage) PolicyOverride {
+			return PolicyOverride{MaxTransfersPerHour: intPtr(u.TransfersLastHour + 1)}
+		}, 1, 1, PolicyHourlyCount},
+		{"account age", func(TransferUsage) PolicyOverride {
+			return PolicyOverride{MinAccountAgeSeconds: &yearAge}
+		}, 0, 1, PolicyAccountTooNew},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			username := "policy_" + strings.ReplaceAll(c.name, " ", "_")
+			getTokenForUser(t, username)
+			sender := GetUser(username)
+			usage, err := GetTransferUsage(db, sender.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := SetPolicyOverride(&sender.ID, c.override(usage)); err != nil {
+				t.Fatal(err)
+			}
+			defer DeletePolicyOverride(&sender.ID)
+
+			if c.first > 0 {
+				if err := sender.TransferCoins(recipient, c.first, TransferMeta{}); err != nil {
+					t.Fatalf("First transfer: %v", err)
+				}
+			}
+			var violation *PolicyViolation
+			err = sender.TransferCoins(recipient, c.second, TransferMeta{})
+			if !errors.As(err, &violation) || violation.Code != c.code {
+				t.Fatalf("Expected %s, got %v", c.code, err)
+			}
+			if api := toAPIError(err); api.Status != http.StatusForbidden || api.Details == nil {
+				t.Errorf("Expected 403 with details, got %+v", api)
+			}
+		})
+	}
+}
+
+func TestAdminManagesLimits(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	getTokenForUser(t, "limits_admin")
+	config.AdminUserIDs = append(config.AdminUserIDs, GetUser("limits_admin").ID)
+
+	r := newRouter()
+	adminToken := getTokenForUser(t, "limits_admin")
+	userToken := getTokenForUser(t, "limits_user")
+	do := func(token, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := do(userToken, "PUT", "/api/admin/users/limits_user/limits", `{"dailyLimit": 1000000}`); rr.Code != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a regular user, got %d", rr.Code)
+	}
+	if rr := do(adminToken, "PUT", "/api/admin/users/limits_user/limits", `{"maxPerTransfer": -1}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a negative limit, got %d", rr.Code)
+	}
+
+	rr := do(adminToken, "PUT", "/api/admin/users/limits_user/limits", `{"maxPerTransfer": 7, "dailyLimit": null}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rr.Code, rr.Body)
+	}
+	var resp PolicyOverrideResponse
+	json.NewDecoder(rr.Body).Decode(&resp)
+	if resp.Override == nil || resp.Override.MaxPerTransfer == nil || *resp.Override.MaxPerTransfer != 7 ||
+		resp.Override.DailyLimit != nil || resp.Effective.MaxPerTransfer != 7 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+
+	// Пользователь видит персональный лимит в /api/limits
+	var limits struct {
+		Limits map[string]int `json:"limits"`
+	}
+	json.NewDecoder(do(userToken, "GET", "/api/limits", "").Body).Decode(&limits)
+	if limits.Limits["maxPerTransfer"] != 7 {
+		t.Errorf("Expected maxPerTransfer 7 in /api/limits, got %+v", limits)
+	}
+
+	if rr := do(adminToken, "DELETE", "/api/admin/users/limits_user/limits", ""); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d", rr.Code)
+	}
+	if rr := do(adminToken, "DELETE", "/api/admin/users/limits_user/limits", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing override, got %d", rr.Code)
+	}
+	if rr := do(adminToken, "GET", "/api/admin/users/limits_nobody/limits", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown user, got %d", rr.Code)
+	}
+}
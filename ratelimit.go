@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Группы маршрутов с отдельными лимитами запросов
+const (
+	RateGroupAuth    = "auth"    // Вход и регистрация, по IP
+	RateGroupRead    = "read"    // Тяжёлые запросы чтения
+	RateGroupWrite   = "write"   // Переводы и покупки
+	RateGroupDefault = "default" // Остальные маршруты с авторизацией
+)
+
+// rateLimitRouteGroups - маршруты с отдельным лимитом; остальные попадают в default
+var rateLimitRouteGroups = map[string]string{
+	"GET /api/info":            RateGroupRead,
+	"GET /api/limits":          RateGroupRead,
+	"GET /api/events":          RateGroupRead,
+	"GET /api/events/ws":       RateGroupRead,
+	"GET /me/merch":            RateGroupRead,
+	"GET /me/transactions":     RateGroupRead,
+	"POST /api/sendCoin":       RateGroupWrite,
+	"POST /api/sendCoin/batch": RateGroupWrite,
+	"POST /me/transfer":        RateGroupWrite,
+	"GET /api/buy/{item}":      RateGroupWrite,
+	"GET /api/v2/me":           RateGroupRead,
+	"POST /api/v2/transfers":   RateGroupWrite,
+	"POST /api/v2/purchases":   RateGroupWrite,
+	// Методы gRPC: HTTP/2 POST на /<сервис>/<метод>
+	"POST /merch.v1.MerchStore/GetInfo":  RateGroupRead,
+	"POST /merch.v1.MerchStore/SendCoin": RateGroupWrite,
+	"POST /merch.v1.MerchStore/BuyItem":  RateGroupWrite,
+}
+
+// RateLimit - параметры token bucket: Rate токенов в секунду, не больше Burst.
+// Нулевой Rate отключает лимит.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// parseRateLimit разбирает лимит вида "10/1s", "60/1m,20" (после запятой - burst)
+func parseRateLimit(s string) (RateLimit, error) {
+	spec, burstStr, hasBurst := strings.Cut(strings.TrimSpace(s), ",")
+	countStr, periodStr, ok := strings.Cut(spec, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("лимит %q: ожидается <число>/<период>", s)
+	}
+	count, err := strconv.Atoi(countStr)
+	if err != nil || count < 0 {
+		return RateLimit{}, fmt.Errorf("лимит %q: неверное число запросов", s)
+	}
+	if periodStr != "" && (periodStr[0] < '0' || periodStr[0] > '9') {
+		periodStr = "1" + periodStr // "10/s" = "10/1s"
+	}
+	period, err := time.ParseDuration(periodStr)
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("лимит %q: неверный период", s)
+	}
+	limit := RateLimit{Rate: float64(count) / period.Seconds(), Burst: count}
+	if hasBurst {
+		if limit.Burst, err = strconv.Atoi(burstStr); err != nil || limit.Burst < 1 {
+			return RateLimit{}, fmt.Errorf("лимит %q: неверный burst", s)
+		}
+	}
+	if limit.Burst < 1 && limit.Rate > 0 {
+		limit.Burst = 1
+	}
+	return limit, nil
+}
+
+// RateLimitResult - решение лимитера для одного запроса
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // Когда появится следующий токен (если отказано)
+	Reset      time.Duration // Когда корзина наполнится полностью
+}
+
+// RateLimiter - хранилище корзин. В памяти - для одного экземпляра,
+// в Postgres - общее для нескольких экземпляров.
+type RateLimiter interface {
+	Allow(key string, limit RateLimit) (RateLimitResult, error)
+	// Run удаляет давно не использованные корзины до отмены контекста
+	Run(ctx context.Context)
+}
+
+// bucketResult считает ответ по числу токенов после запроса
+func bucketResult(allowed bool, tokens float64, limit RateLimit) RateLimitResult {
+	res := RateLimitResult{Allowed: allowed, Remaining: int(math.Floor(tokens))}
+	res.Reset = time.Duration((float64(limit.Burst) - tokens) / limit.Rate * float64(time.Second))
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	return res
+}
+
+// MemoryRateLimiter хранит корзины в памяти процесса
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	now     func() time.Time
+}
+
+type memoryBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewMemoryRateLimiter() *MemoryRateLimiter {
+	return &MemoryRateLimiter{buckets: map[string]*memoryBucket{}, now: time.Now}
+}
+
+func (l *MemoryRateLimiter) Allow(key string, limit RateLimit) (RateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	b := l.buckets[key]
+	if b == nil {
+		b = &memoryBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return bucketResult(false, b.tokens, limit), nil
+	}
+	b.tokens--
+	return bucketResult(true, b.tokens, limit), nil
+}
+
+func (l *MemoryRateLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if l.now().Sub(b.last) > time.Hour {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// PostgresRateLimiter хранит корзины в таблице rate_limit_buckets. Пополнение и списание
+// выполняются одной командой, поэтому экземпляры не мешают друг другу.
+type PostgresRateLimiter struct{}
+
+func (PostgresRateLimiter) Allow(key string, limit RateLimit) (RateLimitResult, error) {
+	var tokens float64
+	var allowed bool
+	err := db.QueryRow(`
+		INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+		VALUES ($1, $2::DOUBLE PRECISION - 1, TRUE, now())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = LEAST($2, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * $3)
+				- CASE WHEN LEAST($2, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * $3) >= 1 THEN 1 ELSE 0 END,
+			allowed = LEAST($2, b.tokens + EXTRACT(EPOCH FROM now() - b.updated_at) * $3) >= 1,
+			updated_at = now()
+		RETURNING tokens, allowed
+	`, key, limit.Burst, limit.Rate).Scan(&tokens, &allowed)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return bucketResult(allowed, tokens, limit), nil
+}
+
+func (PostgresRateLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		db.Exec(`DELETE FROM rate_limit_buckets WHERE updated_at < now() - INTERVAL '1 hour'`)
+	}
+}
+
+// newRateLimiter выбирает хранилище по RATE_LIMIT_BACKEND
+func newRateLimiter(backend string) RateLimiter {
+	if backend == "postgres" {
+		return PostgresRateLimiter{}
+	}
+	return NewMemoryRateLimiter()
+}
+
+var rateLimiter = newRateLimiter(config.RateLimitBackend)
+
+// applyRateLimit списывает токен и выставляет заголовки X-RateLimit-*.
+// Возвращает false, если клиент получил 429.
+func applyRateLimit(w http.ResponseWriter, r *http.Request, key string, limit RateLimit) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	res, err := rateLimiter.Allow(key, limit)
+	if err != nil {
+		// Недоступность хранилища лимитов не должна останавливать магазин
+		log.Printf("Ошибка лимитера запросов: %v", err)
+		return true
+	}
+
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+	if res.Allowed {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, CodeRateLimited, "rate_limited")
+	return false
+}
+
+// routeRateGroup определяет группу лимита по шаблону маршрута
+func routeRateGroup(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		tmpl, _ := route.GetPathTemplate()
+		if group, ok := rateLimitRouteGroups[r.Method+" "+tmpl]; ok {
+			return group
+		}
+	}
+	return RateGroupDefault
+}
+
+// RateLimitMiddleware ограничивает запросы пользователя по группам маршрутов.
+// Должен стоять после JWTMiddleware.
+func RateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group := routeRateGroup(r)
+		key := "ip:" + clientIP(r)
+		if username, _ := r.Context().Value("username").(string); username != "" {
+			key = "user:" + username
+		}
+		if !applyRateLimit(w, r, group+":"+key, config.RateLimits[group]) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitByIP ограничивает открытые маршруты входа по адресу клиента
+func limitByIP(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !applyRateLimit(w, r, RateGroupAuth+":ip:"+clientIP(r), config.RateLimits[RateGroupAuth]) {
+			return
+		}
+		h(w, r)
+	})
+}
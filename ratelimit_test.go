@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	cases := map[string]RateLimit{
+		"10/1s":    {Rate: 10, Burst: 10},
+		"10/s":     {Rate: 10, Burst: 10},
+		"60/1m,20": {Rate: 1, Burst: 20},
+		"0/1s":     {Rate: 0, Burst: 0},
+	}
+	for spec, want := range cases {
+		got, err := parseRateLimit(spec)
+		if err != nil || got != want {
+			t.Errorf("%q: got %+v (%v), want %+v", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"", "10", "x/1s", "10/0s", "10/1s,0", "10/1s,x"} {
+		if _, err := parseRateLimit(spec); err == nil {
+			t.Errorf("%q: expected error", spec)
+		}
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	l := NewMemoryRateLimiter()
+	now := time.Unix(1700000000, 0)
+	l.now = func() time.Time { return now }
+	limit := RateLimit{Rate: 1, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		if res, _ := l.Allow("k", limit); !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("Request %d: got %+v", i, res)
+		}
+	}
+	res, _ := l.Allow("k", limit)
+	if res.Allowed || res.RetryAfter != time.Second {
+		t.Fatalf("Expected denial with 1s retry, got %+v", res)
+	}
+	if res, _ := l.Allow("other", limit); !res.Allowed {
+		t.Fatal("Buckets must be independent per key")
+	}
+
+	now = now.Add(1500 * time.Millisecond)
+	if res, _ := l.Allow("k", limit); !res.Allowed {
+		t.Fatalf("Expected refill after 1.5s, got %+v", res)
+	}
+	if res, _ := l.Allow("k", limit); res.Allowed {
+		t.Fatalf("Only one token should have been refilled, got %+v", res)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	savedLimiter, savedLimits := rateLimiter, config.RateLimits
+	defer func() { rateLimiter, config.RateLimits = savedLimiter, savedLimits }()
+	rateLimiter = NewMemoryRateLimiter()
+	config.RateLimits = map[string]RateLimit{RateGroupDefault: {Rate: 0.5, Burst: 2}}
+
+	handler := RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(username string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/schedules", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "username", username))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	serve("alice")
+	rr := serve("alice")
+	if rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Limit") != "2" || rr.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Fatalf("Unexpected response: %d %v", rr.Code, rr.Header())
+	}
+	rr = serve("alice")
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") != "2" {
+		t.Fatalf("Expected 429 with Retry-After 2, got %d %v", rr.Code, rr.Header())
+	}
+	if rr := serve("bob"); rr.Code != http.StatusOK {
+		t.Fatalf("Other users must not share the bucket, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Роли пользователей. Роль user есть у всех и в базе не хранится.
+const (
+	RoleUser         = "user"
+	RoleMerchManager = "merch_manager"
+	RoleTreasurer    = "treasurer"
+	RoleAdmin        = "admin"
+)
+
+// Permission - право на группу служебных маршрутов
+type Permission string
+
+const (
+	PermMerchManage    Permission = "merch:manage"    // Цены и ассортимент мерча
+	PermFraudReview    Permission = "fraud:review"    // Отчёт антифрода и разбор находок
+	PermAccountsFreeze Permission = "accounts:freeze" // Заморозка и разморозка аккаунтов
+	PermAccountsManage Permission = "accounts:manage" // Деактивация и удаление аккаунтов
+	PermInvitesManage  Permission = "invites:manage"  // Приглашения для регистрации
+	PermKeysRotate     Permission = "keys:rotate"     // Ротация ключей подписи JWT
+	PermRolesManage    Permission = "roles:manage"    // Назначение ролей
+	PermWebhooksManage Permission = "webhooks:manage" // Подписки на вебхуки и их доставки
+	PermLimitsManage   Permission = "limits:manage"   // Глобальные и персональные лимиты переводов
+)
+
+// rolePermissions - права каждой роли; у admin есть все права
+var rolePermissions = map[string][]Permission{
+	RoleUser:         {},
+	RoleMerchManager: {PermMerchManage},
+	RoleTreasurer:    {PermFraudReview, PermAccountsFreeze, PermLimitsManage},
+	RoleAdmin: {PermMerchManage, PermFraudReview, PermAccountsFreeze, PermAccountsManage,
+		PermInvitesManage, PermKeysRotate, PermRolesManage, PermWebhooksManage, PermLimitsManage},
+}
+
+var (
+	ErrUnknownRole     = errors.New("неизвестная роль")
+	ErrRoleNotAssigned = errors.New("роль не назначена")
+)
+
+// RoleAuditEntry - запись журнала изменений ролей
+type RoleAuditEntry struct {
+	ID        int       `json:"id"`
+	Actor     string    `json:"actor"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	Action    string    `json:"action"` // grant или revoke
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// HasPermission проверяет, даёт ли хотя бы одна из ролей токена право
+func (c *Claims) HasPermission(perm Permission) bool {
+	for _, role := range c.Roles {
+		for _, p := range rolePermissions[role] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GetUserRoles возвращает роли пользователя: user, назначенные в базе
+// и admin для перечисленных в ADMIN_USER_IDS. Имя для этого не годится:
+// незанятое или освобождённое удалением имя может зарегистрировать кто угодно.
+func GetUserRoles(user *User) ([]string, error) {
+	roles := []string{RoleUser}
+	rows, err := db.Query(`SELECT role FROM user_roles WHERE user_id = $1 ORDER BY role`, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hasAdmin := false
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+		hasAdmin = hasAdmin || role == RoleAdmin
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !hasAdmin {
+		for _, id := range config.AdminUserIDs {
+			if user.ID == id {
+				roles = append(roles, RoleAdmin)
+				break
+			}
+		}
+	}
+	return roles, nil
+}
+
+// isAssignableRole - роли, которые можно назначить через API
+func isAssignableRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok && role != RoleUser
+}
+
+// GrantRole назначает роль и записывает это в журнал. Повторное назначение ничего не меняет.
+func GrantRole(actor, username, role, reason string) error {
+	if !isAssignableRole(role) {
+		return ErrUnknownRole
+	}
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		INSERT INTO user_roles (user_id, role, granted_by) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, role) DO NOTHING
+	`, user.ID, role, actor)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	_, err = tx.Exec(`
+		INSERT INTO role_audit (actor, username, role, action, reason) VALUES ($1, $2, $3, 'grant', $4)
+	`, actor, user.Username, role, nullIfEmpty(reason))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RevokeRole снимает роль и завершает сессии пользователя, чтобы уже выданные
+// токены со снятой ролью перестали действовать
+func RevokeRole(actor, username, role, reason string) error {
+	if !isAssignableRole(role) {
+		return ErrUnknownRole
+	}
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM user_roles WHERE user_id = $1 AND role = $2`, user.ID, role)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrRoleNotAssigned
+	}
+	_, err = tx.Exec(`
+		INSERT INTO role_audit (actor, username, role, action, reason) VALUES ($1, $2, $3, 'revoke', $4)
+	`, actor, user.Username, role, nullIfEmpty(reason))
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return RevokeAllSessions(user.ID)
+}
+
+// ListRoleAudit возвращает журнал изменений ролей, новые записи сначала
+func ListRoleAudit(username string, limit int) ([]RoleAuditEntry, error) {
+	rows, err := db.Query(`
+		SELECT id, actor, username, role, action, COALESCE(reason, ''), created_at
+		FROM role_audit
+		WHERE $1 = '' OR LOWER(username) = LOWER($1)
+		ORDER BY id DESC LIMIT $2
+	`, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]RoleAuditEntry, 0)
+	for rows.Next() {
+		var e RoleAuditEntry
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Username, &e.Role, &e.Action, &e.Reason, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// RequirePermission пропускает запрос, только если роли из токена дают право.
+// Должен стоять после JWTMiddleware.
+func RequirePermission(perm Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, _ := r.Context().Value("claims").(*Claims)
+			if claims == nil || !claims.HasPermission(perm) {
+				writeError(w, r, http.StatusForbidden, CodeForbidden, "forbidden")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withPermission оборачивает обработчик маршрута проверкой права
+func withPermission(perm Permission, h http.HandlerFunc) http.Handler {
+	return RequirePermission(perm)(h)
+}
+
+// ListRolesHandler возвращает роли и их права.
+func ListRolesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rolePermissions)
+}
+
+// GetUserRolesHandler возвращает роли пользователя.
+func GetUserRolesHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetUserByUsername(mux.Vars(r)["username"])
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+	roles, err := GetUserRoles(user)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "roles_fetch_failed")
+		return
+	}
+	sort.Strings(roles)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"username": user.Username, "roles": roles})
+}
+
+// GrantRoleHandler назначает роль ({"reason"} в теле необязателен).
+func GrantRoleHandler(w http.ResponseWriter, r *http.Request) {
+	changeRole(w, r, GrantRole)
+}
+
+// RevokeRoleHandler снимает роль.
+func RevokeRoleHandler(w http.ResponseWriter, r *http.Request) {
+	changeRole(w, r, RevokeRole)
+}
+
+func changeRole(w http.ResponseWriter, r *http.Request, change func(actor, username, role, reason string) error) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+			return
+		}
+	}
+	vars := mux.Vars(r)
+	actor := r.Context().Value("username").(string)
+
+	err := change(actor, vars["username"], vars["role"], req.Reason)
+	switch {
+	case errors.Is(err, ErrUnknownRole):
+		writeError(w, r, http.StatusBadRequest, CodeValidationFailed, "unknown_role")
+		return
+	case errors.Is(err, ErrUserNotFound):
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	case errors.Is(err, ErrRoleNotAssigned):
+		writeError(w, r, http.StatusNotFound, CodeNotFound, "role_not_assigned")
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "role_update_failed")
+		return
+	}
+
+	GetUserRolesHandler(w, r)
+}
+
+// RoleAuditHandler возвращает журнал изменений ролей (?username= для одного пользователя).
+func RoleAuditHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := ListRoleAudit(r.URL.Query().Get("username"), 200)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "audit_fetch_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClaimsHasPermission(t *testing.T) {
+	cases := []struct {
+		roles []string
+		perm  Permission
+		want  bool
+	}{
+		{[]string{RoleUser}, PermFraudReview, false},
+		{[]string{RoleUser, RoleTreasurer}, PermFraudReview, true},
+		{[]string{RoleUser, RoleTreasurer}, PermMerchManage, false},
+		{[]string{RoleUser, RoleMerchManager}, PermMerchManage, true},
+		{[]string{RoleUser, RoleAdmin}, PermRolesManage, true},
+		{[]string{"unknown"}, PermRolesManage, false},
+		{nil, PermKeysRotate, false},
+	}
+	for _, c := range cases {
+		claims := &Claims{Roles: c.roles}
+		if got := claims.HasPermission(c.perm); got != c.want {
+			t.Errorf("roles %v, %s: got %v, want %v", c.roles, c.perm, got, c.want)
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	handler := RequirePermission(PermAccountsFreeze)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	serve := func(claims *Claims) int {
+		req := httptest.NewRequest("POST", "/api/admin/users/bob/freeze", nil)
+		if claims != nil {
+			req = req.WithContext(context.WithValue(req.Context(), "claims", claims))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := serve(nil); code != http.StatusForbidden {
+		t.Errorf("Without claims: expected 403, got %d", code)
+	}
+	if code := serve(&Claims{Username: "u", Roles: []string{RoleUser, RoleMerchManager}}); code != http.StatusForbidden {
+		t.Errorf("Merch manager: expected 403, got %d", code)
+	}
+	if code := serve(&Claims{Username: "t", Roles: []string{RoleUser, RoleTreasurer}}); code != http.StatusNoContent {
+		t.Errorf("Treasurer: expected 204, got %d", code)
+	}
+}
+
+func TestAdminUserIDsGrantAdmin(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	getTokenForUser(t, "bootstrap_admin")
+	admin := GetUser("bootstrap_admin")
+	config.AdminUserIDs = []int{admin.ID}
+
+	hasAdmin := func(user *User) bool {
+		roles, err := GetUserRoles(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, role := range roles {
+			if role == RoleAdmin {
+				return true
+			}
+		}
+		return false
+	}
+	if !hasAdmin(admin) {
+		t.Error("Expected admin role for a user listed in ADMIN_USER_IDS")
+	}
+	// Другой аккаунт с тем же именем (после удаления или в другом регистре) роль не получает
+	getTokenForUser(t, "bootstrap_other")
+	impostor := GetUser("bootstrap_other")
+	impostor.Username = admin.Username
+	if hasAdmin(impostor) {
+		t.Error("Admin role granted by username")
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Статусы запланированного перевода
+const (
+	ScheduleActive    = "active"
+	SchedulePaused    = "paused"
+	ScheduleCompleted = "completed" // Разовый перевод выполнен
+	ScheduleFailed    = "failed"    // Разовый перевод завершился ошибкой
+)
+
+var (
+	ErrScheduleNotFound  = errors.New("расписание не найдено")
+	ErrScheduleSameState = errors.New("расписание не найдено или уже в этом состоянии")
+	ErrInvalidSchedule   = errors.New("неверное расписание")
+)
+
+// ScheduleRequest - запрос на создание запланированного перевода.
+// Нужно указать либо RunAt (разовый перевод), либо Cron (регулярный).
+type ScheduleRequest struct {
+	ToUser string     `json:"toUser"`          // Имя получателя монет
+	Amount int        `json:"amount"`          // Количество монет
+	RunAt  *time.Time `json:"runAt,omitempty"` // Время разового перевода (RFC 3339)
+	Cron   string     `json:"cron,omitempty"`  // Расписание в формате cron, время в UTC
+	TransferMeta
+}
+
+// ScheduledTransfer - запланированный перевод монет
+type ScheduledTransfer struct {
+	ID           int        `json:"id"`
+	ToUser       string     `json:"toUser"`
+	Amount       int        `json:"amount"`
+	Cron         string     `json:"cron,omitempty"`
+	Status       string     `json:"status"`
+	NextRunAt    *time.Time `json:"nextRunAt,omitempty"`
+	LastRunAt    *time.Time `json:"lastRunAt,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+	FailureCount int        `json:"failureCount"` // Ошибок подряд с последнего успешного запуска
+	CreatedAt    time.Time  `json:"createdAt"`
+	TransferMeta
+}
+
+// ScheduleRun - запись об одном запуске запланированного перевода
+type ScheduleRun struct {
+	RunAt   time.Time `json:"runAt"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+const scheduleColumns = `
+	s.id, u.username, s.amount, COALESCE(s.cron_expr, ''), s.status,
+	s.next_run_at, s.last_run_at, COALESCE(s.last_error, ''), s.failure_count, s.created_at,
+	COALESCE(s.memo, ''), COALESCE(s.category, '')
+`
+
+func scanScheduledTransfer(row interface{ Scan(...interface{}) error }) (*ScheduledTransfer, error) {
+	var s ScheduledTransfer
+	var nextRun, lastRun sql.NullTime
+	err := row.Scan(&s.ID, &s.ToUser, &s.Amount, &s.Cron, &s.Status,
+		&nextRun, &lastRun, &s.LastError, &s.FailureCount, &s.CreatedAt, &s.Memo, &s.Category)
+	if err != nil {
+		return nil, err
+	}
+	if nextRun.Valid {
+		s.NextRunAt = &nextRun.Time
+	}
+	if lastRun.Valid {
+		s.LastRunAt = &lastRun.Time
+	}
+	return &s, nil
+}
+
+// CreateScheduledTransfer сохраняет новый запланированный перевод от имени отправителя
+func CreateScheduledTransfer(sender, recipient *User, req ScheduleRequest) (*ScheduledTransfer, error) {
+	var cronExpr sql.NullString
+	var nextRun time.Time
+	if req.Cron != "" {
+		schedule, err := ParseCron(req.Cron)
+		if err != nil {
+			return nil, &FieldError{Field: "cron", Err: fmt.Errorf("%w: %v", ErrInvalidSchedule, err)}
+		}
+		nextRun = schedule.Next(time.Now().UTC())
+		if nextRun.IsZero() {
+			return nil, &FieldError{Field: "cron", Err: fmt.Errorf("%w: никогда не срабатывает", ErrInvalidSchedule)}
+		}
+		cronExpr = sql.NullString{String: req.Cron, Valid: true}
+	} else {
+		nextRun = req.RunAt.UTC()
+	}
+
+	var id int
+	err := db.QueryRow(`
+		INSERT INTO scheduled_transfers (sender_id, receiver_id, amount, cron_expr, next_run_at, memo, category)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`, sender.ID, recipient.ID, req.Amount, cronExpr, nextRun,
+		nullIfEmpty(req.Memo), nullIfEmpty(req.Category)).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+	return GetScheduledTransfer(sender.ID, id)
+}
+
+// GetScheduledTransfer возвращает перевод, только если он принадлежит отправителю
+func GetScheduledTransfer(senderID, id int) (*ScheduledTransfer, error) {
+	row := db.QueryRow(`SELECT `+scheduleColumns+`
+		FROM scheduled_transfers s
+		JOIN users u ON u.id = s.receiver_id
+		WHERE s.id = $1 AND s.sender_id = $2
+	`, id, senderID)
+	s, err := scanScheduledTransfer(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrScheduleNotFound
+	}
+	return s, err
+}
+
+// ListScheduledTransfers возвращает все запланированные переводы отправителя
+func ListScheduledTransfers(senderID int) ([]ScheduledTransfer, error) {
+	rows, err := db.Query(`SELECT `+scheduleColumns+`
+		FROM scheduled_transfers s
+		JOIN users u ON u.id = s.receiver_id
+		WHERE s.sender_id = $1
+		ORDER BY s.id
+	`, senderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := make([]ScheduledTransfer, 0)
+	for rows.Next() {
+		s, err := scanScheduledTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, *s)
+	}
+	return schedules, rows.Err()
+}
+
+// SetScheduleStatus ставит расписание на паузу или возобновляет его.
+// При возобновлении регулярного перевода пропущенные запуски не догоняются.
+func SetScheduleStatus(senderID, id int, status string) (*ScheduledTransfer, error) {
+	current, err := GetScheduledTransfer(senderID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	from, nextRun := ScheduleActive, current.NextRunAt
+	if status == ScheduleActive {
+		from = SchedulePaused
+		if current.Cron != "" {
+			schedule, err := ParseCron(current.Cron)
+			if err != nil {
+				return nil, err
+			}
+			next := schedule.Next(time.Now().UTC())
+			nextRun = &next
+		}
+	}
+
+	res, err := db.Exec(`
+		UPDATE scheduled_transfers SET status = $1, next_run_at = $2, failure_count = 0
+		WHERE id = $3 AND sender_id = $4 AND status = $5
+	`, status, nextRun, id, senderID, from)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrScheduleSameState
+	}
+	return GetScheduledTransfer(senderID, id)
+}
+
+// DeleteScheduledTransfer удаляет расписание вместе с историей запусков
+func DeleteScheduledTransfer(senderID, id int) error {
+	res, err := db.Exec(`DELETE FROM scheduled_transfers WHERE id = $1 AND sender_id = $2`, id, senderID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrScheduleNotFound
+	}
+	return nil
+}
+
+// ListScheduleRuns возвращает последние запуски расписания, новые сначала
+func ListScheduleRuns(senderID, id int) ([]ScheduleRun, error) {
+	if _, err := GetScheduledTransfer(senderID, id); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`
+		SELECT run_at, success, COALESCE(error, '')
+		FROM scheduled_transfer_runs
+		WHERE schedule_id = $1
+		ORDER BY id DESC
+		LIMIT 100
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]ScheduleRun, 0)
+	for rows.Next() {
+		var run ScheduleRun
+		if err := rows.Scan(&run.RunAt, &run.Success, &run.Error); err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// Scheduler периодически выполняет наступившие запланированные переводы.
+// Состояние хранится в базе, поэтому переживает перезапуски, а благодаря
+// FOR UPDATE SKIP LOCKED несколько экземпляров приложения не выполнят один запуск дважды.
+type Scheduler struct {
+	interval time.Duration
+}
+
+// NewScheduler создаёт планировщик с заданным интервалом опроса базы
+func NewScheduler(interval time.Duration) *Scheduler {
+	return &Scheduler{interval: interval}
+}
+
+// Run работает до отмены контекста
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.RunDue(time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue выполняет все переводы, время которых наступило к моменту now
+func (s *Scheduler) RunDue(now time.Time) {
+	for {
+		ran, err := runNextScheduledTransfer(now)
+		if err != nil {
+			log.Printf("Ошибка планировщика переводов: %v", err)
+			return
+		}
+		if !ran {
+			return
+		}
+	}
+}
+
+// runNextScheduledTransfer выполняет один наступивший перевод. Результат запуска
+// и следующее время срабатывания записываются в той же транзакции, что и сам перевод.
+// Неудачный запуск не повторяется сразу: регулярный перевод ждёт следующего
+// срабатывания, а после ScheduleMaxFailures ошибок подряд ставится на паузу.
+func runNextScheduledTransfer(now time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var id, senderID, receiverID, amount, failures int
+	var cronExpr sql.NullString
+	var meta TransferMeta
+	err = tx.QueryRow(`
+		SELECT id, sender_id, receiver_id, amount, cron_expr, failure_count,
+			COALESCE(memo, ''), COALESCE(category, '')
+		FROM scheduled_transfers
+		WHERE status = 'active' AND next_run_at <= $1
+		ORDER BY next_run_at
+		LIMIT 1
+		FOR UPDATE SKIP LOCKED
+	`, now).Scan(&id, &senderID, &receiverID, &amount, &cronExpr, &failures, &meta.Memo, &meta.Category)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// Ошибку перевода откатываем до точки сохранения, чтобы записать её в историю
+	if _, err := tx.Exec(`SAVEPOINT scheduled_transfer`); err != nil {
+		return false, err
+	}
+	runErr := transferCoinsTx(tx, senderID, receiverID, amount, meta)
+	if runErr != nil {
+		if _, err := tx.Exec(`ROLLBACK TO SAVEPOINT scheduled_transfer`); err != nil {
+			return false, err
+		}
+		failures++
+	} else {
+		failures = 0
+	}
+
+	status := ScheduleActive
+	var nextRun *time.Time
+	if cronExpr.Valid {
+		schedule, err := ParseCron(cronExpr.String)
+		if err != nil {
+			return false, err
+		}
+		if next := schedule.Next(now); !next.IsZero() {
+			nextRun = &next
+		} else {
+			status = ScheduleCompleted
+		}
+		if runErr != nil && failures >= config.ScheduleMaxFailures {
+			status = SchedulePaused
+		}
+	} else if runErr != nil {
+		status = ScheduleFailed
+	} else {
+		status = ScheduleCompleted
+	}
+
+	var lastError sql.NullString
+	if runErr != nil {
+		lastError = sql.NullString{String: runErr.Error(), Valid: true}
+	}
+	_, err = tx.Exec(`
+		UPDATE scheduled_transfers
+		SET status = $1, next_run_at = $2, last_run_at = $3, last_error = $4, failure_count = $5
+		WHERE id = $6
+	`, status, nextRun, now, lastError, failures, id)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO scheduled_transfer_runs (schedule_id, run_at, success, error)
+		VALUES ($1, $2, $3, $4)
+	`, id, now, runErr == nil, lastError)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// scheduleOwner извлекает текущего пользователя и id расписания из запроса
+func scheduleOwner(w http.ResponseWriter, r *http.Request) (*User, int, bool) {
+	username := r.Context().Value("username").(string)
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return nil, 0, false
+	}
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	return user, id, true
+}
+
+// CreateScheduleHandler создаёт разовый или регулярный перевод монет.
+func CreateScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	var req ScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ToUser == "" || req.Amount <= 0 {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+	if (req.RunAt == nil) == (req.Cron == "") {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "schedule_kind_required")
+		return
+	}
+	if req.RunAt != nil && !req.RunAt.After(time.Now()) {
+		writeFieldError(w, r, "runAt", "run_at_in_past")
+		return
+	}
+	meta, err := normalizeTransferMeta(req.TransferMeta)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	req.TransferMeta = meta
+
+	username := r.Context().Value("username").(string)
+	sender, err := GetUserByUsername(username)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+
+	recipient, err := GetUserByUsername(req.ToUser)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeRecipientNotFound, "recipient_not_found")
+		return
+	}
+	// Расписание переводит деньги без участия пользователя, поэтому код нужен при создании
+	if !stepUpVerified(w, r, sender, req.Amount) {
+		return
+	}
+
+	schedule, err := CreateScheduledTransfer(sender, recipient, req)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// ListSchedulesHandler возвращает запланированные переводы пользователя.
+func ListSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	user, _, ok := scheduleOwner(w, r)
+	if !ok {
+		return
+	}
+
+	schedules, err := ListScheduledTransfers(user.ID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "schedules_fetch_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// PauseScheduleHandler приостанавливает запланированный перевод.
+func PauseScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	setScheduleStatus(w, r, SchedulePaused)
+}
+
+// ResumeScheduleHandler возобновляет приостановленный перевод.
+func ResumeScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	setScheduleStatus(w, r, ScheduleActive)
+}
+
+func setScheduleStatus(w http.ResponseWriter, r *http.Request, status string) {
+	user, id, ok := scheduleOwner(w, r)
+	if !ok {
+		return
+	}
+
+	schedule, err := SetScheduleStatus(user.ID, id, status)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedule)
+}
+
+// DeleteScheduleHandler удаляет запланированный перевод.
+func DeleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	user, id, ok := scheduleOwner(w, r)
+	if !ok {
+		return
+	}
+
+	if err := DeleteScheduledTransfer(user.ID, id); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListScheduleRunsHandler возвращает историю запусков, включая ошибки.
+func ListScheduleRunsHandler(w http.ResponseWriter, r *http.Request) {
+	user, id, ok := scheduleOwner(w, r)
+	if !ok {
+		return
+	}
+
+	runs, err := ListScheduleRuns(user.ID, id)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runs)
+}
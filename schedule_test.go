@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// scheduleUsers регистрирует отправителя и получателя запланированных переводов
+func scheduleUsers(t *testing.T, sender, recipient string) (*User, *User) {
+	getTokenForUser(t, sender)
+	getTokenForUser(t, recipient)
+	return GetUser(sender), GetUser(recipient)
+}
+
+// createSchedule сохраняет расписание и удаляет его после теста
+func createSchedule(t *testing.T, sender, recipient *User, req ScheduleRequest) *ScheduledTransfer {
+	schedule, err := CreateScheduledTransfer(sender, recipient, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DeleteScheduledTransfer(sender.ID, schedule.ID) })
+	return schedule
+}
+
+func getSchedule(t *testing.T, sender *User, id int) *ScheduledTransfer {
+	schedule, err := GetScheduledTransfer(sender.ID, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schedule
+}
+
+func TestScheduledTransferRuns(t *testing.T) {
+	sender, recipient := scheduleUsers(t, "schedule_sender", "schedule_recipient")
+	runAt := time.Now().UTC().Add(time.Hour)
+	schedule := createSchedule(t, sender, recipient, ScheduleRequest{
+		ToUser: recipient.Username, Amount: 5, RunAt: &runAt, TransferMeta: TransferMeta{Memo: "по расписанию"},
+	})
+
+	// До наступления времени перевод не выполняется
+	NewScheduler(time.Second).RunDue(runAt.Add(-time.Minute))
+	if s := getSchedule(t, sender, schedule.ID); s.Status != ScheduleActive || s.LastRunAt != nil {
+		t.Fatalf("Schedule ran too early: %+v", s)
+	}
+
+	NewScheduler(time.Second).RunDue(runAt)
+	if got := GetUser(sender.Username).Coins; got != sender.Coins-5 {
+		t.Errorf("Expected sender balance %d, got %d", sender.Coins-5, got)
+	}
+	if got := GetUser(recipient.Username).Coins; got != recipient.Coins+5 {
+		t.Errorf("Expected recipient balance %d, got %d", recipient.Coins+5, got)
+	}
+	s := getSchedule(t, sender, schedule.ID)
+	if s.Status != ScheduleCompleted || s.NextRunAt != nil || s.LastError != "" {
+		t.Errorf("Expected completed schedule, got %+v", s)
+	}
+	runs, err := ListScheduleRuns(sender.ID, schedule.ID)
+	if err != nil || len(runs) != 1 || !runs[0].Success {
+		t.Errorf("Expected one successful run, got %+v, %v", runs, err)
+	}
+}
+
+func TestScheduledTransferInsufficientFunds(t *testing.T) {
+	sender, recipient := scheduleUsers(t, "schedule_poor", "schedule_poor_recipient")
+	runAt := time.Now().UTC().Add(time.Hour)
+	schedule := createSchedule(t, sender, recipient, ScheduleRequest{
+		ToUser: recipient.Username, Amount: sender.Coins + 1, RunAt: &runAt,
+	})
+
+	NewScheduler(time.Second).RunDue(runAt)
+	if got := GetUser(sender.Username).Coins; got != sender.Coins {
+		t.Errorf("Failed run changed the balance: %d -> %d", sender.Coins, got)
+	}
+	s := getSchedule(t, sender, schedule.ID)
+	if s.Status != ScheduleFailed || s.LastError == "" || s.FailureCount != 1 {
+		t.Errorf("Expected failed schedule with an error, got %+v", s)
+	}
+	runs, err := ListScheduleRuns(sender.ID, schedule.ID)
+	if err != nil || len(runs) != 1 || runs[0].Success || runs[0].Error == "" {
+		t.Errorf("Expected one failed run, got %+v, %v", runs, err)
+	}
+}
+
+func TestScheduledTransferPausesAfterFailures(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.ScheduleMaxFailures = 2
+
+	sender, recipient := scheduleUsers(t, "schedule_failing", "schedule_failing_recipient")
+	schedule := createSchedule(t, sender, recipient, ScheduleRequest{
+		ToUser: recipient.Username, Amount: sender.Coins + 1, Cron: "* * * * *",
+	})
+
+	// Первая ошибка: регулярный перевод ждёт следующего срабатывания
+	NewScheduler(time.Second).RunDue(*schedule.NextRunAt)
+	s := getSchedule(t, sender, schedule.ID)
+	if s.Status != ScheduleActive || s.FailureCount != 1 || s.NextRunAt == nil || !s.NextRunAt.After(*schedule.NextRunAt) {
+		t.Fatalf("Expected active schedule with one failure, got %+v", s)
+	}
+
+	NewScheduler(time.Second).RunDue(*s.NextRunAt)
+	if s := getSchedule(t, sender, schedule.ID); s.Status != SchedulePaused || s.FailureCount != 2 {
+		t.Errorf("Expected paused schedule after %d failures, got %+v", config.ScheduleMaxFailures, s)
+	}
+}
+
+func TestScheduledTransferSkipsLocked(t *testing.T) {
+	sender, recipient := scheduleUsers(t, "schedule_locked", "schedule_locked_recipient")
+	runAt := time.Now().UTC().Add(time.Hour)
+	schedule := createSchedule(t, sender, recipient, ScheduleRequest{ToUser: recipient.Username, Amount: 1, RunAt: &runAt})
+
+	// Другой экземпляр уже выполняет этот запуск и держит строку
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT id FROM scheduled_transfers WHERE id = $1 FOR UPDATE`, schedule.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		NewScheduler(time.Second).RunDue(runAt)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Scheduler waited for a locked schedule instead of skipping it")
+	}
+	if s := getSchedule(t, sender, schedule.ID); s.Status != ScheduleActive || s.LastRunAt != nil {
+		t.Fatalf("Locked schedule was run: %+v", s)
+	}
+
+	tx.Rollback()
+	NewScheduler(time.Second).RunDue(runAt)
+	if s := getSchedule(t, sender, schedule.ID); s.Status != ScheduleCompleted {
+		t.Errorf("Expected the schedule to run once unlocked, got %+v", s)
+	}
+}
+
+func TestScheduleEndpoints(t *testing.T) {
+	r := newRouter()
+	token := getTokenForUser(t, "schedule_api_owner")
+	otherToken := getTokenForUser(t, "schedule_api_other")
+	getTokenForUser(t, "schedule_api_recipient")
+
+	do := func(token, method, path string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	errorCode := func(rr *httptest.ResponseRecorder) string {
+		var resp ErrorResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		if len(resp.Errors) == 0 {
+			return ""
+		}
+		return resp.Errors[0].Code
+	}
+
+	rr := do(token, "POST", "/api/schedules", ScheduleRequest{ToUser: "schedule_api_recipient", Amount: 3, Cron: "0 9 * * 1"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", rr.Code, rr.Body)
+	}
+	var created ScheduledTransfer
+	json.NewDecoder(rr.Body).Decode(&created)
+	owner := GetUser("schedule_api_owner")
+	defer DeleteScheduledTransfer(owner.ID, created.ID)
+	if created.Status != ScheduleActive || created.NextRunAt == nil || created.NextRunAt.Weekday() != time.Monday {
+		t.Fatalf("Unexpected schedule %+v", created)
+	}
+
+	if rr := do(token, "POST", "/api/schedules", ScheduleRequest{ToUser: "schedule_api_recipient", Amount: 3, Cron: "61 * * * *"}); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid cron, got %d", rr.Code)
+	}
+
+	path := fmt.Sprintf("/api/schedules/%d", created.ID)
+	if rr := do(otherToken, "POST", path+"/pause", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for another user's schedule, got %d", rr.Code)
+	}
+
+	rr = do(token, "POST", path+"/pause", nil)
+	var paused ScheduledTransfer
+	json.NewDecoder(rr.Body).Decode(&paused)
+	if rr.Code != http.StatusOK || paused.Status != SchedulePaused {
+		t.Fatalf("Expected paused schedule, got %d %+v", rr.Code, paused)
+	}
+	if rr := do(token, "POST", path+"/pause", nil); rr.Code != http.StatusNotFound || errorCode(rr) != CodeNotFound {
+		t.Errorf("Expected 404 when pausing twice, got %d: %s", rr.Code, rr.Body)
+	}
+
+	rr = do(token, "POST", path+"/resume", nil)
+	var resumed ScheduledTransfer
+	json.NewDecoder(rr.Body).Decode(&resumed)
+	if rr.Code != http.StatusOK || resumed.Status != ScheduleActive || resumed.NextRunAt == nil || !resumed.NextRunAt.After(time.Now()) {
+		t.Fatalf("Expected resumed schedule with a future run, got %d %+v", rr.Code, resumed)
+	}
+
+	if rr := do(token, "DELETE", path, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 on delete, got %d", rr.Code)
+	}
+	if rr := do(token, "GET", path+"/runs", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a deleted schedule, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Сценарии переводов и покупок без привязки к HTTP. Ими пользуются обработчики
+// /api (v1) и /api/v2, поэтому проверки и порядок шагов у версий совпадают.
+// Ошибки отдаются как есть, статус и код ответа для них выбирает toAPIError.
+
+// Actor - пользователь, от имени которого выполняется операция
+type Actor struct {
+	Username string
+	OTP      string // Код 2FA из заголовка X-OTP для операций дороже STEP_UP_THRESHOLD
+	IP       string // Адрес клиента: неверные коды 2FA блокируют его, как при входе
+}
+
+// actorFromRequest - пользователь из токена запроса
+func actorFromRequest(r *http.Request) Actor {
+	actor := Actor{OTP: r.Header.Get("X-OTP"), IP: clientIP(r)}
+	actor.Username, _ = r.Context().Value("username").(string)
+	return actor
+}
+
+// Transfer - выполненный перевод
+type Transfer struct {
+	FromUser string `json:"fromUser"`
+	ToUser   string `json:"toUser"`
+	Amount   int    `json:"amount"`
+	Balance  int    `json:"balance"` // Монет у отправителя после перевода
+	TransferMeta
+}
+
+// Purchase - совершённая покупка
+type Purchase struct {
+	Item    string `json:"item"`
+	Price   int    `json:"price"`
+	Balance int    `json:"balance"` // Монет у покупателя после покупки
+}
+
+// checkStepUp требует второй фактор для операций дороже STEP_UP_THRESHOLD у
+// пользователей с двухфакторной аутентификацией. Запросы с персональным токеном
+// проверяются так же: украденный токен не должен обходить второй фактор.
+func checkStepUp(actor Actor, user *User, amount int) error {
+	if config.StepUpThreshold <= 0 || amount <= config.StepUpThreshold {
+		return nil
+	}
+	enabled, err := TOTPEnabled(user.ID)
+	if err != nil || !enabled {
+		return err
+	}
+	if actor.OTP == "" {
+		return &APIError{Status: http.StatusForbidden, Code: StepUpRequired, Key: "step_up_required", Args: []interface{}{config.StepUpThreshold}}
+	}
+	return verifyStepUpCode(user, actor.IP, actor.OTP)
+}
+
+// SendCoins переводит монеты от actor получателю req.ToUser
+func SendCoins(actor Actor, req SendCoinRequest) (*Transfer, error) {
+	if req.ToUser == "" || req.Amount <= 0 {
+		return nil, &APIError{Code: CodeBadRequest, Key: "bad_request"}
+	}
+	// Имена сравниваются без учёта регистра, как при поиске пользователя
+	if strings.EqualFold(req.ToUser, actor.Username) {
+		return nil, ErrSelfTransfer
+	}
+	meta, err := normalizeTransferMeta(req.TransferMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	sender, err := GetUserByUsername(actor.Username)
+	if err != nil {
+		return nil, err
+	}
+	recipient, err := GetUserByUsername(req.ToUser)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, ErrRecipientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Баланс проверяется до второго фактора, чтобы не тратить код на заведомый отказ
+	if sender.Coins < req.Amount {
+		return nil, &APIError{Code: CodeInsufficientFunds, Key: "insufficient_funds_transfer"}
+	}
+	if err := checkStepUp(actor, sender, req.Amount); err != nil {
+		return nil, err
+	}
+	if err := sender.TransferCoins(recipient, req.Amount, meta); err != nil {
+		return nil, err
+	}
+
+	return &Transfer{
+		FromUser:     sender.Username,
+		ToUser:       recipient.Username,
+		Amount:       req.Amount,
+		Balance:      sender.Coins,
+		TransferMeta: meta,
+	}, nil
+}
+
+// BuyItem покупает товар itemName за монеты actor
+func BuyItem(actor Actor, itemName string) (*Purchase, error) {
+	item, err := GetMerchandiseByName(itemName)
+	if err != nil {
+		return nil, err
+	}
+	user, err := GetUserByUsername(actor.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Coins < item.Price {
+		return nil, &APIError{Code: CodeInsufficientFunds, Key: "insufficient_funds_purchase"}
+	}
+	if err := checkStepUp(actor, user, item.Price); err != nil {
+		return nil, err
+	}
+	if err := user.BuyMerch(item); err != nil {
+		return nil, err
+	}
+
+	return &Purchase{Item: item.Name, Price: item.Price, Balance: user.Coins}, nil
+}
+
+// GetUserInfo собирает баланс, инвентарь и историю переводов пользователя.
+// category ограничивает историю одной категорией, пустая - все переводы.
+func GetUserInfo(username, category string) (*InfoResponse, error) {
+	if !IsValidCategory(category) {
+		return nil, &FieldError{Field: "category", Err: ErrUnknownCategory}
+	}
+	user, err := GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	info := &InfoResponse{Coins: user.Coins, Inventory: make([]InventoryItem, 0)}
+
+	// Инвентарь (купленные товары)
+	rows, err := db.Query(`
+		SELECT m.name, COUNT(*)
+		FROM merchandise m
+		JOIN purchases p ON m.id = p.merchandise_id
+		WHERE p.user_id = $1
+		GROUP BY m.name
+	`, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item InventoryItem
+		if err := rows.Scan(&item.Type, &item.Quantity); err != nil {
+			return nil, err
+		}
+		info.Inventory = append(info.Inventory, item)
+	}
+
+	// Полученные переводы
+	rows, err = db.Query(`
+		SELECT u.username, t.amount, COALESCE(t.memo, ''), COALESCE(t.category, '')
+		FROM transactions t
+		JOIN users u ON u.id = t.sender_id
+		WHERE t.receiver_id = $1 AND ($2::text = '' OR t.category = $2)
+	`, user.ID, category)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var transfer ReceivedTransferInfo
+		if err := rows.Scan(&transfer.FromUser, &transfer.Amount, &transfer.Memo, &transfer.Category); err != nil {
+			return nil, err
+		}
+		info.CoinHistory.Received = append(info.CoinHistory.Received, transfer)
+	}
+
+	// Отправленные переводы
+	rows, err = db.Query(`
+		SELECT u.username, t.amount, COALESCE(t.memo, ''), COALESCE(t.category, '')
+		FROM transactions t
+		JOIN users u ON u.id = t.receiver_id
+		WHERE t.sender_id = $1 AND ($2::text = '' OR t.category = $2)
+	`, user.ID, category)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var transfer SentTransferInfo
+		if err := rows.Scan(&transfer.ToUser, &transfer.Amount, &transfer.Memo, &transfer.Category); err != nil {
+			return nil, err
+		}
+		info.CoinHistory.Sent = append(info.CoinHistory.Sent, transfer)
+	}
+	return info, rows.Err()
+}
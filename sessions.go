@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Session - сессия пользователя, к которой привязан refresh-токен
+type Session struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	Current    bool      `json:"current"` // Сессия, из которой сделан запрос
+}
+
+var ErrInvalidRefreshToken = errors.New("refresh-токен недействителен")
+
+// randomToken возвращает n случайных байт в base64url
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken - в базе хранятся только SHA-256 от refresh-токенов
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIP возвращает IP клиента без порта
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// issueAccessToken создаёт короткоживущий JWT, привязанный к сессии
+func issueAccessToken(user *User, sessionID string) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	roles, err := GetUserRoles(user)
+	if err != nil {
+		return "", err
+	}
+	lang, err := GetUserLanguage(user.ID)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := &Claims{
+		Username:  user.Username,
+		SessionID: sessionID,
+		Roles:     roles,
+		Language:  lang,
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Issuer:    config.JWTIssuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(config.AccessTokenTTL).Unix(),
+		},
+	}
+	return keyManager.Sign(claims)
+}
+
+// storeRefreshToken создаёт новый refresh-токен сессии
+func storeRefreshToken(tx *sql.Tx, sessionID string) (string, error) {
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (token_hash, session_id, expires_at) VALUES ($1, $2, $3)
+	`, hashToken(refreshToken), sessionID, time.Now().Add(config.RefreshTokenTTL))
+	return refreshToken, err
+}
+
+// CreateSession открывает сессию и выдаёт пару access/refresh токенов
+func CreateSession(user *User, userAgent, ip string) (*AuthResponse, error) {
+	sessionID, err := randomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO sessions (id, user_id, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4, $5)
+	`, sessionID, user.ID, userAgent, ip, time.Now().Add(config.RefreshTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := storeRefreshToken(tx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := issueAccessToken(user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthResponse{Token: accessToken, RefreshToken: refreshToken,
+		ExpiresIn: int(config.AccessTokenTTL.Seconds())}, nil
+}
+
+// RefreshSession меняет refresh-токен на новую пару токенов. Каждый refresh-токен
+// одноразовый: повторное предъявление уже использованного токена означает, что
+// его украли, и вся сессия отзывается.
+func RefreshSession(refreshToken string) (*AuthResponse, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sessionID string
+	var used, sessionRevoked bool
+	var user User
+	err = tx.QueryRow(`
+		SELECT s.id, rt.used_at IS NOT NULL, s.revoked_at IS NOT NULL, u.id, u.username, u.coins
+		FROM refresh_tokens rt
+		JOIN sessions s ON s.id = rt.session_id
+		JOIN users u ON u.id = s.user_id
+		WHERE rt.token_hash = $1 AND rt.expires_at > now() AND s.expires_at > now()
+		FOR UPDATE OF rt, s
+	`, hashToken(refreshToken)).Scan(&sessionID, &used, &sessionRevoked, &user.ID, &user.Username, &user.Coins)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if sessionRevoked {
+		return nil, ErrInvalidRefreshToken
+	}
+	if used {
+		if _, err := tx.Exec(`UPDATE sessions SET revoked_at = now() WHERE id = $1`, sessionID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		revocations.RevokeSession(sessionID, time.Now())
+		log.Printf("Повторное использование refresh-токена, сессия %s отозвана", sessionID)
+		return nil, ErrInvalidRefreshToken
+	}
+
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = now() WHERE token_hash = $1`, hashToken(refreshToken)); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET last_used_at = now() WHERE id = $1`, sessionID); err != nil {
+		return nil, err
+	}
+	newRefreshToken, err := storeRefreshToken(tx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := issueAccessToken(&user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthResponse{Token: accessToken, RefreshToken: newRefreshToken,
+		ExpiresIn: int(config.AccessTokenTTL.Seconds())}, nil
+}
+
+// RevokeAccessToken отзывает конкретный access-токен до истечения его срока
+func RevokeAccessToken(claims *Claims) error {
+	if claims.Id == "" {
+		return nil
+	}
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	_, err := db.Exec(`
+		INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING
+	`, claims.Id, expiresAt)
+	if err == nil {
+		revocations.RevokeToken(claims.Id, expiresAt)
+	}
+	return err
+}
+
+// RevokeSession завершает сессию: её refresh-токены и access-токены перестают действовать
+func RevokeSession(userID int, sessionID string) error {
+	_, err := db.Exec(`
+		UPDATE sessions SET revoked_at = now() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, sessionID, userID)
+	if err == nil {
+		revocations.RevokeSession(sessionID, time.Now())
+	}
+	return err
+}
+
+// RevokeAllSessions завершает все сессии пользователя ("выйти везде")
+func RevokeAllSessions(userID int) error {
+	rows, err := db.Query(`
+		UPDATE sessions SET revoked_at = now() WHERE user_id = $1 AND revoked_at IS NULL RETURNING id
+	`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	now := time.Now()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		revocations.RevokeSession(id, now)
+	}
+	return rows.Err()
+}
+
+// ListSessions возвращает активные сессии пользователя
+func ListSessions(userID int, currentID string) ([]Session, error) {
+	rows, err := db.Query(`
+		SELECT id, COALESCE(user_agent, ''), COALESCE(ip, ''), created_at, last_used_at, expires_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now()
+		ORDER BY last_used_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]Session, 0)
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		s.Current = s.ID == currentID
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevocationList - кэш отозванных токенов и сессий в памяти, чтобы JWTMiddleware
+// не ходил в базу на каждый запрос. Отзывы этого экземпляра видны сразу,
+// отзывы других экземпляров - после очередной синхронизации с базой.
+// Хранить отозванные сессии нужно не дольше срока жизни access-токена.
+type RevocationList struct {
+	mu       sync.RWMutex
+	tokens   map[string]time.Time // jti -> когда токен истекает сам
+	sessions map[string]time.Time // id сессии -> когда отозвана
+}
+
+var revocations = &RevocationList{
+	tokens:   map[string]time.Time{},
+	sessions: map[string]time.Time{},
+}
+
+// IsRevoked проверяет access-токен по jti и сессии
+func (l *RevocationList) IsRevoked(claims *Claims) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if _, ok := l.tokens[claims.Id]; ok && claims.Id != "" {
+		return true
+	}
+	_, ok := l.sessions[claims.SessionID]
+	return ok && claims.SessionID != ""
+}
+
+func (l *RevocationList) RevokeToken(jti string, expiresAt time.Time) {
+	l.mu.Lock()
+	l.tokens[jti] = expiresAt
+	l.mu.Unlock()
+}
+
+func (l *RevocationList) RevokeSession(id string, revokedAt time.Time) {
+	l.mu.Lock()
+	l.sessions[id] = revokedAt
+	l.mu.Unlock()
+}
+
+// Sync перечитывает отзывы из базы
+func (l *RevocationList) Sync() error {
+	tokens := map[string]time.Time{}
+	rows, err := db.Query(`SELECT jti, expires_at FROM revoked_tokens WHERE expires_at > now()`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var jti string
+		var expiresAt time.Time
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[jti] = expiresAt
+	}
+	rows.Close()
+
+	sessions := map[string]time.Time{}
+	rows, err = db.Query(`
+		SELECT id, revoked_at FROM sessions WHERE revoked_at > now() - $1::INTERVAL
+	`, pgInterval(config.AccessTokenTTL))
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id string
+		var revokedAt time.Time
+		if err := rows.Scan(&id, &revokedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		sessions[id] = revokedAt
+	}
+	rows.Close()
+
+	l.mu.Lock()
+	l.tokens, l.sessions = tokens, sessions
+	l.mu.Unlock()
+	return nil
+}
+
+// Run синхронизирует кэш с базой до отмены контекста и чистит истёкшие записи
+func (l *RevocationList) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := l.Sync(); err != nil {
+			log.Printf("Ошибка синхронизации отозванных токенов: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < now()`)
+		db.Exec(`DELETE FROM refresh_tokens WHERE expires_at < now()`)
+		db.Exec(`DELETE FROM oidc_login_states WHERE created_at < now() - INTERVAL '10 minutes'`)
+		db.Exec(`
+			DELETE FROM login_attempts
+			WHERE last_failure_at < now() - $1::INTERVAL AND (locked_until IS NULL OR locked_until < now())
+		`, pgInterval(config.LoginFailureWindow))
+	}
+}
+
+// writeToken открывает сессию и отправляет пользователю пару токенов
+func writeToken(w http.ResponseWriter, r *http.Request, user *User, status int) {
+	resp, err := CreateSession(user, r.UserAgent(), clientIP(r))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "token_create_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// RefreshHandler выдаёт новую пару токенов по refresh-токену.
+func RefreshHandler(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+
+	resp, err := RefreshSession(req.RefreshToken)
+	if errors.Is(err, ErrInvalidRefreshToken) {
+		writeError(w, r, http.StatusUnauthorized, CodeInvalidToken, "refresh_token_invalid")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "token_refresh_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// LogoutHandler завершает текущую сессию и отзывает предъявленный access-токен.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*Claims)
+	user, err := GetUserByUsername(claims.Username)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+
+	if err := RevokeAccessToken(claims); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "logout_failed")
+		return
+	}
+	if claims.SessionID != "" {
+		if err := RevokeSession(user.ID, claims.SessionID); err != nil {
+			writeError(w, r, http.StatusInternalServerError, CodeInternal, "logout_failed")
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogoutAllHandler завершает все сессии пользователя на всех устройствах.
+func LogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*Claims)
+	user, err := GetUserByUsername(claims.Username)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+
+	if err := RevokeAllSessions(user.ID); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "logout_failed")
+		return
+	}
+	if err := RevokeAccessToken(claims); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "logout_failed")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListSessionsHandler возвращает активные сессии пользователя.
+func ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	claims := r.Context().Value("claims").(*Claims)
+	user, err := GetUserByUsername(claims.Username)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return
+	}
+
+	sessions, err := ListSessions(user.ID, claims.SessionID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "sessions_fetch_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+func TestRevocationListIsRevoked(t *testing.T) {
+	l := &RevocationList{tokens: map[string]time.Time{}, sessions: map[string]time.Time{}}
+	l.RevokeToken("jti-1", time.Now().Add(time.Hour))
+	l.RevokeSession("session-1", time.Now())
+
+	cases := []struct {
+		claims  Claims
+		revoked bool
+	}{
+		{Claims{}, false},
+		{Claims{SessionID: "session-2"}, false},
+		{Claims{SessionID: "session-1"}, true},
+		{Claims{SessionID: "session-2", StandardClaims: jwt.StandardClaims{Id: "jti-1"}}, true},
+		{Claims{SessionID: "session-2", StandardClaims: jwt.StandardClaims{Id: "jti-2"}}, false},
+	}
+	for _, c := range cases {
+		if got := l.IsRevoked(&c.claims); got != c.revoked {
+			t.Errorf("IsRevoked(%+v) = %v, want %v", c.claims, got, c.revoked)
+		}
+	}
+}
+
+// newSession открывает сессию пользователя, как при входе
+func newSession(t *testing.T, username string) (*User, *AuthResponse) {
+	getTokenForUser(t, username)
+	user := GetUser(username)
+	resp, err := CreateSession(user, "sessions-test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, resp
+}
+
+// expectTokenError проверяет, что access-токен больше не принимается
+func expectTokenError(t *testing.T, token, key string) {
+	t.Helper()
+	_, apiErr := authenticateBearer("Bearer " + token)
+	if apiErr == nil || apiErr.Status != http.StatusUnauthorized || apiErr.Key != key {
+		t.Errorf("Expected 401 %s, got %+v", key, apiErr)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	_, first := newSession(t, "session_reuse")
+
+	second, err := RefreshSession(first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("Refresh token was not rotated")
+	}
+	if _, apiErr := authenticateBearer("Bearer " + second.Token); apiErr != nil {
+		t.Fatalf("New access token rejected: %+v", apiErr)
+	}
+
+	// Повторное предъявление старого токена - признак кражи: отзывается вся сессия
+	if _, err := RefreshSession(first.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Fatalf("Expected ErrInvalidRefreshToken on reuse, got %v", err)
+	}
+	if _, err := RefreshSession(second.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Expected the rotated token to die with the session, got %v", err)
+	}
+	expectTokenError(t, second.Token, "token_revoked")
+
+	if _, err := RefreshSession("not-a-refresh-token"); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Expected ErrInvalidRefreshToken for an unknown token, got %v", err)
+	}
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	r := newRouter()
+	_, session := newSession(t, "session_logout")
+	do := func(token, method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := do(session.Token, "GET", "/api/info"); code != http.StatusOK {
+		t.Fatalf("Expected 200 before logout, got %d", code)
+	}
+	if code := do(session.Token, "POST", "/api/auth/logout"); code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on logout, got %d", code)
+	}
+	if code := do(session.Token, "GET", "/api/info"); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 after logout, got %d", code)
+	}
+	if _, err := RefreshSession(session.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+		t.Errorf("Expected refresh to fail after logout, got %v", err)
+	}
+}
+
+func TestLogoutAllRevokesEverySession(t *testing.T) {
+	user, first := newSession(t, "session_logout_all")
+	second, err := CreateSession(user, "sessions-test-2", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RevokeAllSessions(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*AuthResponse{first, second} {
+		expectTokenError(t, s.Token, "token_revoked")
+		if _, err := RefreshSession(s.RefreshToken); !errors.Is(err, ErrInvalidRefreshToken) {
+			t.Errorf("Expected refresh to fail after logout-all, got %v", err)
+		}
+	}
+	sessions, err := ListSessions(user.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("Expected no active sessions, got %+v", sessions)
+	}
+}
+
+func TestRevocationListSync(t *testing.T) {
+	user, session := newSession(t, "session_sync")
+	claims := &Claims{}
+	if _, err := keyManager.ParseToken(session.Token, claims); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeAccessToken(claims); err != nil {
+		t.Fatal(err)
+	}
+	_, other := newSession(t, "session_sync")
+	otherClaims := &Claims{}
+	if _, err := keyManager.ParseToken(other.Token, otherClaims); err != nil {
+		t.Fatal(err)
+	}
+	if err := RevokeSession(user.ID, otherClaims.SessionID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Другой экземпляр приложения узнаёт об отзывах из базы
+	l := &RevocationList{tokens: map[string]time.Time{}, sessions: map[string]time.Time{}}
+	if err := l.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !l.IsRevoked(claims) || !l.IsRevoked(otherClaims) {
+		t.Error("Expected revocations from the database after Sync")
+	}
+}
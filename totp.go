@@ -0,0 +1,425 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Параметры TOTP (RFC 6238) - значения по умолчанию, которые понимают все приложения-аутентификаторы
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // Сколько соседних интервалов принимать из-за расхождения часов
+	recoveryCodeCount = 10
+)
+
+// Коды ответа, по которым клиент понимает, что нужен второй фактор
+const (
+	OTPRequired    = "otp_required"
+	OTPInvalid     = "otp_invalid"
+	StepUpRequired = "step_up_required"
+)
+
+var (
+	ErrTOTPNotEnrolled = errors.New("двухфакторная аутентификация не подключена")
+	ErrTOTPEnabled     = errors.New("двухфакторная аутентификация уже включена")
+	ErrInvalidOTP      = errors.New("неверный код подтверждения")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment - данные для подключения приложения-аутентификатора
+type TOTPEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioningUri"` // otpauth:// для QR-кода
+}
+
+// TOTPStatus - состояние двухфакторной аутентификации пользователя
+type TOTPStatus struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recoveryCodesLeft"`
+	StepUpThreshold   int  `json:"stepUpThreshold"` // Переводы и покупки дороже требуют код
+}
+
+// OTPRequest - код из приложения или резервный код
+type OTPRequest struct {
+	Code string `json:"code"`
+}
+
+// totpCode вычисляет код для интервала step (RFC 4226, HMAC-SHA1)
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP возвращает интервал, которому соответствует код, или -1
+func matchTOTP(secret []byte, code string, now time.Time) int64 {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+// provisioningURI строит otpauth://-адрес для QR-кода
+func provisioningURI(username, secret string) string {
+	label := url.PathEscape(config.JWTIssuer + ":" + username)
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {config.JWTIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+// EnrollTOTP создаёт новый секрет; он начинает действовать после ConfirmTOTP
+func EnrollTOTP(user *User) (*TOTPEnrollment, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	secret := base32NoPadding.EncodeToString(raw)
+
+	res, err := db.Exec(`
+		INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_used_step = NULL
+		WHERE NOT user_totp.enabled
+	`, user.ID, secret)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrTOTPEnabled
+	}
+	return &TOTPEnrollment{Secret: secret, ProvisioningURI: provisioningURI(user.Username, secret)}, nil
+}
+
+// useTOTP проверяет код приложения. Использованный интервал запоминается,
+// поэтому перехваченный код нельзя предъявить повторно.
+func useTOTP(q queryRower, userID int, code string, requireEnabled bool) error {
+	var secret string
+	var enabled bool
+	err := q.QueryRow(`SELECT secret, enabled FROM user_totp WHERE user_id = $1`, userID).Scan(&secret, &enabled)
+	if err == sql.ErrNoRows || (err == nil && requireEnabled && !enabled) {
+		return ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return err
+	}
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		return err
+	}
+	step := matchTOTP(key, strings.TrimSpace(code), time.Now())
+	if step < 0 {
+		return ErrInvalidOTP
+	}
+
+	var used bool
+	err = q.QueryRow(`
+		UPDATE user_totp SET last_used_step = $2
+		WHERE user_id = $1 AND (last_used_step IS NULL OR last_used_step < $2)
+		RETURNING TRUE
+	`, userID, step).Scan(&used)
+	if err == sql.ErrNoRows {
+		return ErrInvalidOTP
+	}
+	return err
+}
+
+// useRecoveryCode погашает одноразовый резервный код
+func useRecoveryCode(userID int, code string) error {
+	code = strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	res, err := db.Exec(`
+		UPDATE totp_recovery_codes SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, hashToken(code))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidOTP
+	}
+	return nil
+}
+
+// VerifySecondFactor принимает код приложения или резервный код
+func VerifySecondFactor(userID int, code string) error {
+	if code == "" {
+		return ErrInvalidOTP
+	}
+	err := useTOTP(db, userID, code, true)
+	if errors.Is(err, ErrInvalidOTP) {
+		return useRecoveryCode(userID, code)
+	}
+	return err
+}
+
+// TOTPEnabled сообщает, включена ли у пользователя двухфакторная аутентификация
+func TOTPEnabled(userID int) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(`SELECT enabled FROM user_totp WHERE user_id = $1`, userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// newRecoveryCodes заменяет резервные коды пользователя новыми и возвращает их открытые значения
+func newRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := base32NoPadding.EncodeToString(raw) // 8 символов
+		if _, err := tx.Exec(`
+			INSERT INTO totp_recovery_codes (user_id, code_hash) VALUES ($1, $2)
+		`, userID, hashToken(code)); err != nil {
+			return nil, err
+		}
+		codes[i] = code[:4] + "-" + code[4:]
+	}
+	return codes, nil
+}
+
+// ConfirmTOTP включает двухфакторную аутентификацию после проверки первого кода
+// и выдаёт резервные коды
+func ConfirmTOTP(userID int, code string) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var enabled bool
+	err = tx.QueryRow(`SELECT enabled FROM user_totp WHERE user_id = $1 FOR UPDATE`, userID).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return nil, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, ErrTOTPEnabled
+	}
+	if err := useTOTP(tx, userID, code, false); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE user_totp SET enabled = TRUE, enabled_at = now() WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	codes, err := newRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// RegenerateRecoveryCodes выдаёт новый набор резервных кодов, прежние перестают действовать
+func RegenerateRecoveryCodes(userID int) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	codes, err := newRecoveryCodes(tx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// DisableTOTP отключает двухфакторную аутентификацию
+func DisableTOTP(userID int) error {
+	_, err := db.Exec(`DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err == nil {
+		_, err = db.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	}
+	return err
+}
+
+// stepUpVerified проверяет второй фактор через checkStepUp для обработчиков.
+// Возвращает false, если ответ уже отправлен.
+func stepUpVerified(w http.ResponseWriter, r *http.Request, user *User, amount int) bool {
+	if err := checkStepUp(actorFromRequest(r), user, amount); err != nil {
+		writeAPIError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// writeStepUpError отвечает на неудачную проверку кода из X-OTP: блокировка и
+// внутренние ошибки - как есть, неверный или пропущенный код - 403 step_up_required
+func writeStepUpError(w http.ResponseWriter, r *http.Request, err error) {
+	if !errors.Is(err, ErrInvalidOTP) {
+		writeAPIError(w, r, err)
+		return
+	}
+	writeError(w, r, http.StatusForbidden, StepUpRequired, "otp_header_required")
+}
+
+// currentUser - пользователь из токена запроса
+func currentUser(w http.ResponseWriter, r *http.Request) *User {
+	user, err := GetUserByUsername(r.Context().Value("username").(string))
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, CodeUserNotFound, "user_not_found")
+		return nil
+	}
+	return user
+}
+
+// TOTPStatusHandler сообщает, включена ли двухфакторная аутентификация.
+func TOTPStatusHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+	status := TOTPStatus{StepUpThreshold: config.StepUpThreshold}
+	err := db.QueryRow(`
+		SELECT COALESCE((SELECT enabled FROM user_totp WHERE user_id = $1), FALSE),
+			(SELECT COUNT(*) FROM totp_recovery_codes WHERE user_id = $1 AND used_at IS NULL)
+	`, user.ID).Scan(&status.Enabled, &status.RecoveryCodesLeft)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "status_fetch_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// EnrollTOTPHandler выдаёт секрет и otpauth://-адрес для QR-кода.
+func EnrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+	enrollment, err := EnrollTOTP(user)
+	if errors.Is(err, ErrTOTPEnabled) {
+		writeError(w, r, http.StatusConflict, CodeConflict, "totp_already_enabled")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "totp_enroll_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrollment)
+}
+
+// ConfirmTOTPHandler включает двухфакторную аутентификацию по первому коду
+// и возвращает резервные коды (показываются один раз).
+func ConfirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var req OTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+	user := currentUser(w, r)
+	if user == nil {
+		return
+	}
+
+	codes, err := ConfirmTOTP(user.ID, req.Code)
+	switch {
+	case errors.Is(err, ErrTOTPNotEnrolled):
+		writeError(w, r, http.StatusConflict, CodeConflict, "totp_enroll_first")
+		return
+	case errors.Is(err, ErrTOTPEnabled):
+		writeError(w, r, http.StatusConflict, CodeConflict, "totp_already_enabled")
+		return
+	case errors.Is(err, ErrInvalidOTP):
+		writeError(w, r, http.StatusBadRequest, OTPInvalid, "otp_invalid")
+		return
+	case err != nil:
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "totp_enroll_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+}
+
+// RegenerateRecoveryCodesHandler выдаёт новые резервные коды по действующему коду.
+func RegenerateRecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := verifiedOTPUser(w, r)
+	if !ok {
+		return
+	}
+	codes, err := RegenerateRecoveryCodes(user.ID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "recovery_codes_failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{"recoveryCodes": codes})
+}
+
+// DisableTOTPHandler отключает двухфакторную аутентификацию по действующему коду.
+func DisableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := verifiedOTPUser(w, r)
+	if !ok {
+		return
+	}
+	if err := DisableTOTP(user.ID); err != nil {
+		writeError(w, r, http.StatusInternalServerError, CodeInternal, "totp_disable_failed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifiedOTPUser проверяет код из тела запроса для действий с самой 2FA
+func verifiedOTPUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	var req OTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return nil, false
+	}
+	user := currentUser(w, r)
+	if user == nil {
+		return nil, false
+	}
+	err := verifyStepUpCode(user, clientIP(r), req.Code)
+	if errors.Is(err, ErrTOTPNotEnrolled) {
+		writeError(w, r, http.StatusConflict, CodeConflict, "totp_not_enabled")
+		return nil, false
+	}
+	if err != nil && !errors.Is(err, ErrInvalidOTP) {
+		writeAPIError(w, r, err)
+		return nil, false
+	}
+	if err != nil {
+		writeError(w, r, http.StatusForbidden, OTPInvalid, "otp_invalid")
+		return nil, false
+	}
+	return user, true
+}
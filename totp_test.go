@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+// Тестовые векторы RFC 6238 (SHA1), последние 6 цифр
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	cases := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range cases {
+		if got := totpCode(secret, unix/totpPeriod); got != want {
+			t.Errorf("T=%d: got %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+
+	if got := matchTOTP(secret, totpCode(secret, step), now); got != step {
+		t.Errorf("Current code: got step %d, want %d", got, step)
+	}
+	if got := matchTOTP(secret, totpCode(secret, step-1), now); got != step-1 {
+		t.Errorf("Previous code should be accepted for clock skew, got %d", got)
+	}
+	if got := matchTOTP(secret, totpCode(secret, step-3), now); got != -1 {
+		t.Errorf("Stale code accepted at step %d", got)
+	}
+	if got := matchTOTP(secret, "", now); got != -1 {
+		t.Errorf("Empty code accepted at step %d", got)
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	u, err := url.Parse(provisioningURI("ivan.petrov", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/"+config.JWTIssuer+":ivan.petrov" {
+		t.Errorf("Unexpected URI: %s", u)
+	}
+	q := u.Query()
+	if q.Get("secret") != "JBSWY3DPEHPK3PXP" || q.Get("issuer") != config.JWTIssuer || q.Get("digits") != "6" {
+		t.Errorf("Unexpected parameters: %v", q)
+	}
+}
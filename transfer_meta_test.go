@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTransferMeta(t *testing.T) {
+	cases := []struct {
+		name     string
+		in       TransferMeta
+		memo     string
+		category string
+		err      error
+	}{
+		{"empty", TransferMeta{}, "", "", nil},
+		{"trim and collapse spaces", TransferMeta{Memo: "  за   обед\n\tвчера "}, "за обед вчера", "", nil},
+		{"control and invisible characters", TransferMeta{Memo: "спа\u0000си\u200bбо\u202e"}, "спасибо", "", nil},
+		{"category case and spaces", TransferMeta{Category: " Thanks "}, "", CategoryThanks, nil},
+		{"max length", TransferMeta{Memo: strings.Repeat("я", MaxMemoLength)}, strings.Repeat("я", MaxMemoLength), "", nil},
+		{"length after trimming", TransferMeta{Memo: " " + strings.Repeat("я", MaxMemoLength) + " "}, strings.Repeat("я", MaxMemoLength), "", nil},
+		{"too long", TransferMeta{Memo: strings.Repeat("я", MaxMemoLength+1)}, "", "", ErrMemoTooLong},
+		{"unknown category", TransferMeta{Category: "bribe"}, "", "", ErrUnknownCategory},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := normalizeTransferMeta(c.in)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("Expected error %v, got %v", c.err, err)
+			}
+			if c.err != nil {
+				return
+			}
+			if got.Memo != c.memo || got.Category != c.category {
+				t.Errorf("Expected %q/%q, got %q/%q", c.memo, c.category, got.Memo, got.Category)
+			}
+		})
+	}
+}
+
+func TestIsValidCategory(t *testing.T) {
+	cases := map[string]bool{
+		"":                    true,
+		CategoryThanks:        true,
+		CategoryBet:           true,
+		CategoryReimbursement: true,
+		CategoryGift:          true,
+		"Thanks":              false, // нормализация - задача normalizeTransferMeta
+		"salary":              false,
+	}
+	for category, want := range cases {
+		if got := IsValidCategory(category); got != want {
+			t.Errorf("IsValidCategory(%q) = %v, want %v", category, got, want)
+		}
+	}
+}
+
+func TestCategoryFilterRejectsUnknown(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/api/info":        InfoHandler,
+		"/me/transactions": GetTransactionsHandler,
+	}
+	for path, handler := range handlers {
+		req := httptest.NewRequest("GET", path+"?category=salary", nil)
+		req = req.WithContext(context.WithValue(req.Context(), "username", "alice"))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		var resp ErrorResponse
+		json.NewDecoder(rr.Body).Decode(&resp)
+		if rr.Code != http.StatusBadRequest || len(resp.Errors) != 1 || resp.Errors[0].Field != "category" {
+			t.Errorf("%s: expected 400 on category, got %d %+v", path, rr.Code, resp.Errors)
+		}
+	}
+}
+
+func TestCategoryFilter(t *testing.T) {
+	r := newRouter()
+	token := getTokenForUser(t, "category_sender")
+	getTokenForUser(t, "category_recipient")
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		bodyBytes, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, path, bytes.NewBuffer(bodyBytes))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+	for _, meta := range []TransferMeta{{Memo: "за обед", Category: CategoryThanks}, {Category: CategoryBet}} {
+		if rr := do("POST", "/api/sendCoin", SendCoinRequest{ToUser: "category_recipient", Amount: 1, TransferMeta: meta}); rr.Code != http.StatusOK {
+			t.Fatalf("Transfer %+v: expected 200, got %d: %s", meta, rr.Code, rr.Body)
+		}
+	}
+
+	var history TransactionHistory
+	json.NewDecoder(do("GET", "/me/transactions?category=thanks", nil).Body).Decode(&history)
+	if len(history.Outgoing) == 0 {
+		t.Fatal("Expected outgoing thanks transfers")
+	}
+	for _, tr := range history.Outgoing {
+		if tr.Category != CategoryThanks {
+			t.Errorf("Filter by thanks returned %+v", tr)
+		}
+	}
+
+	var info InfoResponse
+	json.NewDecoder(do("GET", "/api/info?category=bet", nil).Body).Decode(&info)
+	if len(info.CoinHistory.Sent) == 0 {
+		t.Fatal("Expected sent bet transfers")
+	}
+	for _, tr := range info.CoinHistory.Sent {
+		if tr.Category != CategoryBet || tr.Memo != "" {
+			t.Errorf("Filter by bet returned %+v", tr)
+		}
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Исходящие вебхуки для интеграций (бот, HR-система, склад). Источник - журнал
+// domain_events: WebhookSink получает события через OutboxRelay и в транзакции
+// его курсора пишет строку webhook_deliveries на каждую подписку, поэтому событие
+// не теряется, не дублируется и не отправляется для откатившейся операции.
+// WebhookDispatcher отправляет доставки с повторами, а после WEBHOOK_MAX_ATTEMPTS
+// неудач доставка становится dead и ждёт ручного повтора.
+
+// Типы событий вебхуков; purchase.completed совпадает с событием потока /api/events
+const (
+	EventTransferCompleted = "transfer.completed"
+	EventUserCreated       = "user.created"
+)
+
+var webhookEventTypes = []string{EventTransferCompleted, EventPurchaseCompleted, EventUserCreated}
+
+// Состояния доставки
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// webhookSecretPrefix - начало сгенерированного секрета подписи
+const webhookSecretPrefix = "whsec_"
+
+var (
+	ErrWebhookNotFound       = errors.New("подписка на вебхуки не найдена")
+	ErrDeliveryNotFound      = errors.New("доставка не найдена или не в состоянии dead")
+	ErrInvalidWebhookURL     = errors.New("адрес вебхука должен быть абсолютным http(s) URL")
+	ErrWebhookSecretTooShort = errors.New("секрет подписи слишком короткий")
+)
+
+// Webhook - подписка на события
+type Webhook struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	Secret    string    `json:"secret,omitempty"` // Только в ответе на создание
+}
+
+// CreateWebhookRequest - запрос на подписку; без secret он генерируется
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+// minWebhookSecretLength - минимальная длина секрета, заданного вручную
+const minWebhookSecretLength = 16
+
+// Validate проверяет адрес, типы событий и секрет
+func (req CreateWebhookRequest) Validate() error {
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &FieldError{Field: "url", Err: ErrInvalidWebhookURL}
+	}
+	if len(req.Events) == 0 {
+		return &APIError{Code: CodeValidationFailed, Field: "events", Key: "webhook_events_required"}
+	}
+	for _, event := range req.Events {
+		if !isWebhookEvent(event) {
+			return &APIError{Code: CodeValidationFailed, Field: "events", Key: "unknown_webhook_event", Args: []interface{}{event}}
+		}
+	}
+	if req.Secret != "" && len(req.Secret) < minWebhookSecretLength {
+		return &FieldError{Field: "secret", Err: ErrWebhookSecretTooShort}
+	}
+	return nil
+}
+
+func isWebhookEvent(event string) bool {
+	for _, e := range webhookEventTypes {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// TransferCompletedEvent - data события transfer.completed
+type TransferCompletedEvent struct {
+	TransferID int    `json:"transferId"`
+	FromUser   string `json:"fromUser"`
+	ToUser     string `json:"toUser"`
+	Amount     int    `json:"amount"`
+	TransferMeta
+}
+
+// PurchaseWebhookEvent - data события purchase.completed для вебхука
+type PurchaseWebhookEvent struct {
+	Username string `json:"username"`
+	PurchaseCompletedEvent
+}
+
+// UserCreatedEvent - data события user.created
+type UserCreatedEvent struct {
+	UserID   int    `json:"userId"`
+	Username string `json:"username"`
+}
+
+// WebhookPayload - тело запроса к получателю
+type WebhookPayload struct {
+	ID        int64           `json:"id"` // id доставки, одинаков при повторах
+	Type      string          `json:"type"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// WebhookDelivery - доставка события одной подписке
+type WebhookDelivery struct {
+	ID            int64            `json:"id"`
+	WebhookID     int              `json:"webhookId"`
+	Event         string           `json:"event"`
+	Status        string           `json:"status"`
+	Attempts      int              `json:"attempts"`
+	NextAttemptAt *time.Time       `json:"nextAttemptAt,omitempty"` // Только для pending
+	LastError     string           `json:"lastError,omitempty"`
+	CreatedAt     time.Time        `json:"createdAt"`
+	DeliveredAt   *time.Time       `json:"deliveredAt,omitempty"`
+	Log           []WebhookAttempt `json:"log"`
+}
+
+// WebhookAttempt - запись журнала попыток доставки
+type WebhookAttempt struct {
+	AttemptedAt time.Time `json:"attemptedAt"`
+	StatusCode  *int      `json:"statusCode,omitempty"` // nil - ответа не было
+	Error       string    `json:"error,omitempty"`
+	DurationMs  int       `json:"durationMs"`
+}
+
+// webhookEvent переводит доменное событие в событие вебхука; ok = false - у
+// доменного события нет вебхука
+func webhookEvent(e DomainEvent) (eventType string, data interface{}, ok bool, err error) {
+	switch e.Type {
+	case DomainCoinsTransferred:
+		// data coins.transferred и user.created совпадает с data вебхука
+		return EventTransferCompleted, e.Data, true, nil
+	case DomainUserCreated:
+		return EventUserCreated, e.Data, true, nil
+	case DomainMerchPurchased:
+		var purchase MerchPurchasedEvent
+		if err := json.Unmarshal(e.Data, &purchase); err != nil {
+			return "", nil, false, fmt.Errorf("событие %d: %v", e.ID, err)
+		}
+		return EventPurchaseCompleted, PurchaseWebhookEvent{
+			Username: purchase.Username, PurchaseCompletedEvent: PurchaseCompletedEvent{Item: purchase.Item, Price: purchase.Price},
+		}, true, nil
+	}
+	return "", nil, false, nil
+}
+
+// WebhookSink раскладывает доменные события по подпискам в webhook_deliveries.
+// Подписка получает только события, случившиеся после её создания.
+type WebhookSink struct{}
+
+func (WebhookSink) Name() string { return "webhooks" }
+
+func (s WebhookSink) Publish(ctx context.Context, events []DomainEvent) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.PublishTx(tx, events); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (WebhookSink) PublishTx(tx *sql.Tx, events []DomainEvent) error {
+	for _, e := range events {
+		eventType, data, ok, err := webhookEvent(e)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO webhook_deliveries (subscription_id, event_type, payload)
+			SELECT id, $1, $2 FROM webhook_subscriptions WHERE $1 = ANY(event_types) AND created_at <= $3
+		`, eventType, payload, e.OccurredAt)
+		if err != nil {
+			return fmt.Errorf("ошибка при записи вебхука: %w", err)
+		}
+	}
+	return nil
+}
+
+// CreateWebhook создаёт подписку; секрет возвращается один раз
+func CreateWebhook(createdBy string, req CreateWebhookRequest) (*Webhook, error) {
+	if req.Secret == "" {
+		secret, err := randomToken(32)
+		if err != nil {
+			return nil, err
+		}
+		req.Secret = webhookSecretPrefix + secret
+	}
+	hook := &Webhook{URL: req.URL, Events: req.Events, CreatedBy: createdBy, Secret: req.Secret}
+	err := db.QueryRow(`
+		INSERT INTO webhook_subscriptions (url, event_types, secret, created_by)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, req.URL, pq.Array(req.Events), req.Secret, createdBy).Scan(&hook.ID, &hook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// ListWebhooks возвращает все подписки без секретов
+func ListWebhooks() ([]Webhook, error) {
+	rows, err := db.Query(`
+		SELECT id, url, event_types, created_by, created_at
+		FROM webhook_subscriptions ORDER BY id
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := make([]Webhook, 0)
+	for rows.Next() {
+		var h Webhook
+		if err := rows.Scan(&h.ID, &h.URL, pq.Array(&h.Events), &h.CreatedBy, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, h)
+	}
+	return hooks, rows.Err()
+}
+
+// DeleteWebhook удаляет подписку вместе с недоставленными событиями и журналом
+func DeleteWebhook(id int) error {
+	res, err := db.Exec(`DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// ListWebhookDeliveries возвращает последние доставки подписки с журналом попыток;
+// status фильтрует по состоянию, пустой - все
+func ListWebhookDeliveries(webhookID int, status string, limit int) ([]WebhookDelivery, error) {
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM webhook_subscriptions WHERE id = $1)`, webhookID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWebhookNotFound
+	}
+
+	rows, err := db.Query(`
+		SELECT id, subscription_id, event_type, status, attempts, next_attempt_at,
+			COALESCE(last_error, ''), created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE subscription_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY id DESC
+		LIMIT $3
+	`, webhookID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]WebhookDelivery, 0)
+	index := map[int64]int{}
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var d WebhookDelivery
+		var nextAttempt time.Time
+		var deliveredAt sql.NullTime
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &nextAttempt,
+			&d.LastError, &d.CreatedAt, &deliveredAt); err != nil {
+			return nil, err
+		}
+		if d.Status == DeliveryPending {
+			d.NextAttemptAt = &nextAttempt
+		}
+		d.DeliveredAt = nullTimePtr(deliveredAt)
+		d.Log = make([]WebhookAttempt, 0)
+		index[d.ID] = len(deliveries)
+		ids = append(ids, d.ID)
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	attempts, err := db.Query(`
+		SELECT delivery_id, attempted_at, status_code, COALESCE(error, ''), duration_ms
+		FROM webhook_delivery_attempts
+		WHERE delivery_id = ANY($1)
+		ORDER BY id
+	`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer attempts.Close()
+	for attempts.Next() {
+		var deliveryID int64
+		var a WebhookAttempt
+		var statusCode sql.NullInt64
+		if err := attempts.Scan(&deliveryID, &a.AttemptedAt, &statusCode, &a.Error, &a.DurationMs); err != nil {
+			return nil, err
+		}
+		a.StatusCode = nullIntPtr(statusCode)
+		d := &deliveries[index[deliveryID]]
+		d.Log = append(d.Log, a)
+	}
+	return deliveries, attempts.Err()
+}
+
+// RetryWebhookDelivery возвращает доставку из dead в очередь с новым счётчиком попыток
+func RetryWebhookDelivery(id int64) error {
+	res, err := db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = $2, attempts = 0, next_attempt_at = now()
+		WHERE id = $1 AND status = $3
+	`, id, DeliveryPending, DeliveryDead)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrDeliveryNotFound
+	}
+	return nil
+}
+
+// signWebhook - подпись тела: HMAC-SHA256 секрета от "<timestamp>.<тело>".
+// Получатель проверяет подпись и отбрасывает запросы со старым timestamp.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// webhookBackoff - задержка перед попыткой attempts+1: WebhookBackoffBase,
+// дальше каждая неудача удваивает её до WebhookBackoffMax
+func webhookBackoff(attempts int) time.Duration {
+	exp := attempts - 1
+	if exp < 0 {
+		exp = 0
+	}
+	if exp > 30 {
+		return config.WebhookBackoffMax
+	}
+	d := time.Duration(float64(config.WebhookBackoffBase) * math.Pow(2, float64(exp)))
+	if d > config.WebhookBackoffMax {
+		return config.WebhookBackoffMax
+	}
+	return d
+}
+
+// webhookJob - доставка, взятая диспетчером в работу
+type webhookJob struct {
+	ID        int64
+	Event     string
+	Data      json.RawMessage
+	Attempts  int
+	CreatedAt time.Time
+	URL       string
+	Secret    string
+}
+
+// WebhookDispatcher отправляет доставки из webhook_deliveries. Доставка берётся в работу
+// сдвигом next_attempt_at вперёд, поэтому HTTP-запрос идёт вне транзакции,
+// а несколько экземпляров не отправят одну доставку одновременно.
+type WebhookDispatcher struct {
+	interval time.Duration
+	client   *http.Client
+}
+
+// NewWebhookDispatcher создаёт диспетчер с заданным интервалом опроса базы
+func NewWebhookDispatcher(interval time.Duration) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		interval: interval,
+		client:   &http.Client{Timeout: config.WebhookTimeout},
+	}
+}
+
+// Run работает до отмены контекста
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		d.RunDue(ctx, time.Now().UTC())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue отправляет все доставки, время попытки которых наступило к моменту now
+func (d *WebhookDispatcher) RunDue(ctx context.Context, now time.Time) {
+	for ctx.Err() == nil {
+		job, err := claimWebhookDelivery(now)
+		if err != nil {
+			log.Printf("Ошибка отправки вебхуков: %v", err)
+			return
+		}
+		if job == nil {
+			return
+		}
+		if err := d.deliver(ctx, job); err != nil {
+			log.Printf("Ошибка записи результата вебхука %d: %v", job.ID, err)
+			return
+		}
+	}
+}
+
+// claimWebhookDelivery берёт в работу одну наступившую доставку; nil - таких нет.
+// Если экземпляр упадёт, не записав результат, доставка вернётся в очередь через
+// два таймаута запроса.
+func claimWebhookDelivery(now time.Time) (*webhookJob, error) {
+	var job webhookJob
+	err := db.QueryRow(`
+		UPDATE webhook_deliveries d SET next_attempt_at = $2
+		FROM webhook_subscriptions s
+		WHERE d.id = (
+			SELECT id FROM webhook_deliveries
+			WHERE status = $3 AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		) AND s.id = d.subscription_id
+		RETURNING d.id, d.event_type, d.payload, d.attempts, d.created_at, s.url, s.secret
+	`, now, now.Add(2*config.WebhookTimeout), DeliveryPending).
+		Scan(&job.ID, &job.Event, &job.Data, &job.Attempts, &job.CreatedAt, &job.URL, &job.Secret)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// deliver отправляет доставку и записывает попытку в журнал
+func (d *WebhookDispatcher) deliver(ctx context.Context, job *webhookJob) error {
+	started := time.Now()
+	statusCode, sendErr := d.send(ctx, job, started)
+	duration := time.Since(started)
+
+	attempts := job.Attempts + 1
+	status := DeliveryPending
+	nextAttempt := time.Now().UTC().Add(webhookBackoff(attempts))
+	var lastError sql.NullString
+	var deliveredAt sql.NullTime
+	if sendErr == nil {
+		status = DeliveryDelivered
+		deliveredAt = sql.NullTime{Time: time.Now(), Valid: true}
+	} else {
+		lastError = sql.NullString{String: sendErr.Error(), Valid: true}
+		if attempts >= config.WebhookMaxAttempts {
+			status = DeliveryDead
+			log.Printf("Вебхук %d (%s) не доставлен после %d попыток: %v", job.ID, job.URL, attempts, sendErr)
+		}
+	}
+	var code sql.NullInt64
+	if statusCode != 0 {
+		code = sql.NullInt64{Int64: int64(statusCode), Valid: true}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, next_attempt_at = $3, last_error = $4, delivered_at = $5
+		WHERE id = $6
+	`, status, attempts, nextAttempt, lastError, deliveredAt, job.ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO webhook_delivery_attempts (delivery_id, status_code, error, duration_ms)
+		VALUES ($1, $2, $3, $4)
+	`, job.ID, code, lastError, duration.Milliseconds())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// send выполняет запрос к получателю. Успех - любой ответ 2xx; statusCode 0 -
+// ответа не было.
+func (d *WebhookDispatcher) send(ctx context.Context, job *webhookJob, now time.Time) (int, error) {
+	body, err := json.Marshal(WebhookPayload{ID: job.ID, Type: job.Event, CreatedAt: job.CreatedAt, Data: job.Data})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", job.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "merch-store-webhooks")
+	req.Header.Set("X-Webhook-Event", job.Event)
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(job.ID, 10))
+	req.Header.Set("X-Webhook-Signature", signWebhook(job.Secret, now.Unix(), body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Тело ответа не нужно, но дочитывается, чтобы соединение вернулось в пул
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("получатель ответил %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// pathWebhookID извлекает id подписки из пути
+func pathWebhookID(r *http.Request) int {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	return id
+}
+
+// CreateWebhookHandler создаёт подписку на события.
+func CreateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, CodeBadRequest, "bad_request")
+		return
+	}
+	if err := req.Validate(); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	admin := r.Context().Value("username").(string)
+	hook, err := CreateWebhook(admin, req)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(hook)
+}
+
+// ListWebhooksHandler возвращает все подписки.
+func ListWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks, err := ListWebhooks()
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hooks)
+}
+
+// DeleteWebhookHandler удаляет подписку.
+func DeleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if err := DeleteWebhook(pathWebhookID(r)); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListWebhookDeliveriesHandler возвращает журнал доставок подписки (?status=dead для dead-letter).
+func ListWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != DeliveryPending && status != DeliveryDelivered && status != DeliveryDead {
+		writeFieldError(w, r, "status", "unknown_delivery_status", status)
+		return
+	}
+
+	deliveries, err := ListWebhookDeliveries(pathWebhookID(r), status, 100)
+	if err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// RetryWebhookDeliveryHandler повторяет доставку из dead-letter.
+func RetryWebhookDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err := RetryWebhookDelivery(id); err != nil {
+		writeAPIError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": DeliveryPending})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config.WebhookBackoffBase = 30 * time.Second
+	config.WebhookBackoffMax = time.Hour
+
+	cases := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{8, time.Hour}, // 30с * 2^7 = 64 минуты, ограничено максимумом
+		{1000, time.Hour},
+	}
+	for _, c := range cases {
+		if got := webhookBackoff(c.attempts); got != c.want {
+			t.Errorf("%d attempts: got %v, want %v", c.attempts, got, c.want)
+		}
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	want := "t=1700000000,v1=" + hex.EncodeToString(mac.Sum(nil))
+	if got := signWebhook("secret", 1700000000, body); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestCreateWebhookRequestValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		req   CreateWebhookRequest
+		field string
+	}{
+		{"relative url", CreateWebhookRequest{URL: "/hook", Events: []string{EventUserCreated}}, "url"},
+		{"ftp url", CreateWebhookRequest{URL: "ftp://example.com", Events: []string{EventUserCreated}}, "url"},
+		{"no events", CreateWebhookRequest{URL: "https://example.com/hook"}, "events"},
+		{"unknown event", CreateWebhookRequest{URL: "https://example.com/hook", Events: []string{"balance.changed"}}, "events"},
+		{"short secret", CreateWebhookRequest{URL: "https://example.com/hook", Events: []string{EventUserCreated}, Secret: "abc"}, "secret"},
+		{"valid", CreateWebhookRequest{URL: "http://localhost:9000/hook", Events: webhookEventTypes}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.req.Validate()
+			if c.field == "" {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if err == nil || toAPIError(err).Field != c.field {
+				t.Errorf("Expected error on %s, got %v", c.field, err)
+			}
+		})
+	}
+}
+
+func TestWebhookEvent(t *testing.T) {
+	transfer := json.RawMessage(`{"transferId":7,"fromUser":"alice","toUser":"bob","amount":5}`)
+	cases := []struct {
+		event     DomainEvent
+		eventType string
+		data      string
+	}{
+		{DomainEvent{Type: DomainCoinsTransferred, Data: transfer}, EventTransferCompleted, string(transfer)},
+		{DomainEvent{Type: DomainUserCreated, Data: json.RawMessage(`{"userId":3,"username":"carol"}`)}, EventUserCreated, `{"userId":3,"username":"carol"}`},
+		{
+			DomainEvent{Type: DomainMerchPurchased, Data: json.RawMessage(`{"userId":3,"username":"carol","item":"pen","price":10,"balance":90}`)},
+			EventPurchaseCompleted, `{"username":"carol","item":"pen","price":10}`,
+		},
+		{DomainEvent{Type: DomainPriceChanged, Data: json.RawMessage(`{"item":"pen","newPrice":12}`)}, "", ""},
+	}
+	for _, c := range cases {
+		eventType, data, ok, err := webhookEvent(c.event)
+		if err != nil {
+			t.Fatalf("%s: %v", c.event.Type, err)
+		}
+		if ok != (c.eventType != "") || eventType != c.eventType {
+			t.Errorf("%s: expected %q, got %q (%v)", c.event.Type, c.eventType, eventType, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if body, _ := json.Marshal(data); string(body) != c.data {
+			t.Errorf("%s: expected data %s, got %s", c.event.Type, c.data, body)
+		}
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	status := http.StatusNoContent
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	dispatcher := NewWebhookDispatcher(time.Second)
+	job := &webhookJob{ID: 7, Event: EventUserCreated, Data: json.RawMessage(`{"userId":1,"username":"ivan"}`),
+		URL: receiver.URL, Secret: "whsec_test"}
+	now := time.Unix(1700000000, 0)
+	if code, err := dispatcher.send(context.Background(), job, now); err != nil || code != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %d, %v", code, err)
+	}
+	if got.Header.Get("X-Webhook-Event") != EventUserCreated || got.Header.Get("X-Webhook-Delivery") != "7" {
+		t.Errorf("Unexpected headers %v", got.Header)
+	}
+	if got.Header.Get("X-Webhook-Signature") != signWebhook("whsec_test", now.Unix(), body) {
+		t.Error("Signature does not match the body")
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil || payload.ID != 7 || payload.Type != EventUserCreated {
+		t.Errorf("Unexpected payload %s", body)
+	}
+
+	status = http.StatusBadGateway
+	if code, err := dispatcher.send(context.Background(), job, now); err == nil || code != http.StatusBadGateway {
+		t.Errorf("Expected 502 to fail, got %d, %v", code, err)
+	}
+}
+
+func TestWebhookDeliveryRetriesAndDeadLetter(t *testing.T) {
+	requireDB(t)
+	saved := config
+	defer func() { config = saved }()
+	config.WebhookMaxAttempts = 2
+	config.WebhookBackoffBase = time.Millisecond
+	config.WebhookBackoffMax = time.Millisecond
+
+	var mu sync.Mutex
+	var received []WebhookPayload
+	fail := true
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var p WebhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		received = append(received, p)
+	}))
+	defer receiver.Close()
+
+	hook, err := CreateWebhook("admin", CreateWebhookRequest{URL: receiver.URL, Events: []string{EventTransferCompleted}})
+	if err != nil {
+		t.Fatalf("CreateWebhook: %v", err)
+	}
+	defer DeleteWebhook(hook.ID)
+
+	getTokenForUser(t, "webhook_sender")
+	getTokenForUser(t, "webhook_recipient")
+	sender, recipient := GetUser("webhook_sender"), GetUser("webhook_recipient")
+	if err := sender.TransferCoins(recipient, 5, TransferMeta{Memo: "webhook"}); err != nil {
+		t.Fatalf("TransferCoins: %v", err)
+	}
+	// Доставки появляются, когда relay отдаёт доменное событие приёмнику вебхуков
+	relay := NewOutboxRelay(time.Second, 500, WebhookSink{})
+	relay.RunOnce(context.Background())
+	relay.RunOnce(context.Background()) // повторный запуск не дублирует доставку
+
+	dispatcher := NewWebhookDispatcher(time.Second)
+	// Две неудачи подряд переводят доставку в dead
+	for i := 0; i < 2; i++ {
+		dispatcher.RunDue(context.Background(), time.Now().UTC().Add(time.Second))
+	}
+	deliveries, err := ListWebhookDeliveries(hook.ID, DeliveryDead, 10)
+	if err != nil || len(deliveries) != 1 || len(deliveries[0].Log) != 2 {
+		t.Fatalf("Expected one dead delivery with 2 attempts, got %+v, %v", deliveries, err)
+	}
+	if code := deliveries[0].Log[0].StatusCode; code == nil || *code != http.StatusInternalServerError {
+		t.Errorf("Expected logged 500, got %v", code)
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	if err := RetryWebhookDelivery(deliveries[0].ID); err != nil {
+		t.Fatalf("RetryWebhookDelivery: %v", err)
+	}
+	if err := RetryWebhookDelivery(deliveries[0].ID); !errors.Is(err, ErrDeliveryNotFound) {
+		t.Errorf("Expected second retry of a pending delivery to fail, got %v", err)
+	}
+	dispatcher.RunDue(context.Background(), time.Now().UTC().Add(time.Second))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 1 || received[0].Type != EventTransferCompleted {
+		t.Fatalf("Expected one transfer.completed webhook, got %+v", received)
+	}
+	var data TransferCompletedEvent
+	json.Unmarshal(received[0].Data, &data)
+	if data.FromUser != "webhook_sender" || data.ToUser != "webhook_recipient" || data.Amount != 5 || data.Memo != "webhook" {
+		t.Errorf("Unexpected transfer payload %+v", data)
+	}
+}